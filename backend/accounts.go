@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+)
+
+// Владельцы зон: использование и квоты, зоны и поиск записей владельца,
+// передача зоны другому владельцу
+
+func (h *Handler) accounts(g *gin.Context) {
+	accounts, err := h.svc.Accounts(g.Request.Context())
+	respond(g, accounts, err)
+}
+
+func (h *Handler) account(g *gin.Context) {
+	account, err := h.svc.Account(g.Request.Context(), g.Param("account"))
+	respond(g, account, err)
+}
+
+func (h *Handler) accountZones(g *gin.Context) {
+	zones, err := h.svc.AccountZones(g.Request.Context(), g.Param("account"))
+	respond(g, zones, err)
+}
+
+// accountSearch ?pattern=&maxResults=, шаблон как у searchRecords
+func (h *Handler) accountSearch(g *gin.Context) {
+	maxResult, err := atoi("maxResults", g.Query("maxResults"), 100)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	rr, err := h.svc.Search(g.Request.Context(), g.Query("pattern"), g.Param("account"), nil, maxResult)
+	respond(g, rr, err)
+}
+
+// setQuota ?zones=&records=, 0 не ограничивает
+func (h *Handler) setQuota(g *gin.Context) {
+	zones, err := atoi("zones", g.Query("zones"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	records, err := atoi("records", g.Query("records"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	done(g, h.svc.SetQuota(g.Request.Context(), g.Param("account"), &core.Quota{Zones: zones, Records: records}))
+}
+
+func (h *Handler) deleteQuota(g *gin.Context) {
+	done(g, h.svc.DeleteQuota(g.Request.Context(), g.Param("account")))
+}
+
+func (h *Handler) moveZone(g *gin.Context) {
+	done(g, h.svc.MoveZone(g.Request.Context(), g.Param("zone"), g.Param("account")))
+}
@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+)
+
+// Управление кластером. Узел указывается идентификатором или адресом dqlite.
+
+func (h *Handler) clusterNodes(g *gin.Context) {
+	nodes, err := h.cluster.Nodes(g.Request.Context())
+	if err != nil {
+		fail(g, http.StatusServiceUnavailable, err)
+		return
+	}
+	ok(g, nodes)
+}
+
+func (h *Handler) clusterStatus(g *gin.Context) {
+	status, err := h.cluster.Status(g.Request.Context())
+	if err != nil {
+		fail(g, http.StatusServiceUnavailable, err)
+		return
+	}
+	ok(g, status)
+}
+
+func (h *Handler) clusterLeader(g *gin.Context) {
+	leader, err := h.cluster.Leader(g.Request.Context())
+	if err != nil {
+		fail(g, http.StatusServiceUnavailable, err)
+		return
+	}
+	ok(g, leader)
+}
+
+func (h *Handler) clusterRemove(g *gin.Context) {
+	h.clusterResult(g, h.cluster.Remove(g.Request.Context(), g.Param("node")))
+}
+
+func (h *Handler) clusterTransfer(g *gin.Context) {
+	h.clusterResult(g, h.cluster.Transfer(g.Request.Context(), g.Param("node")))
+}
+
+func (h *Handler) clusterAssign(g *gin.Context) {
+	h.clusterResult(g, h.cluster.Assign(g.Request.Context(), g.Param("node"), g.Param("role")))
+}
+
+func (h *Handler) clusterResult(g *gin.Context, err error) {
+	if err != nil {
+		fail(g, http.StatusBadRequest, err)
+		return
+	}
+	ok(g, true)
+}
+
+// Уровень логирования меняется без перезапуска до следующего SIGHUP,
+// который снова применяет log.level из конфигурации
+
+func (h *Handler) getLogLevel(g *gin.Context) {
+	ok(g, logging.Level())
+}
+
+func (h *Handler) setLogLevel(g *gin.Context) {
+	if err := logging.SetLevel(g.Param("level")); err != nil {
+		fail(g, http.StatusBadRequest, err)
+		return
+	}
+	logging.FromContext(g.Request.Context()).WithField("level", g.Param("level")).Info("уровень логирования изменён")
+	ok(g, true)
+}
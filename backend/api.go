@@ -0,0 +1,755 @@
+package backend
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/auth"
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/pkg/errors"
+)
+
+// HTTP API управления зонами в формате PowerDNS (/api/v1/servers/localhost).
+// Ответы без конверта remote backend: объекты как в PowerDNS, ошибки
+// {"error": "..."}. Имена в API с точкой в конце, в базе без неё.
+
+const apiServer = "/api/v1/servers/localhost"
+
+// apiFail отвечает ошибкой в формате PowerDNS API
+func apiFail(g *gin.Context, status int, err error) {
+	g.Error(err)
+	g.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
+
+// apiRespond отвечает result с кодом status или ошибкой сервиса
+func apiRespond(g *gin.Context, status int, result interface{}, err error) {
+	if err != nil {
+		apiFail(g, errorStatus(err), err)
+		return
+	}
+	if result == nil {
+		g.Status(status)
+		return
+	}
+	g.JSON(status, result)
+}
+
+// bindJSON разбирает тело запроса, при ошибке отвечает 400
+func bindJSON(g *gin.Context, v interface{}) bool {
+	if err := g.ShouldBindJSON(v); err != nil {
+		apiFail(g, http.StatusBadRequest, errors.Wrap(err, "тело запроса"))
+		return false
+	}
+	return true
+}
+
+func canonical(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// zoneParam имя зоны из пути без точки в конце
+func zoneParam(g *gin.Context) string {
+	return strings.TrimSuffix(g.Param("zone_id"), ".")
+}
+
+// contentNames поля с именами в содержимом записей по типам
+var contentNames = map[string][]int{
+	"NS":    {0},
+	"CNAME": {0},
+	"PTR":   {0},
+	"DNAME": {0},
+	"MX":    {1},
+	"SRV":   {3},
+	"SOA":   {0, 1},
+}
+
+// convertNames меняет имена в содержимом записи функцией f
+func convertNames(qtype, content string, f func(string) string) string {
+	fields, ok := contentNames[qtype]
+	if !ok {
+		return content
+	}
+	parts := strings.Fields(content)
+	for _, i := range fields {
+		if i < len(parts) && parts[i] != "." {
+			parts[i] = f(parts[i])
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func storedContent(qtype, content string) string {
+	return convertNames(qtype, content, func(name string) string { return strings.TrimSuffix(name, ".") })
+}
+
+func apiContent(qtype, content string) string {
+	return convertNames(qtype, content, canonical)
+}
+
+var kinds = map[string]string{
+	"NATIVE":    "Native",
+	"MASTER":    "Master",
+	"SLAVE":     "Slave",
+	"PRIMARY":   "Master",
+	"SECONDARY": "Slave",
+}
+
+// storedKind тип зоны в базе по типу из API
+func storedKind(kind string) string {
+	if k, ok := kinds[strings.ToUpper(kind)]; ok {
+		return strings.ToUpper(k)
+	}
+	return strings.ToUpper(kind)
+}
+
+func apiKind(kind string) string {
+	if k, ok := kinds[strings.ToUpper(kind)]; ok {
+		return k
+	}
+	return kind
+}
+
+type apiRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+type apiRRSet struct {
+	Name       string        `json:"name"`
+	Type       string        `json:"type"`
+	TTL        int           `json:"ttl"`
+	ChangeType string        `json:"changetype,omitempty"`
+	Records    []apiRecord   `json:"records"`
+	Comments   []interface{} `json:"comments"`
+}
+
+type apiZone struct {
+	ID             string   `json:"id"`
+	Name           string   `json:"name"`
+	Type           string   `json:"type"`
+	URL            string   `json:"url"`
+	Kind           string   `json:"kind"`
+	Serial         int64    `json:"serial"`
+	NotifiedSerial int64    `json:"notified_serial"`
+	EditedSerial   int64    `json:"edited_serial"`
+	Masters        []string `json:"masters"`
+	DNSSEC         bool     `json:"dnssec"`
+	Account        string   `json:"account"`
+}
+
+// apiZoneDetail зона с записями, rrsets есть в ответе и у пустой зоны
+type apiZoneDetail struct {
+	*apiZone
+	RRSets []*apiRRSet `json:"rrsets"`
+}
+
+func newAPIZone(di *core.DomainInfo) *apiZone {
+	name := canonical(di.Zone)
+	masters := di.Master
+	if masters == nil {
+		masters = []string{}
+	}
+	return &apiZone{
+		ID:             name,
+		Name:           name,
+		Type:           "Zone",
+		URL:            apiServer + "/zones/" + name,
+		Kind:           apiKind(di.Kind),
+		Serial:         di.Serial,
+		NotifiedSerial: di.NotifiedSerial,
+		EditedSerial:   di.Serial,
+		Masters:        masters,
+		Account:        di.Account,
+	}
+}
+
+// rrsets собирает записи зоны в наборы по имени и типу, пустые
+// нетерминальные имена пропускаются
+func rrsets(records []*core.DNSResourceRecord) []*apiRRSet {
+	sets := make([]*apiRRSet, 0)
+	index := make(map[string]*apiRRSet)
+	for _, rr := range records {
+		if rr.Qtype == "" {
+			continue
+		}
+		key := rr.Qname + "\x00" + rr.Qtype
+		set, ok := index[key]
+		if !ok {
+			set = &apiRRSet{Name: canonical(rr.Qname), Type: rr.Qtype, TTL: rr.TTL, Records: []apiRecord{}, Comments: []interface{}{}}
+			index[key] = set
+			sets = append(sets, set)
+		}
+		set.Records = append(set.Records, apiRecord{Content: apiContent(rr.Qtype, rr.Content), Disabled: rr.Disabled})
+	}
+	sort.SliceStable(sets, func(i, j int) bool {
+		if sets[i].Name != sets[j].Name {
+			return sets[i].Name < sets[j].Name
+		}
+		return sets[i].Type < sets[j].Type
+	})
+	return sets
+}
+
+// records записи набора для сохранения в базе
+func (set *apiRRSet) records() []*core.DNSResourceRecord {
+	records := make([]*core.DNSResourceRecord, 0, len(set.Records))
+	qtype := strings.ToUpper(set.Type)
+	for _, r := range set.Records {
+		records = append(records, &core.DNSResourceRecord{
+			Qname:    strings.TrimSuffix(set.Name, "."),
+			Qtype:    qtype,
+			Content:  storedContent(qtype, r.Content),
+			TTL:      set.TTL,
+			Disabled: r.Disabled,
+			Auth:     true,
+		})
+	}
+	return records
+}
+
+func (h *Handler) apiServers(g *gin.Context) {
+	g.JSON(http.StatusOK, []gin.H{apiServerInfo()})
+}
+
+func (h *Handler) apiServer(g *gin.Context) {
+	g.JSON(http.StatusOK, apiServerInfo())
+}
+
+func apiServerInfo() gin.H {
+	return gin.H{
+		"type":        "Server",
+		"id":          "localhost",
+		"daemon_type": "authoritative",
+		"version":     "pdns-dqlite",
+		"url":         apiServer,
+		"zones_url":   apiServer + "/zones{/zone}",
+		"config_url":  apiServer + "/config{/config_setting}",
+	}
+}
+
+// apiZones список зон, ?zone= отбирает одну
+func (h *Handler) apiZones(g *gin.Context) {
+	dis, err := h.svc.GetAllDomains(g.Request.Context(), true)
+	if err != nil {
+		apiFail(g, errorStatus(err), err)
+		return
+	}
+	filter := strings.TrimSuffix(g.Query("zone"), ".")
+	zones := make([]*apiZone, 0, len(dis))
+	for _, di := range keyDomains(g.Request.Context(), dis) {
+		if filter == "" || strings.EqualFold(filter, di.Zone) {
+			zones = append(zones, newAPIZone(di))
+		}
+	}
+	g.JSON(http.StatusOK, zones)
+}
+
+// apiSearchResult найденная зона или запись в формате search-data PowerDNS
+type apiSearchResult struct {
+	ObjectType string `json:"object_type"`
+	Name       string `json:"name"`
+	ZoneID     string `json:"zone_id"`
+	Zone       string `json:"zone,omitempty"`
+	Type       string `json:"type,omitempty"`
+	Content    string `json:"content,omitempty"`
+	TTL        int    `json:"ttl,omitempty"`
+	Disabled   *bool  `json:"disabled,omitempty"`
+}
+
+// matchPattern имя подходит под шаблон searchRecords: * любые символы, ? один символ
+func matchPattern(pattern, name string) bool {
+	expr := regexp.QuoteMeta(strings.ToLower(pattern))
+	expr = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(expr)
+	ok, err := regexp.MatchString("^"+expr+"$", strings.ToLower(name))
+	return err == nil && ok
+}
+
+// apiSearch ?q=&max=&object_type=, ищет зоны и записи только среди зон,
+// доступных ключу: ключ владельца ищет записи только в своих зонах
+func (h *Handler) apiSearch(g *gin.Context) {
+	ctx := g.Request.Context()
+	q := strings.TrimSuffix(g.Query("q"), ".")
+	if q == "" {
+		apiFail(g, http.StatusUnprocessableEntity, errors.Wrap(core.ErrInvalid, "не указан q"))
+		return
+	}
+	max, err := atoi("max", g.Query("max"), 100)
+	if err != nil {
+		apiFail(g, http.StatusBadRequest, err)
+		return
+	}
+	objectType := g.DefaultQuery("object_type", "all")
+	switch objectType {
+	case "all", "zone", "record", "comment":
+	default:
+		apiFail(g, http.StatusUnprocessableEntity, errors.Wrapf(core.ErrInvalid, "object_type %q", objectType))
+		return
+	}
+	dis, err := h.svc.GetAllDomains(ctx, true)
+	if err != nil {
+		apiFail(g, errorStatus(err), err)
+		return
+	}
+	dis = keyDomains(ctx, dis)
+	results := make([]*apiSearchResult, 0)
+	byID := make(map[int]*core.DomainInfo, len(dis))
+	for _, di := range dis {
+		byID[di.ID] = di
+		if (objectType == "all" || objectType == "zone") && matchPattern(q, di.Zone) && len(results) < max {
+			name := canonical(di.Zone)
+			results = append(results, &apiSearchResult{ObjectType: "zone", Name: name, ZoneID: name})
+		}
+	}
+	if objectType == "all" || objectType == "record" {
+		// Зоны ключа передаются в запрос, иначе LIMIT могут занять чужие записи
+		account, domains := "", []int(nil)
+		if key := auth.FromContext(ctx); key != nil && key.Restricted() {
+			account, domains = key.Account, make([]int, 0, len(dis))
+			for _, di := range dis {
+				domains = append(domains, di.ID)
+			}
+		}
+		rrs, err := h.svc.Search(ctx, q, account, domains, max)
+		if err != nil {
+			apiFail(g, errorStatus(err), err)
+			return
+		}
+		for _, rr := range rrs {
+			di, ok := byID[rr.DomainID]
+			if !ok || len(results) >= max {
+				continue
+			}
+			zone, disabled := canonical(di.Zone), rr.Disabled
+			results = append(results, &apiSearchResult{
+				ObjectType: "record",
+				Name:       canonical(rr.Qname),
+				ZoneID:     zone,
+				Zone:       zone,
+				Type:       rr.Qtype,
+				Content:    apiContent(rr.Qtype, rr.Content),
+				TTL:        rr.TTL,
+				Disabled:   &disabled,
+			})
+		}
+	}
+	g.JSON(http.StatusOK, results)
+}
+
+// domain зона name, nil если её нет и ответ уже отправлен
+func (h *Handler) domain(g *gin.Context, name string) *core.DomainInfo {
+	di, err := h.svc.GetDomainInfo(g.Request.Context(), name)
+	if err == nil && di.ID == 0 {
+		err = errors.Wrapf(core.ErrNotFound, "Domain %s", name)
+	}
+	if err != nil {
+		apiFail(g, errorStatus(err), err)
+		return nil
+	}
+	return di
+}
+
+// zone зона с записями, nil если ответ уже отправлен
+func (h *Handler) zone(g *gin.Context, name string) *apiZoneDetail {
+	ctx := g.Request.Context()
+	di := h.domain(g, name)
+	if di == nil {
+		return nil
+	}
+	records, err := h.svc.List(ctx, di.Zone, di.ID, true)
+	if err != nil {
+		apiFail(g, errorStatus(err), err)
+		return nil
+	}
+	// В getDomainInfo serial это notified_serial, серийный номер берётся из SOA
+	di.NotifiedSerial, di.Serial = di.Serial, 0
+	for _, rr := range records {
+		if rr.Qtype == "SOA" && strings.EqualFold(rr.Qname, di.Zone) {
+			if parts := strings.Fields(rr.Content); len(parts) > 2 {
+				di.Serial, _ = strconv.ParseInt(parts[2], 10, 64)
+			}
+		}
+	}
+	z := &apiZoneDetail{apiZone: newAPIZone(di), RRSets: rrsets(records)}
+	if keys, err := h.svc.GetDomainKeys(ctx, di.Zone); err == nil {
+		for _, k := range keys {
+			z.DNSSEC = z.DNSSEC || k.Active
+		}
+	}
+	return z
+}
+
+func (h *Handler) apiGetZone(g *gin.Context) {
+	if z := h.zone(g, zoneParam(g)); z != nil {
+		g.JSON(http.StatusOK, z)
+	}
+}
+
+// apiCreateZone создаёт зону. Без SOA в rrsets она создаётся по первому
+// серверу из nameservers, NS записи добавляются из nameservers.
+func (h *Handler) apiCreateZone(g *gin.Context) {
+	var req struct {
+		Name        string      `json:"name"`
+		Kind        string      `json:"kind"`
+		Masters     []string    `json:"masters"`
+		Account     string      `json:"account"`
+		Nameservers []string    `json:"nameservers"`
+		RRSets      []*apiRRSet `json:"rrsets"`
+	}
+	if !bindJSON(g, &req) {
+		return
+	}
+	name := strings.TrimSuffix(req.Name, ".")
+	if req.Kind == "" {
+		req.Kind = "Native"
+	}
+	// Ключ владельца создаёт зоны только себе
+	if key := auth.FromContext(g.Request.Context()); key != nil && req.Account == "" {
+		req.Account = key.Account
+	}
+	if !keyAllows(g, name, req.Account) {
+		return
+	}
+	records := make([]*core.DNSResourceRecord, 0)
+	soa, ns := false, false
+	for _, set := range req.RRSets {
+		if strings.EqualFold(strings.TrimSuffix(set.Name, "."), name) {
+			soa = soa || strings.EqualFold(set.Type, "SOA")
+			ns = ns || strings.EqualFold(set.Type, "NS")
+		}
+		records = append(records, set.records()...)
+	}
+	if !ns {
+		for _, server := range req.Nameservers {
+			records = append(records, &core.DNSResourceRecord{
+				Qname: name, Qtype: "NS", TTL: 3600, Content: strings.TrimSuffix(server, "."), Auth: true,
+			})
+		}
+	}
+	if !soa && name != "" {
+		primary := "a.misconfigured.dns.server.invalid"
+		if len(req.Nameservers) != 0 {
+			primary = strings.TrimSuffix(req.Nameservers[0], ".")
+		}
+		records = append([]*core.DNSResourceRecord{{
+			Qname: name, Qtype: "SOA", TTL: 3600, Auth: true,
+			Content: primary + " hostmaster." + name + " 1 10800 3600 604800 3600",
+		}}, records...)
+	}
+	ctx := g.Request.Context()
+	z := &core.Zone{Name: name, Kind: storedKind(req.Kind), Masters: req.Masters, Account: req.Account}
+	if err := h.svc.CreateZone(ctx, z, records); err != nil {
+		apiFail(g, errorStatus(err), err)
+		return
+	}
+	if created := h.zone(g, name); created != nil {
+		g.JSON(http.StatusCreated, created)
+	}
+}
+
+// apiUpdateZone меняет kind, masters и account, отсутствующие поля не меняются
+func (h *Handler) apiUpdateZone(g *gin.Context) {
+	var req struct {
+		Kind    *string   `json:"kind"`
+		Masters *[]string `json:"masters"`
+		Account *string   `json:"account"`
+	}
+	if !bindJSON(g, &req) {
+		return
+	}
+	ctx := g.Request.Context()
+	name := zoneParam(g)
+	di := h.domain(g, name)
+	if di == nil {
+		return
+	}
+	z := &core.Zone{Name: di.Zone, Kind: di.Kind, Masters: di.Master, Account: di.Account}
+	if req.Kind != nil {
+		z.Kind = storedKind(*req.Kind)
+	}
+	if req.Masters != nil {
+		z.Masters = *req.Masters
+	}
+	if req.Account != nil {
+		z.Account = *req.Account
+	}
+	if !keyAllows(g, z.Name, z.Account) {
+		return
+	}
+	apiRespond(g, http.StatusNoContent, nil, h.svc.UpdateZone(ctx, z))
+}
+
+func (h *Handler) apiDeleteZone(g *gin.Context) {
+	apiRespond(g, http.StatusNoContent, nil, h.svc.DeleteZone(g.Request.Context(), zoneParam(g)))
+}
+
+// apiPatchZone изменения rrsets с changetype REPLACE или DELETE одной транзакцией
+func (h *Handler) apiPatchZone(g *gin.Context) {
+	var req struct {
+		RRSets []*apiRRSet `json:"rrsets"`
+	}
+	if !bindJSON(g, &req) {
+		return
+	}
+	changes := make([]*core.RRSetChange, 0, len(req.RRSets))
+	for _, set := range req.RRSets {
+		change := &core.RRSetChange{Name: set.Name, Type: set.Type}
+		switch strings.ToUpper(set.ChangeType) {
+		case "REPLACE":
+			change.Replace = true
+			change.Records = set.records()
+		case "DELETE":
+		default:
+			apiFail(g, http.StatusUnprocessableEntity, errors.Errorf("changetype %q, ожидается REPLACE или DELETE", set.ChangeType))
+			return
+		}
+		changes = append(changes, change)
+	}
+	apiRespond(g, http.StatusNoContent, nil, h.svc.PatchRRSets(g.Request.Context(), zoneParam(g), changes))
+}
+
+func apiMetadata(kind string, values []string) gin.H {
+	if values == nil {
+		values = []string{}
+	}
+	return gin.H{"type": "Metadata", "kind": kind, "metadata": values}
+}
+
+// zoneExists отвечает 404, если зоны из пути нет
+func (h *Handler) zoneExists(g *gin.Context) bool {
+	return h.domain(g, zoneParam(g)) != nil
+}
+
+func (h *Handler) apiListMetadata(g *gin.Context) {
+	if !h.zoneExists(g) {
+		return
+	}
+	meta, err := h.svc.GetAllDomainMetadata(g.Request.Context(), zoneParam(g))
+	if err != nil {
+		apiFail(g, errorStatus(err), err)
+		return
+	}
+	kinds := make([]string, 0, len(meta))
+	for kind := range meta {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	list := make([]gin.H, 0, len(meta))
+	for _, kind := range kinds {
+		list = append(list, apiMetadata(kind, meta[kind]))
+	}
+	g.JSON(http.StatusOK, list)
+}
+
+func (h *Handler) apiGetMetadata(g *gin.Context) {
+	if !h.zoneExists(g) {
+		return
+	}
+	values, err := h.svc.GetDomainMetadata(g.Request.Context(), zoneParam(g), g.Param("kind"))
+	apiRespond(g, http.StatusOK, apiMetadata(g.Param("kind"), values), err)
+}
+
+type metadataRequest struct {
+	Kind     string   `json:"kind"`
+	Metadata []string `json:"metadata"`
+}
+
+// setMetadata заменяет значения kind и отвечает новым состоянием
+func (h *Handler) setMetadata(g *gin.Context, status int, kind string, values []string) {
+	if kind == "" {
+		apiFail(g, http.StatusUnprocessableEntity, errors.New("не указан kind"))
+		return
+	}
+	err := h.svc.SetDomainMetadata(g.Request.Context(), zoneParam(g), kind, values)
+	apiRespond(g, status, apiMetadata(kind, values), err)
+}
+
+func (h *Handler) apiCreateMetadata(g *gin.Context) {
+	var req metadataRequest
+	if !h.zoneExists(g) || !bindJSON(g, &req) {
+		return
+	}
+	h.setMetadata(g, http.StatusCreated, req.Kind, req.Metadata)
+}
+
+func (h *Handler) apiUpdateMetadata(g *gin.Context) {
+	var req metadataRequest
+	if !h.zoneExists(g) || !bindJSON(g, &req) {
+		return
+	}
+	h.setMetadata(g, http.StatusOK, g.Param("kind"), req.Metadata)
+}
+
+func (h *Handler) apiDeleteMetadata(g *gin.Context) {
+	if !h.zoneExists(g) {
+		return
+	}
+	apiRespond(g, http.StatusNoContent, nil, h.svc.SetDomainMetadata(g.Request.Context(), zoneParam(g), g.Param("kind"), nil))
+}
+
+type apiCryptokey struct {
+	Type       string   `json:"type"`
+	ID         int      `json:"id"`
+	KeyType    string   `json:"keytype"`
+	Active     bool     `json:"active"`
+	Published  bool     `json:"published"`
+	Flags      int      `json:"flags"`
+	DNSKEY     string   `json:"dnskey,omitempty"`
+	DS         []string `json:"ds,omitempty"`
+	Algorithm  string   `json:"algorithm,omitempty"`
+	Bits       int      `json:"bits,omitempty"`
+	PrivateKey string   `json:"privatekey,omitempty"`
+}
+
+func newAPICryptokey(zone string, key *core.KeyData, private bool) *apiCryptokey {
+	k := &apiCryptokey{Type: "Cryptokey", ID: key.ID, KeyType: "zsk", Active: key.Active, Published: key.Published, Flags: key.Flags}
+	if key.Flags&1 == 1 {
+		k.KeyType = "ksk"
+	}
+	// Ключ, который не удалось разобрать, всё равно попадает в список
+	if public, err := core.PublicKey(zone, key); err == nil {
+		k.DNSKEY = public.DNSKEY
+		k.Algorithm = core.AlgorithmName(public.Algorithm)
+		k.Bits = public.Bits
+		if k.KeyType == "ksk" {
+			k.DS = []string{public.DS}
+		}
+	}
+	if private {
+		k.PrivateKey = key.Content
+	}
+	return k
+}
+
+// cryptokey ключ зоны из пути, nil если ответ уже отправлен
+func (h *Handler) cryptokey(g *gin.Context) *core.KeyData {
+	id, err := strconv.Atoi(g.Param("id"))
+	if err != nil {
+		apiFail(g, http.StatusBadRequest, errors.Errorf("id: ожидается целое число, получено %q", g.Param("id")))
+		return nil
+	}
+	if !h.zoneExists(g) {
+		return nil
+	}
+	keys, err := h.svc.GetDomainKeys(g.Request.Context(), zoneParam(g))
+	if err != nil {
+		apiFail(g, errorStatus(err), err)
+		return nil
+	}
+	for _, k := range keys {
+		if k.ID == id {
+			return k
+		}
+	}
+	apiFail(g, http.StatusNotFound, errors.Wrapf(core.ErrNotFound, "Cryptokey %d", id))
+	return nil
+}
+
+func (h *Handler) apiListCryptokeys(g *gin.Context) {
+	if !h.zoneExists(g) {
+		return
+	}
+	zone := zoneParam(g)
+	keys, err := h.svc.GetDomainKeys(g.Request.Context(), zone)
+	if err != nil {
+		apiFail(g, errorStatus(err), err)
+		return
+	}
+	list := make([]*apiCryptokey, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, newAPICryptokey(zone, k, false))
+	}
+	g.JSON(http.StatusOK, list)
+}
+
+func (h *Handler) apiGetCryptokey(g *gin.Context) {
+	if key := h.cryptokey(g); key != nil {
+		g.JSON(http.StatusOK, newAPICryptokey(zoneParam(g), key, true))
+	}
+}
+
+// apiCreateCryptokey импортирует privatekey или создаёт ключ алгоритмом
+// algorithm, по умолчанию ECDSAP256SHA256
+func (h *Handler) apiCreateCryptokey(g *gin.Context) {
+	req := struct {
+		KeyType    string `json:"keytype"`
+		Active     bool   `json:"active"`
+		Published  *bool  `json:"published"`
+		Algorithm  string `json:"algorithm"`
+		PrivateKey string `json:"privatekey"`
+	}{}
+	if !h.zoneExists(g) || !bindJSON(g, &req) {
+		return
+	}
+	key := &core.KeyData{Active: req.Active, Published: req.Published == nil || *req.Published, Content: req.PrivateKey}
+	switch strings.ToLower(req.KeyType) {
+	case "ksk", "csk":
+		key.Flags = 257
+	case "zsk":
+		key.Flags = 256
+	default:
+		apiFail(g, http.StatusUnprocessableEntity, errors.Errorf("keytype %q, ожидается ksk, zsk или csk", req.KeyType))
+		return
+	}
+	if key.Content == "" {
+		if req.Algorithm == "" {
+			req.Algorithm = "ECDSAP256SHA256"
+		}
+		algorithm, err := core.Algorithm(req.Algorithm)
+		if err == nil {
+			key.Content, err = core.GenerateKey(algorithm)
+		}
+		if err != nil {
+			apiFail(g, errorStatus(err), err)
+			return
+		}
+	}
+	zone := zoneParam(g)
+	if _, err := core.PublicKey(zone, key); err != nil {
+		apiFail(g, errorStatus(err), err)
+		return
+	}
+	err := h.svc.AddDomainKey(g.Request.Context(), zone, key)
+	apiRespond(g, http.StatusCreated, newAPICryptokey(zone, key, true), err)
+}
+
+// apiUpdateCryptokey меняет active и published
+func (h *Handler) apiUpdateCryptokey(g *gin.Context) {
+	var req struct {
+		Active    *bool `json:"active"`
+		Published *bool `json:"published"`
+	}
+	key := h.cryptokey(g)
+	if key == nil || !bindJSON(g, &req) {
+		return
+	}
+	ctx, zone := g.Request.Context(), zoneParam(g)
+	var err error
+	if req.Active != nil && *req.Active != key.Active {
+		if *req.Active {
+			err = h.svc.ActivateDomainKey(ctx, zone, key.ID)
+		} else {
+			err = h.svc.DeactivateDomainKey(ctx, zone, key.ID)
+		}
+	}
+	if err == nil && req.Published != nil && *req.Published != key.Published {
+		if *req.Published {
+			err = h.svc.PublishDomainKey(ctx, zone, key.ID)
+		} else {
+			err = h.svc.UnPublishDomainKey(ctx, zone, key.ID)
+		}
+	}
+	apiRespond(g, http.StatusNoContent, nil, err)
+}
+
+func (h *Handler) apiDeleteCryptokey(g *gin.Context) {
+	if key := h.cryptokey(g); key != nil {
+		apiRespond(g, http.StatusNoContent, nil, h.svc.RemoveDomainKey(g.Request.Context(), zoneParam(g), key.ID))
+	}
+}
@@ -0,0 +1,157 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const zones = "/api/v1/servers/localhost/zones"
+
+// checkAPIError ошибка HTTP API имеет вид {"error": "..."}
+func checkAPIError(t *testing.T, code int, body []byte) {
+	t.Helper()
+	if code < http.StatusBadRequest {
+		return
+	}
+	resp := map[string]string{}
+	require.NoError(t, json.Unmarshal(body, &resp), string(body))
+	assert.NotEmpty(t, resp["error"])
+}
+
+// TestAPIContract проходит по всем маршрутам HTTP API PowerDNS
+func TestAPIContract(t *testing.T) {
+	r := newTestRoutes(t, true)
+	require.NoError(t, logging.SetLevel("error"))
+	t.Cleanup(func() { logging.SetLevel("info") })
+
+	cases := []contractCase{
+		{route: "GET /api/v1/servers", path: "/api/v1/servers", status: 200},
+		{route: "GET /api/v1/servers/localhost", path: "/api/v1/servers/localhost", status: 200},
+
+		{route: "POST /api/v1/servers/localhost/zones", path: zones, json: `{"name":"example.com.","kind":"Native","nameservers":["ns1.example.com."]}`, status: 201},
+		{route: "POST /api/v1/servers/localhost/zones", path: zones, json: `{"name":"example.com.","kind":"Native"}`, status: 409},
+		{route: "POST /api/v1/servers/localhost/zones", path: zones, json: `{"name":"example.org.","kind":"Producer"}`, status: 422},
+		{route: "POST /api/v1/servers/localhost/zones", path: zones, json: `{"name":`, status: 400},
+		{route: "GET /api/v1/servers/localhost/zones", path: zones, status: 200},
+		{route: "GET /api/v1/servers/localhost/search-data", path: apiServer + "/search-data?q=*example*", status: 200},
+		{route: "GET /api/v1/servers/localhost/search-data", path: apiServer + "/search-data?q=www*&object_type=zones", status: 422},
+		{route: "GET /api/v1/servers/localhost/search-data", path: apiServer + "/search-data?q=www*&max=x", status: 400},
+		{route: "GET /api/v1/servers/localhost/zones/:zone_id", path: zones + "/example.com.", status: 200},
+		{route: "GET /api/v1/servers/localhost/zones/:zone_id", path: zones + "/missing.example.", status: 404},
+		{route: "PATCH /api/v1/servers/localhost/zones/:zone_id", path: zones + "/example.com.", json: `{"rrsets":[
+			{"name":"www.example.com.","type":"A","ttl":300,"changetype":"REPLACE","records":[{"content":"192.0.2.1","disabled":false}]}
+		]}`, status: 204},
+		{route: "PATCH /api/v1/servers/localhost/zones/:zone_id", path: zones + "/example.com.", json: `{"rrsets":[
+			{"name":"www.example.org.","type":"A","ttl":300,"changetype":"REPLACE","records":[{"content":"192.0.2.1"}]}
+		]}`, status: 422},
+		{route: "PATCH /api/v1/servers/localhost/zones/:zone_id", path: zones + "/example.com.", json: `{"rrsets":[{"name":"www.example.com.","type":"A","changetype":"EXTEND"}]}`, status: 422},
+		{route: "PATCH /api/v1/servers/localhost/zones/:zone_id", path: zones + "/missing.example.", json: `{"rrsets":[]}`, status: 404},
+		{route: "PUT /api/v1/servers/localhost/zones/:zone_id", path: zones + "/example.com.", json: `{"kind":"Primary"}`, status: 204},
+		{route: "PUT /api/v1/servers/localhost/zones/:zone_id", path: zones + "/example.com.", json: `{"kind":"Catalog"}`, status: 422},
+		{route: "PUT /api/v1/servers/localhost/zones/:zone_id", path: zones + "/missing.example.", json: `{}`, status: 404},
+
+		{route: "POST /api/v1/servers/localhost/zones/:zone_id/metadata", path: zones + "/example.com./metadata", json: `{"kind":"ALSO-NOTIFY","metadata":["192.0.2.5"]}`, status: 201},
+		{route: "POST /api/v1/servers/localhost/zones/:zone_id/metadata", path: zones + "/example.com./metadata", json: `{"metadata":[]}`, status: 422},
+		{route: "POST /api/v1/servers/localhost/zones/:zone_id/metadata", path: zones + "/missing.example./metadata", json: `{}`, status: 404},
+		{route: "GET /api/v1/servers/localhost/zones/:zone_id/metadata", path: zones + "/example.com./metadata", status: 200},
+		{route: "GET /api/v1/servers/localhost/zones/:zone_id/metadata/:kind", path: zones + "/example.com./metadata/ALSO-NOTIFY", status: 200},
+		{route: "PUT /api/v1/servers/localhost/zones/:zone_id/metadata/:kind", path: zones + "/example.com./metadata/ALSO-NOTIFY", json: `{"metadata":["192.0.2.6"]}`, status: 200},
+		{route: "DELETE /api/v1/servers/localhost/zones/:zone_id/metadata/:kind", path: zones + "/example.com./metadata/ALSO-NOTIFY", status: 204},
+
+		{route: "POST /api/v1/servers/localhost/zones/:zone_id/cryptokeys", path: zones + "/example.com./cryptokeys", json: `{"keytype":"ksk","active":true}`, status: 201},
+		{route: "POST /api/v1/servers/localhost/zones/:zone_id/cryptokeys", path: zones + "/example.com./cryptokeys", json: `{"keytype":"zsk","algorithm":"RSASHA256"}`, status: 422},
+		{route: "POST /api/v1/servers/localhost/zones/:zone_id/cryptokeys", path: zones + "/example.com./cryptokeys", json: `{"keytype":"xsk"}`, status: 422},
+		{route: "GET /api/v1/servers/localhost/zones/:zone_id/cryptokeys", path: zones + "/example.com./cryptokeys", status: 200},
+		{route: "GET /api/v1/servers/localhost/zones/:zone_id/cryptokeys/:id", path: zones + "/example.com./cryptokeys/1", status: 200},
+		{route: "GET /api/v1/servers/localhost/zones/:zone_id/cryptokeys/:id", path: zones + "/example.com./cryptokeys/9", status: 404},
+		{route: "GET /api/v1/servers/localhost/zones/:zone_id/cryptokeys/:id", path: zones + "/example.com./cryptokeys/x", status: 400},
+		{route: "PUT /api/v1/servers/localhost/zones/:zone_id/cryptokeys/:id", path: zones + "/example.com./cryptokeys/1", json: `{"active":false}`, status: 204},
+		{route: "DELETE /api/v1/servers/localhost/zones/:zone_id/cryptokeys/:id", path: zones + "/example.com./cryptokeys/1", status: 204},
+		{route: "DELETE /api/v1/servers/localhost/zones/:zone_id/cryptokeys/:id", path: zones + "/example.com./cryptokeys/1", status: 404},
+
+		{route: "DELETE /api/v1/servers/localhost/zones/:zone_id", path: zones + "/example.com.", status: 204},
+		{route: "DELETE /api/v1/servers/localhost/zones/:zone_id", path: zones + "/example.com.", status: 404},
+	}
+
+	covered := map[string]bool{}
+	for _, c := range cases {
+		c.method = strings.Fields(c.route)[0]
+		t.Run(c.method+" "+c.path, func(t *testing.T) {
+			w := c.do(r)
+			assert.Equal(t, c.status, w.Code, w.Body.String())
+			checkAPIError(t, w.Code, w.Body.Bytes())
+			if w.Code == http.StatusNoContent {
+				assert.Empty(t, w.Body.String())
+			}
+		})
+		covered[c.route] = true
+	}
+	for _, route := range r.Routes() {
+		if strings.HasPrefix(route.Path, "/api/") {
+			assert.True(t, covered[route.Method+" "+route.Path], "нет случая для %s %s", route.Method, route.Path)
+		}
+	}
+}
+
+func TestAPIZone(t *testing.T) {
+	r := newTestRoutes(t, false)
+
+	w := contractCase{method: "POST", path: zones, json: `{"name":"example.com.","kind":"Master","nameservers":["ns1.example.com."],"rrsets":[
+		{"name":"example.com.","type":"MX","ttl":300,"records":[{"content":"10 mail.example.com."}]}
+	]}`}.do(r)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var zone struct {
+		ID     string `json:"id"`
+		Kind   string `json:"kind"`
+		Serial int64  `json:"serial"`
+		RRSets []struct {
+			Name    string `json:"name"`
+			Type    string `json:"type"`
+			Records []struct {
+				Content string `json:"content"`
+			} `json:"records"`
+		} `json:"rrsets"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &zone))
+	assert.Equal(t, "example.com.", zone.ID)
+	assert.Equal(t, "Master", zone.Kind)
+	assert.EqualValues(t, 1, zone.Serial)
+	require.Len(t, zone.RRSets, 3)
+	assert.Equal(t, "MX", zone.RRSets[0].Type)
+	assert.Equal(t, "10 mail.example.com.", zone.RRSets[0].Records[0].Content)
+	assert.Equal(t, "ns1.example.com. hostmaster.example.com. 1 10800 3600 604800 3600", zone.RRSets[2].Records[0].Content)
+
+	// Remote backend отдаёт PowerDNS имена без точки
+	w = contractCase{method: "GET", path: "/lookup/example.com/MX"}.do(r)
+	assert.Contains(t, w.Body.String(), `"content":"10 mail.example.com"`)
+
+	w = contractCase{method: "PATCH", path: zones + "/example.com", json: `{"rrsets":[
+		{"name":"example.com.","type":"MX","changetype":"DELETE"},
+		{"name":"www.example.com.","type":"CNAME","ttl":60,"changetype":"REPLACE","records":[{"content":"example.com."}]}
+	]}`}.do(r)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	w = contractCase{method: "GET", path: zones + "/example.com."}.do(r)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &zone))
+	assert.EqualValues(t, 2, zone.Serial, "serial is increased")
+	types := []string{}
+	for _, set := range zone.RRSets {
+		types = append(types, set.Type)
+	}
+	assert.Equal(t, []string{"NS", "SOA", "CNAME"}, types)
+
+	// Без --dnssec метаданные и ключи недоступны
+	w = contractCase{method: "GET", path: zones + "/example.com./cryptokeys"}.do(r)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+	assert.JSONEq(t, `{"error":"Only for DNSSEC"}`, w.Body.String())
+
+	w = contractCase{method: "GET", path: zones + "?zone=example.com."}.do(r)
+	assert.Contains(t, w.Body.String(), `"url":"/api/v1/servers/localhost/zones/example.com."`)
+	w = contractCase{method: "GET", path: zones + "?zone=missing.example."}.do(r)
+	assert.JSONEq(t, `[]`, w.Body.String())
+}
@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+)
+
+// caller отмечает в контексте запроса, кто его сделал: CN клиентского
+// сертификата, а без него адрес клиента или unix для запросов через сокет.
+// Попадает в журнал изменений.
+func caller() gin.HandlerFunc {
+	return func(g *gin.Context) {
+		who := g.ClientIP()
+		if who == "" {
+			who = "unix"
+		}
+		if tls := g.Request.TLS; tls != nil && len(tls.PeerCertificates) != 0 {
+			who = tls.PeerCertificates[0].Subject.CommonName
+		}
+		g.Request = g.Request.WithContext(audit.WithCaller(g.Request.Context(), who))
+	}
+}
+
+// getAudit журнал изменений: ?zone=&method=&caller=&since=24h&until=&limit=
+func (h *Handler) getAudit(g *gin.Context) {
+	now := time.Now()
+	since, err := audit.ParseTime(g.Query("since"), now)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	until, err := audit.ParseTime(g.Query("until"), now)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	limit, err := atoi("limit", g.Query("limit"), 100)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	entries, err := h.svc.Audit(g.Request.Context(), audit.Filter{
+		Zone:   g.Query("zone"),
+		Method: g.Query("method"),
+		Caller: g.Query("caller"),
+		Since:  since,
+		Until:  until,
+		Limit:  limit,
+	})
+	respond(g, entries, err)
+}
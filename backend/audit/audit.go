@@ -0,0 +1,208 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/pkg/errors"
+)
+
+// Журнал изменений пополняется только добавлением строк. Запись журнала
+// делается в той же транзакции базы, что и само изменение, поэтому
+// изменение без записи в журнале не сохраняется.
+const (
+	insertQuery = "INSERT INTO audit (at, node, method, zone, caller, before_value, after_value) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	selectQuery = "SELECT id, at, node, method, zone, caller, before_value, after_value FROM audit"
+	pruneQuery  = "DELETE FROM audit WHERE at < ?"
+)
+
+// Entry запись журнала: кто, когда и через какой узел изменил зону.
+// Before и After состояние изменённых данных до и после в JSON.
+type Entry struct {
+	ID     int64           `json:"id"`
+	Time   time.Time       `json:"time"`
+	Node   string          `json:"node"`
+	Method string          `json:"method"`
+	Zone   string          `json:"zone"`
+	Caller string          `json:"caller"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Execer *sql.DB или *sql.Tx, в транзакции которого сделано изменение
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type callerKey struct{}
+
+// WithCaller контекст запроса с тем, кто его сделал
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// Caller кто сделал запрос, пустая строка для внутренних вызовов
+func Caller(ctx context.Context) string {
+	if ctx != nil {
+		if caller, ok := ctx.Value(callerKey{}).(string); ok {
+			return caller
+		}
+	}
+	return ""
+}
+
+// Record добавляет запись в журнал. before и after сохраняются в JSON, nil
+// означает, что данных до или после изменения нет.
+func Record(ctx context.Context, e Execer, node, method, zone string, before, after interface{}) error {
+	b, err := marshal(before)
+	if err != nil {
+		return err
+	}
+	a, err := marshal(after)
+	if err != nil {
+		return err
+	}
+	_, err = e.ExecContext(ctx, insertQuery, time.Now().Unix(), node, method, strings.ToLower(strings.TrimSuffix(zone, ".")), Caller(ctx), b, a)
+	return errors.Wrap(err, "не удалось записать изменение в журнал")
+}
+
+func marshal(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "не удалось сохранить данные изменения")
+	}
+	if string(data) == "null" {
+		return nil, nil
+	}
+	return string(data), nil
+}
+
+// Filter условия выборки из журнала, пустые поля не ограничивают выборку
+type Filter struct {
+	Zone   string
+	Method string
+	Caller string
+	Since  time.Time
+	Until  time.Time
+	Limit  int // последние Limit записей, ноль без ограничения
+}
+
+// Query записи журнала по возрастанию времени
+func Query(ctx context.Context, db *sql.DB, f Filter) ([]*Entry, error) {
+	where := make([]string, 0, 5)
+	args := make([]interface{}, 0, 6)
+	if f.Zone != "" {
+		where = append(where, "zone = ?")
+		args = append(args, strings.ToLower(strings.TrimSuffix(f.Zone, ".")))
+	}
+	if f.Method != "" {
+		where = append(where, "method = ?")
+		args = append(args, strings.ToLower(f.Method))
+	}
+	if f.Caller != "" {
+		where = append(where, "caller = ?")
+		args = append(args, f.Caller)
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "at >= ?")
+		args = append(args, f.Since.Unix())
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "at < ?")
+		args = append(args, f.Until.Unix())
+	}
+	query := selectQuery
+	if len(where) != 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "не удалось прочитать журнал изменений")
+	}
+	defer rows.Close()
+	entries := make([]*Entry, 0)
+	for rows.Next() {
+		e := new(Entry)
+		var at int64
+		var zone, caller, before, after sql.NullString
+		if err = rows.Scan(&e.ID, &at, &e.Node, &e.Method, &zone, &caller, &before, &after); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(at, 0).UTC()
+		e.Zone, e.Caller = zone.String, caller.String
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// Выбраны последние записи, а отдаются по порядку
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// Prune удаляет записи старше before и возвращает их число
+func Prune(ctx context.Context, db *sql.DB, before time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, pruneQuery, before.Unix())
+	if err != nil {
+		return 0, errors.Wrap(err, "не удалось удалить старые записи журнала")
+	}
+	return res.RowsAffected()
+}
+
+// Schedule раз в interval удаляет записи старше retention, пока не отменён ctx.
+// Удаление идемпотентно, поэтому его может выполнять каждый узел.
+func Schedule(ctx context.Context, db *sql.DB, retention, interval time.Duration) {
+	log := logging.Logger.WithField("component", "audit")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := Prune(ctx, db, now.Add(-retention))
+			if err != nil {
+				log.WithError(err).Error("старые записи журнала не удалены")
+				continue
+			}
+			if n != 0 {
+				log.WithField("entries", n).Info("удалены старые записи журнала")
+			}
+		}
+	}
+}
+
+// ParseTime время из длительности назад от now ("24h") или в формате RFC 3339
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("ожидается длительность (24h) или время RFC 3339, получено %q", value)
+	}
+	return t, nil
+}
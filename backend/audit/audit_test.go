@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordQuery(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := WithCaller(context.Background(), "192.0.2.10")
+
+	require.NoError(t, Record(ctx, db, "node1", "setdomainmetadata", "Example.com.",
+		map[string][]string{"SOA-EDIT": {}}, map[string][]string{"SOA-EDIT": {"INCEPTION-INCREMENT"}}))
+	require.NoError(t, Record(context.Background(), db, "node2", "createslavedomain", "example.org", nil, []string{"192.0.2.1:53"}))
+	var nilSlice []string
+	require.NoError(t, Record(ctx, db, "node1", "feedents", "example.com", nilSlice, []string{"a.example.com"}))
+
+	all, err := Query(ctx, db, Filter{})
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	assert.Equal(t, "setdomainmetadata", all[0].Method, "oldest first")
+	assert.Equal(t, "example.com", all[0].Zone, "zone name is normalized")
+	assert.Equal(t, "192.0.2.10", all[0].Caller)
+	assert.Equal(t, "node1", all[0].Node)
+	assert.JSONEq(t, `{"SOA-EDIT":[]}`, string(all[0].Before))
+	assert.JSONEq(t, `{"SOA-EDIT":["INCEPTION-INCREMENT"]}`, string(all[0].After))
+	assert.Empty(t, all[1].Caller, "internal calls have no caller")
+	assert.Nil(t, all[1].Before)
+	assert.Nil(t, all[2].Before, "nil value inside interface is stored as NULL")
+	assert.WithinDuration(t, time.Now(), all[0].Time, 2*time.Second)
+
+	zone, err := Query(ctx, db, Filter{Zone: "EXAMPLE.COM"})
+	require.NoError(t, err)
+	assert.Len(t, zone, 2)
+	dotted, err := Query(ctx, db, Filter{Zone: "Example.COM."})
+	require.NoError(t, err)
+	assert.Len(t, dotted, 2, "zone filter is normalized like Record")
+	method, err := Query(ctx, db, Filter{Zone: "example.com", Method: "FeedEnts"})
+	require.NoError(t, err)
+	assert.Len(t, method, 1)
+	caller, err := Query(ctx, db, Filter{Caller: "192.0.2.10"})
+	require.NoError(t, err)
+	assert.Len(t, caller, 2)
+	last, err := Query(ctx, db, Filter{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, last, 2)
+	assert.Equal(t, "createslavedomain", last[0].Method, "limit keeps the latest entries")
+	future, err := Query(ctx, db, Filter{Since: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, future)
+	past, err := Query(ctx, db, Filter{Until: time.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, past)
+}
+
+func TestPrune(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	_, err = db.Exec(insertQuery, time.Now().Add(-48*time.Hour).Unix(), "node1", "setfresh", "example.com", nil, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, Record(ctx, db, "node1", "setfresh", "example.com", nil, nil))
+
+	n, err := Prune(ctx, db, time.Now().Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, n)
+	left, err := Query(ctx, db, Filter{})
+	require.NoError(t, err)
+	assert.Len(t, left, 1)
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	tm, err := ParseTime("24h", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-24*time.Hour), tm)
+	tm, err = ParseTime("2022-05-01T00:00:00Z", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC), tm)
+	tm, err = ParseTime("", now)
+	require.NoError(t, err)
+	assert.True(t, tm.IsZero())
+	_, err = ParseTime("yesterday", now)
+	assert.Error(t, err)
+}
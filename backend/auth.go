@@ -0,0 +1,148 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/ivan-bokov/pdns-dqlite/backend/auth"
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/pkg/errors"
+)
+
+// SetKeys включает проверку ключей API: remote backend принимает только
+// ключи backend, управление только ключи admin. nil выключает проверку.
+func (h *Handler) SetKeys(keys *auth.Keys) {
+	h.keys = keys
+}
+
+// apiKey ключ из заголовка X-API-Key или пароля HTTP Basic. Remote backend
+// PowerDNS не добавляет своих заголовков, но передаёт пароль из url=
+// в remote-connection-string (url=http://pdns:<ключ>@127.0.0.1:4001/).
+func apiKey(g *gin.Context) string {
+	if key := g.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	_, password, _ := g.Request.BasicAuth()
+	return password
+}
+
+// authenticate пропускает запросы с действующим ключом вида kind. failure
+// отвечает в формате группы маршрутов.
+func (h *Handler) authenticate(kind string, failure func(*gin.Context, int, error)) gin.HandlerFunc {
+	return func(g *gin.Context) {
+		if h.keys == nil {
+			return
+		}
+		ctx := g.Request.Context()
+		key, err := h.keys.Authenticate(ctx, apiKey(g))
+		if err != nil {
+			if status := errorStatus(err); status == http.StatusUnauthorized {
+				g.Header("WWW-Authenticate", `Basic realm="pdns-dqlite"`)
+			}
+			failure(g, errorStatus(err), err)
+			return
+		}
+		if key.Kind != kind {
+			failure(g, http.StatusForbidden, errors.Wrapf(auth.ErrForbidden, "ключ %s вида %s, нужен %s", key.Name, key.Kind, kind))
+			return
+		}
+		if key.ReadOnly && g.Request.Method != http.MethodGet && g.Request.Method != http.MethodHead {
+			failure(g, http.StatusForbidden, errors.Wrapf(auth.ErrForbidden, "ключ %s только для чтения", key.Name))
+			return
+		}
+		ctx = audit.WithCaller(auth.WithKey(ctx, key), key.Name)
+		g.Request = g.Request.WithContext(ctx)
+	}
+}
+
+// zoneScope пропускает запросы ключа, ограниченного зонами или владельцем,
+// только к его зонам. Зона берётся из пути, а у журнала из ?zone=: на других
+// маршрутах параметр запроса ничего не ограничивает и не должен открывать
+// доступ. Маршруты владельца без зоны доступны ключу этого владельца без
+// списка зон, остальные маршруты без зоны такому ключу недоступны.
+func (h *Handler) zoneScope(failure func(*gin.Context, int, error)) gin.HandlerFunc {
+	return func(g *gin.Context) {
+		key := auth.FromContext(g.Request.Context())
+		if key == nil || !key.Restricted() {
+			return
+		}
+		zone := g.Param("zone_id")
+		if zone == "" {
+			zone = g.Param("zone")
+		}
+		if zone == "" && g.FullPath() == auditPath {
+			zone = g.Query("zone")
+		}
+		if zone == "" {
+			if account := g.Param("account"); account == "" || account != key.Account || len(key.Zones) != 0 {
+				failure(g, http.StatusForbidden, errors.Wrapf(auth.ErrForbidden, "ключ %s ограничен зонами", key.Name))
+			}
+			return
+		}
+		allowed, err := h.allowsZone(g.Request.Context(), key, strings.TrimSuffix(zone, "."))
+		if err != nil {
+			failure(g, errorStatus(err), err)
+			return
+		}
+		if !allowed {
+			failure(g, http.StatusForbidden, errors.Wrapf(auth.ErrForbidden, "ключ %s, зона %s", key.Name, zone))
+		}
+	}
+}
+
+// auditPath маршрут журнала, единственный, где зона задаётся ?zone=
+const auditPath = "/admin/audit"
+
+// fullAccess пропускает только ключи без ограничений по зонам и владельцу:
+// квоты и передача зон между владельцами доступны только администраторам
+func fullAccess(failure func(*gin.Context, int, error)) gin.HandlerFunc {
+	return func(g *gin.Context) {
+		if key := auth.FromContext(g.Request.Context()); key != nil && key.Restricted() {
+			failure(g, http.StatusForbidden, errors.Wrapf(auth.ErrForbidden, "ключ %s ограничен зонами или владельцем", key.Name))
+		}
+	}
+}
+
+// allowsZone ключу доступна существующая зона zone. Несуществующая зона
+// доступна, если подходит по списку зон: обработчик ответит 404.
+func (h *Handler) allowsZone(ctx context.Context, key *auth.Key, zone string) (bool, error) {
+	if key.Account == "" {
+		return key.AllowsZone(zone, ""), nil
+	}
+	di, err := h.svc.GetDomainInfo(ctx, zone)
+	if err != nil {
+		return false, err
+	}
+	if di.ID == 0 {
+		return key.AllowsZone(zone, key.Account), nil
+	}
+	return key.AllowsZone(zone, di.Account), nil
+}
+
+// keyAllows ключу запроса доступна зона name владельца account, иначе ответ 403
+func keyAllows(g *gin.Context, name, account string) bool {
+	key := auth.FromContext(g.Request.Context())
+	if key == nil || key.AllowsZone(name, account) {
+		return true
+	}
+	apiFail(g, http.StatusForbidden, errors.Wrapf(auth.ErrForbidden, "ключ %s, зона %s владельца %q", key.Name, name, account))
+	return false
+}
+
+// keyDomains зоны, доступные ключу запроса
+func keyDomains(ctx context.Context, dis []*core.DomainInfo) []*core.DomainInfo {
+	key := auth.FromContext(ctx)
+	if key == nil || !key.Restricted() {
+		return dis
+	}
+	allowed := make([]*core.DomainInfo, 0, len(dis))
+	for _, di := range dis {
+		if key.AllowsZone(di.Zone, di.Account) {
+			allowed = append(allowed, di)
+		}
+	}
+	return allowed
+}
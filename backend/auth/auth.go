@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/pkg/errors"
+)
+
+// Ключи API хранятся в реплицируемой таблице api_keys только в виде SHA-256:
+// ключ случайный и длинный, поэтому медленный хэш не нужен, а ключ, украденный
+// из резервной копии базы, не работает. Сам ключ показывается один раз при
+// создании и ротации.
+const (
+	keyColumns   = "id, name, kind, read_only, zones, account, created_at, expires_at, rotated_at"
+	insertQuery  = "INSERT INTO api_keys (name, kind, hash, read_only, zones, account, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	listQuery    = "SELECT " + keyColumns + " FROM api_keys ORDER BY name"
+	nameQuery    = "SELECT " + keyColumns + " FROM api_keys WHERE name = ?"
+	lookupQuery  = "SELECT " + keyColumns + " FROM api_keys WHERE hash = ? OR (previous_hash = ? AND previous_until > ?)"
+	rotateQuery  = "UPDATE api_keys SET previous_hash = hash, previous_until = ?, hash = ?, rotated_at = ? WHERE name = ?"
+	deleteQuery  = "DELETE FROM api_keys WHERE name = ?"
+	secretPrefix = "pdq_"
+	maxCached    = 10000
+)
+
+// Виды ключей: backend для remote backend PowerDNS, admin для управления
+const (
+	KindAdmin   = "admin"
+	KindBackend = "backend"
+)
+
+var (
+	ErrNoKey        = errors.New("не передан ключ API")
+	ErrInvalidKey   = errors.New("неверный ключ API")
+	ErrForbidden    = errors.New("ключу API это запрещено")
+	ErrKeyNotFound  = errors.New("ключ API не найден")
+	ErrKeyExists    = errors.New("ключ API с таким именем уже есть")
+	ErrInvalidScope = errors.New("неверные права ключа API")
+)
+
+// Key ключ API и его права. Пустые Zones и Account не ограничивают зоны,
+// ReadOnly разрешает только чтение.
+type Key struct {
+	ID       int64      `json:"id"`
+	Name     string     `json:"name"`
+	Kind     string     `json:"kind"`
+	ReadOnly bool       `json:"read_only"`
+	Zones    []string   `json:"zones,omitempty"`
+	Account  string     `json:"account,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Rotated  *time.Time `json:"rotated,omitempty"`
+}
+
+// Restricted ключ ограничен списком зон или владельцем
+func (k *Key) Restricted() bool {
+	return len(k.Zones) != 0 || k.Account != ""
+}
+
+// AllowsZone ключу доступна зона zone, принадлежащая account
+func (k *Key) AllowsZone(zone, account string) bool {
+	if k.Account != "" && k.Account != account {
+		return false
+	}
+	if len(k.Zones) == 0 {
+		return true
+	}
+	zone = normalize(zone)
+	for _, z := range k.Zones {
+		if normalize(z) == zone {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *Key) validate() error {
+	switch k.Kind {
+	case KindAdmin:
+	case KindBackend:
+		if k.Restricted() {
+			return errors.Wrap(ErrInvalidScope, "ключ backend нельзя ограничить зонами или владельцем")
+		}
+	default:
+		return errors.Wrapf(ErrInvalidScope, "вид ключа %q, ожидается admin или backend", k.Kind)
+	}
+	if k.Name == "" {
+		return errors.Wrap(ErrInvalidScope, "не указано имя ключа")
+	}
+	return nil
+}
+
+func normalize(zone string) string {
+	return strings.ToLower(strings.TrimSuffix(zone, "."))
+}
+
+// Hash хэш ключа, который хранится в базе
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func generate() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "не удалось создать ключ API")
+	}
+	return secretPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Keys ключи API в базе. Проверенные ключи кэшируются на ttl, поэтому
+// удалённый ключ перестаёт работать на других узлах не позже чем через ttl.
+type Keys struct {
+	db   *sql.DB
+	node string
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+type cached struct {
+	key     *Key
+	expires time.Time
+}
+
+func New(db *sql.DB, node string, ttl time.Duration) *Keys {
+	return &Keys{db: db, node: node, ttl: ttl, cache: make(map[string]cached)}
+}
+
+func unix(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Unix()
+}
+
+func fromUnix(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.Unix(v.Int64, 0).UTC()
+	return &t
+}
+
+func scanKey(row interface{ Scan(...interface{}) error }) (*Key, error) {
+	k := new(Key)
+	var zones, account sql.NullString
+	var created int64
+	var expires, rotated sql.NullInt64
+	if err := row.Scan(&k.ID, &k.Name, &k.Kind, &k.ReadOnly, &zones, &account, &created, &expires, &rotated); err != nil {
+		return nil, err
+	}
+	if zones.String != "" {
+		k.Zones = strings.Split(zones.String, ",")
+	}
+	k.Account = account.String
+	k.Created = time.Unix(created, 0).UTC()
+	k.Expires = fromUnix(expires)
+	k.Rotated = fromUnix(rotated)
+	return k, nil
+}
+
+// write выполняет изменение и запись в журнал одной транзакцией
+func (s *Keys) write(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Create сохраняет ключ и возвращает его значение, которое больше нигде не хранится
+func (s *Keys) Create(ctx context.Context, k *Key) (string, error) {
+	if err := k.validate(); err != nil {
+		return "", err
+	}
+	secret, err := generate()
+	if err != nil {
+		return "", err
+	}
+	zones := make([]string, 0, len(k.Zones))
+	for _, z := range k.Zones {
+		zones = append(zones, normalize(z))
+	}
+	k.Zones = zones
+	k.Created = time.Now().UTC().Truncate(time.Second)
+	err = s.write(ctx, func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM api_keys WHERE name = ?", k.Name).Scan(&n); err != nil {
+			return err
+		}
+		if n != 0 {
+			return errors.Wrap(ErrKeyExists, k.Name)
+		}
+		res, err := tx.ExecContext(ctx, insertQuery, k.Name, k.Kind, Hash(secret), k.ReadOnly,
+			strings.Join(k.Zones, ","), k.Account, k.Created.Unix(), unix(k.Expires))
+		if err != nil {
+			return errors.Wrap(err, "не удалось сохранить ключ API")
+		}
+		if k.ID, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		return audit.Record(ctx, tx, s.node, "createkey", "", nil, k)
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Rotate заменяет значение ключа. Старое значение действует ещё grace, чтобы
+// успеть разложить новое по клиентам.
+func (s *Keys) Rotate(ctx context.Context, name string, grace time.Duration) (string, error) {
+	secret, err := generate()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = s.write(ctx, func(tx *sql.Tx) error {
+		before, err := scanKey(tx.QueryRowContext(ctx, nameQuery, name))
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.Wrap(ErrKeyNotFound, name)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, rotateQuery, now.Add(grace).Unix(), Hash(secret), now.Unix(), name); err != nil {
+			return errors.Wrap(err, "не удалось сменить ключ API")
+		}
+		return audit.Record(ctx, tx, s.node, "rotatekey", "", before, map[string]interface{}{"name": name, "grace": grace.String()})
+	})
+	if err != nil {
+		return "", err
+	}
+	s.flush()
+	return secret, nil
+}
+
+// Delete удаляет ключ
+func (s *Keys) Delete(ctx context.Context, name string) error {
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		before, err := scanKey(tx.QueryRowContext(ctx, nameQuery, name))
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.Wrap(ErrKeyNotFound, name)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, deleteQuery, name); err != nil {
+			return errors.Wrap(err, "не удалось удалить ключ API")
+		}
+		return audit.Record(ctx, tx, s.node, "deletekey", "", before, nil)
+	})
+	if err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+// List все ключи без значений
+func (s *Keys) List(ctx context.Context) ([]*Key, error) {
+	rows, err := s.db.QueryContext(ctx, listQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]*Key, 0)
+	for rows.Next() {
+		k, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Authenticate ключ по его значению
+func (s *Keys) Authenticate(ctx context.Context, secret string) (*Key, error) {
+	if secret == "" {
+		return nil, ErrNoKey
+	}
+	hash := Hash(secret)
+	now := time.Now()
+	s.mu.Lock()
+	c, ok := s.cache[hash]
+	s.mu.Unlock()
+	if !ok || now.After(c.expires) {
+		k, err := scanKey(s.db.QueryRowContext(ctx, lookupQuery, hash, hash, now.Unix()))
+		if errors.Is(err, sql.ErrNoRows) {
+			k, err = nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "не удалось проверить ключ API")
+		}
+		c = cached{key: k, expires: now.Add(s.ttl)}
+		s.mu.Lock()
+		if len(s.cache) >= maxCached {
+			// Перебор неверных ключей не должен раздувать кэш
+			s.cache = make(map[string]cached)
+		}
+		s.cache[hash] = c
+		s.mu.Unlock()
+	}
+	if c.key == nil || (c.key.Expires != nil && now.After(*c.key.Expires)) {
+		return nil, ErrInvalidKey
+	}
+	return c.key, nil
+}
+
+func (s *Keys) flush() {
+	s.mu.Lock()
+	s.cache = make(map[string]cached)
+	s.mu.Unlock()
+}
+
+type keyContext struct{}
+
+// WithKey контекст запроса с ключом, которым он подписан
+func WithKey(ctx context.Context, k *Key) context.Context {
+	return context.WithValue(ctx, keyContext{}, k)
+}
+
+// FromContext ключ запроса, nil если проверка ключей выключена
+func FromContext(ctx context.Context) *Key {
+	k, _ := ctx.Value(keyContext{}).(*Key)
+	return k
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newKeys(t *testing.T, ttl time.Duration) *Keys {
+	t.Helper()
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return New(db, "node1", ttl)
+}
+
+func TestKeys(t *testing.T) {
+	ctx := context.Background()
+	keys := newKeys(t, time.Minute)
+
+	secret, err := keys.Create(ctx, &Key{Name: "pdns", Kind: KindBackend})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(secret, secretPrefix))
+	k, err := keys.Authenticate(ctx, secret)
+	require.NoError(t, err)
+	assert.Equal(t, "pdns", k.Name)
+	assert.Equal(t, KindBackend, k.Kind)
+
+	_, err = keys.Create(ctx, &Key{Name: "pdns", Kind: KindAdmin})
+	assert.ErrorIs(t, err, ErrKeyExists)
+	_, err = keys.Create(ctx, &Key{Name: "pdns2", Kind: KindBackend, Zones: []string{"example.com"}})
+	assert.ErrorIs(t, err, ErrInvalidScope)
+	_, err = keys.Create(ctx, &Key{Name: "root", Kind: "root"})
+	assert.ErrorIs(t, err, ErrInvalidScope)
+
+	_, err = keys.Authenticate(ctx, "")
+	assert.ErrorIs(t, err, ErrNoKey)
+	_, err = keys.Authenticate(ctx, secret+"x")
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	var stored int
+	require.NoError(t, keys.db.QueryRow("SELECT COUNT(*) FROM api_keys WHERE hash = ?", secret).Scan(&stored))
+	assert.Zero(t, stored, "only the hash is stored")
+
+	// Старое значение действует до конца grace
+	rotated, err := keys.Rotate(ctx, "pdns", time.Hour)
+	require.NoError(t, err)
+	_, err = keys.Authenticate(ctx, rotated)
+	require.NoError(t, err)
+	_, err = keys.Authenticate(ctx, secret)
+	require.NoError(t, err)
+	again, err := keys.Rotate(ctx, "pdns", 0)
+	require.NoError(t, err)
+	_, err = keys.Authenticate(ctx, rotated)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = keys.Authenticate(ctx, secret)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = keys.Rotate(ctx, "missing", 0)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, keys.Delete(ctx, "pdns"))
+	_, err = keys.Authenticate(ctx, again)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	assert.ErrorIs(t, keys.Delete(ctx, "pdns"), ErrKeyNotFound)
+
+	entries, err := audit.Query(ctx, keys.db, audit.Filter{})
+	require.NoError(t, err)
+	methods := make([]string, 0, len(entries))
+	for _, e := range entries {
+		methods = append(methods, e.Method)
+		assert.NotContains(t, string(e.Before)+string(e.After), secret)
+	}
+	assert.Equal(t, []string{"createkey", "rotatekey", "rotatekey", "deletekey"}, methods)
+}
+
+func TestKeysExpire(t *testing.T) {
+	ctx := context.Background()
+	keys := newKeys(t, time.Minute)
+	past := time.Now().Add(-time.Minute)
+	secret, err := keys.Create(ctx, &Key{Name: "old", Kind: KindAdmin, Expires: &past})
+	require.NoError(t, err)
+	_, err = keys.Authenticate(ctx, secret)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	list, err := keys.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, past.Unix(), list[0].Expires.Unix())
+}
+
+func TestKeysCache(t *testing.T) {
+	ctx := context.Background()
+	keys := newKeys(t, time.Hour)
+	other := New(keys.db, "node2", time.Hour)
+	secret, err := keys.Create(ctx, &Key{Name: "admin", Kind: KindAdmin})
+	require.NoError(t, err)
+	_, err = other.Authenticate(ctx, secret)
+	require.NoError(t, err)
+
+	// Другой узел узнаёт об удалении по истечении ttl
+	require.NoError(t, keys.Delete(ctx, "admin"))
+	_, err = other.Authenticate(ctx, secret)
+	assert.NoError(t, err)
+	other.ttl = 0
+	other.flush()
+	_, err = other.Authenticate(ctx, secret)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestKeyScope(t *testing.T) {
+	k := &Key{Kind: KindAdmin}
+	assert.False(t, k.Restricted())
+	assert.True(t, k.AllowsZone("example.com", "anyone"))
+
+	k = &Key{Kind: KindAdmin, Zones: []string{"example.com"}}
+	assert.True(t, k.AllowsZone("Example.COM.", ""))
+	assert.False(t, k.AllowsZone("sub.example.com", ""))
+
+	k = &Key{Kind: KindAdmin, Account: "team"}
+	assert.True(t, k.AllowsZone("example.org", "team"))
+	assert.False(t, k.AllowsZone("example.org", "other"))
+	assert.False(t, k.AllowsZone("example.org", ""))
+}
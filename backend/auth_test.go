@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/ivan-bokov/pdns-dqlite/backend/auth"
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAuthRoutes(t *testing.T) (*gin.Engine, *auth.Keys, *sql.DB) {
+	t.Helper()
+	require.NoError(t, logging.SetLevel("error"))
+	t.Cleanup(func() { logging.SetLevel("info") })
+	h, db := newTestHandler(t, false)
+	keys := auth.New(db, "127.0.0.1:9001", time.Minute)
+	h.SetKeys(keys)
+	r := h.InitRoutes()
+	h.DebugRoutes(r)
+	return r, keys, db
+}
+
+func createKey(t *testing.T, keys *auth.Keys, k *auth.Key) map[string]string {
+	t.Helper()
+	secret, err := keys.Create(context.Background(), k)
+	require.NoError(t, err)
+	return map[string]string{"X-API-Key": secret}
+}
+
+func TestAuthKinds(t *testing.T) {
+	r, keys, db := newAuthRoutes(t)
+	admin := createKey(t, keys, &auth.Key{Name: "admin", Kind: auth.KindAdmin})
+	backend := createKey(t, keys, &auth.Key{Name: "pdns", Kind: auth.KindBackend})
+	reader := createKey(t, keys, &auth.Key{Name: "reader", Kind: auth.KindBackend, ReadOnly: true})
+
+	for _, c := range []contractCase{
+		{method: "GET", path: "/healthz", status: 200},
+		{method: "GET", path: "/metrics", status: 200},
+		{method: "GET", path: "/getAllDomains", status: 401},
+		{method: "GET", path: "/getAllDomains", header: map[string]string{"X-API-Key": "pdq_wrong"}, status: 401},
+		{method: "GET", path: "/getAllDomains", header: backend, status: 200},
+		{method: "GET", path: "/getAllDomains", header: admin, status: 403},
+		{method: "GET", path: "/getAllDomains", header: reader, status: 200},
+		{method: "POST", path: "/createslavedomain/192.0.2.1/example.com", header: reader, status: 403},
+		{method: "POST", path: "/createslavedomain/192.0.2.1/example.com", header: backend, status: 200},
+		{method: "GET", path: "/admin/log/level", status: 401},
+		{method: "GET", path: "/admin/log/level", header: backend, status: 403},
+		{method: "GET", path: "/admin/log/level", header: admin, status: 200},
+		{method: "POST", path: "/test/k?value=v", header: backend, status: 403},
+	} {
+		w := c.do(r)
+		assert.Equal(t, c.status, w.Code, "%s %s: %s", c.method, c.path, w.Body.String())
+		if c.path != "/metrics" {
+			checkEnvelope(t, w)
+		}
+		if w.Code == http.StatusUnauthorized {
+			assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// Remote backend передаёт ключ паролем из url=
+	req := httptest.NewRequest("GET", "/getAllDomains", nil)
+	req.SetBasicAuth("pdns", backend["X-API-Key"])
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w401 := contractCase{method: "GET", path: zones}.do(r)
+	assert.Equal(t, http.StatusUnauthorized, w401.Code)
+	checkAPIError(t, w401.Code, w401.Body.Bytes())
+
+	entries, err := audit.Query(context.Background(), db, audit.Filter{Method: "createslavedomain"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "pdns", entries[0].Caller, "changes are logged under the key name")
+}
+
+func TestAuthScope(t *testing.T) {
+	r, keys, _ := newAuthRoutes(t)
+	admin := createKey(t, keys, &auth.Key{Name: "admin", Kind: auth.KindAdmin})
+	team := createKey(t, keys, &auth.Key{Name: "team", Kind: auth.KindAdmin, Account: "team"})
+	one := createKey(t, keys, &auth.Key{Name: "one", Kind: auth.KindAdmin, Zones: []string{"example.org"}})
+	viewer := createKey(t, keys, &auth.Key{Name: "viewer", Kind: auth.KindAdmin, ReadOnly: true})
+
+	for _, c := range []contractCase{
+		{method: "POST", path: zones, json: `{"name":"example.com.","kind":"Native"}`, header: team, status: 201},
+		{method: "POST", path: zones, json: `{"name":"example.net.","kind":"Native","account":"other"}`, header: team, status: 403},
+		{method: "POST", path: zones, json: `{"name":"example.net.","kind":"Native"}`, header: one, status: 403},
+		{method: "POST", path: zones, json: `{"name":"example.org.","kind":"Native"}`, header: one, status: 201},
+		{method: "POST", path: zones, json: `{"name":"example.net.","kind":"Native"}`, header: viewer, status: 403},
+		{method: "GET", path: zones + "/example.com.", header: team, status: 200},
+		{method: "GET", path: zones + "/example.com.", header: one, status: 403},
+		{method: "GET", path: zones + "/example.org.", header: team, status: 403},
+		{method: "GET", path: zones + "/example.org.", header: viewer, status: 200},
+		{method: "PUT", path: zones + "/example.com.", json: `{"account":"other"}`, header: team, status: 403},
+		{method: "PATCH", path: zones + "/example.com.", json: `{"rrsets":[]}`, header: team, status: 204},
+		{method: "DELETE", path: zones + "/example.org.", header: viewer, status: 403},
+		{method: "GET", path: "/admin/zones/example.org/versions", header: one, status: 200},
+		{method: "GET", path: "/admin/zones/example.com/versions", header: one, status: 403},
+		{method: "GET", path: "/admin/audit?zone=example.org", header: one, status: 200},
+		{method: "GET", path: "/admin/audit", header: one, status: 403},
+		{method: "GET", path: "/admin/cluster/nodes", header: team, status: 403},
+		{method: "GET", path: "/admin/cluster/nodes?zone=example.org", header: one, status: 403},
+		{method: "DELETE", path: "/admin/cluster/nodes/2?zone=example.org", header: one, status: 403},
+		{method: "POST", path: "/admin/cluster/transfer/2?zone=example.org", header: one, status: 403},
+		{method: "POST", path: "/admin/cluster/assign/2/spare?zone=example.org", header: one, status: 403},
+		{method: "GET", path: "/admin/accounts?zone=example.org", header: one, status: 403},
+		{method: "GET", path: "/admin/accounts?zone=example.com", header: team, status: 403},
+		{method: "GET", path: "/admin/log/level?zone=example.org", header: one, status: 403},
+		{method: "PUT", path: "/admin/log/level/debug?zone=example.org", header: one, status: 403},
+		{method: "GET", path: "/admin/zones/example.com/versions?zone=example.org", header: one, status: 403},
+		{method: "GET", path: "/admin/accounts/team", header: team, status: 200},
+		{method: "GET", path: "/admin/accounts/team/search?pattern=*", header: team, status: 200},
+		{method: "GET", path: "/admin/accounts/other/zones", header: team, status: 403},
+		{method: "GET", path: "/admin/accounts/team/zones", header: one, status: 403},
+		{method: "GET", path: "/admin/accounts", header: team, status: 403},
+		{method: "PUT", path: "/admin/accounts/team/quota?zones=100", header: team, status: 403},
+		{method: "PUT", path: "/admin/zones/example.com/account/other", header: team, status: 403},
+		{method: "PUT", path: "/admin/accounts/team/quota?zones=1", header: admin, status: 200},
+		{method: "POST", path: zones, json: `{"name":"example.net.","kind":"Native"}`, header: team, status: 422},
+		{method: "PUT", path: "/admin/zones/example.org/account/team", header: admin, status: 422},
+	} {
+		w := c.do(r)
+		assert.Equal(t, c.status, w.Code, "%s %s: %s", c.method, c.path, w.Body.String())
+	}
+
+	names := func(header map[string]string) []string {
+		w := contractCase{method: "GET", path: zones, header: header}.do(r)
+		require.Equal(t, http.StatusOK, w.Code)
+		var list []struct {
+			Name string `json:"name"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		out := make([]string, 0, len(list))
+		for _, z := range list {
+			out = append(out, z.Name)
+		}
+		return out
+	}
+	assert.Equal(t, []string{"example.com."}, names(team))
+
+	w := contractCase{method: "GET", path: apiServer + "/search-data?q=*example*", header: team}.do(r)
+	require.Equal(t, http.StatusOK, w.Code)
+	var found []struct {
+		ObjectType string `json:"object_type"`
+		Zone       string `json:"zone_id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	require.NotEmpty(t, found)
+	for _, f := range found {
+		assert.Equal(t, "example.com.", f.Zone, "%s of another account", f.ObjectType)
+	}
+	assert.Equal(t, []string{"example.org."}, names(one))
+
+	// Записи чужих зон не занимают max ключа, ограниченного зонами
+	w = contractCase{method: "GET", path: apiServer + "/search-data?q=*example*&object_type=record&max=1", header: one}.do(r)
+	require.Equal(t, http.StatusOK, w.Code)
+	found = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	require.Len(t, found, 1)
+	assert.Equal(t, "example.org.", found[0].Zone)
+	assert.ElementsMatch(t, []string{"example.com.", "example.org."}, names(admin))
+}
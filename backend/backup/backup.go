@@ -0,0 +1,295 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/pkg/errors"
+)
+
+// header первая строка резервной копии, по ней restore узнаёт формат
+const header = "-- pdns-dqlite backup v1"
+
+// Ext расширение файлов резервных копий, рядом лежит контрольная сумма Ext+".sha256"
+const Ext = ".sql.gz"
+
+// FileName имя файла резервной копии, сделанной в момент t
+func FileName(prefix string, t time.Time) string {
+	return prefix + "-" + t.UTC().Format("20060102T150405Z") + Ext
+}
+
+// tables таблицы с данными без служебных таблиц storage.ServiceTables
+func tables(ctx context.Context, q interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	skip := make(map[string]bool)
+	for _, name := range storage.ServiceTables {
+		skip[name] = true
+	}
+	list := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if !skip[name] {
+			list = append(list, name)
+		}
+	}
+	return list, rows.Err()
+}
+
+// literal записывает значение как литерал SQL. Переводы строк выносятся
+// в char(), чтобы каждая команда занимала ровно одну строку.
+func literal(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case []byte:
+		return "X'" + hex.EncodeToString(v) + "'"
+	case time.Time:
+		return literal(v.Format(time.RFC3339Nano))
+	case string:
+		s := "'" + strings.ReplaceAll(v, "'", "''") + "'"
+		s = strings.ReplaceAll(s, "\n", "'||char(10)||'")
+		return strings.ReplaceAll(s, "\r", "'||char(13)||'")
+	}
+	return literal(fmt.Sprint(v))
+}
+
+// Write выгружает все таблицы в виде команд INSERT, по одной на строку.
+// Чтение идёт в одной транзакции, поэтому копия согласована.
+func Write(ctx context.Context, db *sql.DB, w io.Writer) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	list, err := tables(ctx, tx)
+	if err != nil {
+		return errors.Wrap(err, "не удалось получить список таблиц")
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, header)
+	for _, table := range list {
+		if err = dumpTable(ctx, tx, table, bw); err != nil {
+			return errors.Wrapf(err, "не удалось выгрузить %s", table)
+		}
+	}
+	return bw.Flush()
+}
+
+func dumpTable(ctx context.Context, tx *sql.Tx, table string, w io.Writer) error {
+	rows, err := tx.QueryContext(ctx, `SELECT * FROM "`+table+`"`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	prefix := `INSERT INTO "` + table + `" ("` + strings.Join(columns, `","`) + `") VALUES (`
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	literals := make([]string, len(columns))
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			literals[i] = literal(v)
+		}
+		if _, err = fmt.Fprintln(w, prefix+strings.Join(literals, ",")+");"); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Restore загружает резервную копию в пустую базу со схемой storage.Schema
+func Restore(ctx context.Context, db *sql.DB, r io.Reader) error {
+	list, err := tables(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, table := range list {
+		var n int
+		if err = db.QueryRowContext(ctx, `SELECT count(*) FROM "`+table+`"`).Scan(&n); err != nil {
+			return err
+		}
+		if n != 0 {
+			return errors.Errorf("база не пустая: в таблице %s есть записи", table)
+		}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() || scanner.Text() != header {
+		return errors.New("файл не является резервной копией pdns-dqlite")
+	}
+	for line := 2; scanner.Scan(); line++ {
+		stmt := scanner.Text()
+		if stmt == "" || strings.HasPrefix(stmt, "--") {
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return errors.Wrapf(err, "строка %d", line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Create сохраняет сжатую резервную копию в path и контрольную сумму в path.sha256.
+// Файл появляется под своим именем только целиком.
+func Create(ctx context.Context, db *sql.DB, path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	sum := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(tmp, sum))
+	if err = Write(ctx, db, zw); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	line := hex.EncodeToString(sum.Sum(nil)) + "  " + filepath.Base(path) + "\n"
+	if err = ioutil.WriteFile(path+".sha256", []byte(line), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Verify сверяет файл с контрольной суммой, формат совместим с sha256sum
+func Verify(path string) error {
+	data, err := ioutil.ReadFile(path + ".sha256")
+	if err != nil {
+		return errors.Wrap(err, "не могу прочитать контрольную сумму")
+	}
+	want := strings.Fields(string(data))
+	if len(want) == 0 {
+		return errors.Errorf("пустой файл %s.sha256", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err = io.Copy(sum, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != want[0] {
+		return errors.Errorf("контрольная сумма %s не совпадает: %s, ожидалась %s", path, got, want[0])
+	}
+	return nil
+}
+
+// Load проверяет контрольную сумму и загружает копию из path в пустую базу
+func Load(ctx context.Context, db *sql.DB, path string) error {
+	if err := Verify(path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.Wrapf(err, "не могу распаковать %s", path)
+	}
+	defer zr.Close()
+	return Restore(ctx, db, zr)
+}
+
+// Rotate оставляет в dir только keep последних копий с префиксом prefix
+func Rotate(dir, prefix string, keep int) error {
+	matches, err := filepath.Glob(filepath.Join(dir, prefix+"-*"+Ext))
+	if err != nil {
+		return err
+	}
+	// Время в имени файла, поэтому сортировка по имени совпадает с сортировкой по времени
+	sort.Strings(matches)
+	for len(matches) > keep {
+		if err = os.Remove(matches[0]); err != nil {
+			return err
+		}
+		os.Remove(matches[0] + ".sha256")
+		matches = matches[1:]
+	}
+	return nil
+}
+
+// Schedule делает резервную копию в dir каждые interval и хранит keep последних,
+// пока не отменён ctx
+func Schedule(ctx context.Context, db *sql.DB, dir, prefix string, interval time.Duration, keep int) {
+	log := logging.Logger.WithField("component", "backup")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			path := filepath.Join(dir, FileName(prefix, now))
+			if err := Create(ctx, db, path); err != nil {
+				log.WithError(err).WithField("file", path).Error("резервная копия не создана")
+				continue
+			}
+			if err := Rotate(dir, prefix, keep); err != nil {
+				log.WithError(err).Error("не удалось удалить старые резервные копии")
+			}
+			log.WithField("file", path).Info("резервная копия создана")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func records(t *testing.T, db *sql.DB) [][]interface{} {
+	t.Helper()
+	rows, err := db.Query("SELECT id, domain_id, name, type, content, ttl, prio, disabled, ordername, auth FROM records ORDER BY id")
+	require.NoError(t, err)
+	defer rows.Close()
+	list := make([][]interface{}, 0)
+	for rows.Next() {
+		row := make([]interface{}, 10)
+		ptrs := make([]interface{}, len(row))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		require.NoError(t, rows.Scan(ptrs...))
+		list = append(list, row)
+	}
+	require.NoError(t, rows.Err())
+	return list
+}
+
+func TestCreateAndLoad(t *testing.T) {
+	ctx := context.Background()
+	src := newDB(t)
+	_, err := src.Exec(`INSERT INTO domains (id, name, type) VALUES (7, 'example.com', 'NATIVE')`)
+	require.NoError(t, err)
+	_, err = src.Exec(`INSERT INTO records (id, domain_id, name, type, content, ttl, prio, disabled, ordername, auth) VALUES
+		(1, 7, 'example.com', 'SOA', 'ns1.example.com. admin.example.com. 1 10800 3600 604800 3600', 3600, 0, 0, NULL, 1),
+		(5, 7, 'example.com', 'TXT', '"it''s"'||char(10)||'"multi line"', 300, NULL, 1, 'x', 0)`)
+	require.NoError(t, err)
+	_, err = src.Exec(`INSERT INTO tsigkeys (name, algorithm, secret) VALUES ('key', 'hmac-sha256', ?)`, []byte{0, 1, 2})
+	require.NoError(t, err)
+	// Узел, запускавшийся с --debug: отладочная таблица не попадает в копию
+	require.NoError(t, storage.InitDebug(src))
+	_, err = src.Exec(`INSERT INTO model (key, value) VALUES ('k', 'v')`)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, FileName("power-dns", time.Now()))
+	require.NoError(t, Create(ctx, src, path))
+	require.NoError(t, Verify(path))
+
+	dst := newDB(t)
+	require.NoError(t, Load(ctx, dst, path))
+	assert.Equal(t, records(t, src), records(t, dst))
+	var secret []byte
+	require.NoError(t, dst.QueryRow(`SELECT secret FROM tsigkeys`).Scan(&secret))
+	assert.Equal(t, []byte{0, 1, 2}, secret)
+
+	assert.Error(t, Load(ctx, dst, path), "target must be empty")
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, FileName("power-dns", time.Now()))
+	require.NoError(t, Create(context.Background(), newDB(t), path))
+	require.NoError(t, Verify(path))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0o644))
+	assert.Error(t, Verify(path))
+	assert.Error(t, Load(context.Background(), newDB(t), path))
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	db := newDB(t)
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, Create(context.Background(), db, filepath.Join(dir, FileName("power-dns", start.Add(time.Duration(i)*time.Hour)))))
+	}
+	require.NoError(t, Rotate(dir, "power-dns", 2))
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "power-dns-20261001T030000Z.sql.gz"),
+		filepath.Join(dir, "power-dns-20261001T030000Z.sql.gz.sha256"),
+		filepath.Join(dir, "power-dns-20261001T040000Z.sql.gz"),
+		filepath.Join(dir, "power-dns-20261001T040000Z.sql.gz.sha256"),
+	}, files)
+}
@@ -0,0 +1,254 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Имена файлов удостоверяющего центра кластера
+const (
+	CACert = "ca.crt"
+	CAKey  = "ca.key"
+)
+
+// checkInterval как часто при установке соединения проверяется, не заменены ли файлы сертификата
+const checkInterval = 10 * time.Second
+
+func newKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// write сохраняет сертификат и ключ в PEM, ключ доступен только владельцу
+func write(dir, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	for _, path := range []string{certPath, keyPath} {
+		if _, err = os.Stat(path); err == nil {
+			return errors.Errorf("%s уже существует", path)
+		}
+	}
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return errors.Wrapf(err, "не могу создать %s", dir)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = ioutil.WriteFile(certPath, certPEM, 0o644); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return ioutil.WriteFile(keyPath, keyPEM, 0o600)
+}
+
+// InitCA создаёт в dir самоподписанный удостоверяющий центр кластера
+func InitCA(dir, name string, validity time.Duration) error {
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	return write(dir, "ca", der, key)
+}
+
+// Issue выпускает сертификат узла name, подписанный центром из dir.
+// Сертификат используется и как серверный, и как клиентский. Узлы
+// проверяют друг друга по адресу, поэтому hosts должен содержать все
+// IP адреса и имена, по которым к узлу подключаются другие узлы.
+func Issue(dir, name string, hosts []string, validity time.Duration) error {
+	if len(hosts) == 0 {
+		return errors.New("не указаны адреса узла")
+	}
+	ca, err := tls.LoadX509KeyPair(filepath.Join(dir, CACert), filepath.Join(dir, CAKey))
+	if err != nil {
+		return errors.Wrap(err, "не могу загрузить удостоверяющий центр")
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return err
+	}
+	return write(dir, name, der, key)
+}
+
+// Keypair сертификат узла, который перечитывается с диска при замене файлов,
+// так что обновлённые сертификаты применяются без перезапуска
+type Keypair struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func LoadKeypair(certFile, keyFile string) (*Keypair, error) {
+	k := &Keypair{certFile: certFile, keyFile: keyFile}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *Keypair) modified() (time.Time, error) {
+	var last time.Time
+	for _, path := range []string{k.certFile, k.keyFile} {
+		st, err := os.Stat(path)
+		if err != nil {
+			return last, err
+		}
+		if st.ModTime().After(last) {
+			last = st.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// Reload перечитывает сертификат и ключ. При ошибке остаётся прежний сертификат.
+func (k *Keypair) Reload() error {
+	modTime, err := k.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "не могу загрузить сертификат %s", k.certFile)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cert, k.modTime, k.checked = &cert, modTime, time.Now()
+	return nil
+}
+
+// current возвращает сертификат, перед этим не чаще checkInterval проверяя файлы
+func (k *Keypair) current() *tls.Certificate {
+	k.mu.Lock()
+	stale := time.Since(k.checked) > checkInterval
+	if stale {
+		k.checked = time.Now()
+	}
+	cert, modTime := k.cert, k.modTime
+	k.mu.Unlock()
+	if stale {
+		if m, err := k.modified(); err == nil && m.After(modTime) && k.Reload() == nil {
+			k.mu.Lock()
+			cert = k.cert
+			k.mu.Unlock()
+		}
+	}
+	return cert
+}
+
+// LoadPool загружает сертификаты удостоверяющих центров из PEM файла
+func LoadPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "не могу прочитать %s", caFile)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("в %s нет сертификатов", caFile)
+	}
+	return pool, nil
+}
+
+// ServerConfig возвращает настройки TLS для API. Если задан pool, клиент
+// должен предъявить сертификат, подписанный одним из его центров.
+func ServerConfig(k *Keypair, pool *x509.CertPool) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return k.current(), nil
+		},
+	}
+	if pool != nil {
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
+
+// Config возвращает настройки TLS для входящих и исходящих соединений dqlite
+// с взаимной проверкой сертификатов
+func Config(k *Keypair, pool *x509.CertPool) (listen *tls.Config, dial *tls.Config) {
+	listen = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return k.current(), nil
+		},
+	}
+	dial = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return k.current(), nil
+		},
+	}
+	return listen, dial
+}
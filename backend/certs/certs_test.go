@@ -0,0 +1,142 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handshake устанавливает соединение между двумя узлами и возвращает
+// сертификат, который предъявил сервер
+func handshake(t *testing.T, listen, dial *tls.Config, addr string) (*x509.Certificate, error) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	server := tls.Server(c1, listen)
+	go server.Handshake()
+	d := dial.Clone()
+	d.ServerName = addr
+	client := tls.Client(c2, d)
+	if err := client.Handshake(); err != nil {
+		return nil, err
+	}
+	return client.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, InitCA(dir, "pdns-dqlite", time.Hour))
+	assert.Error(t, InitCA(dir, "pdns-dqlite", time.Hour), "existing CA is not overwritten")
+	require.NoError(t, Issue(dir, "node1", []string{"127.0.0.1", "node1.local"}, time.Hour))
+	assert.Error(t, Issue(dir, "node2", nil, time.Hour))
+
+	st, err := os.Stat(filepath.Join(dir, "node1.key"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), st.Mode().Perm())
+
+	pool, err := LoadPool(filepath.Join(dir, CACert))
+	require.NoError(t, err)
+	kp, err := LoadKeypair(filepath.Join(dir, "node1.crt"), filepath.Join(dir, "node1.key"))
+	require.NoError(t, err)
+	listen, dial := Config(kp, pool)
+
+	cert, err := handshake(t, listen, dial, "127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, "node1", cert.Subject.CommonName)
+	_, err = handshake(t, listen, dial, "127.0.0.2")
+	assert.Error(t, err, "address is not in the certificate")
+
+	// Сертификат чужого центра не принимается
+	other := t.TempDir()
+	require.NoError(t, InitCA(other, "other", time.Hour))
+	require.NoError(t, Issue(other, "node1", []string{"127.0.0.1"}, time.Hour))
+	otherPool, err := LoadPool(filepath.Join(other, CACert))
+	require.NoError(t, err)
+	_, otherDial := Config(kp, otherPool)
+	_, err = handshake(t, listen, otherDial, "127.0.0.1")
+	assert.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, InitCA(dir, "pdns-dqlite", time.Hour))
+	require.NoError(t, Issue(dir, "node1", []string{"127.0.0.1"}, time.Hour))
+	require.NoError(t, Issue(dir, "rotated", []string{"127.0.0.1"}, time.Hour))
+
+	certFile, keyFile := filepath.Join(dir, "node1.crt"), filepath.Join(dir, "node1.key")
+	kp, err := LoadKeypair(certFile, keyFile)
+	require.NoError(t, err)
+	first := kp.current()
+
+	require.NoError(t, os.Rename(filepath.Join(dir, "rotated.crt"), certFile))
+	require.NoError(t, os.Rename(filepath.Join(dir, "rotated.key"), keyFile))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	assert.Same(t, first, kp.current(), "files are checked at most every checkInterval")
+
+	kp.checked = time.Time{}
+	assert.NotSame(t, first, kp.current())
+
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("broken"), 0o644))
+	assert.Error(t, kp.Reload())
+	assert.NotNil(t, kp.current(), "previous certificate is kept")
+}
+
+// accept возвращает ошибку проверки клиента на стороне сервера. Нужно
+// настоящее соединение: в net.Pipe сервер и клиент блокируются, одновременно
+// отправляя друг другу данные.
+func accept(t *testing.T, listen, dial *tls.Config) error {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	d := dial.Clone()
+	d.ServerName = "127.0.0.1"
+	go func() {
+		if c, err := tls.Dial("tcp", l.Addr().String(), d); err == nil {
+			// Ответ сервера на сертификат в TLS 1.3 приходит после рукопожатия клиента
+			c.Read(make([]byte, 1))
+			c.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	return tls.Server(conn, listen).Handshake()
+}
+
+func TestServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, InitCA(dir, "pdns-dqlite", time.Hour))
+	require.NoError(t, Issue(dir, "api", []string{"127.0.0.1"}, time.Hour))
+	require.NoError(t, Issue(dir, "pdns1", []string{"10.0.0.1"}, time.Hour))
+	pool, err := LoadPool(filepath.Join(dir, CACert))
+	require.NoError(t, err)
+	server, err := LoadKeypair(filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key"))
+	require.NoError(t, err)
+	client, err := LoadKeypair(filepath.Join(dir, "pdns1.crt"), filepath.Join(dir, "pdns1.key"))
+	require.NoError(t, err)
+	_, withCert := Config(client, pool)
+	anonymous := &tls.Config{RootCAs: pool}
+
+	assert.NoError(t, accept(t, ServerConfig(server, nil), anonymous), "client certificate is optional without a CA")
+	assert.NoError(t, accept(t, ServerConfig(server, pool), withCert))
+	assert.Error(t, accept(t, ServerConfig(server, pool), anonymous))
+
+	other := t.TempDir()
+	require.NoError(t, InitCA(other, "other", time.Hour))
+	require.NoError(t, Issue(other, "pdns1", []string{"10.0.0.1"}, time.Hour))
+	stranger, err := LoadKeypair(filepath.Join(other, "pdns1.crt"), filepath.Join(other, "pdns1.key"))
+	require.NoError(t, err)
+	_, strangerDial := Config(stranger, pool)
+	assert.Error(t, accept(t, ServerConfig(server, pool), strangerDial), "certificate of another CA")
+}
@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/canonical/go-dqlite/client"
+	"github.com/pkg/errors"
+)
+
+// Client операции go-dqlite клиента, которые нужны для управления кластером
+type Client interface {
+	Leader(ctx context.Context) (*client.NodeInfo, error)
+	Cluster(ctx context.Context) ([]client.NodeInfo, error)
+	Remove(ctx context.Context, id uint64) error
+	Transfer(ctx context.Context, id uint64) error
+	Assign(ctx context.Context, id uint64, role client.NodeRole) error
+	Describe(ctx context.Context) (*client.NodeMetadata, error)
+	Close() error
+}
+
+// Connect подключается к лидеру кластера
+type Connect func(ctx context.Context) (Client, error)
+
+// Dial подключается к конкретному узлу, чтобы узнать его домен отказа
+type Dial func(ctx context.Context, address string) (Client, error)
+
+// Roles желаемое распределение ролей из конфигурации
+type Roles struct {
+	Voters   int `json:"voters"`
+	StandBys int `json:"standbys"`
+}
+
+// Status узлы кластера вместе с желаемым и фактическим числом ролей
+type Status struct {
+	Roles    Roles  `json:"roles"`
+	Voters   int    `json:"voters"`
+	StandBys int    `json:"standbys"`
+	Nodes    []Node `json:"nodes"`
+}
+
+// Node узел кластера в том виде, в котором он показывается в CLI и API
+type Node struct {
+	ID            uint64 `json:"id"`
+	Address       string `json:"address"`
+	Role          string `json:"role"`
+	Leader        bool   `json:"leader"`
+	FailureDomain uint64 `json:"failure_domain"`
+	Online        bool   `json:"online"`
+}
+
+type Manager struct {
+	connect Connect
+	dial    Dial
+	roles   Roles
+}
+
+func New(connect Connect, dial Dial, roles Roles) *Manager {
+	return &Manager{connect: connect, dial: dial, roles: roles}
+}
+
+// NewWithAddresses ищет лидера среди перечисленных адресов, используется в CLI,
+// когда экземпляра dqlite в процессе нет
+func NewWithAddresses(addresses []string, roles Roles, options ...client.Option) *Manager {
+	return New(func(ctx context.Context) (Client, error) {
+		store := client.NewInmemNodeStore()
+		nodes := make([]client.NodeInfo, 0, len(addresses))
+		for _, addr := range addresses {
+			nodes = append(nodes, client.NodeInfo{Address: addr})
+		}
+		if err := store.Set(ctx, nodes); err != nil {
+			return nil, err
+		}
+		cli, err := client.FindLeader(ctx, store, options...)
+		if err != nil {
+			return nil, errors.Wrap(err, "не удалось найти лидера кластера")
+		}
+		return cli, nil
+	}, func(ctx context.Context, address string) (Client, error) {
+		cli, err := client.New(ctx, address, options...)
+		if err != nil {
+			return nil, err
+		}
+		return cli, nil
+	}, roles)
+}
+
+func (m *Manager) Nodes(ctx context.Context) ([]Node, error) {
+	cli, err := m.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	return nodes(ctx, cli)
+}
+
+func nodes(ctx context.Context, cli Client) ([]Node, error) {
+	leader, err := cli.Leader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := cli.Cluster(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Node, 0, len(infos))
+	for _, info := range infos {
+		list = append(list, Node{
+			ID:      info.ID,
+			Address: info.Address,
+			Role:    info.Role.String(),
+			Leader:  leader != nil && leader.ID == info.ID,
+		})
+	}
+	return list, nil
+}
+
+// Status опрашивает каждый узел, недоступные узлы отмечаются как offline
+func (m *Manager) Status(ctx context.Context) (*Status, error) {
+	list, err := m.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{Roles: m.roles, Nodes: list}
+	for i := range list {
+		n := &list[i]
+		switch n.Role {
+		case client.Voter.String():
+			status.Voters++
+		case client.StandBy.String():
+			status.StandBys++
+		}
+		cli, err := m.dial(ctx, n.Address)
+		if err != nil {
+			continue
+		}
+		meta, err := cli.Describe(ctx)
+		cli.Close()
+		if err != nil {
+			continue
+		}
+		n.Online, n.FailureDomain = true, meta.FailureDomain
+	}
+	return status, nil
+}
+
+func (m *Manager) Leader(ctx context.Context) (*Node, error) {
+	list, err := m.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range list {
+		if n.Leader {
+			return &n, nil
+		}
+	}
+	return nil, errors.New("в кластере нет лидера")
+}
+
+// find ищет узел по идентификатору или адресу
+func find(list []Node, ref string) (*Node, error) {
+	id, _ := strconv.ParseUint(ref, 10, 64)
+	for _, n := range list {
+		if n.Address == ref || (id != 0 && n.ID == id) {
+			return &n, nil
+		}
+	}
+	return nil, errors.Errorf("узел %s не найден в кластере", ref)
+}
+
+// withNode подключается к лидеру и находит узел по идентификатору или адресу
+func (m *Manager) withNode(ctx context.Context, ref string, fn func(cli Client, node *Node) error) error {
+	cli, err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	list, err := nodes(ctx, cli)
+	if err != nil {
+		return err
+	}
+	node, err := find(list, ref)
+	if err != nil {
+		return err
+	}
+	return fn(cli, node)
+}
+
+// Remove удаляет узел из кластера, например вышедший из строя сервер.
+// Лидера удалить нельзя, сначала нужно передать лидерство.
+func (m *Manager) Remove(ctx context.Context, ref string) error {
+	return m.withNode(ctx, ref, func(cli Client, node *Node) error {
+		if node.Leader {
+			return errors.Errorf("узел %s является лидером, сначала передайте лидерство", node.Address)
+		}
+		return cli.Remove(ctx, node.ID)
+	})
+}
+
+// Transfer передаёт лидерство указанному узлу
+func (m *Manager) Transfer(ctx context.Context, ref string) error {
+	return m.withNode(ctx, ref, func(cli Client, node *Node) error {
+		if node.Leader {
+			return nil
+		}
+		return cli.Transfer(ctx, node.ID)
+	})
+}
+
+// Assign меняет роль узла: voter, stand-by или spare
+func (m *Manager) Assign(ctx context.Context, ref string, role string) error {
+	r, err := ParseRole(role)
+	if err != nil {
+		return err
+	}
+	return m.withNode(ctx, ref, func(cli Client, node *Node) error {
+		return cli.Assign(ctx, node.ID, r)
+	})
+}
+
+func ParseRole(role string) (client.NodeRole, error) {
+	switch role {
+	case "voter":
+		return client.Voter, nil
+	case "stand-by", "standby":
+		return client.StandBy, nil
+	case "spare":
+		return client.Spare, nil
+	}
+	return 0, errors.Errorf("неизвестная роль %s, допустимы: voter, stand-by, spare", role)
+}
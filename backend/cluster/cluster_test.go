@@ -0,0 +1,144 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/canonical/go-dqlite/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClient struct {
+	leader uint64
+	nodes  []client.NodeInfo
+	closed int
+}
+
+func (f *fakeClient) Leader(ctx context.Context) (*client.NodeInfo, error) {
+	for _, n := range f.nodes {
+		if n.ID == f.leader {
+			return &n, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeClient) Cluster(ctx context.Context) ([]client.NodeInfo, error) {
+	return f.nodes, nil
+}
+
+func (f *fakeClient) Remove(ctx context.Context, id uint64) error {
+	for i, n := range f.nodes {
+		if n.ID == id {
+			f.nodes = append(f.nodes[:i], f.nodes[i+1:]...)
+		}
+	}
+	return nil
+}
+
+func (f *fakeClient) Transfer(ctx context.Context, id uint64) error {
+	f.leader = id
+	return nil
+}
+
+func (f *fakeClient) Assign(ctx context.Context, id uint64, role client.NodeRole) error {
+	for i := range f.nodes {
+		if f.nodes[i].ID == id {
+			f.nodes[i].Role = role
+		}
+	}
+	return nil
+}
+
+func (f *fakeClient) Describe(ctx context.Context) (*client.NodeMetadata, error) {
+	return &client.NodeMetadata{}, nil
+}
+
+func (f *fakeClient) Close() error {
+	f.closed++
+	return nil
+}
+
+func newFake() (*Manager, *fakeClient) {
+	fake := &fakeClient{
+		leader: 1,
+		nodes: []client.NodeInfo{
+			{ID: 1, Address: "127.0.0.1:6001", Role: client.Voter},
+			{ID: 2, Address: "127.0.0.1:6002", Role: client.Voter},
+			{ID: 3, Address: "127.0.0.1:6003", Role: client.StandBy},
+		},
+	}
+	connect := func(ctx context.Context) (Client, error) { return fake, nil }
+	dial := func(ctx context.Context, address string) (Client, error) {
+		if address == "127.0.0.1:6003" {
+			return nil, errors.New("connection refused")
+		}
+		return &nodeClient{fakeClient: fake, domain: uint64(len(address))}, nil
+	}
+	return New(connect, dial, Roles{Voters: 3, StandBys: 1}), fake
+}
+
+// nodeClient подключение к конкретному узлу
+type nodeClient struct {
+	*fakeClient
+	domain uint64
+}
+
+func (c *nodeClient) Describe(ctx context.Context) (*client.NodeMetadata, error) {
+	return &client.NodeMetadata{FailureDomain: c.domain}, nil
+}
+
+func TestNodesAndLeader(t *testing.T) {
+	m, fake := newFake()
+	ctx := context.Background()
+
+	list, err := m.Nodes(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Node{
+		{ID: 1, Address: "127.0.0.1:6001", Role: "voter", Leader: true},
+		{ID: 2, Address: "127.0.0.1:6002", Role: "voter"},
+		{ID: 3, Address: "127.0.0.1:6003", Role: "stand-by"},
+	}, list)
+
+	leader, err := m.Leader(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), leader.ID)
+	assert.Equal(t, 2, fake.closed)
+
+	fake.leader = 0
+	_, err = m.Leader(ctx)
+	assert.Error(t, err)
+}
+
+func TestStatus(t *testing.T) {
+	m, _ := newFake()
+	status, err := m.Status(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, Roles{Voters: 3, StandBys: 1}, status.Roles)
+	assert.Equal(t, 2, status.Voters)
+	assert.Equal(t, 1, status.StandBys)
+	assert.True(t, status.Nodes[0].Online)
+	assert.Equal(t, uint64(14), status.Nodes[0].FailureDomain)
+	assert.False(t, status.Nodes[2].Online, "unreachable node")
+}
+
+func TestRemoveTransferAssign(t *testing.T) {
+	m, fake := newFake()
+	ctx := context.Background()
+
+	assert.Error(t, m.Remove(ctx, "127.0.0.1:6001"), "leader can not be removed")
+	assert.Error(t, m.Remove(ctx, "127.0.0.1:6009"))
+	require.NoError(t, m.Remove(ctx, "3"))
+	assert.Len(t, fake.nodes, 2)
+
+	require.NoError(t, m.Transfer(ctx, "127.0.0.1:6002"))
+	assert.Equal(t, uint64(2), fake.leader)
+	require.NoError(t, m.Remove(ctx, "127.0.0.1:6001"))
+	assert.Len(t, fake.nodes, 1)
+
+	require.NoError(t, m.Assign(ctx, "2", "spare"))
+	assert.Equal(t, client.Spare, fake.nodes[0].Role)
+	assert.Error(t, m.Assign(ctx, "2", "observer"))
+}
@@ -0,0 +1,465 @@
+package config
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix префикс переменных окружения. Имя переменной строится из пути
+// поля в файле конфигурации: log.level -> PDNS_DQLITE_LOG_LEVEL.
+const EnvPrefix = "PDNS_DQLITE_"
+
+// Config настройки узла. Каждое поле можно задать в файле конфигурации,
+// переменной окружения и флагом командной строки, флаг имеет наивысший приоритет.
+// Поля с тегом reload применяются по SIGHUP без перезапуска.
+type Config struct {
+	API         string            `yaml:"api" short:"a" usage:"address used to expose the API, may be empty with socket.path"`
+	Host        string            `yaml:"host" usage:"address used for internal database replication"`
+	Cluster     []string          `yaml:"cluster" short:"c" usage:"database addresses of existing nodes"`
+	Dir         string            `yaml:"dir" short:"D" usage:"data directory"`
+	DNSSEC      bool              `yaml:"dnssec" usage:"enable DNSSEC methods"`
+	Debug       bool              `yaml:"debug" usage:"enable the test/:key debug routes and their model table"`
+	QueriesFile string            `yaml:"queries_file" flag:"queries" usage:"YAML file with SQL query overrides"`
+	Queries     map[string]string `yaml:"queries,omitempty"`
+	TLS         TLS               `yaml:"tls"`
+	Socket      Socket            `yaml:"socket"`
+	Replication Replication       `yaml:"replication"`
+	Roles       Roles             `yaml:"roles"`
+	Backup      Backup            `yaml:"backup"`
+	Log         Log               `yaml:"log"`
+	Timeouts    Timeouts          `yaml:"timeouts"`
+	Retry       Retry             `yaml:"retry"`
+	Cache       Cache             `yaml:"cache"`
+	Audit       Audit             `yaml:"audit"`
+	Auth        Auth              `yaml:"auth"`
+}
+
+// TLS сертификат API. С ClientCA клиенты должны предъявить сертификат,
+// подписанный этим центром. Обновлённые сертификат и ключ подхватываются
+// без перезапуска.
+type TLS struct {
+	Cert     string `yaml:"cert" usage:"API server certificate"`
+	Key      string `yaml:"key" usage:"API server private key"`
+	ClientCA string `yaml:"client_ca" usage:"CA that must sign API client certificates, empty accepts clients without certificates"`
+}
+
+// Socket Unix сокет API, доступ к нему ограничивается правами файла
+type Socket struct {
+	Path string `yaml:"path" usage:"Unix socket to expose the API on, in addition to api or instead of it"`
+	Mode string `yaml:"mode" usage:"octal permissions of the API Unix socket"`
+}
+
+// FileMode права файла сокета
+func (s Socket) FileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, errors.Errorf("неверные права сокета %q, ожидается восьмеричное число, например 0660", s.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Replication взаимный TLS для трафика dqlite между узлами. Обновлённые
+// сертификат и ключ узла подхватываются без перезапуска.
+type Replication struct {
+	CA   string `yaml:"ca" usage:"cluster CA certificate for dqlite replication TLS"`
+	Cert string `yaml:"cert" usage:"node certificate for dqlite replication TLS"`
+	Key  string `yaml:"key" usage:"node private key for dqlite replication TLS"`
+}
+
+// Roles распределение ролей узлов dqlite. Voters, StandBys и AdjustmentFrequency
+// должны совпадать на всех узлах кластера, лидер периодически приводит роли
+// к этим числам с учётом доменов отказа.
+type Roles struct {
+	Role                string        `yaml:"role" usage:"role requested for this node at start: voter, stand-by, spare"`
+	Voters              int           `yaml:"voters" usage:"desired number of voting nodes, an odd number"`
+	StandBys            int           `yaml:"standbys" usage:"desired number of stand-by nodes"`
+	FailureDomain       uint64        `yaml:"failure_domain" usage:"failure domain of this node, e.g. rack or data center number"`
+	AdjustmentFrequency time.Duration `yaml:"adjustment_frequency" usage:"how often the leader adjusts node roles"`
+}
+
+// Backup регулярные резервные копии в локальную папку, включаются заданием dir
+type Backup struct {
+	Dir      string        `yaml:"dir" usage:"directory for scheduled backups, empty disables them"`
+	Interval time.Duration `yaml:"interval" usage:"how often to take a scheduled backup"`
+	Keep     int           `yaml:"keep" usage:"how many scheduled backups to keep"`
+}
+
+// Retry повтор запросов к базе, пока dqlite выбирает нового лидера. Повторяются
+// только чтения и записи, которые безопасно выполнить дважды.
+type Retry struct {
+	Timeout time.Duration `yaml:"timeout" reload:"true" usage:"total time to retry a query while dqlite elects a leader, 0 disables retries"`
+	Backoff time.Duration `yaml:"backoff" reload:"true" usage:"pause before the first retry, doubled after each attempt"`
+}
+
+// Cache локальный кэш ответов lookup, list и getdomainmetadata. Изменения
+// на других узлах видны не позже чем через poll.
+type Cache struct {
+	Size        int           `yaml:"size" usage:"number of cached answers, 0 disables the cache"`
+	TTL         time.Duration `yaml:"ttl" reload:"true" usage:"how long an answer is cached"`
+	NegativeTTL time.Duration `yaml:"negative_ttl" reload:"true" usage:"how long an empty answer or a missing zone is cached"`
+	Poll        time.Duration `yaml:"poll" usage:"how often to read zone changes made on other nodes"`
+}
+
+// Audit журнал изменений зон и версии их записей
+type Audit struct {
+	Retention time.Duration `yaml:"retention" usage:"how long to keep change log entries, 0 keeps them forever"`
+	Versions  int           `yaml:"versions" reload:"true" usage:"how many record snapshots to keep per zone for diff and rollback, 0 disables them"`
+}
+
+// Auth проверка ключей API. Ключи создаются командой keys и хранятся в базе.
+type Auth struct {
+	Enabled bool          `yaml:"enabled" usage:"require API keys: backend keys for the remote backend, admin keys for management routes"`
+	Cache   time.Duration `yaml:"cache" usage:"how long a checked API key is cached, a deleted key keeps working up to this long"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" reload:"true" usage:"log level: debug, info, warn, error"`
+	Format string `yaml:"format" usage:"log format: logfmt, json"`
+}
+
+type Timeouts struct {
+	Ready    time.Duration `yaml:"ready" usage:"how long to wait for the dqlite node to become ready"`
+	Request  time.Duration `yaml:"request" usage:"API request read/write timeout"`
+	Backend  time.Duration `yaml:"backend" reload:"true" usage:"PowerDNS remote backend timeout (timeout= in remote-connection-string)"`
+	Shutdown time.Duration `yaml:"shutdown" usage:"how long to drain requests and transactions on shutdown"`
+}
+
+func Default() *Config {
+	return &Config{
+		Dir:    "/tmp/pdns-dqlite",
+		Socket: Socket{Mode: "0660"},
+		Log:    Log{Level: "info", Format: "logfmt"},
+		Roles: Roles{
+			Voters:              3,
+			StandBys:            3,
+			AdjustmentFrequency: 30 * time.Second,
+		},
+		Backup: Backup{
+			Interval: 24 * time.Hour,
+			Keep:     7,
+		},
+		Timeouts: Timeouts{
+			Ready:    time.Minute,
+			Request:  10 * time.Second,
+			Backend:  2 * time.Second,
+			Shutdown: 30 * time.Second,
+		},
+		Retry: Retry{
+			Timeout: time.Second,
+			Backoff: 20 * time.Millisecond,
+		},
+		Cache: Cache{
+			TTL:         time.Minute,
+			NegativeTTL: 10 * time.Second,
+			Poll:        time.Second,
+		},
+		Audit: Audit{
+			Retention: 90 * 24 * time.Hour,
+			Versions:  20,
+		},
+		Auth: Auth{
+			Enabled: true,
+			Cache:   10 * time.Second,
+		},
+	}
+}
+
+// field поле конфигурации вместе с путём в файле
+type field struct {
+	path  []string
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+func (f field) key() string {
+	return strings.Join(f.path, ".")
+}
+
+func (f field) env() string {
+	return EnvPrefix + strings.ToUpper(strings.Join(f.path, "_"))
+}
+
+func (f field) flag() string {
+	if name, ok := f.tag.Lookup("flag"); ok {
+		return name
+	}
+	return strings.ReplaceAll(strings.Join(f.path, "-"), "_", "-")
+}
+
+func fields(c *Config) []field {
+	var walk func(v reflect.Value, path []string) []field
+	walk = func(v reflect.Value, path []string) []field {
+		list := make([]field, 0)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+			p := append(append([]string{}, path...), name)
+			switch sf.Type.Kind() {
+			case reflect.Struct:
+				list = append(list, walk(v.Field(i), p)...)
+			case reflect.Map:
+				// карты задаются только в файле
+			default:
+				list = append(list, field{path: p, value: v.Field(i), tag: sf.Tag})
+			}
+		}
+		return list
+	}
+	return walk(reflect.ValueOf(c).Elem(), nil)
+}
+
+func set(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice:
+		list := make([]string, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return errors.Errorf("неподдерживаемый тип %s", v.Type())
+	}
+	return nil
+}
+
+// Flags регистрирует флаги для всех полей конфигурации. Значения флагов
+// попадают в отдельный экземпляр и применяются в Load поверх файла и окружения.
+type Flags struct {
+	fs  *pflag.FlagSet
+	cfg *Config
+}
+
+func BindFlags(fs *pflag.FlagSet) *Flags {
+	f := &Flags{fs: fs, cfg: Default()}
+	for _, fd := range fields(f.cfg) {
+		name, short, usage := fd.flag(), fd.tag.Get("short"), fd.tag.Get("usage")
+		switch p := fd.value.Addr().Interface().(type) {
+		case *string:
+			fs.StringVarP(p, name, short, *p, usage)
+		case *bool:
+			fs.BoolVarP(p, name, short, *p, usage)
+		case *int:
+			fs.IntVarP(p, name, short, *p, usage)
+		case *uint64:
+			fs.Uint64VarP(p, name, short, *p, usage)
+		case *[]string:
+			fs.StringSliceVarP(p, name, short, *p, usage)
+		case *time.Duration:
+			fs.DurationVarP(p, name, short, *p, usage)
+		}
+	}
+	return f
+}
+
+// Load собирает конфигурацию: значения по умолчанию, файл, переменные окружения, флаги
+func Load(path string, flags *Flags) (*Config, error) {
+	c := Default()
+	if path == "" {
+		path = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, fd := range fields(c) {
+		if s, ok := os.LookupEnv(fd.env()); ok {
+			if err := set(fd.value, s); err != nil {
+				return nil, errors.Wrapf(err, "неверное значение %s", fd.env())
+			}
+		}
+	}
+	if flags != nil {
+		from := fields(flags.cfg)
+		for i, fd := range fields(c) {
+			if flags.fs.Changed(fd.flag()) {
+				fd.value.Set(from[i].value)
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "не могу прочитать %s", path)
+	}
+	if filepath.Ext(path) == ".toml" {
+		// TOML приводится к YAML, чтобы длительности и теги разбирались одинаково
+		doc := make(map[string]interface{})
+		if err = toml.Unmarshal(data, &doc); err != nil {
+			return errors.Wrapf(err, "не могу разобрать %s", path)
+		}
+		if data, err = yaml.Marshal(doc); err != nil {
+			return err
+		}
+	}
+	if err = yaml.Unmarshal(data, c); err != nil {
+		return errors.Wrapf(err, "не могу разобрать %s", path)
+	}
+	return nil
+}
+
+var levels = []string{"debug", "info", "warn", "error"}
+
+func (c *Config) Validate() error {
+	if c.API == "" && c.Socket.Path == "" {
+		return errors.New("не указан адрес API (api) или сокет (socket.path)")
+	}
+	if c.Host == "" {
+		return errors.New("не указан адрес dqlite (host)")
+	}
+	addrs := append([]string{c.Host}, c.Cluster...)
+	if c.API != "" {
+		addrs = append(addrs, c.API)
+	}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return errors.Wrapf(err, "неверный адрес %s", addr)
+		}
+	}
+	if c.Dir == "" {
+		return errors.New("не указана папка с данными (dir)")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("для TLS нужно указать и сертификат, и ключ")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		return errors.New("для проверки клиентов (tls.client_ca) нужен сертификат API")
+	}
+	if _, err := c.Socket.FileMode(); err != nil {
+		return err
+	}
+	r := c.Replication
+	if (r.CA == "") != (r.Cert == "") || (r.Cert == "") != (r.Key == "") {
+		return errors.New("для TLS репликации нужно указать центр сертификации, сертификат и ключ")
+	}
+	switch c.Roles.Role {
+	case "", "voter", "stand-by", "standby", "spare":
+	default:
+		return errors.Errorf("неизвестная роль %s, допустимы: voter, stand-by, spare", c.Roles.Role)
+	}
+	if c.Roles.Voters < 1 || c.Roles.Voters%2 == 0 {
+		return errors.New("число голосующих узлов (roles.voters) должно быть нечётным")
+	}
+	if c.Roles.StandBys < 0 {
+		return errors.New("число резервных узлов (roles.standbys) не может быть отрицательным")
+	}
+	if c.Roles.AdjustmentFrequency <= 0 {
+		return errors.New("частота пересмотра ролей должна быть положительной")
+	}
+	if c.Backup.Dir != "" && (c.Backup.Interval <= 0 || c.Backup.Keep < 1) {
+		return errors.New("для резервных копий нужны положительные interval и keep")
+	}
+	valid := false
+	for _, l := range levels {
+		valid = valid || c.Log.Level == l
+	}
+	if !valid {
+		return errors.Errorf("неизвестный уровень логирования %s", c.Log.Level)
+	}
+	if c.Log.Format != "logfmt" && c.Log.Format != "json" {
+		return errors.Errorf("неизвестный формат логов %s, допустимы: logfmt, json", c.Log.Format)
+	}
+	if c.Timeouts.Ready <= 0 || c.Timeouts.Request <= 0 || c.Timeouts.Backend <= 0 || c.Timeouts.Shutdown <= 0 {
+		return errors.New("таймауты должны быть положительными")
+	}
+	if c.Retry.Timeout < 0 || c.Retry.Backoff <= 0 {
+		return errors.New("retry.timeout не может быть отрицательным, retry.backoff должен быть положительным")
+	}
+	if c.Audit.Retention < 0 || c.Audit.Versions < 0 {
+		return errors.New("audit.retention и audit.versions не могут быть отрицательными")
+	}
+	if c.Auth.Cache < 0 {
+		return errors.New("auth.cache не может быть отрицательным")
+	}
+	if c.Cache.Size < 0 {
+		return errors.New("cache.size не может быть отрицательным")
+	}
+	if c.Cache.Size > 0 && (c.Cache.TTL < 0 || c.Cache.NegativeTTL < 0 || c.Cache.Poll <= 0) {
+		return errors.New("cache.ttl и cache.negative_ttl не могут быть отрицательными, cache.poll должен быть положительным")
+	}
+	return nil
+}
+
+func (c *Config) String() string {
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+// Changed возвращает изменённые поля, которые применяются без перезапуска,
+// и поля, которые вступят в силу только после перезапуска
+func (c *Config) Changed(next *Config) (reload, restart []string) {
+	reload, restart = make([]string, 0), make([]string, 0)
+	nextFields := fields(next)
+	for i, fd := range fields(c) {
+		if reflect.DeepEqual(fd.value.Interface(), nextFields[i].value.Interface()) {
+			continue
+		}
+		if fd.tag.Get("reload") == "true" {
+			reload = append(reload, fd.key())
+		} else {
+			restart = append(restart, fd.key())
+		}
+	}
+	if !reflect.DeepEqual(c.Queries, next.Queries) {
+		restart = append(restart, "queries")
+	}
+	return reload, restart
+}
+
+// Reload копия c, в которой поля с тегом reload взяты из next
+func (c *Config) Reload(next *Config) *Config {
+	out := *c
+	nextFields := fields(next)
+	for i, fd := range fields(&out) {
+		if fd.tag.Get("reload") == "true" {
+			fd.value.Set(nextFields[i].value)
+		}
+	}
+	return &out
+}
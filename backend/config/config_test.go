@@ -0,0 +1,164 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "pdns-dqlite.yaml", `
+api: 127.0.0.1:4001
+host: 127.0.0.1:6001
+cluster: [127.0.0.1:6002, 127.0.0.1:6003]
+log:
+  level: warn
+timeouts:
+  request: 3s
+socket:
+  path: /run/pdns-dqlite/api.sock
+  mode: 0600
+queries:
+  basic-query: select 1
+`)
+	t.Setenv("PDNS_DQLITE_HOST", "127.0.0.1:7001")
+	t.Setenv("PDNS_DQLITE_DNSSEC", "true")
+	t.Setenv("PDNS_DQLITE_LOG_LEVEL", "error")
+
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags := BindFlags(fs)
+	require.NoError(t, fs.Parse([]string{"--log-level", "debug", "-D", "/var/lib/pdns-dqlite"}))
+
+	c, err := Load(path, flags)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:4001", c.API)
+	assert.Equal(t, "127.0.0.1:7001", c.Host, "env overrides file")
+	assert.Equal(t, []string{"127.0.0.1:6002", "127.0.0.1:6003"}, c.Cluster)
+	assert.True(t, c.DNSSEC)
+	assert.Equal(t, "debug", c.Log.Level, "flag overrides env")
+	assert.Equal(t, "/var/lib/pdns-dqlite", c.Dir)
+	assert.Equal(t, 3*time.Second, c.Timeouts.Request)
+	assert.Equal(t, time.Minute, c.Timeouts.Ready, "defaults are kept")
+	assert.True(t, c.Auth.Enabled, "API keys are required by default")
+	assert.Equal(t, map[string]string{"basic-query": "select 1"}, c.Queries)
+	mode, err := c.Socket.FileMode()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), mode)
+	assert.NoError(t, c.Validate())
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeFile(t, "pdns-dqlite.toml", `
+api = "127.0.0.1:4001"
+host = "127.0.0.1:6001"
+
+[tls]
+cert = "/etc/pdns-dqlite/api.crt"
+key = "/etc/pdns-dqlite/api.key"
+
+[timeouts]
+request = "5s"
+
+[roles]
+voters = 5
+`)
+	t.Setenv("PDNS_DQLITE_CLUSTER", "127.0.0.1:6002, 127.0.0.1:6003")
+	t.Setenv("PDNS_DQLITE_ROLES_FAILURE_DOMAIN", "2")
+	t.Setenv("PDNS_DQLITE_CACHE_NEGATIVE_TTL", "30s")
+	t.Setenv("PDNS_DQLITE_AUTH_ENABLED", "false")
+	c, err := Load(path, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:6001", c.Host)
+	assert.Equal(t, "/etc/pdns-dqlite/api.key", c.TLS.Key)
+	assert.Equal(t, 5*time.Second, c.Timeouts.Request)
+	assert.Equal(t, []string{"127.0.0.1:6002", "127.0.0.1:6003"}, c.Cluster)
+	assert.Equal(t, 5, c.Roles.Voters)
+	assert.Equal(t, 3, c.Roles.StandBys)
+	assert.Equal(t, uint64(2), c.Roles.FailureDomain)
+	assert.Equal(t, 30*time.Second, c.Cache.NegativeTTL)
+	assert.False(t, c.Auth.Enabled)
+	assert.NoError(t, c.Validate())
+
+	t.Setenv("PDNS_DQLITE_TIMEOUTS_READY", "soon")
+	_, err = Load(path, nil)
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		c := Default()
+		c.API, c.Host = "127.0.0.1:4001", "127.0.0.1:6001"
+		return c
+	}
+	require.NoError(t, valid().Validate())
+	socket := valid()
+	socket.API, socket.Socket.Path = "", "/run/pdns-dqlite/api.sock"
+	require.NoError(t, socket.Validate(), "socket instead of api")
+
+	for name, broken := range map[string]func(c *Config){
+		"no api":      func(c *Config) { c.API = "" },
+		"no host":     func(c *Config) { c.Host = "" },
+		"bad cluster": func(c *Config) { c.Cluster = []string{"127.0.0.1"} },
+		"no dir":      func(c *Config) { c.Dir = "" },
+		"tls key":     func(c *Config) { c.TLS.Cert = "api.crt" },
+		"client ca":   func(c *Config) { c.TLS.ClientCA = "ca.crt" },
+		"socket mode": func(c *Config) { c.Socket.Mode = "rw-rw----" },
+		"wide mode":   func(c *Config) { c.Socket.Mode = "7777" },
+		"raft ca":     func(c *Config) { c.Replication.Cert, c.Replication.Key = "node.crt", "node.key" },
+		"role":        func(c *Config) { c.Roles.Role = "observer" },
+		"voters":      func(c *Config) { c.Roles.Voters = 4 },
+		"backup keep": func(c *Config) { c.Backup.Dir, c.Backup.Keep = "/var/backups", 0 },
+		"log level":   func(c *Config) { c.Log.Level = "trace" },
+		"log format":  func(c *Config) { c.Log.Format = "xml" },
+		"timeout":     func(c *Config) { c.Timeouts.Request = 0 },
+		"backend":     func(c *Config) { c.Timeouts.Backend = -time.Second },
+		"retry":       func(c *Config) { c.Retry.Backoff = 0 },
+		"cache":       func(c *Config) { c.Cache.Size, c.Cache.Poll = 100, 0 },
+		"audit":       func(c *Config) { c.Audit.Retention = -time.Hour },
+		"versions":    func(c *Config) { c.Audit.Versions = -1 },
+		"auth cache":  func(c *Config) { c.Auth.Cache = -time.Second },
+	} {
+		c := valid()
+		broken(c)
+		assert.Error(t, c.Validate(), name)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	c := Default()
+	next := Default()
+	next.Log.Level = "debug"
+	next.Retry.Timeout = 5 * time.Second
+	reload, restart := c.Changed(next)
+	assert.Equal(t, []string{"log.level", "retry.timeout"}, reload)
+	assert.Empty(t, restart)
+
+	next.Cluster = []string{"127.0.0.1:6002"}
+	next.Cache.Size = 100
+	next.Cache.TTL = time.Minute * 5
+	reload, restart = c.Changed(next)
+	assert.Equal(t, []string{"log.level", "retry.timeout", "cache.ttl"}, reload)
+	assert.Equal(t, []string{"cluster", "cache.size"}, restart)
+
+	// Применяются только поля, которые меняются без перезапуска
+	applied := c.Reload(next)
+	assert.Equal(t, "debug", applied.Log.Level)
+	assert.Equal(t, 5*time.Second, applied.Retry.Timeout)
+	assert.Equal(t, 5*time.Minute, applied.Cache.TTL)
+	assert.Empty(t, applied.Cluster)
+	assert.Zero(t, applied.Cache.Size)
+	assert.Equal(t, "info", c.Log.Level)
+}
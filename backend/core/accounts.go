@@ -0,0 +1,320 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Квоты владельцев зон (account) хранятся в реплицируемой таблице
+// account_quotas и проверяются в той же транзакции, что и изменение: если
+// зон или записей владельца стало больше квоты, транзакция откатывается.
+// Уменьшать число зон и записей можно и сверх квоты, например после её снижения.
+
+const (
+	quotaQuery       = "SELECT max_zones, max_records FROM account_quotas WHERE account = ?"
+	setQuotaQuery    = "REPLACE INTO account_quotas (account, max_zones, max_records) VALUES (?, ?, ?)"
+	deleteQuotaQuery = "DELETE FROM account_quotas WHERE account = ?"
+	usageQuery       = "SELECT COUNT(DISTINCT domains.id), COUNT(records.id) FROM domains LEFT JOIN records ON records.domain_id = domains.id AND records.type IS NOT NULL WHERE domains.account = ?"
+	domainAccount    = "SELECT COALESCE(account, '') FROM domains WHERE id = ?"
+	accountsQuery    = `SELECT a.account, COALESCE(u.zones, 0), COALESCE(u.records, 0), q.account IS NOT NULL, q.max_zones, q.max_records
+FROM (SELECT account FROM domains WHERE account != '' UNION SELECT account FROM account_quotas) a
+LEFT JOIN (SELECT domains.account, COUNT(DISTINCT domains.id) AS zones, COUNT(records.id) AS records
+  FROM domains LEFT JOIN records ON records.domain_id = domains.id AND records.type IS NOT NULL
+  WHERE domains.account != '' GROUP BY domains.account) u ON u.account = a.account
+LEFT JOIN account_quotas q ON q.account = a.account
+ORDER BY a.account`
+	accountZonesQuery = "SELECT name FROM domains WHERE COALESCE(account, '') = ? ORDER BY name"
+)
+
+// Quota ограничения владельца, 0 не ограничивает
+type Quota struct {
+	Zones   int `json:"zones"`
+	Records int `json:"records"`
+}
+
+// Account владелец зон, число его зон и записей без пустых нетерминальных
+// имён и квота
+type Account struct {
+	Name    string `json:"name"`
+	Zones   int    `json:"zones"`
+	Records int    `json:"records"`
+	Quota   *Quota `json:"quota,omitempty"`
+}
+
+func limit(n int) interface{} {
+	if n <= 0 {
+		return nil
+	}
+	return n
+}
+
+// usage число зон и записей владельца и его квота
+type usage struct {
+	zones, records int
+	quota          Quota
+}
+
+// quotas запоминает использование квот владельцами до первого изменения в
+// транзакции и проверяет их в конце
+type quotas struct {
+	mu     sync.Mutex
+	before map[string]*usage // nil для владельцев без квоты
+}
+
+func newQuotas() *quotas {
+	return &quotas{before: make(map[string]*usage)}
+}
+
+func accountUsage(ctx context.Context, q querier, account string) (*usage, error) {
+	var zones, records sql.NullInt64
+	err := q.QueryRowContext(ctx, quotaQuery, account).Scan(&zones, &records)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	u := &usage{quota: Quota{Zones: int(zones.Int64), Records: int(records.Int64)}}
+	if err = q.QueryRowContext(ctx, usageQuery, account).Scan(&u.zones, &u.records); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// watch запоминает использование квоты владельцем account
+func (q *quotas) watch(ctx context.Context, tx querier, account string) error {
+	if account == "" {
+		return nil
+	}
+	q.mu.Lock()
+	_, seen := q.before[account]
+	q.mu.Unlock()
+	if seen {
+		return nil
+	}
+	u, err := accountUsage(ctx, tx, account)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.before[account] = u
+	q.mu.Unlock()
+	return nil
+}
+
+// watchDomain запоминает использование квоты владельцем зоны domainID
+func (q *quotas) watchDomain(ctx context.Context, tx querier, domainID int) error {
+	var account string
+	err := tx.QueryRowContext(ctx, domainAccount, domainID).Scan(&account)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return q.watch(ctx, tx, account)
+}
+
+// check отклоняет изменение, если число зон или записей владельца выросло сверх квоты
+func (q *quotas) check(ctx context.Context, tx querier) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for account, before := range q.before {
+		if before == nil {
+			continue
+		}
+		after, err := accountUsage(ctx, tx, account)
+		if err != nil {
+			return err
+		}
+		if after == nil {
+			continue
+		}
+		if max := after.quota.Zones; max > 0 && after.zones > max && after.zones > before.zones {
+			return errors.Wrapf(ErrQuotaExceeded, "владелец %s: зон %d, квота %d", account, after.zones, max)
+		}
+		if max := after.quota.Records; max > 0 && after.records > max && after.records > before.records {
+			return errors.Wrapf(ErrQuotaExceeded, "владелец %s: записей %d, квота %d", account, after.records, max)
+		}
+	}
+	return nil
+}
+
+// Accounts владельцы зон и владельцы с квотами
+func (s *Service) Accounts(ctx context.Context) ([]*Account, error) {
+	rows, err := s.db.QueryContext(ctx, accountsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accounts := make([]*Account, 0)
+	for rows.Next() {
+		a := new(Account)
+		var limited bool
+		var zones, records sql.NullInt64
+		if err = rows.Scan(&a.Name, &a.Zones, &a.Records, &limited, &zones, &records); err != nil {
+			return nil, err
+		}
+		if limited {
+			a.Quota = &Quota{Zones: int(zones.Int64), Records: int(records.Int64)}
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// Account число зон и записей владельца и его квота
+func (s *Service) Account(ctx context.Context, name string) (*Account, error) {
+	a := &Account{Name: name}
+	if err := s.db.QueryRowContext(ctx, usageQuery, name).Scan(&a.Zones, &a.Records); err != nil {
+		return nil, err
+	}
+	var zones, records sql.NullInt64
+	err := s.db.QueryRowContext(ctx, quotaQuery, name).Scan(&zones, &records)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.Quota = &Quota{Zones: int(zones.Int64), Records: int(records.Int64)}
+	return a, nil
+}
+
+// AccountZones имена зон владельца, пустой account выбирает зоны без владельца
+func (s *Service) AccountZones(ctx context.Context, account string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, accountZonesQuery, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	zones := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		zones = append(zones, name)
+	}
+	return zones, rows.Err()
+}
+
+// SetQuota задаёт квоту владельца. Квота ниже текущего использования не
+// удаляет зоны и записи, а только запрещает их добавлять.
+func (s *Service) SetQuota(ctx context.Context, account string, q *Quota) error {
+	if account == "" {
+		return errors.Wrap(ErrInvalid, "не указан владелец")
+	}
+	if q.Zones < 0 || q.Records < 0 {
+		return errors.Wrap(ErrInvalid, "квота не может быть отрицательной")
+	}
+	return s.write(ctx, func(tx *sql.Tx) error {
+		before, err := accountUsage(ctx, tx, account)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, setQuotaQuery, account, limit(q.Zones), limit(q.Records)); err != nil {
+			return errors.Wrap(err, "не удалось сохранить квоту")
+		}
+		var was *Quota
+		if before != nil {
+			was = &before.quota
+		}
+		return s.audit(ctx, tx, "setquota", "", map[string]interface{}{"account": account, "quota": was},
+			map[string]interface{}{"account": account, "quota": q})
+	})
+}
+
+// DeleteQuota снимает ограничения владельца
+func (s *Service) DeleteQuota(ctx context.Context, account string) error {
+	return s.write(ctx, func(tx *sql.Tx) error {
+		before, err := accountUsage(ctx, tx, account)
+		if err != nil {
+			return err
+		}
+		if before == nil {
+			return errors.Wrapf(ErrNotFound, "квота владельца %s", account)
+		}
+		if _, err = tx.ExecContext(ctx, deleteQuotaQuery, account); err != nil {
+			return errors.Wrap(err, "не удалось удалить квоту")
+		}
+		return s.audit(ctx, tx, "deletequota", "", map[string]interface{}{"account": account, "quota": before.quota}, nil)
+	})
+}
+
+// MoveZone передаёт зону другому владельцу запросом update-account-query.
+// Зоны и записи переходят в квоту нового владельца.
+func (s *Service) MoveZone(ctx context.Context, zone, account string) error {
+	zone = strings.TrimSuffix(zone, ".")
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		id, err := zoneID(ctx, tx, zone)
+		if err != nil {
+			return err
+		}
+		var before string
+		if err = tx.QueryRowContext(ctx, domainAccount, id).Scan(&before); err != nil {
+			return err
+		}
+		q := newQuotas()
+		if err = q.watch(ctx, tx, account); err != nil {
+			return err
+		}
+		if _, err = s.execTx(ctx, tx, "update-account-query", "account", account, "domain", zone); err != nil {
+			return err
+		}
+		if err = q.check(ctx, tx); err != nil {
+			return err
+		}
+		if err = s.audit(ctx, tx, "movezone", zone, &DomainInfo{Account: before}, &DomainInfo{Account: account}); err != nil {
+			return err
+		}
+		return s.changedTx(ctx, tx, map[int]bool{id: true})
+	})
+	if err != nil {
+		return err
+	}
+	s.cache.invalidate([]string{zone})
+	return nil
+}
+
+// Search записи, имя или содержимое которых подходит под шаблон pattern
+// (как у searchRecords: * и ?), только в зонах владельца account, если он указан,
+// и только в зонах domains, если список не nil. Ограничения применяются до
+// LIMIT, поэтому чужие записи не вытесняют из ответа доступные.
+func (s *Service) Search(ctx context.Context, pattern, account string, domains []int, max int) ([]*DNSResourceRecord, error) {
+	if domains != nil && len(domains) == 0 {
+		return []*DNSResourceRecord{}, nil
+	}
+	ids := make([]string, 0, len(domains))
+	for _, id := range domains {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	escaped := Pattern2SQLPattern(pattern)
+	rows, err := s.query(ctx,
+		"search-account-records-query",
+		"value", escaped,
+		"value2", escaped,
+		"account", account,
+		"domains", strings.Join(ids, ","),
+		"limit", max,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rrset := make([]*DNSResourceRecord, 0)
+	for rows.Next() {
+		rr := new(DNSResourceRecord)
+		err = rows.Scan(&rr.Content, &rr.TTL, &rr.Prio, &rr.Qtype, &rr.DomainID, &rr.Disabled, &rr.Qname, &rr.Auth)
+		if err != nil {
+			return nil, err
+		}
+		rrset = append(rrset, rr)
+	}
+	return rrset, rows.Err()
+}
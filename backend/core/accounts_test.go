@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func teamZone(t *testing.T, s *Service, name, account string) error {
+	t.Helper()
+	return s.CreateZone(context.Background(), &Zone{Name: name, Kind: "NATIVE", Account: account}, []*DNSResourceRecord{
+		{Qname: name, Qtype: "SOA", TTL: 3600, Content: fmt.Sprintf(soa, 1), Auth: true},
+		{Qname: "www." + name, Qtype: "A", TTL: 300, Content: "192.0.2.1", Auth: true},
+	})
+}
+
+func TestAccountQuotas(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	assert.ErrorIs(t, s.SetQuota(ctx, "", &Quota{Zones: 1}), ErrInvalid)
+	assert.ErrorIs(t, s.SetQuota(ctx, "team", &Quota{Zones: -1}), ErrInvalid)
+	assert.ErrorIs(t, s.DeleteQuota(ctx, "team"), ErrNotFound)
+
+	require.NoError(t, s.SetQuota(ctx, "team", &Quota{Zones: 1, Records: 3}))
+	require.NoError(t, teamZone(t, s, "team.example", "team"))
+	assert.ErrorIs(t, teamZone(t, s, "second.example", "team"), ErrQuotaExceeded)
+	di, err := s.GetDomainInfo(ctx, "second.example")
+	require.NoError(t, err)
+	assert.Zero(t, di.ID, "zone over quota is not created")
+
+	mail := &RRSetChange{Name: "mail.team.example", Type: "A", Replace: true, Records: []*DNSResourceRecord{
+		{Content: "192.0.2.2", TTL: 300}, {Content: "192.0.2.3", TTL: 300},
+	}}
+	assert.ErrorIs(t, s.PatchRRSets(ctx, "team.example", []*RRSetChange{mail}), ErrQuotaExceeded)
+	rrs, err := s.Lookup(ctx, "A", "mail.team.example", -1)
+	require.NoError(t, err)
+	assert.Empty(t, rrs)
+
+	// Записи из транзакции PowerDNS проверяются при фиксации
+	di, err = s.GetDomainInfo(ctx, "team.example")
+	require.NoError(t, err)
+	require.NoError(t, s.StartTransaction(ctx, 1, -1))
+	require.NoError(t, s.ReplaceRRSet(ctx, 1, di.ID, "mail.team.example", "A", []*DNSResourceRecord{
+		{Qname: "mail.team.example", Qtype: "A", Content: "192.0.2.2", TTL: 300},
+		{Qname: "mail.team.example", Qtype: "A", Content: "192.0.2.3", TTL: 300},
+	}))
+	assert.ErrorIs(t, s.CommitTransaction(ctx, 1), ErrQuotaExceeded)
+	assert.Zero(t, s.OpenTransactions())
+
+	// После снижения квоты записи можно удалять, но не добавлять
+	require.NoError(t, s.SetQuota(ctx, "team", &Quota{Zones: 1, Records: 1}))
+	require.NoError(t, s.PatchRRSets(ctx, "team.example", []*RRSetChange{{Name: "www.team.example", Type: "A"}}))
+
+	account, err := s.Account(ctx, "team")
+	require.NoError(t, err)
+	assert.Equal(t, &Account{Name: "team", Zones: 1, Records: 1, Quota: &Quota{Zones: 1, Records: 1}}, account)
+	assert.Len(t, auditEntries(t, s, "setquota"), 2)
+
+	require.NoError(t, s.DeleteQuota(ctx, "team"))
+	require.NoError(t, teamZone(t, s, "second.example", "team"))
+}
+
+func TestAccountMoveZone(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	require.NoError(t, teamZone(t, s, "a.example", ""))
+	require.NoError(t, teamZone(t, s, "b.example", "team"))
+	require.NoError(t, s.SetQuota(ctx, "other", &Quota{Zones: 1}))
+
+	require.NoError(t, s.MoveZone(ctx, "a.example.", "other"))
+	di, err := s.GetDomainInfo(ctx, "a.example")
+	require.NoError(t, err)
+	assert.Equal(t, "other", di.Account)
+	assert.ErrorIs(t, s.MoveZone(ctx, "b.example", "other"), ErrQuotaExceeded)
+	assert.ErrorIs(t, s.MoveZone(ctx, "c.example", "other"), ErrNotFound)
+	assert.Len(t, auditEntries(t, s, "movezone"), 1)
+
+	accounts, err := s.Accounts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []*Account{
+		{Name: "other", Zones: 1, Records: 2, Quota: &Quota{Zones: 1}},
+		{Name: "team", Zones: 1, Records: 2},
+	}, accounts)
+	zones, err := s.AccountZones(ctx, "team")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b.example"}, zones)
+
+	found, err := s.Search(ctx, "www.*", "team", nil, 10)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "www.b.example", found[0].Qname)
+	found, err = s.Search(ctx, "www.*", "", nil, 10)
+	require.NoError(t, err)
+	assert.Len(t, found, 2)
+	b, err := s.GetDomainInfo(ctx, "b.example")
+	require.NoError(t, err)
+	found, err = s.Search(ctx, "www.*", "", []int{b.ID}, 1)
+	require.NoError(t, err)
+	require.Len(t, found, 1, "limit applies after the zone filter")
+	assert.Equal(t, "www.b.example", found[0].Qname)
+	found, err = s.Search(ctx, "www.*", "", []int{}, 10)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/pkg/errors"
+)
+
+// Состояние данных до и после изменения для журнала читается этими запросами
+// в той же транзакции, что и изменение. Они не входят в переопределяемые
+// запросы: журнал должен видеть таблицы, а не то, что отдаётся PowerDNS.
+const (
+	zoneNameQuery    = "SELECT name FROM domains WHERE id = ?"
+	zoneRecordsQuery = "SELECT count(*) FROM records WHERE domain_id = ? AND type IS NOT NULL"
+	auditRRSetQuery  = "SELECT name, type, content, ttl, COALESCE(prio, 0), disabled, auth FROM records WHERE domain_id = ? AND name = ? AND type IS NOT NULL AND (? = 'ANY' OR type = ?) ORDER BY type, content"
+	auditKeyQuery    = "SELECT c.id, c.flags, c.active, c.published FROM cryptokeys c JOIN domains d ON d.id = c.domain_id WHERE d.name = ? AND c.id = ?"
+	auditMetaQuery   = "SELECT m.content FROM domainmetadata m JOIN domains d ON d.id = m.domain_id WHERE d.name = ? AND m.kind = ? ORDER BY m.id"
+	auditNotifyQuery = "SELECT name, notified_serial, last_check FROM domains WHERE id = ?"
+)
+
+// keyState ключ DNSSEC в журнале, закрытая часть не сохраняется
+type keyState struct {
+	ID        int  `json:"id"`
+	Flags     int  `json:"flags"`
+	Active    bool `json:"active"`
+	Published bool `json:"published"`
+}
+
+// zoneState состояние зоны для записей журнала о полной замене и обслуживании
+type zoneState struct {
+	Records        *int   `json:"records,omitempty"`
+	Ents           *int   `json:"ents,omitempty"`
+	NotifiedSerial *int64 `json:"notified_serial,omitempty"`
+	LastCheck      *int64 `json:"last_check,omitempty"`
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// SetNode задаёт узел, от имени которого пишутся записи журнала изменений
+func (s *Service) SetNode(node string) {
+	s.node = node
+}
+
+// Audit записи журнала изменений
+func (s *Service) Audit(ctx context.Context, f audit.Filter) ([]*audit.Entry, error) {
+	return audit.Query(ctx, s.db, f)
+}
+
+func (s *Service) audit(ctx context.Context, tx audit.Execer, method, zone string, before, after interface{}) error {
+	return audit.Record(ctx, tx, s.node, method, zone, before, after)
+}
+
+// write выполняет изменение и запись о нём в журнал в одной транзакции базы,
+// поэтому при повторе после смены лидера запись не задваивается
+func (s *Service) write(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func zoneName(ctx context.Context, q querier, domainID int) (string, error) {
+	var name string
+	err := q.QueryRowContext(ctx, zoneNameQuery, domainID).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errors.Wrapf(ErrNotFound, "Domain %d", domainID)
+	}
+	return name, err
+}
+
+func zoneRecords(ctx context.Context, q querier, domainID int) (int, error) {
+	var n int
+	err := q.QueryRowContext(ctx, zoneRecordsQuery, domainID).Scan(&n)
+	return n, err
+}
+
+func zoneNotify(ctx context.Context, q querier, domainID int) (string, *zoneState, error) {
+	var name string
+	var notified, lastCheck sql.NullInt64
+	err := q.QueryRowContext(ctx, auditNotifyQuery, domainID).Scan(&name, &notified, &lastCheck)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, errors.Wrapf(ErrNotFound, "Domain %d", domainID)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	state := new(zoneState)
+	if notified.Valid {
+		state.NotifiedSerial = &notified.Int64
+	}
+	if lastCheck.Valid {
+		state.LastCheck = &lastCheck.Int64
+	}
+	return name, state, nil
+}
+
+func auditRRSet(ctx context.Context, q querier, domainID int, qname, qtype string) ([]*DNSResourceRecord, error) {
+	rows, err := q.QueryContext(ctx, auditRRSetQuery, domainID, qname, qtype, qtype)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rrset := make([]*DNSResourceRecord, 0)
+	for rows.Next() {
+		rr := new(DNSResourceRecord)
+		if err = rows.Scan(&rr.Qname, &rr.Qtype, &rr.Content, &rr.TTL, &rr.Prio, &rr.Disabled, &rr.Auth); err != nil {
+			return nil, err
+		}
+		rrset = append(rrset, rr)
+	}
+	return rrset, rows.Err()
+}
+
+// auditKey ключ зоны name, nil если его нет
+func auditKey(ctx context.Context, q querier, name string, id int) (*keyState, error) {
+	key := new(keyState)
+	err := q.QueryRowContext(ctx, auditKeyQuery, name, id).Scan(&key.ID, &key.Flags, &key.Active, &key.Published)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func auditMeta(ctx context.Context, q querier, name, kind string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, auditMetaQuery, name, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	meta := make([]string, 0)
+	for rows.Next() {
+		var m string
+		if err = rows.Scan(&m); err != nil {
+			return nil, err
+		}
+		meta = append(meta, m)
+	}
+	return meta, rows.Err()
+}
+
+// equalStrings одинаковые значения в том же порядке
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func auditEntries(t *testing.T, s *Service, method string) []*audit.Entry {
+	t.Helper()
+	entries, err := s.Audit(context.Background(), audit.Filter{Method: method})
+	require.NoError(t, err)
+	return entries
+}
+
+func TestAuditTransactions(t *testing.T) {
+	ctx := audit.WithCaller(context.Background(), "pdns1")
+	s := newTestService(t, false)
+	s.SetNode("127.0.0.1:9001")
+	id := exampleZone(t, s)
+
+	// Полная замена зоны одной записью
+	zone := auditEntries(t, s, "committransaction")
+	require.Len(t, zone, 1)
+	assert.Equal(t, "example.com", zone[0].Zone)
+	assert.Equal(t, "127.0.0.1:9001", zone[0].Node)
+	assert.JSONEq(t, `{"records":0}`, string(zone[0].Before))
+	assert.JSONEq(t, `{"records":5,"ents":0}`, string(zone[0].After))
+
+	require.NoError(t, s.StartTransaction(ctx, 2, -1))
+	require.NoError(t, s.ReplaceRRSet(ctx, 2, id, "www.example.com", "A", []*DNSResourceRecord{
+		{Qname: "www.example.com", Qtype: "A", TTL: 60, Content: "192.0.2.7"},
+	}))
+	require.NoError(t, s.FeedRecord(ctx, 2, &DNSResourceRecord{DomainID: id, Qname: "mail.example.com", Qtype: "A", TTL: 60, Content: "192.0.2.8"}, ""))
+	require.NoError(t, s.FeedEnts(ctx, 2, id, map[string]bool{"b.mail": true}))
+	require.NoError(t, s.CommitTransaction(ctx, 2))
+
+	rrset := auditEntries(t, s, "replacerrset")
+	require.Len(t, rrset, 1)
+	assert.Equal(t, "pdns1", rrset[0].Caller)
+	assert.JSONEq(t, `[{"qname":"www.example.com","qtype":"A","content":"192.0.2.1","ttl":300,"auth":true}]`, string(rrset[0].Before))
+	assert.JSONEq(t, `[{"qname":"www.example.com","qtype":"A","content":"192.0.2.7","ttl":60,"auth":true}]`, string(rrset[0].After))
+	assert.Len(t, auditEntries(t, s, "feedrecord"), 1)
+	ents := auditEntries(t, s, "feedents")
+	require.Len(t, ents, 1)
+	assert.JSONEq(t, `["b.mail"]`, string(ents[0].After))
+
+	// Откаченная транзакция не оставляет записей
+	require.NoError(t, s.StartTransaction(ctx, 3, -1))
+	require.NoError(t, s.ReplaceRRSet(ctx, 3, id, "www.example.com", "ANY", nil))
+	require.NoError(t, s.AbortTransaction(ctx, 3))
+	assert.Len(t, auditEntries(t, s, "replacerrset"), 1)
+}
+
+func TestAuditWrites(t *testing.T) {
+	ctx := audit.WithCaller(context.Background(), "admin")
+	s := newTestService(t, true)
+	id := exampleZone(t, s)
+
+	require.NoError(t, s.SetNotified(ctx, id, 2022060101))
+	notified := auditEntries(t, s, "setnotified")
+	require.Len(t, notified, 1)
+	assert.JSONEq(t, `{}`, string(notified[0].Before))
+	assert.JSONEq(t, `{"notified_serial":2022060101}`, string(notified[0].After))
+	require.NoError(t, s.SetNotified(ctx, id, 2022060101))
+	assert.Len(t, auditEntries(t, s, "setnotified"), 1, "same serial is not logged again")
+	require.NoError(t, s.setLastCheck(ctx, id, 1654041600))
+	require.NoError(t, s.setLastCheck(ctx, id, 1654041600))
+	assert.Len(t, auditEntries(t, s, "setfresh"), 1, "same last_check is not logged again")
+	require.NoError(t, s.SetFresh(ctx, id))
+	assert.Len(t, auditEntries(t, s, "setfresh"), 2)
+	assert.ErrorIs(t, s.SetNotified(ctx, 999, 1), ErrNotFound)
+
+	require.NoError(t, s.SetDomainMetadata(ctx, "example.com", "ALSO-NOTIFY", []string{"192.0.2.5"}))
+	require.NoError(t, s.SetDomainMetadata(ctx, "example.com", "ALSO-NOTIFY", []string{"192.0.2.5"}))
+	require.NoError(t, s.SetDomainMetadata(ctx, "example.com", "ALSO-NOTIFY", nil))
+	meta := auditEntries(t, s, "setdomainmetadata")
+	require.Len(t, meta, 2)
+	assert.JSONEq(t, `{"ALSO-NOTIFY":[]}`, string(meta[0].Before))
+	assert.JSONEq(t, `{"ALSO-NOTIFY":["192.0.2.5"]}`, string(meta[0].After))
+	assert.JSONEq(t, `{"ALSO-NOTIFY":[]}`, string(meta[1].After))
+
+	require.NoError(t, s.AddDomainKey(ctx, "example.com", &KeyData{Flags: 257, Active: true, Published: true, Content: "Private-key-format: v1.2"}))
+	keys, err := s.GetDomainKeys(ctx, "example.com")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.NoError(t, s.DeactivateDomainKey(ctx, "example.com", keys[0].ID))
+	require.NoError(t, s.RemoveDomainKey(ctx, "example.com", keys[0].ID))
+	require.NoError(t, s.RemoveDomainKey(ctx, "example.com", keys[0].ID))
+
+	added := auditEntries(t, s, "adddomainkey")
+	require.Len(t, added, 1)
+	assert.NotContains(t, string(added[0].After), "Private", "private key is not logged")
+	deactivated := auditEntries(t, s, "deactivatedomainkey")
+	require.Len(t, deactivated, 1)
+	assert.Contains(t, string(deactivated[0].Before), `"active":true`)
+	assert.Contains(t, string(deactivated[0].After), `"active":false`)
+	removed := auditEntries(t, s, "removedomainkey")
+	require.Len(t, removed, 1, "removing a missing key changes nothing")
+	assert.Nil(t, removed[0].After)
+
+	require.NoError(t, s.CreateSlaveDomain(ctx, "192.0.2.1", "slave.example", ""))
+	slave := auditEntries(t, s, "createslavedomain")
+	require.Len(t, slave, 1)
+	assert.Equal(t, "slave.example", slave[0].Zone)
+	assert.Equal(t, "admin", slave[0].Caller)
+}
@@ -0,0 +1,292 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/ivan-bokov/pdns-dqlite/backend/metrics"
+	"github.com/pkg/errors"
+)
+
+// Изменения зон отмечаются в реплицируемой таблице changes: у каждой зоны
+// номер последнего изменения из общей последовательности. Узлы с кэшем
+// периодически читают номера больше уже известного и сбрасывают ответы для
+// изменившихся зон, поэтому устаревший ответ живёт не дольше периода опроса.
+const (
+	bumpChangeQuery     = "REPLACE INTO changes (domain, serial) SELECT ?, COALESCE(MAX(serial), 0) + 1 FROM changes"
+	bumpChangeByIDQuery = "REPLACE INTO changes (domain, serial) SELECT name, (SELECT COALESCE(MAX(serial), 0) + 1 FROM changes) FROM domains WHERE id = ?"
+	lastChangeQuery     = "SELECT COALESCE(MAX(serial), 0) FROM changes"
+	changesQuery        = "SELECT domain FROM changes WHERE serial > ?"
+)
+
+// CacheConfig ограничения локального кэша lookup, list и getdomainmetadata
+type CacheConfig struct {
+	Size        int           // число ответов в кэше
+	TTL         time.Duration // сколько хранится ответ
+	NegativeTTL time.Duration // сколько хранится пустой ответ или «зона не найдена»
+}
+
+type cacheEntry struct {
+	key     string
+	name    string // имя в DNS, по зоне которого запись сбрасывается
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// cache LRU кэш ответов. nil означает, что кэш выключен.
+type cache struct {
+	cfg     CacheConfig
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	gen     uint64 // растёт при каждом сбросе, ответ прочитанный до сброса не сохраняется
+
+	pollMu sync.Mutex
+	serial int64 // последний известный номер изменения
+	synced bool
+}
+
+// EnableCache включает кэш. Номера изменений читает WatchChanges.
+func (s *Service) EnableCache(cfg CacheConfig) {
+	s.cache = &cache{
+		cfg:     cfg,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// SetCacheTTL меняет время жизни новых ответов в кэше, уже сохранённые
+// ответы живут со своим сроком
+func (s *Service) SetCacheTTL(ttl, negativeTTL time.Duration) {
+	c := s.cache
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg.TTL, c.cfg.NegativeTTL = ttl, negativeTTL
+}
+
+func cacheKey(method string, parts ...string) string {
+	return method + "\x00" + strings.Join(parts, "\x00")
+}
+
+// normalize имя в DNS без точки в конце и без учёта регистра
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// inZone name совпадает с zone или находится внутри неё
+func inZone(name, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func (c *cache) get(key string) (*cacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+func (c *cache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put сохраняет ответ, если с момента gen кэш не сбрасывался
+func (c *cache) put(gen uint64, key, name string, value interface{}, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ttl := c.cfg.TTL
+	if negative(value, err) {
+		ttl = c.cfg.NegativeTTL
+	}
+	if ttl <= 0 || gen != c.gen {
+		return
+	}
+	e := &cacheEntry{key: key, name: normalize(name), value: value, err: err, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.cfg.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// negative пустой ответ или «зона не найдена»
+func negative(value interface{}, err error) bool {
+	if err != nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// invalidate сбрасывает ответы для имён внутри перечисленных зон
+func (c *cache) invalidate(zones []string) {
+	if c == nil || len(zones) == 0 {
+		return
+	}
+	normalized := make([]string, len(zones))
+	for i, zone := range zones {
+		normalized[i] = normalize(zone)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key, el := range c.entries {
+		name := el.Value.(*cacheEntry).name
+		for _, zone := range normalized {
+			if inZone(name, zone) {
+				c.lru.Remove(el)
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
+
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// cached отдаёт ответ из кэша или вызывает f и сохраняет её ответ. Ошибки,
+// кроме «зона не найдена», не кэшируются.
+func (s *Service) cached(method, name, key string, f func() (interface{}, error)) (interface{}, error) {
+	if s.cache == nil {
+		return f()
+	}
+	if e, ok := s.cache.get(key); ok {
+		metrics.Cache(method, true)
+		return e.value, e.err
+	}
+	metrics.Cache(method, false)
+	gen := s.cache.generation()
+	value, err := f()
+	if err == nil || errors.Is(err, ErrNotFound) {
+		s.cache.put(gen, key, name, value, err)
+	}
+	return value, err
+}
+
+// changed отмечает изменение зон по имени в changes внутри транзакции tx,
+// чтобы повтор после ошибки не повторял уже зафиксированное изменение.
+// Выполняется на всех узлах, даже без кэша: кэш может быть включён на других.
+// Ответы этого узла сбрасываются после фиксации через cache.invalidate.
+func (s *Service) changed(ctx context.Context, tx *sql.Tx, zones ...string) error {
+	for _, zone := range zones {
+		if _, err := tx.ExecContext(ctx, bumpChangeQuery, normalize(zone)); err != nil {
+			return errors.Wrap(err, "не удалось отметить изменение зоны")
+		}
+	}
+	return nil
+}
+
+// changedTx отмечает изменение зон по идентификаторам внутри транзакции PowerDNS
+func (s *Service) changedTx(ctx context.Context, tx *sql.Tx, ids map[int]bool) error {
+	for id := range ids {
+		if _, err := tx.ExecContext(ctx, bumpChangeByIDQuery, id); err != nil {
+			return errors.Wrap(err, "не удалось отметить изменение зоны")
+		}
+	}
+	return nil
+}
+
+// PollChanges сбрасывает ответы для зон, изменившихся с прошлого опроса
+func (s *Service) PollChanges(ctx context.Context) error {
+	c := s.cache
+	if c == nil {
+		return nil
+	}
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+	var last int64
+	if err := s.db.QueryRowContext(ctx, lastChangeQuery).Scan(&last); err != nil {
+		return errors.Wrap(err, "не удалось прочитать номер изменения")
+	}
+	switch {
+	case !c.synced || last < c.serial:
+		// Первый опрос или база восстановлена из копии: номера начались заново
+		c.flush()
+	case last > c.serial:
+		rows, err := s.db.QueryContext(ctx, changesQuery, c.serial)
+		if err != nil {
+			return errors.Wrap(err, "не удалось прочитать изменения зон")
+		}
+		defer rows.Close()
+		zones := make([]string, 0)
+		for rows.Next() {
+			var zone string
+			if err = rows.Scan(&zone); err != nil {
+				return err
+			}
+			zones = append(zones, zone)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		c.invalidate(zones)
+	}
+	c.serial, c.synced = last, true
+	return nil
+}
+
+// WatchChanges опрашивает changes каждые interval, пока не отменён ctx
+func (s *Service) WatchChanges(ctx context.Context, interval time.Duration) {
+	if s.cache == nil {
+		return
+	}
+	log := logging.Logger.WithField("component", "cache")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.PollChanges(ctx); err != nil && ctx.Err() == nil {
+			log.WithError(err).Warn("изменения зон не прочитаны, ответы устареют не позже ttl")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
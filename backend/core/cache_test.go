@@ -0,0 +1,216 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCachedService(t *testing.T, cfg CacheConfig) *Service {
+	t.Helper()
+	s := newTestService(t, true)
+	s.EnableCache(cfg)
+	require.NoError(t, s.PollChanges(context.Background()))
+	return s
+}
+
+// dropRecords удаляет записи в обход Service, кэш об этом не знает
+func dropRecords(t *testing.T, s *Service, name string) {
+	t.Helper()
+	_, err := s.db.Exec("DELETE FROM records WHERE name = ?", name)
+	require.NoError(t, err)
+}
+
+func TestCacheHit(t *testing.T) {
+	ctx := context.Background()
+	s := newCachedService(t, CacheConfig{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute})
+	exampleZone(t, s)
+
+	rrs, err := s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	require.Len(t, rrs, 1)
+	list, err := s.List(ctx, "example.com", -1, false)
+	require.NoError(t, err)
+	dropRecords(t, s, "www.example.com")
+
+	rrs, err = s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 1, "answer comes from the cache")
+	cached, err := s.List(ctx, "example.com", -1, false)
+	require.NoError(t, err)
+	assert.Len(t, cached, len(list))
+
+	// Ключ включает тип записи
+	rrs, err = s.Lookup(ctx, "AAAA", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Empty(t, rrs)
+
+	_, err = s.List(ctx, "missing.example", -1, false)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.List(ctx, "missing.example", -1, false)
+	assert.ErrorIs(t, err, ErrNotFound, "missing zone is cached with its error")
+}
+
+func TestCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	s := newCachedService(t, CacheConfig{Size: 10, TTL: 50 * time.Millisecond, NegativeTTL: time.Millisecond})
+	exampleZone(t, s)
+
+	rrs, err := s.Lookup(ctx, "MX", "example.com", -1)
+	require.NoError(t, err)
+	assert.Empty(t, rrs)
+	_, err = s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	execQuery(t, s, "insert-record-query",
+		"content", "10 mx.example.com", "ttl", 300, "priority", 0, "qtype", "MX", "domain_id", 1,
+		"disabled", false, "qname", "example.com", "auth", true, "ordername", nil)
+	dropRecords(t, s, "www.example.com")
+	time.Sleep(5 * time.Millisecond)
+
+	rrs, err = s.Lookup(ctx, "MX", "example.com", -1)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 1, "empty answer expires after negative ttl")
+	rrs, err = s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 1, "answer lives for ttl")
+
+	time.Sleep(50 * time.Millisecond)
+	rrs, err = s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Empty(t, rrs)
+
+	// Нулевой ttl после SIGHUP: новые ответы не кэшируются
+	s.SetCacheTTL(0, 0)
+	_, err = s.Lookup(ctx, "MX", "example.com", -1)
+	require.NoError(t, err)
+	_, ok := s.cache.get(cacheKey("lookup", "MX", "example.com", "-1"))
+	assert.False(t, ok)
+}
+
+func TestCacheSize(t *testing.T) {
+	ctx := context.Background()
+	s := newCachedService(t, CacheConfig{Size: 2, TTL: time.Minute, NegativeTTL: time.Minute})
+	exampleZone(t, s)
+
+	for _, qtype := range []string{"A", "AAAA", "A", "TXT"} {
+		_, err := s.Lookup(ctx, qtype, "www.example.com", -1)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, s.cache.lru.Len())
+	_, ok := s.cache.get(cacheKey("lookup", "A", "www.example.com", "-1"))
+	assert.True(t, ok, "recently used answer stays")
+	_, ok = s.cache.get(cacheKey("lookup", "AAAA", "www.example.com", "-1"))
+	assert.False(t, ok, "least recently used answer is evicted")
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	ctx := context.Background()
+	s := newCachedService(t, CacheConfig{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute})
+	id := exampleZone(t, s)
+	other := addZone(t, s, "example.org", "MASTER")
+	feedZone(t, s, other, &DNSResourceRecord{Qname: "www.example.org", Qtype: "A", TTL: 300, Content: "192.0.2.9"})
+
+	_, err := s.Lookup(ctx, "A", "www.example.org", -1)
+	require.NoError(t, err)
+	rrs, err := s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	require.Len(t, rrs, 1)
+
+	// Транзакция PowerDNS сбрасывает только свою зону
+	feedZone(t, s, id, &DNSResourceRecord{Qname: "www.example.com", Qtype: "A", TTL: 300, Content: "192.0.2.3"})
+	rrs, err = s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	require.Len(t, rrs, 1)
+	assert.Equal(t, "192.0.2.3", rrs[0].Content)
+	_, ok := s.cache.get(cacheKey("lookup", "A", "www.example.org", "-1"))
+	assert.True(t, ok)
+
+	// Метаданные
+	require.NoError(t, s.SetDomainMetadata(ctx, "example.com", "ALLOW-AXFR-FROM", []string{"192.0.2.0/24"}))
+	meta, err := s.GetDomainMetadata(ctx, "example.com", "ALLOW-AXFR-FROM")
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.0.2.0/24"}, meta)
+	require.NoError(t, s.SetDomainMetadata(ctx, "example.com", "ALLOW-AXFR-FROM", []string{"AUTO-NS"}))
+	meta, err = s.GetDomainMetadata(ctx, "example.com", "ALLOW-AXFR-FROM")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AUTO-NS"}, meta)
+
+	// Новая зона сбрасывает закэшированное «зона не найдена»
+	_, err = s.List(ctx, "slave.example", -1, false)
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, s.CreateSlaveDomain(ctx, "192.0.2.1", "slave.example", ""))
+	_, err = s.List(ctx, "slave.example", -1, false)
+	assert.NoError(t, err)
+}
+
+func TestCacheCluster(t *testing.T) {
+	ctx := context.Background()
+	writer := newTestService(t, true)
+	id := exampleZone(t, writer)
+	// Второй узел с кэшем над той же базой
+	reader := New(writer.db, true)
+	reader.EnableCache(CacheConfig{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute})
+	require.NoError(t, reader.PollChanges(ctx))
+
+	rrs, err := reader.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	require.Len(t, rrs, 1)
+	feedZone(t, writer, id, &DNSResourceRecord{Qname: "www.example.com", Qtype: "A", TTL: 300, Content: "192.0.2.3"})
+
+	rrs, err = reader.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", rrs[0].Content, "stale until the next poll")
+	require.NoError(t, reader.PollChanges(ctx))
+	rrs, err = reader.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.3", rrs[0].Content)
+
+	// Номера изменений начались заново, например после восстановления из копии
+	_, err = reader.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	_, err = writer.db.Exec("DELETE FROM changes")
+	require.NoError(t, err)
+	require.NoError(t, reader.PollChanges(ctx))
+	assert.Zero(t, reader.cache.lru.Len())
+}
+
+func TestCacheKeyChanges(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, true)
+	exampleZone(t, s)
+	serial := func() int64 {
+		var n int64
+		require.NoError(t, s.db.QueryRow("SELECT serial FROM changes WHERE domain = 'example.com'").Scan(&n))
+		return n
+	}
+
+	last := serial()
+	key := &KeyData{Flags: 257, Active: true, Published: true, Content: "Private-key-format: v1.2"}
+	require.NoError(t, s.AddDomainKey(ctx, "example.com", key))
+	assert.Greater(t, serial(), last)
+	last = serial()
+	for _, change := range []func(ctx context.Context, name string, id int) error{
+		s.DeactivateDomainKey, s.ActivateDomainKey, s.UnPublishDomainKey, s.PublishDomainKey, s.RemoveDomainKey,
+	} {
+		require.NoError(t, change(ctx, "example.com", key.ID))
+		next := serial()
+		assert.Greater(t, next, last)
+		last = next
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, true)
+	exampleZone(t, s)
+	_, err := s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	dropRecords(t, s, "www.example.com")
+	rrs, err := s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Empty(t, rrs)
+	assert.NoError(t, s.PollChanges(ctx))
+}
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"strings"
+
 	"github.com/ivan-bokov/pdns-dqlite/backend/core/sql"
 	"github.com/pkg/errors"
 )
@@ -85,28 +87,129 @@ func init() {
 	declare["delete-comments-query"] = "DELETE FROM comments WHERE domain_id=:domain_id"
 	declare["search-records-query"] = record_query + " name LIKE :value ESCAPE '\\' OR content LIKE :value2 ESCAPE '\\' LIMIT :limit"
 	declare["search-comments-query"] = "SELECT domain_id,name,type,modified_at,account,comment FROM comments WHERE name LIKE :value ESCAPE '\\' OR comment LIKE :value2 ESCAPE '\\' LIMIT :limit"
+	declare["search-account-records-query"] = "SELECT records.content,records.ttl,records.prio,records.type,records.domain_id,records.disabled,records.name,records.auth FROM records JOIN domains ON domains.id=records.domain_id WHERE records.type IS NOT NULL AND (records.name LIKE :value ESCAPE '\\' OR records.content LIKE :value2 ESCAPE '\\') AND (:account='' OR domains.account=:account) AND (:domains='' OR instr(','||:domains||',', ','||records.domain_id||',')>0) LIMIT :limit"
 }
 
-func Prepare(stmt string, args ...interface{}) (string, []interface{}, error) {
-	if _, ok := declare[stmt]; !ok {
-		return "", nil, errors.New("Нет информации о запросе: " + stmt)
+// Query именованный запрос, скомпилированный под драйвер dqlite.
+// Params содержит имена параметров в порядке их следования в SQL.
+type Query struct {
+	Name   string
+	SQL    string
+	Params []string
+}
+
+var queries map[string]*Query
+
+// defaults параметры запросов, объявленных в коде. Переопределённый запрос
+// может использовать только их, иначе core.Service не передаст ему значения.
+var defaults map[string]*Query
+
+func init() {
+	var err error
+	if queries, err = compile(declare); err != nil {
+		panic(err)
 	}
-	qs, names, err := sql.CompileNamedQuery(declare[stmt], sql.QUESTION)
-	if err != nil {
-		return "", nil, errors.Wrap(err, "не удалось разобрать запрос")
+	defaults = queries
+}
+
+func compile(declared map[string]string) (map[string]*Query, error) {
+	compiled := make(map[string]*Query, len(declared))
+	for name, text := range declared {
+		qs, names, err := sql.CompileNamedQuery(text, sql.QUESTION)
+		if err != nil {
+			return nil, errors.Wrapf(err, "не удалось разобрать запрос %s", name)
+		}
+		compiled[name] = &Query{Name: name, SQL: qs, Params: names}
 	}
-	arg, err := sql.ArgToMap(args...)
+	return compiled, nil
+}
+
+// Override заменяет тексты именованных запросов, как gsqlite3-*-query в PowerDNS.
+// Имена можно указывать с префиксом gsqlite3-. Если хотя бы один запрос не
+// проходит проверку, реестр остаётся прежним. Вызывается до создания core.Service.
+func Override(overrides map[string]string) error {
+	declared := make(map[string]string, len(declare))
+	for name, text := range declare {
+		declared[name] = text
+	}
+	for name, text := range overrides {
+		name = strings.TrimPrefix(name, "gsqlite3-")
+		def, ok := defaults[name]
+		if !ok {
+			return errors.New("Нет информации о запросе: " + name)
+		}
+		_, names, err := sql.CompileNamedQuery(text, sql.QUESTION)
+		if err != nil {
+			return errors.Wrapf(err, "не удалось разобрать запрос %s", name)
+		}
+		for _, param := range names {
+			if !contains(def.Params, param) {
+				return errors.Errorf("запрос %s использует неизвестный параметр :%s, допустимы: %s", name, param, strings.Join(def.Params, ", "))
+			}
+		}
+		declared[name] = text
+	}
+	compiled, err := compile(declared)
 	if err != nil {
-		return "", nil, errors.Wrap(err, "не удалось распределить аргументы по парам")
+		return err
 	}
+	declare, queries = declared, compiled
+	return nil
+}
 
-	parametrs := make([]interface{}, 0, len(names))
-	for _, name := range names {
-		if value, ok := arg[name]; !ok {
-			parametrs = append(parametrs, nil)
-		} else {
-			parametrs = append(parametrs, value)
+// Declared возвращает действующие тексты запросов
+func Declared() map[string]string {
+	declared := make(map[string]string, len(declare))
+	for name, text := range declare {
+		declared[name] = text
+	}
+	return declared
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Get возвращает скомпилированный запрос по имени
+func Get(name string) (*Query, error) {
+	q, ok := queries[name]
+	if !ok {
+		return nil, errors.New("Нет информации о запросе: " + name)
+	}
+	return q, nil
+}
+
+// Bind раскладывает пары имя/значение в порядке параметров запроса.
+// Параметры, для которых значение не передано, получают NULL.
+func (q *Query) Bind(args ...interface{}) ([]interface{}, error) {
+	if len(args)%2 != 0 {
+		return nil, errors.New("не удалось распределить аргументы по парам")
+	}
+	parametrs := make([]interface{}, len(q.Params))
+	for i, name := range q.Params {
+		for j := 0; j < len(args); j += 2 {
+			if args[j] == name {
+				parametrs[i] = args[j+1]
+				break
+			}
 		}
 	}
-	return qs, parametrs, nil
+	return parametrs, nil
+}
+
+func Prepare(stmt string, args ...interface{}) (string, []interface{}, error) {
+	q, err := Get(stmt)
+	if err != nil {
+		return "", nil, err
+	}
+	parametrs, err := q.Bind(args...)
+	if err != nil {
+		return "", nil, err
+	}
+	return q.SQL, parametrs, nil
 }
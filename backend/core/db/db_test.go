@@ -0,0 +1,106 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/core/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueriesCompiled(t *testing.T) {
+	assert.Equal(t, len(declare), len(queries))
+	for name, text := range declare {
+		q, err := Get(name)
+		require.NoError(t, err)
+		qs, names, err := sql.CompileNamedQuery(text, sql.QUESTION)
+		require.NoError(t, err)
+		assert.Equal(t, qs, q.SQL, name)
+		assert.Equal(t, names, q.Params, name)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	qs, args, err := Prepare("id-query", "domain_id", 3, "qname", "www.example.com", "qtype", "A")
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT content,ttl,prio,type,domain_id,disabled,name,auth FROM records WHERE disabled=0 and type=? and name=? and domain_id=?", qs)
+	assert.Equal(t, []interface{}{"A", "www.example.com", 3}, args)
+
+	_, args, err = Prepare("insert-zone-query", "domain", "example.com", "type", "MASTER")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"MASTER", "example.com", nil, nil}, args)
+
+	_, args, err = Prepare("search-account-records-query", "value", "www%", "value2", "www%", "account", "team", "limit", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"www%", "www%", "team", "team", nil, nil, 10}, args, "repeated parameter gets the same value")
+
+	_, _, err = Prepare("missing-query")
+	assert.Error(t, err)
+	_, _, err = Prepare("id-query", "domain_id")
+	assert.Error(t, err)
+}
+
+// compileEachCall повторяет прежнюю реализацию Prepare, которая разбирала запрос на каждом вызове
+func compileEachCall(name string, args ...interface{}) (string, []interface{}, error) {
+	qs, names, err := sql.CompileNamedQuery(declare[name], sql.QUESTION)
+	if err != nil {
+		return "", nil, err
+	}
+	arg, err := sql.ArgToMap(args...)
+	if err != nil {
+		return "", nil, err
+	}
+	parametrs := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		parametrs = append(parametrs, arg[name])
+	}
+	return qs, parametrs, nil
+}
+
+func BenchmarkPrepare(b *testing.B) {
+	prepare := map[string]func(string, ...interface{}) (string, []interface{}, error){
+		"compile":  compileEachCall,
+		"registry": Prepare,
+	}
+	for _, impl := range []string{"compile", "registry"} {
+		b.Run("basic-query/"+impl, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, _ = prepare[impl]("basic-query", "qtype", "A", "qname", "www.example.com")
+			}
+		})
+		b.Run("id-query/"+impl, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, _ = prepare[impl]("id-query", "qtype", "A", "qname", "www.example.com", "domain_id", 1)
+			}
+		})
+	}
+}
+
+func TestOverride(t *testing.T) {
+	saved := declare
+	t.Cleanup(func() {
+		declare, queries = saved, defaults
+	})
+
+	err := Override(map[string]string{
+		"gsqlite3-basic-query": "SELECT content,ttl,prio,type,domain_id,disabled,name,auth FROM records WHERE disabled=0 and type=:qtype and name=:qname and domain_id IN (select id from domains where account='team-a')",
+	})
+	require.NoError(t, err)
+	q, err := Get("basic-query")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"qtype", "qname"}, q.Params)
+	assert.Contains(t, Declared()["basic-query"], "team-a")
+
+	err = Override(map[string]string{"missing-query": "select 1"})
+	assert.Error(t, err)
+	err = Override(map[string]string{"basic-query": "select content from records where name=:qname and account=:account"})
+	assert.Error(t, err, "account is not bound by basic-query")
+	err = Override(map[string]string{"basic-query": "select content from records where name=:qname:"})
+	assert.Error(t, err)
+
+	q, err = Get("basic-query")
+	require.NoError(t, err)
+	assert.Contains(t, q.SQL, "team-a", "failed override must keep the registry intact")
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/metrics"
+	"github.com/pkg/errors"
+)
+
+// Statements хранит подготовленные выражения для именованных запросов.
+// database/sql сам переподготавливает *sql.Stmt на каждом новом соединении,
+// поэтому выражение готовится один раз на соединение, а не на каждый вызов.
+type Statements struct {
+	db    *sql.DB
+	mu    sync.RWMutex
+	stmts map[string]*sql.Stmt
+}
+
+func NewStatements(db *sql.DB) *Statements {
+	return &Statements{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// Stmt возвращает подготовленное выражение и аргументы в порядке параметров запроса
+func (s *Statements) Stmt(ctx context.Context, name string, args ...interface{}) (*sql.Stmt, []interface{}, error) {
+	q, err := Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	parametrs, err := q.Bind(args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	metrics.Query(name)
+	s.mu.RLock()
+	stmt, ok := s.stmts[name]
+	s.mu.RUnlock()
+	if ok {
+		return stmt, parametrs, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stmt, ok = s.stmts[name]; ok {
+		return stmt, parametrs, nil
+	}
+	stmt, err = s.db.PrepareContext(ctx, q.SQL)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "не удалось подготовить запрос %s", name)
+	}
+	s.stmts[name] = stmt
+	return stmt, parametrs, nil
+}
+
+// TxStmt возвращает выражение, привязанное к транзакции. Если выражение ещё не
+// подготовлено, оно готовится на соединении транзакции и не кэшируется:
+// занимать второе соединение, пока открыта транзакция, нельзя.
+func (s *Statements) TxStmt(ctx context.Context, tx *sql.Tx, name string, args ...interface{}) (*sql.Stmt, []interface{}, error) {
+	q, err := Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	parametrs, err := q.Bind(args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	metrics.Query(name)
+	s.mu.RLock()
+	stmt, ok := s.stmts[name]
+	s.mu.RUnlock()
+	if ok {
+		return tx.StmtContext(ctx, stmt), parametrs, nil
+	}
+	stmt, err = tx.PrepareContext(ctx, q.SQL)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "не удалось подготовить запрос %s", name)
+	}
+	return stmt, parametrs, nil
+}
+
+func (s *Statements) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for name, stmt := range s.stmts {
+		if cerr := stmt.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.stmts, name)
+	}
+	return err
+}
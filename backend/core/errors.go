@@ -0,0 +1,16 @@
+package core
+
+import "github.com/pkg/errors"
+
+// Ошибки, по которым обработчики API выбирают код ответа
+var (
+	ErrDNSSECDisabled   = errors.New("Only for DNSSEC")
+	ErrNotImplemented   = errors.New("No implementation")
+	ErrNotFound         = errors.New("not found")
+	ErrNoTransaction    = errors.New("Транзакция отсутствует")
+	ErrTransactionBegun = errors.New("Транзакция начата")
+	ErrShuttingDown     = errors.New("service is shutting down")
+	ErrExists           = errors.New("already exists")
+	ErrInvalid          = errors.New("invalid request")
+	ErrQuotaExceeded    = errors.New("account quota exceeded")
+)
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Выгрузка зоны в стабильном виде для резервных копий, сравнения в git и
+// переноса между кластерами. Записи идут в каноническом порядке DNSSEC, а
+// в выгрузке нет идентификаторов и времени, поэтому выгрузки одной и той же
+// зоны совпадают байт в байт.
+
+const (
+	exportZoneQuery     = "SELECT id, type, COALESCE(master, ''), COALESCE(account, '') FROM domains WHERE name = ?"
+	exportMetadataQuery = "SELECT kind, content FROM domainmetadata WHERE domain_id = ? ORDER BY kind, id"
+)
+
+// ZoneExport зона целиком: свойства, метаданные и записи без пустых
+// нетерминальных имён. Имена хранятся без точки в конце, приоритет MX и SRV
+// входит в содержимое.
+type ZoneExport struct {
+	Name     string              `json:"name" yaml:"name"`
+	Kind     string              `json:"kind" yaml:"kind"`
+	Masters  []string            `json:"masters,omitempty" yaml:"masters,omitempty"`
+	Account  string              `json:"account,omitempty" yaml:"account,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	Records  []*ExportRecord     `json:"records" yaml:"records"`
+}
+
+// ExportRecord запись зоны в выгрузке
+type ExportRecord struct {
+	Name     string `json:"name" yaml:"name"`
+	Type     string `json:"type" yaml:"type"`
+	TTL      int    `json:"ttl" yaml:"ttl"`
+	Content  string `json:"content" yaml:"content"`
+	Disabled bool   `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+}
+
+// withPrio добавляет в содержимое MX и SRV приоритет из поля prio, если его
+// там нет: так записи хранили старые версии PowerDNS
+func withPrio(qtype, content string, prio int) string {
+	n := len(strings.Fields(content))
+	if (qtype == "MX" && n == 1) || (qtype == "SRV" && n == 3) {
+		return strconv.Itoa(prio) + " " + content
+	}
+	return content
+}
+
+// CanonicalLess имя a раньше b в каноническом порядке DNSSEC (RFC 4034,
+// 6.1): метки сравниваются справа налево без учёта регистра
+func CanonicalLess(a, b string) bool {
+	la := strings.Split(normalize(a), ".")
+	lb := strings.Split(normalize(b), ".")
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
+
+func typeRank(qtype string) int {
+	switch qtype {
+	case "SOA":
+		return 0
+	case "NS":
+		return 1
+	}
+	return 2
+}
+
+// priority приоритет MX и SRV для сортировки, -1 у остальных типов
+func priority(qtype, content string) int {
+	if qtype != "MX" && qtype != "SRV" {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.SplitN(content, " ", 2)[0])
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// SortRecords упорядочивает записи: имена в каноническом порядке, у имени
+// SOA, затем NS, затем остальные типы по алфавиту, MX и SRV по приоритету
+func SortRecords(records []*ExportRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if !strings.EqualFold(a.Name, b.Name) {
+			return CanonicalLess(a.Name, b.Name)
+		}
+		if ra, rb := typeRank(a.Type), typeRank(b.Type); ra != rb {
+			return ra < rb
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if pa, pb := priority(a.Type, a.Content), priority(b.Type, b.Content); pa != pb {
+			return pa < pb
+		}
+		if a.Content != b.Content {
+			return a.Content < b.Content
+		}
+		if a.TTL != b.TTL {
+			return a.TTL < b.TTL
+		}
+		return !a.Disabled && b.Disabled
+	})
+}
+
+// ExportZone выгружает зону одним чтением из базы
+func (s *Service) ExportZone(ctx context.Context, zone string) (*ZoneExport, error) {
+	zone = strings.TrimSuffix(zone, ".")
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	e := &ZoneExport{Name: zone, Records: make([]*ExportRecord, 0)}
+	var id int
+	var masters string
+	err = tx.QueryRowContext(ctx, exportZoneQuery, zone).Scan(&id, &e.Kind, &masters, &e.Account)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.Wrapf(ErrNotFound, "Domain %s", zone)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if masters != "" {
+		e.Masters = StringTok(masters, " ,\t")
+	}
+	rows, err := tx.QueryContext(ctx, exportMetadataQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var kind, content string
+		if err = rows.Scan(&kind, &content); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if e.Metadata == nil {
+			e.Metadata = make(map[string][]string)
+		}
+		e.Metadata[kind] = append(e.Metadata[kind], content)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	records, err := zoneSnapshot(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range records {
+		if rr.Qtype == "" {
+			continue
+		}
+		e.Records = append(e.Records, &ExportRecord{
+			Name:     rr.Qname,
+			Type:     rr.Qtype,
+			TTL:      rr.TTL,
+			Content:  withPrio(rr.Qtype, rr.Content, rr.Prio),
+			Disabled: rr.Disabled,
+		})
+	}
+	SortRecords(e.Records)
+	return e, nil
+}
+
+// LoadZone загружает зону из выгрузки ExportZone так же, как ImportZone,
+// и заменяет метаданные зоны метаданными выгрузки
+func (s *Service) LoadZone(ctx context.Context, e *ZoneExport, dryRun bool) (*Import, error) {
+	records := make([]*DNSResourceRecord, 0, len(e.Records))
+	for _, r := range e.Records {
+		records = append(records, &DNSResourceRecord{
+			Qname:    strings.TrimSuffix(r.Name, "."),
+			Qtype:    strings.ToUpper(r.Type),
+			TTL:      r.TTL,
+			Content:  r.Content,
+			Disabled: r.Disabled,
+		})
+	}
+	metadata := e.Metadata
+	if metadata == nil {
+		metadata = make(map[string][]string)
+	}
+	z := &Zone{Name: e.Name, Kind: strings.ToUpper(e.Kind), Masters: e.Masters, Account: e.Account}
+	return s.importZone(ctx, z, records, metadata, dryRun)
+}
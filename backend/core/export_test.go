@@ -0,0 +1,77 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalLess(t *testing.T) {
+	names := []string{"example.com", "a.example.com", "yljkjljk.a.example.com", "Z.a.example.com", "zABC.a.EXAMPLE.com", "z.example.com", "*.z.example.com"}
+	for i := range names {
+		for j := range names {
+			assert.Equal(t, i < j, CanonicalLess(names[i], names[j]), "%s < %s", names[i], names[j])
+		}
+	}
+}
+
+func TestExportZone(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, true)
+	_, err := s.ExportZone(ctx, "example.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	id := addZone(t, s, "example.com", "NATIVE")
+	for _, rr := range []*DNSResourceRecord{
+		{Qname: "www.example.com", Qtype: "A", TTL: 300, Content: "192.0.2.1"},
+		{Qname: "example.com", Qtype: "MX", TTL: 300, Content: "mx2.example.com", Prio: 20},
+		{Qname: "example.com", Qtype: "MX", TTL: 300, Content: "5 mx1.example.com"},
+		{Qname: "example.com", Qtype: "SOA", TTL: 3600, Content: fmt.Sprintf(soa, 1)},
+		{Qname: "old.example.com", Qtype: "A", TTL: 300, Content: "192.0.2.9", Disabled: true},
+	} {
+		execQuery(t, s, "insert-record-query", "content", rr.Content, "ttl", rr.TTL, "priority", rr.Prio, "qtype", rr.Qtype,
+			"domain_id", id, "disabled", rr.Disabled, "qname", rr.Qname, "auth", true, "ordername", nil)
+	}
+	execQuery(t, s, "insert-empty-non-terminal-order-query", "domain_id", id, "qname", "sub.example.com", "ordername", nil, "auth", true)
+	require.NoError(t, s.SetDomainMetadata(ctx, "example.com", "ALSO-NOTIFY", []string{"192.0.2.7", "192.0.2.8"}))
+
+	e, err := s.ExportZone(ctx, "example.com.")
+	require.NoError(t, err)
+	assert.Equal(t, &ZoneExport{
+		Name:     "example.com",
+		Kind:     "NATIVE",
+		Metadata: map[string][]string{"ALSO-NOTIFY": {"192.0.2.7", "192.0.2.8"}},
+		Records: []*ExportRecord{
+			{Name: "example.com", Type: "SOA", TTL: 3600, Content: fmt.Sprintf(soa, 1)},
+			{Name: "example.com", Type: "MX", TTL: 300, Content: "5 mx1.example.com"},
+			{Name: "example.com", Type: "MX", TTL: 300, Content: "20 mx2.example.com"},
+			{Name: "old.example.com", Type: "A", TTL: 300, Content: "192.0.2.9", Disabled: true},
+			{Name: "www.example.com", Type: "A", TTL: 300, Content: "192.0.2.1"},
+		},
+	}, e)
+
+	// Выгрузка переносится в другой кластер и выгружается оттуда так же
+	data, err := json.Marshal(e)
+	require.NoError(t, err)
+	other := newTestService(t, true)
+	var loaded ZoneExport
+	require.NoError(t, json.Unmarshal(data, &loaded))
+	result, err := other.LoadZone(ctx, &loaded, false)
+	require.NoError(t, err)
+	assert.True(t, result.Created)
+	again, err := other.ExportZone(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, e, again)
+
+	// Загрузка выгрузки заменяет и метаданные
+	loaded.Metadata = nil
+	_, err = other.LoadZone(ctx, &loaded, false)
+	require.NoError(t, err)
+	again, err = other.ExportZone(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Empty(t, again.Metadata)
+}
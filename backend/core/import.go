@@ -0,0 +1,322 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Загрузка зоны целиком, например из файла зоны BIND. Записи идут тем же
+// путём, что и полная замена зоны через StartTransaction и FeedRecord:
+// записи зоны удаляются запросом delete-zone-query, новые вставляются
+// insert-record-query, пустые нетерминальные имена добавляются
+// insert-empty-non-terminal-order-query. Журнал, версия зоны, квоты и
+// отметка изменения пишутся в той же транзакции. Пробная загрузка проходит
+// все шаги до журнала и откатывается.
+
+// errDryRun откатывает транзакцию пробной загрузки
+var errDryRun = errors.New("пробная загрузка")
+
+// Import итог загрузки зоны: число записей до и после без пустых
+// нетерминальных имён и записи, которые появились и исчезли
+type Import struct {
+	Zone    string               `json:"zone"`
+	Created bool                 `json:"created"`
+	DryRun  bool                 `json:"dry_run"`
+	Before  int                  `json:"before"`
+	After   int                  `json:"after"`
+	Added   []*DNSResourceRecord `json:"added"`
+	Removed []*DNSResourceRecord `json:"removed"`
+}
+
+// parent родительское имя, пустое для имени без точек
+func parent(name string) string {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// authority определяет признак auth записей зоны: имена ниже делегирования
+// и NS самого делегирования не авторитетны, DS на делегировании авторитетна
+func authority(zone string, records []*DNSResourceRecord) func(name, qtype string) bool {
+	cuts := make(map[string]bool)
+	for _, rr := range records {
+		if name := normalize(rr.Qname); rr.Qtype == "NS" && name != zone {
+			cuts[name] = true
+		}
+	}
+	return func(name, qtype string) bool {
+		name = normalize(name)
+		for n := name; n != zone && inZone(n, zone); n = parent(n) {
+			if cuts[n] {
+				return n == name && qtype == "DS"
+			}
+		}
+		return true
+	}
+}
+
+// emptyNonTerminals имена между вершиной зоны и записями, у которых своих
+// записей нет, с признаком auth
+func emptyNonTerminals(zone string, records []*DNSResourceRecord, auth func(name, qtype string) bool) map[string]bool {
+	names := make(map[string]bool, len(records))
+	for _, rr := range records {
+		names[normalize(rr.Qname)] = true
+	}
+	ents := make(map[string]bool)
+	for name := range names {
+		for n := parent(name); n != zone && inZone(n, zone); n = parent(n) {
+			if !names[n] {
+				ents[n] = auth(n, "")
+			}
+		}
+	}
+	return ents
+}
+
+// validContent проверяет содержимое записей основных типов, остальные
+// типы принимаются как есть
+func validContent(qtype, content string) error {
+	fields := strings.Fields(content)
+	numbers := func(fields []string, bits int) bool {
+		for _, f := range fields {
+			if _, err := strconv.ParseUint(f, 10, bits); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+	switch qtype {
+	case "A":
+		if ip := net.ParseIP(content); ip == nil || ip.To4() == nil || strings.Contains(content, ":") {
+			return errors.New("неверный адрес IPv4")
+		}
+	case "AAAA":
+		if ip := net.ParseIP(content); ip == nil || !strings.Contains(content, ":") {
+			return errors.New("неверный адрес IPv6")
+		}
+	case "CNAME", "NS", "PTR", "DNAME":
+		if len(fields) != 1 {
+			return errors.New("ожидается одно имя")
+		}
+	case "MX":
+		if len(fields) != 2 || !numbers(fields[:1], 16) {
+			return errors.New("ожидаются приоритет и имя")
+		}
+	case "SRV":
+		if len(fields) != 4 || !numbers(fields[:3], 16) {
+			return errors.New("ожидаются приоритет, вес, порт и имя")
+		}
+	case "SOA":
+		if len(fields) != 7 || !numbers(fields[2:], 32) {
+			return errors.New("ожидаются два имени и пять чисел")
+		}
+	}
+	return nil
+}
+
+// validateZone проверяет записи загружаемой зоны: имена внутри зоны, одна
+// SOA на вершине, CNAME без других данных и содержимое основных типов
+func validateZone(zone string, records []*DNSResourceRecord) error {
+	soa := 0
+	types := make(map[string]map[string]int)
+	for _, rr := range records {
+		name := normalize(rr.Qname)
+		if !inZone(name, zone) {
+			return errors.Wrapf(ErrInvalid, "имя %s вне зоны %s", rr.Qname, zone)
+		}
+		if rr.Qtype == "" || rr.Content == "" {
+			return errors.Wrapf(ErrInvalid, "у записи %s нет типа или содержимого", rr.Qname)
+		}
+		if rr.TTL < 0 {
+			return errors.Wrapf(ErrInvalid, "запись %s %s: отрицательный TTL", rr.Qname, rr.Qtype)
+		}
+		if err := validContent(rr.Qtype, rr.Content); err != nil {
+			return errors.Wrapf(ErrInvalid, "запись %s %s %q: %v", rr.Qname, rr.Qtype, rr.Content, err)
+		}
+		if rr.Qtype == "SOA" {
+			if name != zone {
+				return errors.Wrapf(ErrInvalid, "SOA %s не на вершине зоны %s", rr.Qname, zone)
+			}
+			soa++
+		}
+		if types[name] == nil {
+			types[name] = make(map[string]int)
+		}
+		types[name][rr.Qtype]++
+	}
+	if soa != 1 {
+		return errors.Wrapf(ErrInvalid, "в зоне %s записей SOA %d вместо одной", zone, soa)
+	}
+	for name, set := range types {
+		if set["CNAME"] == 0 {
+			continue
+		}
+		if set["CNAME"] > 1 {
+			return errors.Wrapf(ErrInvalid, "у %s несколько CNAME", name)
+		}
+		for qtype := range set {
+			if qtype != "CNAME" && qtype != "RRSIG" && qtype != "NSEC" {
+				return errors.Wrapf(ErrInvalid, "у %s кроме CNAME есть %s", name, qtype)
+			}
+		}
+	}
+	return nil
+}
+
+// countRecords число записей без пустых нетерминальных имён
+func countRecords(records []*DNSResourceRecord) int {
+	n := 0
+	for _, rr := range records {
+		if rr.Qtype != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// replaceMetadata заменяет все метаданные зоны
+func (s *Service) replaceMetadata(ctx context.Context, tx *sql.Tx, zone string, metadata map[string][]string) error {
+	if _, err := s.execTx(ctx, tx, "clear-domain-all-metadata-query", "domain", zone); err != nil {
+		return err
+	}
+	kinds := make([]string, 0, len(metadata))
+	for kind := range metadata {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		for _, m := range metadata[kind] {
+			_, err := s.execTx(ctx, tx, "set-domain-metadata-query", "kind", kind, "content", m, "domain", zone)
+			if err != nil {
+				return errors.Wrapf(err, "Unable to set metadata kind %s for domain %s", kind, zone)
+			}
+		}
+	}
+	return nil
+}
+
+// ImportZone заменяет записи зоны на records одной транзакцией. Зона, которой
+// нет, создаётся с типом z.Kind (по умолчанию NATIVE) и владельцем
+// z.Account, у существующей зоны тип и владелец не меняются. С dryRun
+// изменения проверяются, но не сохраняются.
+func (s *Service) ImportZone(ctx context.Context, z *Zone, records []*DNSResourceRecord, dryRun bool) (*Import, error) {
+	return s.importZone(ctx, z, records, nil, dryRun)
+}
+
+// importZone загружает зону, а если metadata не nil, заменяет и метаданные зоны
+func (s *Service) importZone(ctx context.Context, z *Zone, records []*DNSResourceRecord, metadata map[string][]string, dryRun bool) (*Import, error) {
+	z.Name = strings.TrimSuffix(z.Name, ".")
+	if z.Name == "" {
+		return nil, errors.Wrap(ErrInvalid, "не указано имя зоны")
+	}
+	if z.Kind == "" {
+		z.Kind = "NATIVE"
+	}
+	if err := validKind(z.Kind); err != nil {
+		return nil, err
+	}
+	zone := normalize(z.Name)
+	if err := validateZone(zone, records); err != nil {
+		return nil, err
+	}
+	result := &Import{Zone: z.Name, DryRun: dryRun}
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		q := newQuotas()
+		id, err := zoneID(ctx, tx, z.Name)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			if err = q.watch(ctx, tx, z.Account); err != nil {
+				return err
+			}
+			_, err = s.execTx(ctx, tx, "insert-zone-query",
+				"domain", z.Name,
+				"account", z.Account,
+				"masters", strings.Join(z.Masters, ","),
+				"type", z.Kind,
+			)
+			if err != nil {
+				return err
+			}
+			if id, err = zoneID(ctx, tx, z.Name); err != nil {
+				return err
+			}
+			result.Created = true
+		case err != nil:
+			return err
+		default:
+			if err = s.baseline(ctx, tx, id); err != nil {
+				return err
+			}
+			if err = q.watchDomain(ctx, tx, id); err != nil {
+				return err
+			}
+		}
+		before, err := zoneSnapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if _, err = s.execTx(ctx, tx, "delete-zone-query", "domain_id", id); err != nil {
+			return err
+		}
+		auth := authority(zone, records)
+		for _, rr := range records {
+			rr.DomainID, rr.Auth = id, auth(rr.Qname, rr.Qtype)
+			if err = s.feedRecord(ctx, tx, rr, ""); err != nil {
+				return err
+			}
+		}
+		ents := emptyNonTerminals(zone, records, auth)
+		for name, a := range ents {
+			_, err = s.execTx(ctx, tx, "insert-empty-non-terminal-order-query",
+				"domain_id", id,
+				"qname", name,
+				"ordername", nil,
+				"auth", a || !s.dnssec,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		if metadata != nil {
+			if err = s.replaceMetadata(ctx, tx, z.Name, metadata); err != nil {
+				return err
+			}
+		}
+		if err = q.check(ctx, tx); err != nil {
+			return err
+		}
+		after, err := zoneSnapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		result.Before, result.After = countRecords(before), countRecords(after)
+		result.Added, result.Removed = subtract(after, before), subtract(before, after)
+		if dryRun {
+			return errDryRun
+		}
+		n := len(ents)
+		err = s.audit(ctx, tx, "importzone", z.Name, &zoneState{Records: &result.Before}, &zoneState{Records: &result.After, Ents: &n})
+		if err != nil {
+			return err
+		}
+		if err = s.snapshot(ctx, tx, id, "importzone"); err != nil {
+			return err
+		}
+		return s.changedTx(ctx, tx, map[int]bool{id: true})
+	})
+	if errors.Is(err, errDryRun) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.cache.invalidate([]string{z.Name})
+	return result, nil
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func importRecords(serial int, extra ...*DNSResourceRecord) []*DNSResourceRecord {
+	return append([]*DNSResourceRecord{
+		{Qname: "example.com", Qtype: "SOA", TTL: 3600, Content: fmt.Sprintf(soa, serial)},
+		{Qname: "example.com", Qtype: "NS", TTL: 3600, Content: "ns1.example.com"},
+		{Qname: "ns1.example.com", Qtype: "A", TTL: 3600, Content: "192.0.2.53"},
+	}, extra...)
+}
+
+func TestImportZone(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, true)
+	s.SetVersions(5)
+
+	result, err := s.ImportZone(ctx, &Zone{Name: "example.com."}, importRecords(1,
+		&DNSResourceRecord{Qname: "www.a.b.example.com", Qtype: "A", TTL: 300, Content: "192.0.2.1"},
+		&DNSResourceRecord{Qname: "sub.example.com", Qtype: "NS", TTL: 3600, Content: "ns.sub.example.com"},
+		&DNSResourceRecord{Qname: "sub.example.com", Qtype: "DS", TTL: 3600, Content: "1 8 2 abcd"},
+		&DNSResourceRecord{Qname: "ns.sub.example.com", Qtype: "A", TTL: 3600, Content: "192.0.2.54"},
+	), false)
+	require.NoError(t, err)
+	assert.True(t, result.Created)
+	assert.Equal(t, 0, result.Before)
+	assert.Equal(t, 7, result.After)
+	assert.Len(t, result.Added, 7)
+
+	di, err := s.GetDomainInfo(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "NATIVE", di.Kind)
+	records, err := zoneSnapshot(ctx, s.db, di.ID)
+	require.NoError(t, err)
+	auth := make(map[string]bool)
+	for _, rr := range records {
+		auth[rr.Qname+" "+rr.Qtype] = rr.Auth
+	}
+	assert.Equal(t, map[string]bool{
+		"a.b.example.com ":      true,
+		"b.example.com ":        true,
+		"example.com NS":        true,
+		"example.com SOA":       true,
+		"ns.sub.example.com A":  false,
+		"ns1.example.com A":     true,
+		"sub.example.com DS":    true,
+		"sub.example.com NS":    false,
+		"www.a.b.example.com A": true,
+	}, auth)
+
+	// Пробная загрузка показывает изменения и ничего не меняет
+	next := importRecords(2, &DNSResourceRecord{Qname: "mail.example.com", Qtype: "MX", TTL: 300, Content: "10 mx.example.com"})
+	result, err = s.ImportZone(ctx, &Zone{Name: "example.com"}, next, true)
+	require.NoError(t, err)
+	assert.False(t, result.Created)
+	assert.Equal(t, 7, result.Before)
+	assert.Equal(t, 4, result.After)
+	require.Len(t, result.Added, 2)
+	assert.Equal(t, "SOA", result.Added[0].Qtype)
+	assert.Equal(t, "mail.example.com", result.Added[1].Qname)
+	assert.Len(t, result.Removed, 5)
+	rrs, err := s.Lookup(ctx, "A", "www.a.b.example.com", -1)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 1)
+	assert.Len(t, auditEntries(t, s, "importzone"), 1)
+
+	result, err = s.ImportZone(ctx, &Zone{Name: "example.com"}, next, false)
+	require.NoError(t, err)
+	assert.Equal(t, 4, result.After)
+	rrs, err = s.Lookup(ctx, "A", "www.a.b.example.com", -1)
+	require.NoError(t, err)
+	assert.Empty(t, rrs)
+	assert.Len(t, auditEntries(t, s, "importzone"), 2)
+	versions, err := s.Versions(ctx, "example.com")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, int64(2), versions[1].Serial)
+}
+
+func TestImportZoneInvalid(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	for name, records := range map[string][]*DNSResourceRecord{
+		"no soa":      importRecords(1)[1:],
+		"two soa":     importRecords(1, &DNSResourceRecord{Qname: "example.com", Qtype: "SOA", TTL: 3600, Content: fmt.Sprintf(soa, 2)}),
+		"soa below":   append(importRecords(1)[1:], &DNSResourceRecord{Qname: "sub.example.com", Qtype: "SOA", TTL: 3600, Content: fmt.Sprintf(soa, 1)}),
+		"out of zone": importRecords(1, &DNSResourceRecord{Qname: "example.net", Qtype: "A", TTL: 300, Content: "192.0.2.1"}),
+		"bad a":       importRecords(1, &DNSResourceRecord{Qname: "www.example.com", Qtype: "A", TTL: 300, Content: "2001:db8::1"}),
+		"bad aaaa":    importRecords(1, &DNSResourceRecord{Qname: "www.example.com", Qtype: "AAAA", TTL: 300, Content: "192.0.2.1"}),
+		"bad mx":      importRecords(1, &DNSResourceRecord{Qname: "example.com", Qtype: "MX", TTL: 300, Content: "mx.example.com"}),
+		"bad srv":     importRecords(1, &DNSResourceRecord{Qname: "_sip._udp.example.com", Qtype: "SRV", TTL: 300, Content: "0 5 sip.example.com"}),
+		"cname and a": importRecords(1, &DNSResourceRecord{Qname: "ns1.example.com", Qtype: "CNAME", TTL: 300, Content: "example.com"}),
+		"negative":    importRecords(1, &DNSResourceRecord{Qname: "www.example.com", Qtype: "A", TTL: -1, Content: "192.0.2.1"}),
+	} {
+		_, err := s.ImportZone(ctx, &Zone{Name: "example.com"}, records, false)
+		assert.ErrorIs(t, err, ErrInvalid, name)
+	}
+	_, err := s.ImportZone(ctx, &Zone{Name: "example.com", Kind: "FORWARD"}, importRecords(1), false)
+	assert.ErrorIs(t, err, ErrInvalid)
+	di, err := s.GetDomainInfo(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Zero(t, di.ID)
+
+	require.NoError(t, s.SetQuota(ctx, "team", &Quota{Records: 3}))
+	_, err = s.ImportZone(ctx, &Zone{Name: "example.com", Account: "team"}, importRecords(1), false)
+	require.NoError(t, err)
+	_, err = s.ImportZone(ctx, &Zone{Name: "example.com"}, importRecords(2,
+		&DNSResourceRecord{Qname: "www.example.com", Qtype: "A", TTL: 300, Content: "192.0.2.1"}), true)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
@@ -0,0 +1,230 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Ключи DNSSEC хранятся в cryptokeys в формате приватных ключей BIND
+// (Private-key-format: v1.2), как их пишет PowerDNS.
+
+// Алгоритмы DNSSEC, для которых считается DNSKEY
+const (
+	AlgRSASHA256       = 8
+	AlgRSASHA512       = 10
+	AlgECDSAP256SHA256 = 13
+	AlgED25519         = 15
+)
+
+var algorithms = map[string]int{
+	"RSASHA256":       AlgRSASHA256,
+	"RSASHA512":       AlgRSASHA512,
+	"ECDSAP256SHA256": AlgECDSAP256SHA256,
+	"ED25519":         AlgED25519,
+}
+
+// Algorithm номер алгоритма по имени или номеру
+func Algorithm(name string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		name = AlgorithmName(n)
+	}
+	if n, ok := algorithms[strings.ToUpper(name)]; ok {
+		return n, nil
+	}
+	return 0, errors.Wrapf(ErrInvalid, "алгоритм %q не поддерживается", name)
+}
+
+// AlgorithmName имя алгоритма по номеру
+func AlgorithmName(n int) string {
+	for name, alg := range algorithms {
+		if alg == n {
+			return name
+		}
+	}
+	return strconv.Itoa(n)
+}
+
+// GenerateKey создаёт приватный ключ. RSA ключи создаёт PowerDNS
+// (pdnsutil add-zone-key), здесь только ECDSA P-256 и Ed25519.
+func GenerateKey(algorithm int) (string, error) {
+	var secret []byte
+	switch algorithm {
+	case AlgECDSAP256SHA256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		secret = key.D.FillBytes(make([]byte, 32))
+	case AlgED25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		secret = key.Seed()
+	default:
+		return "", errors.Wrapf(ErrInvalid, "создание ключей %s не поддерживается", AlgorithmName(algorithm))
+	}
+	return fmt.Sprintf("Private-key-format: v1.2\nAlgorithm: %d (%s)\nPrivateKey: %s\n",
+		algorithm, AlgorithmName(algorithm), base64.StdEncoding.EncodeToString(secret)), nil
+}
+
+// privateKey поля приватного ключа BIND
+func privateKey(content string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if ok {
+			fields[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	if _, ok := fields["Algorithm"]; !ok {
+		return nil, errors.Wrap(ErrInvalid, "в приватном ключе нет Algorithm")
+	}
+	return fields, nil
+}
+
+func field(fields map[string]string, name string) ([]byte, error) {
+	v, err := base64.StdEncoding.DecodeString(fields[name])
+	if err != nil || len(v) == 0 {
+		return nil, errors.Wrapf(ErrInvalid, "в приватном ключе нет %s", name)
+	}
+	return v, nil
+}
+
+// KeyAlgorithm номер алгоритма приватного ключа
+func KeyAlgorithm(content string) (int, error) {
+	fields, err := privateKey(content)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.Fields(fields["Algorithm"])[0])
+	if err != nil {
+		return 0, errors.Wrapf(ErrInvalid, "алгоритм %q", fields["Algorithm"])
+	}
+	return n, nil
+}
+
+// publicKey открытый ключ в формате RDATA записи DNSKEY
+func publicKey(algorithm int, fields map[string]string) ([]byte, error) {
+	switch algorithm {
+	case AlgECDSAP256SHA256:
+		d, err := field(fields, "PrivateKey")
+		if err != nil {
+			return nil, err
+		}
+		x, y := elliptic.P256().ScalarBaseMult(d)
+		return append(x.FillBytes(make([]byte, 32)), y.FillBytes(make([]byte, 32))...), nil
+	case AlgED25519:
+		seed, err := field(fields, "PrivateKey")
+		if err != nil {
+			return nil, err
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, errors.Wrap(ErrInvalid, "длина ключа Ed25519")
+		}
+		return ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey), nil
+	case AlgRSASHA256, AlgRSASHA512:
+		modulus, err := field(fields, "Modulus")
+		if err != nil {
+			return nil, err
+		}
+		exponent, err := field(fields, "PublicExponent")
+		if err != nil {
+			return nil, err
+		}
+		exponent = new(big.Int).SetBytes(exponent).Bytes()
+		// RFC 3110: длина экспоненты одним байтом или нулём и двумя байтами
+		var key []byte
+		if len(exponent) < 256 {
+			key = append(key, byte(len(exponent)))
+		} else {
+			key = append(key, 0, byte(len(exponent)>>8), byte(len(exponent)))
+		}
+		return append(append(key, exponent...), modulus...), nil
+	}
+	return nil, errors.Wrapf(ErrInvalid, "алгоритм %s не поддерживается", AlgorithmName(algorithm))
+}
+
+// DNSKEY запись DNSKEY и DS (SHA-256) ключа зоны
+type DNSKEY struct {
+	Algorithm int
+	Bits      int
+	Tag       uint16
+	DNSKEY    string
+	DS        string
+}
+
+// PublicKey считает DNSKEY и DS для ключа key зоны zone
+func PublicKey(zone string, key *KeyData) (*DNSKEY, error) {
+	fields, err := privateKey(key.Content)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := KeyAlgorithm(key.Content)
+	if err != nil {
+		return nil, err
+	}
+	public, err := publicKey(algorithm, fields)
+	if err != nil {
+		return nil, err
+	}
+	rdata := make([]byte, 4, 4+len(public))
+	binary.BigEndian.PutUint16(rdata, uint16(key.Flags))
+	rdata[2], rdata[3] = 3, byte(algorithm)
+	rdata = append(rdata, public...)
+
+	bits := len(public) * 8
+	switch algorithm {
+	case AlgECDSAP256SHA256:
+		bits = 256
+	case AlgRSASHA256, AlgRSASHA512:
+		modulus, _ := field(fields, "Modulus")
+		bits = new(big.Int).SetBytes(modulus).BitLen()
+	}
+	tag := keyTag(rdata)
+	digest := sha256.Sum256(append(wireName(zone), rdata...))
+	return &DNSKEY{
+		Algorithm: algorithm,
+		Bits:      bits,
+		Tag:       tag,
+		DNSKEY:    fmt.Sprintf("%d 3 %d %s", key.Flags, algorithm, base64.StdEncoding.EncodeToString(public)),
+		DS:        fmt.Sprintf("%d %d 2 %s", tag, algorithm, hex.EncodeToString(digest[:])),
+	}, nil
+}
+
+// keyTag RFC 4034, приложение B
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+// wireName имя в каноническом виде для подсчёта DS
+func wireName(name string) []byte {
+	var wire []byte
+	for _, label := range strings.Split(normalize(name), ".") {
+		if label != "" {
+			wire = append(append(wire, byte(len(label))), label...)
+		}
+	}
+	return append(wire, 0)
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicKey(t *testing.T) {
+	// Примеры из RFC 8080 и RFC 6605
+	ed, err := PublicKey("example.com.", &KeyData{Flags: 257, Content: "Private-key-format: v1.2\nAlgorithm: 15 (ED25519)\nPrivateKey: ODIyNjAzODQ2MjgwODAxMjI2NDUxOTAyMDQxNDIyNjI=\n"})
+	require.NoError(t, err)
+	assert.Equal(t, "257 3 15 l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4=", ed.DNSKEY)
+	assert.Equal(t, "3613 15 2 3aa5ab37efce57f737fc1627013fee07bdf241bd10f3b1964ab55c78e79a304b", ed.DS)
+
+	ec, err := PublicKey("example.net", &KeyData{Flags: 257, Content: "Private-key-format: v1.2\nAlgorithm: 13 (ECDSAP256SHA256)\nPrivateKey: GU6SnQ/Ou+xC5RumuIUIuJZteXT2z0O/ok1s38Et6mQ=\n"})
+	require.NoError(t, err)
+	assert.Equal(t, "257 3 13 GojIhhXUN/u4v54ZQqGSnyhWJwaubCvTmeexv7bR6edbkrSqQpF64cYbcB7wNcP+e+MAnLr+Wi9xMWyQLc8NAA==", ec.DNSKEY)
+	assert.Equal(t, "55648 13 2 b4c8c1fe2e7477127b27115656ad6256f424625bf5c1e2770ce6d6e37df61d17", ec.DS)
+	assert.Equal(t, 256, ec.Bits)
+
+	_, err = PublicKey("example.com", &KeyData{Content: "ksk"})
+	assert.ErrorIs(t, err, ErrInvalid)
+}
+
+func TestGenerateKey(t *testing.T) {
+	for _, name := range []string{"ECDSAP256SHA256", "ed25519", "13"} {
+		alg, err := Algorithm(name)
+		require.NoError(t, err)
+		content, err := GenerateKey(alg)
+		require.NoError(t, err)
+		key, err := PublicKey("example.com", &KeyData{Flags: 256, Content: content})
+		require.NoError(t, err)
+		assert.Equal(t, alg, key.Algorithm)
+	}
+	_, err := GenerateKey(AlgRSASHA256)
+	assert.ErrorIs(t, err, ErrInvalid)
+	_, err = Algorithm("DSA")
+	assert.ErrorIs(t, err, ErrInvalid)
+}
@@ -0,0 +1,261 @@
+package core
+
+import (
+	"context"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+	"time"
+
+	dqlite "github.com/canonical/go-dqlite/driver"
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/ivan-bokov/pdns-dqlite/backend/metrics"
+	"github.com/pkg/errors"
+)
+
+// Retry повтор вызовов, пока dqlite выбирает нового лидера
+type Retry struct {
+	Timeout time.Duration // общее время повторов одного вызова, ноль отключает повторы
+	Backoff time.Duration // первая пауза, после каждой попытки удваивается до maxBackoff
+}
+
+// DefaultRetry укладывается в таймаут remote backend PowerDNS по умолчанию (2s)
+var DefaultRetry = Retry{Timeout: time.Second, Backoff: 20 * time.Millisecond}
+
+const maxBackoff = 250 * time.Millisecond
+
+// Коды ошибок dqlite, которые go-dqlite не экспортирует
+const (
+	errIoErr                     = 10
+	errIoErrNotLeader            = errIoErr | 40<<8
+	errIoErrLeadershipLost       = errIoErr | 41<<8
+	errIoErrNotLeaderLegacy      = errIoErr | 32<<8
+	errIoErrLeadershipLostLegacy = errIoErr | 33<<8
+)
+
+// SetRetry задаёт повторы для следующих вызовов
+func (s *Service) SetRetry(r Retry) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.retries = r
+}
+
+func (s *Service) retryConfig() Retry {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.retries
+}
+
+// Retryable ошибка вызвана отсутствием или сменой лидера, и вызов можно повторить
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, dqlite.ErrNoAvailableLeader) {
+		return true
+	}
+	var e dqlite.Error
+	if errors.As(err, &e) {
+		switch e.Code {
+		case errIoErrNotLeader, errIoErrLeadershipLost, errIoErrNotLeaderLegacy, errIoErrLeadershipLostLegacy,
+			dqlite.ErrBusy, dqlite.ErrBusyRecovery, dqlite.ErrBusySnapshot:
+			return true
+		}
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "not leader") || strings.Contains(msg, "leadership lost")
+}
+
+// retry выполняет f и повторяет её с растущей паузой, пока ошибка Retryable,
+// не истёк Timeout из SetRetry и не отменён ctx. f должна быть идемпотентной.
+func (s *Service) retry(ctx context.Context, method string, f func() error) error {
+	err := f()
+	retries := s.retryConfig()
+	if !Retryable(err) || retries.Timeout <= 0 {
+		return err
+	}
+	stop := time.Now().Add(retries.Timeout)
+	backoff := retries.Backoff
+	for attempt := 1; ; attempt++ {
+		if time.Now().Add(backoff).After(stop) {
+			metrics.RetryExhausted(method)
+			return errors.Wrapf(err, "нет лидера dqlite, %d попыток", attempt)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrap(ctx.Err(), err.Error())
+		case <-timer.C:
+		}
+		metrics.Retry(method)
+		logging.FromContext(ctx).WithError(err).WithField("method", method).WithField("attempt", attempt).Debug("повтор после смены лидера")
+		if err = f(); !Retryable(err) {
+			return err
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Методы ниже только читают или пишут одно и то же значение при повторе,
+// поэтому их можно повторять при смене лидера. Запись внутри транзакции
+// PowerDNS, её фиксация, добавление ключей и зон не повторяются.
+
+func (s *Service) Lookup(ctx context.Context, qtype string, qname string, zoneID int) (list []*DNSResourceRecord, err error) {
+	v, err := s.cached("lookup", qname, cacheKey("lookup", qtype, qname, strconv.Itoa(zoneID)), func() (interface{}, error) {
+		err = s.retry(ctx, "lookup", func() error {
+			list, err = s.lookup(ctx, qtype, qname, zoneID)
+			return err
+		})
+		return list, err
+	})
+	list, _ = v.([]*DNSResourceRecord)
+	return list, err
+}
+
+func (s *Service) List(ctx context.Context, zonename string, domainID int, includeDisabled bool) (list []*DNSResourceRecord, err error) {
+	v, err := s.cached("list", zonename, cacheKey("list", zonename, strconv.Itoa(domainID), strconv.FormatBool(includeDisabled)), func() (interface{}, error) {
+		err = s.retry(ctx, "list", func() error {
+			list, err = s.list(ctx, zonename, domainID, includeDisabled)
+			return err
+		})
+		return list, err
+	})
+	list, _ = v.([]*DNSResourceRecord)
+	return list, err
+}
+
+func (s *Service) GetDomainInfo(ctx context.Context, name string) (di *DomainInfo, err error) {
+	err = s.retry(ctx, "getdomaininfo", func() error {
+		di, err = s.getDomainInfo(ctx, name)
+		return err
+	})
+	return di, err
+}
+
+func (s *Service) GetAllDomains(ctx context.Context, includeDisabled bool) (dis []*DomainInfo, err error) {
+	err = s.retry(ctx, "getalldomains", func() error {
+		dis, err = s.getAllDomains(ctx, includeDisabled)
+		return err
+	})
+	return dis, err
+}
+
+func (s *Service) GetAllDomainMetadata(ctx context.Context, name string) (meta map[string][]string, err error) {
+	err = s.retry(ctx, "getalldomainmetadata", func() error {
+		meta, err = s.getAllDomainMetadata(ctx, name)
+		return err
+	})
+	return meta, err
+}
+
+func (s *Service) GetDomainMetadata(ctx context.Context, name string, kind string) (meta []string, err error) {
+	v, err := s.cached("getdomainmetadata", name, cacheKey("getdomainmetadata", name, kind), func() (interface{}, error) {
+		err = s.retry(ctx, "getdomainmetadata", func() error {
+			meta, err = s.getDomainMetadata(ctx, name, kind)
+			return err
+		})
+		return meta, err
+	})
+	meta, _ = v.([]string)
+	return meta, err
+}
+
+func (s *Service) GetDomainKeys(ctx context.Context, name string) (keys []*KeyData, err error) {
+	err = s.retry(ctx, "getdomainkeys", func() error {
+		keys, err = s.getDomainKeys(ctx, name)
+		return err
+	})
+	return keys, err
+}
+
+func (s *Service) GetTSIGKey(ctx context.Context, name string) (algorithm *string, content *string, err error) {
+	err = s.retry(ctx, "gettsigkey", func() error {
+		algorithm, content, err = s.getTSIGKey(ctx, name)
+		return err
+	})
+	return algorithm, content, err
+}
+
+func (s *Service) SuperMasterBackend(ctx context.Context, ip string, domain string, nsset []*DNSResourceRecord) (nameserver *string, account *string, err error) {
+	err = s.retry(ctx, "supermasterbackend", func() error {
+		nameserver, account, err = s.superMasterBackend(ctx, ip, domain, nsset)
+		return err
+	})
+	return nameserver, account, err
+}
+
+func (s *Service) SearchRecords(ctx context.Context, pattern string, maxResult int) (rrset []*DNSResourceRecord, err error) {
+	err = s.retry(ctx, "searchrecords", func() error {
+		rrset, err = s.searchRecords(ctx, pattern, maxResult)
+		return err
+	})
+	return rrset, err
+}
+
+func (s *Service) GetUpdatedMasters(ctx context.Context) (dis []*DomainInfo, err error) {
+	err = s.retry(ctx, "getupdatedmasters", func() error {
+		dis, err = s.getUpdatedMasters(ctx)
+		return err
+	})
+	return dis, err
+}
+
+func (s *Service) SetNotified(ctx context.Context, domainID int, serial int) error {
+	return s.retry(ctx, "setnotified", func() error {
+		return s.setNotified(ctx, domainID, serial)
+	})
+}
+
+func (s *Service) SetFresh(ctx context.Context, domainID int) error {
+	return s.retry(ctx, "setfresh", func() error {
+		return s.setFresh(ctx, domainID)
+	})
+}
+
+// SetDomainMetadata при повторе заново очищает и записывает тот же набор значений
+func (s *Service) SetDomainMetadata(ctx context.Context, name string, kind string, meta []string) error {
+	return s.retry(ctx, "setdomainmetadata", func() error {
+		return s.setDomainMetadata(ctx, name, kind, meta)
+	})
+}
+
+func (s *Service) RemoveDomainKey(ctx context.Context, name string, id int) error {
+	return s.retry(ctx, "removedomainkey", func() error {
+		return s.removeDomainKey(ctx, name, id)
+	})
+}
+
+func (s *Service) ActivateDomainKey(ctx context.Context, name string, id int) error {
+	return s.retry(ctx, "activatedomainkey", func() error {
+		return s.activateDomainKey(ctx, name, id)
+	})
+}
+
+func (s *Service) DeactivateDomainKey(ctx context.Context, name string, id int) error {
+	return s.retry(ctx, "deactivatedomainkey", func() error {
+		return s.deactivateDomainKey(ctx, name, id)
+	})
+}
+
+func (s *Service) PublishDomainKey(ctx context.Context, name string, id int) error {
+	return s.retry(ctx, "publishdomainkey", func() error {
+		return s.publishDomainKey(ctx, name, id)
+	})
+}
+
+func (s *Service) UnPublishDomainKey(ctx context.Context, name string, id int) error {
+	return s.retry(ctx, "unpublishdomainkey", func() error {
+		return s.unPublishDomainKey(ctx, name, id)
+	})
+}
+
+// StartTransaction повторяется целиком: пока транзакция не зарегистрирована,
+// неудачная попытка откатывается и ничего не оставляет
+func (s *Service) StartTransaction(ctx context.Context, trxid, domainID int) error {
+	return s.retry(ctx, "starttransaction", func() error {
+		return s.startTransaction(ctx, trxid, domainID)
+	})
+}
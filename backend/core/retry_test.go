@@ -0,0 +1,163 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dqlite "github.com/canonical/go-dqlite/driver"
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// leaderless имитирует выборы лидера: пока fails больше нуля, каждое
+// обращение к базе возвращает err
+type leaderless struct {
+	fails int64
+	err   error
+}
+
+func (l *leaderless) lose(n int64, err error) {
+	l.err = err
+	atomic.StoreInt64(&l.fails, n)
+}
+
+func (l *leaderless) check() error {
+	if atomic.AddInt64(&l.fails, -1) >= 0 {
+		return l.err
+	}
+	atomic.StoreInt64(&l.fails, 0)
+	return nil
+}
+
+type leaderlessConnector struct {
+	drv driver.Driver
+	l   *leaderless
+}
+
+func (c *leaderlessConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.drv.Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	return &leaderlessConn{Conn: conn, l: c.l}, nil
+}
+
+func (c *leaderlessConnector) Driver() driver.Driver { return c.drv }
+
+type leaderlessConn struct {
+	driver.Conn
+	l *leaderless
+}
+
+func (c *leaderlessConn) Prepare(query string) (driver.Stmt, error) {
+	if err := c.l.check(); err != nil {
+		return nil, err
+	}
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &leaderlessStmt{Stmt: stmt, l: c.l}, nil
+}
+
+type leaderlessStmt struct {
+	driver.Stmt
+	l *leaderless
+}
+
+func (s *leaderlessStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.l.check(); err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(args)
+}
+
+func (s *leaderlessStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.l.check(); err != nil {
+		return nil, err
+	}
+	return s.Stmt.Query(args)
+}
+
+func newLeaderlessService(t *testing.T) (*Service, *leaderless) {
+	t.Helper()
+	mem, err := storage.NewMemory()
+	require.NoError(t, err)
+	drv := mem.Driver()
+	mem.Close()
+
+	l := new(leaderless)
+	conn := sql.OpenDB(&leaderlessConnector{drv: drv, l: l})
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, storage.Init(conn))
+	s := New(conn, false)
+	s.SetRetry(Retry{Timeout: 200 * time.Millisecond, Backoff: time.Millisecond})
+	return s, l
+}
+
+func TestRetryable(t *testing.T) {
+	assert.False(t, Retryable(nil))
+	assert.False(t, Retryable(errors.New("no such table")))
+	assert.False(t, Retryable(ErrNotFound))
+	assert.True(t, Retryable(driver.ErrBadConn))
+	assert.True(t, Retryable(errors.Wrap(dqlite.ErrNoAvailableLeader, "open")))
+	assert.True(t, Retryable(dqlite.Error{Code: errIoErrNotLeader, Message: "not leader"}))
+	assert.True(t, Retryable(dqlite.Error{Code: errIoErrLeadershipLost}))
+	assert.True(t, Retryable(dqlite.Error{Code: dqlite.ErrBusy}))
+	assert.False(t, Retryable(dqlite.Error{Code: 19, Message: "UNIQUE constraint failed"}))
+}
+
+func TestRetryLeaderChange(t *testing.T) {
+	ctx := context.Background()
+	s, l := newLeaderlessService(t)
+	id := exampleZone(t, s)
+
+	// Лидер потерян на время нескольких попыток: чтение и идемпотентная запись проходят
+	l.lose(3, dqlite.ErrNoAvailableLeader)
+	rrs, err := s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 1)
+
+	l.lose(3, dqlite.Error{Code: errIoErrLeadershipLost, Message: "leadership lost"})
+	require.NoError(t, s.SetNotified(ctx, id, 2022060102))
+	di, err := s.GetDomainInfo(ctx, "example.com")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2022060102, di.Serial)
+
+	// Добавление зоны не повторяется: повтор мог бы создать её дважды
+	l.lose(1, dqlite.ErrNoAvailableLeader)
+	assert.ErrorIs(t, s.CreateSlaveDomain(ctx, "192.0.2.1", "slave.example.com", ""), dqlite.ErrNoAvailableLeader)
+
+	// Другие ошибки не повторяются
+	_, err = s.List(ctx, "missing.example", -1, false)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRetryBounded(t *testing.T) {
+	ctx := context.Background()
+	s, l := newLeaderlessService(t)
+
+	l.lose(1<<30, dqlite.ErrNoAvailableLeader)
+	start := time.Now()
+	_, err := s.Lookup(ctx, "A", "www.example.com", -1)
+	assert.ErrorIs(t, err, dqlite.ErrNoAvailableLeader)
+	assert.Less(t, time.Since(start), time.Second, "retries stop after Retry.Timeout")
+
+	// Отменённый запрос прекращает повторы сразу
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = s.Lookup(cancelled, "A", "www.example.com", -1)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	s.SetRetry(Retry{})
+	l.lose(1, dqlite.ErrNoAvailableLeader)
+	_, err = s.Lookup(ctx, "A", "www.example.com", -1)
+	assert.ErrorIs(t, err, dqlite.ErrNoAvailableLeader, "zero timeout disables retries")
+}
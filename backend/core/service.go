@@ -1,83 +1,270 @@
 package core
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/ivan-bokov/pdns-dqlite/backend/core/db"
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 type Service struct {
-	dnssec bool
-	db     *sql.DB
-	mu     sync.Mutex
-	tx     map[int]*sql.Tx
+	dnssec  bool
+	db      *sql.DB
+	stmts   *db.Statements
+	mu      sync.Mutex
+	tx      map[int]*transaction
+	closing bool
+	drained chan struct{}
+	cache   *cache
+	node    string
+	// Настройки, которые меняются по SIGHUP во время работы
+	settings sync.RWMutex
+	retries  Retry
+	versions int
 }
 
-func New(db *sql.DB, dnssec bool) *Service {
+// transaction транзакция PowerDNS живёт между запросами, поэтому не привязана
+// к их контексту и держит своё соединение до фиксации или отката
+type transaction struct {
+	conn     *sql.Conn
+	tx       *sql.Tx
+	domainID int
+	domains  map[int]bool // зоны, изменённые в транзакции
+	quotas   *quotas
+	// Полная замена зоны domainID попадает в журнал одной записью при фиксации
+	zone    string
+	before  int // записей в зоне до замены
+	records int
+	ents    int
+}
+
+// end освобождает соединение транзакции после Commit или Rollback
+func (t *transaction) end(err error) error {
+	if cerr := t.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func New(conn *sql.DB, dnssec bool) *Service {
 	return &Service{
-		dnssec: dnssec,
-		db:     db,
-		tx:     map[int]*sql.Tx{},
+		dnssec:   dnssec,
+		db:       conn,
+		stmts:    db.NewStatements(conn),
+		tx:       map[int]*transaction{},
+		retries:  DefaultRetry,
+		versions: DefaultVersions,
 	}
 }
 
-func (s *Service) SetNotified(domainID int, serial int) error {
-	stmt, args, err := db.Prepare(
-		"update-serial-query",
-		"serial", serial,
-		"domain_id", domainID,
-	)
+// Shutdown запрещает новые транзакции и ждёт завершения открытых.
+// Если ctx истекает раньше, оставшиеся транзакции откатываются. Вызывается,
+// пока API ещё принимает запросы: иначе PowerDNS не сможет завершить
+// открытые транзакции. Остальные запросы обслуживаются до Close.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if len(s.tx) != 0 && s.drained == nil {
+		s.drained = make(chan struct{})
+	}
+	drained := s.drained
+	s.mu.Unlock()
+
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "aborted %d open transactions", s.abortAll())
+		}
+	}
+	return nil
+}
+
+// OpenTransactions число открытых транзакций PowerDNS
+func (s *Service) OpenTransactions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tx)
+}
+
+func (s *Service) abortAll() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.tx)
+	for trxid, t := range s.tx {
+		t.end(t.tx.Rollback())
+		delete(s.tx, trxid)
+	}
+	return n
+}
+
+// Close закрывает подготовленные запросы, после остановки API
+func (s *Service) Close() error {
+	return s.stmts.Close()
+}
+
+func (s *Service) query(ctx context.Context, name string, args ...interface{}) (*sql.Rows, error) {
+	stmt, params, err := s.stmts.Stmt(ctx, name, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = s.db.Exec(stmt, args...)
+	return stmt.QueryContext(ctx, params...)
+}
+
+func (s *Service) queryRow(ctx context.Context, name string, args ...interface{}) (*sql.Row, error) {
+	stmt, params, err := s.stmts.Stmt(ctx, name, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return stmt.QueryRowContext(ctx, params...), nil
 }
 
-func (s *Service) setLastCheck(domainID int, lastcheck int64) error {
-	stmt, args, err := db.Prepare(
-		"update-lastcheck-query",
-		"last_check", lastcheck,
-		"domain_id", domainID,
-	)
+func (s *Service) exec(ctx context.Context, name string, args ...interface{}) (sql.Result, error) {
+	stmt, params, err := s.stmts.Stmt(ctx, name, args...)
 	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, params...)
+}
+
+func (s *Service) execTx(ctx context.Context, tx *sql.Tx, name string, args ...interface{}) (sql.Result, error) {
+	stmt, params, err := s.stmts.TxStmt(ctx, tx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, params...)
+}
+
+// scanError пишет в лог строку результата, которую не удалось разобрать и
+// которая пропускается, чтобы не терять остальной ответ
+func scanError(ctx context.Context, err error, fields logrus.Fields) {
+	logging.FromContext(ctx).WithError(err).WithFields(fields).Error("строка результата пропущена")
+}
+
+func (s *Service) transaction(trxid int) (*transaction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tx[trxid]
+	return t, ok
+}
+
+// touch запоминает зону, изменённую в транзакции: при фиксации её номер
+// изменения растёт, сохраняется версия и проверяется квота владельца. Перед
+// первым изменением зоны без версий сохраняется её исходное состояние.
+func (s *Service) touch(ctx context.Context, t *transaction, domainID int) error {
+	if domainID <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	first := !t.domains[domainID]
+	t.domains[domainID] = true
+	s.mu.Unlock()
+	if !first {
+		return nil
+	}
+	if err := t.quotas.watchDomain(ctx, t.tx, domainID); err != nil {
 		return err
 	}
-	_, err = s.db.Exec(stmt, args...)
+	return s.baseline(ctx, t.tx, domainID)
+}
+
+// count учитывает записи, загруженные при полной замене зоны
+func (s *Service) count(t *transaction, records, ents int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.records += records
+	t.ents += ents
+}
+
+// auditEnts пустые нетерминальные имена при полной замене зоны только
+// учитываются, в остальных транзакциях сразу попадают в журнал
+func (s *Service) auditEnts(ctx context.Context, t *transaction, domainID int, nonterm map[string]bool) error {
+	if t.domainID > 0 && domainID == t.domainID {
+		s.count(t, 0, len(nonterm))
+		return nil
+	}
+	zone, err := zoneName(ctx, t.tx, domainID)
 	if err != nil {
 		return err
 	}
-	return nil
+	names := make([]string, 0, len(nonterm))
+	for qname := range nonterm {
+		names = append(names, qname)
+	}
+	sort.Strings(names)
+	return s.audit(ctx, t.tx, "feedents", zone, nil, names)
 }
 
-func (s *Service) SetFresh(domainID int) error {
-	return s.setLastCheck(domainID, time.Now().UTC().Unix())
+func (s *Service) setNotified(ctx context.Context, domainID int, serial int) error {
+	return s.write(ctx, func(tx *sql.Tx) error {
+		zone, before, err := zoneNotify(ctx, tx, domainID)
+		if err != nil {
+			return err
+		}
+		_, err = s.execTx(ctx, tx,
+			"update-serial-query",
+			"serial", serial,
+			"domain_id", domainID,
+		)
+		if err != nil {
+			return err
+		}
+		after := int64(serial)
+		if before.NotifiedSerial != nil && *before.NotifiedSerial == after {
+			// PowerDNS сообщает тот же serial при каждой проверке, журнал не растёт
+			return nil
+		}
+		return s.audit(ctx, tx, "setnotified", zone, &zoneState{NotifiedSerial: before.NotifiedSerial}, &zoneState{NotifiedSerial: &after})
+	})
 }
 
-func (s *Service) Lookup(qtype string, qname string, zoneID int) ([]*DNSResourceRecord, error) {
+func (s *Service) setLastCheck(ctx context.Context, domainID int, lastcheck int64) error {
+	return s.write(ctx, func(tx *sql.Tx) error {
+		zone, before, err := zoneNotify(ctx, tx, domainID)
+		if err != nil {
+			return err
+		}
+		_, err = s.execTx(ctx, tx,
+			"update-lastcheck-query",
+			"last_check", lastcheck,
+			"domain_id", domainID,
+		)
+		if err != nil {
+			return err
+		}
+		if before.LastCheck != nil && *before.LastCheck == lastcheck {
+			return nil
+		}
+		return s.audit(ctx, tx, "setfresh", zone, &zoneState{LastCheck: before.LastCheck}, &zoneState{LastCheck: &lastcheck})
+	})
+}
+
+func (s *Service) setFresh(ctx context.Context, domainID int) error {
+	return s.setLastCheck(ctx, domainID, time.Now().UTC().Unix())
+}
+
+func (s *Service) lookup(ctx context.Context, qtype string, qname string, zoneID int) ([]*DNSResourceRecord, error) {
 	var err error
-	var stmt string
-	var args []interface{}
+	var rows *sql.Rows
 	listRR := make([]*DNSResourceRecord, 0)
 	if qtype != "ANY" {
 		if zoneID < 0 {
-			stmt, args, err = db.Prepare(
+			rows, err = s.query(ctx,
 				"basic-query",
 				"qtype", qtype,
 				"qname", qname,
 			)
 		} else {
-			stmt, args, err = db.Prepare(
+			rows, err = s.query(ctx,
 				"id-query",
 				"qtype", qtype,
 				"qname", qname,
@@ -86,12 +273,12 @@ func (s *Service) Lookup(qtype string, qname string, zoneID int) ([]*DNSResource
 		}
 	} else {
 		if zoneID < 0 {
-			stmt, args, err = db.Prepare(
+			rows, err = s.query(ctx,
 				"any-query",
 				"qname", qname,
 			)
 		} else {
-			stmt, args, err = db.Prepare(
+			rows, err = s.query(ctx,
 				"any-id-query",
 				"qname", qname,
 				"domain_id", zoneID,
@@ -101,43 +288,38 @@ func (s *Service) Lookup(qtype string, qname string, zoneID int) ([]*DNSResource
 	if err != nil {
 		return nil, err
 	}
-	rows, err := s.db.Query(stmt, args...)
+	defer rows.Close()
 	for rows.Next() {
 		rr := new(DNSResourceRecord)
 		err = rows.Scan(&rr.Content, &rr.TTL, &rr.Prio, &rr.Qtype, &rr.DomainID, &rr.Disabled, &rr.Qname, &rr.Auth)
 		if err != nil {
-			//TODO Добавить логирование
+			scanError(ctx, err, logrus.Fields{"method": "lookup", "qname": qname, "qtype": qtype})
 			continue
 		}
 		listRR = append(listRR, rr)
 	}
-	return listRR, err
+	return listRR, rows.Err()
 }
 
-func (s *Service) List(zonename string, domainID int, includeDisabled bool) ([]*DNSResourceRecord, error) {
+func (s *Service) list(ctx context.Context, zonename string, domainID int, includeDisabled bool) ([]*DNSResourceRecord, error) {
 	listRR := make([]*DNSResourceRecord, 0)
 	if domainID < 0 {
-		stmt, args, err := db.Prepare(
+		row, err := s.queryRow(ctx,
 			"get-domain-id",
 			"domain", zonename,
 		)
 		if err != nil {
 			return listRR, err
 		}
-		rows, err := s.db.Query(stmt, args...)
+		err = row.Scan(&domainID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return listRR, errors.Wrapf(ErrNotFound, "Domain %s", zonename)
+		}
 		if err != nil {
 			return listRR, err
 		}
-		if rows.Next() {
-			err = rows.Scan(domainID)
-			if err != nil {
-				return listRR, err
-			}
-		} else {
-			return listRR, errors.New(fmt.Sprintf("Domain not found: %s", zonename))
-		}
 	}
-	stmt, args, err := db.Prepare(
+	rows, err := s.query(ctx,
 		"list-query",
 		"include_disabled", includeDisabled,
 		"domain_id", domainID,
@@ -145,84 +327,142 @@ func (s *Service) List(zonename string, domainID int, includeDisabled bool) ([]*
 	if err != nil {
 		return listRR, err
 	}
-	rows, err := s.db.Query(stmt, args...)
-	if err != nil {
-		return listRR, err
-	}
+	defer rows.Close()
 	for rows.Next() {
 		rr := new(DNSResourceRecord)
-		err = rows.Scan(&rr.Content, &rr.TTL, &rr.Prio, &rr.Qtype, &rr.DomainID, &rr.Disabled, &rr.Qname, &rr.Auth)
+		var ordername sql.NullString
+		err = rows.Scan(&rr.Content, &rr.TTL, &rr.Prio, &rr.Qtype, &rr.DomainID, &rr.Disabled, &rr.Qname, &rr.Auth, &ordername)
 		if err != nil {
-			//TODO Добавить логирование
+			scanError(ctx, err, logrus.Fields{"method": "list", "domain_id": domainID})
 			continue
 		}
+		rr.OrderName = ordername.String
 		listRR = append(listRR, rr)
 	}
-	return listRR, err
+	return listRR, rows.Err()
 }
 
-func (s *Service) GetBeforeAndAfterNamesAbsolute(id int, qname string) error {
+func (s *Service) GetBeforeAndAfterNamesAbsolute(ctx context.Context, id int, qname string) error {
 	if !s.dnssec {
-		return errors.New("Only for DNSSEC")
+		return ErrDNSSECDisabled
 	}
-	return errors.New("No implementation")
+	return ErrNotImplemented
 }
 
-func (s *Service) SetDomainMetadata(name string, kind string, meta []string) error {
+func (s *Service) setDomainMetadata(ctx context.Context, name string, kind string, meta []string) error {
 	if !s.dnssec {
-		return errors.New("Only for DNSSEC")
-	}
-	stmt, args, err := db.Prepare("clear-domain-metadata-query",
-		"domain", name,
-		"kind", kind,
-	)
-	if err != nil {
-		return err
+		return ErrDNSSECDisabled
 	}
-	_, err = s.db.Exec(stmt, args...)
-	errs := make([]error, 0)
-	if len(meta) != 0 {
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		before, err := auditMeta(ctx, tx, name, kind)
+		if err != nil {
+			return err
+		}
+		if _, err = s.execTx(ctx, tx, "clear-domain-metadata-query",
+			"domain", name,
+			"kind", kind,
+		); err != nil {
+			return err
+		}
 		for _, m := range meta {
-			stmt, args, err = db.Prepare("set-domain-metadata-query",
+			_, err = s.execTx(ctx, tx, "set-domain-metadata-query",
 				"kind", kind,
 				"content", m,
 				"domain", name,
 			)
 			if err != nil {
-				errs = append(errs, errors.New(fmt.Sprintf("%v", err)))
-				continue
-			}
-			_, err = s.db.Exec(stmt, args...)
-			if err != nil {
-				errs = append(errs, errors.New(fmt.Sprintf("%v", err)))
+				return errors.Wrapf(err, "Unable to set metadata kind %s for domain %s", kind, name)
 			}
 		}
+		after, err := auditMeta(ctx, tx, name, kind)
+		if err != nil {
+			return err
+		}
+		if equalStrings(before, after) {
+			return nil
+		}
+		if err = s.audit(ctx, tx, "setdomainmetadata", name, map[string][]string{kind: before}, map[string][]string{kind: after}); err != nil {
+			return err
+		}
+		return s.changed(ctx, tx, name)
+	})
+	if err != nil {
+		return err
 	}
-	if len(errs) != 0 {
-		return errors.New(fmt.Sprintf("Unable to set metadata kind %s for domain %s", kind, name))
-	}
+	s.cache.invalidate([]string{name})
 	return nil
 }
 
-func (s *Service) AddDomainKey(name string, key *KeyData) error {
+// AddDomainKey добавляет ключ зоне и записывает его идентификатор в key.ID
+func (s *Service) AddDomainKey(ctx context.Context, name string, key *KeyData) error {
 	if !s.dnssec {
-		return errors.New("Only for DNSSEC")
-	}
-	stmt, args, err := db.Prepare("add-domain-key-query",
-		"domain", name,
-		"flags", key.Flags,
-		"active", key.Active,
-		"published", key.Published,
-		"content", key.Content,
-	)
+		return ErrDNSSECDisabled
+	}
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		res, err := s.execTx(ctx, tx, "add-domain-key-query",
+			"domain", name,
+			"flags", key.Flags,
+			"active", key.Active,
+			"published", key.Published,
+			"content", key.Content,
+		)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errors.Wrapf(ErrNotFound, "Domain %s", name)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		key.ID = int(id)
+		after, err := auditKey(ctx, tx, name, key.ID)
+		if err != nil {
+			return err
+		}
+		if err = s.audit(ctx, tx, "adddomainkey", name, nil, after); err != nil {
+			return err
+		}
+		return s.changed(ctx, tx, name)
+	})
 	if err != nil {
 		return err
 	}
-	_, err = s.db.Exec(stmt, args...)
+	s.cache.invalidate([]string{name})
 	return nil
 }
 
-func (s *Service) FeedRecord(rr *DNSResourceRecord, ordername string) error {
+func (s *Service) FeedRecord(ctx context.Context, trxid int, rr *DNSResourceRecord, ordername string) error {
+	t, ok := s.transaction(trxid)
+	if !ok {
+		return errors.Wrap(ErrNoTransaction, "feedRecord")
+	}
+	if rr.DomainID == 0 {
+		rr.DomainID = t.domainID
+	}
+	if err := s.touch(ctx, t, rr.DomainID); err != nil {
+		return err
+	}
+	if err := s.feedRecord(ctx, t.tx, rr, ordername); err != nil {
+		return err
+	}
+	if t.domainID > 0 && rr.DomainID == t.domainID {
+		s.count(t, 1, 0)
+		return nil
+	}
+	zone, err := zoneName(ctx, t.tx, rr.DomainID)
+	if err != nil {
+		return err
+	}
+	return s.audit(ctx, t.tx, "feedrecord", zone, nil, []*DNSResourceRecord{rr})
+}
+
+func (s *Service) feedRecord(ctx context.Context, tx *sql.Tx, rr *DNSResourceRecord, ordername string) error {
 	var oName interface{}
 	prio := 0
 	auth := true
@@ -241,7 +481,7 @@ func (s *Service) FeedRecord(rr *DNSResourceRecord, ordername string) error {
 	} else {
 		oName = []byte(strings.ToLower(ordername))
 	}
-	stmt, args, err := db.Prepare("insert-record-query",
+	_, err := s.execTx(ctx, tx, "insert-record-query",
 		"content", content,
 		"ttl", rr.TTL,
 		"priority", prio,
@@ -252,43 +492,56 @@ func (s *Service) FeedRecord(rr *DNSResourceRecord, ordername string) error {
 		"auth", auth,
 		"ordername", oName,
 	)
-	if err != nil {
-		return err
-	}
-	_, err = s.db.Exec(stmt, args...)
 	return err
 }
 
-func (s *Service) CreateSlaveDomain(ip string, domain string) error {
-	stmt, args, err := db.Prepare("insert-zone-query",
-		"domain", domain,
-		"account", "",
-		"masters", fmt.Sprintf("%s:53", ip),
-		"type", "SLAVE",
-	)
+// CreateSlaveDomain создаёт вторичную зону от supermaster. Зона получает
+// владельца account из supermasters и учитывается в его квоте.
+func (s *Service) CreateSlaveDomain(ctx context.Context, ip string, domain string, account string) error {
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		q := newQuotas()
+		if err := q.watch(ctx, tx, account); err != nil {
+			return err
+		}
+		master := fmt.Sprintf("%s:53", ip)
+		_, err := s.execTx(ctx, tx, "insert-zone-query",
+			"domain", domain,
+			"account", account,
+			"masters", master,
+			"type", "SLAVE",
+		)
+		if err != nil {
+			return err
+		}
+		if err = q.check(ctx, tx); err != nil {
+			return err
+		}
+		if err = s.audit(ctx, tx, "createslavedomain", domain, nil, &DomainInfo{Zone: domain, Kind: "SLAVE", Master: []string{master}, Account: account}); err != nil {
+			return err
+		}
+		// Сбрасывает закэшированное «зона не найдена»
+		return s.changed(ctx, tx, domain)
+	})
 	if err != nil {
 		return err
 	}
-	_, err = s.db.Exec(stmt, args...)
-	return err
+	s.cache.invalidate([]string{domain})
+	return nil
 }
 
-func (s *Service) GetAllDomainMetadata(name string) (map[string][]string, error) {
+func (s *Service) getAllDomainMetadata(ctx context.Context, name string) (map[string][]string, error) {
 	meta := make(map[string][]string)
-	stmt, args, err := db.Prepare(
+	rows, err := s.query(ctx,
 		"get-all-domain-metadata-query",
 		"domain", name,
 	)
 	if err != nil {
 		return meta, err
 	}
-	rows, err := s.db.Query(stmt, args...)
-	if err != nil {
-		return meta, err
-	}
+	defer rows.Close()
 	for rows.Next() {
 		var m1, m2 string
-		err = rows.Scan(m1, m2)
+		err = rows.Scan(&m1, &m2)
 		if err != nil {
 			return make(map[string][]string), err
 		}
@@ -297,67 +550,71 @@ func (s *Service) GetAllDomainMetadata(name string) (map[string][]string, error)
 		}
 		meta[m1] = append(meta[m1], m2)
 	}
-	return meta, nil
+	return meta, rows.Err()
 }
 
-func (s *Service) GetDomainInfo(name string) (*DomainInfo, error) {
-	stmt, args, err := db.Prepare(
+func (s *Service) getDomainInfo(ctx context.Context, name string) (*DomainInfo, error) {
+	rows, err := s.query(ctx,
 		"info-zone-query",
 		"domain", name,
 	)
 	if err != nil {
 		return new(DomainInfo), err
 	}
-
-	rows, err := s.db.Query(stmt, args...)
-	if err != nil {
-		return new(DomainInfo), err
-	}
+	defer rows.Close()
 	di := new(DomainInfo)
 	if rows.Next() {
-		master := ""
-		err = rows.Scan(&di.ID, &di.Zone, &master, &di.LastCheck, &di.Serial, &di.Kind, &di.Account)
+		var master, account sql.NullString
+		var lastCheck, serial sql.NullInt64
+		err = rows.Scan(&di.ID, &di.Zone, &master, &lastCheck, &serial, &di.Kind, &account)
 		if err != nil {
-			log.Println("[ERROR] " + err.Error())
+			logging.FromContext(ctx).WithError(err).WithField("method", "getdomaininfo").Error("не удалось разобрать строку результата")
 			return new(DomainInfo), err
 		}
-		if master != "" {
-			di.Master = StringTok(master, " ,\t")
+		if master.String != "" {
+			di.Master = StringTok(master.String, " ,\t")
 		}
+		di.LastCheck = lastCheck.Int64
+		di.Serial = serial.Int64
+		di.Account = account.String
 	}
-	return di, nil
+	return di, rows.Err()
 }
 
-func (s *Service) GetAllDomains(includeDisabled bool) ([]*DomainInfo, error) {
-	stmt, args, err := db.Prepare(
+func (s *Service) getAllDomains(ctx context.Context, includeDisabled bool) ([]*DomainInfo, error) {
+	rows, err := s.query(ctx,
 		"get-all-domains-query",
 		"include_disabled", includeDisabled,
 	)
 	if err != nil {
 		return nil, err
 	}
-	rows, err := s.db.Query(stmt, args...)
-	if err != nil {
-		return nil, err
-	}
+	defer rows.Close()
 	dis := make([]*DomainInfo, 0, 10)
 	for rows.Next() {
 		di := new(DomainInfo)
-		master := ""
-		err = rows.Scan(&di.ID, &di.Zone, &master, &di.LastCheck, &di.Serial, &di.Kind, &di.Account)
+		var content, master, account sql.NullString
+		var notifiedSerial, lastCheck sql.NullInt64
+		err = rows.Scan(&di.ID, &di.Zone, &content, &di.Kind, &master, &notifiedSerial, &lastCheck, &account)
 		if err != nil {
-			log.Println("[ERROR] " + err.Error())
+			logging.FromContext(ctx).WithError(err).WithField("method", "getalldomains").Error("не удалось разобрать строку результата")
 			return nil, err
 		}
-		if master != "" {
-			di.Master = StringTok(master, " ,\t")
+		if master.String != "" {
+			di.Master = StringTok(master.String, " ,\t")
 		}
+		if parts := StringTok(content.String, ""); len(parts) > 2 {
+			di.Serial, _ = strconv.ParseInt(parts[2], 10, 64)
+		}
+		di.NotifiedSerial = notifiedSerial.Int64
+		di.LastCheck = lastCheck.Int64
+		di.Account = account.String
 		dis = append(dis, di)
 	}
-	return dis, nil
+	return dis, rows.Err()
 }
-func (s *Service) GetDomainMetadata(name string, kind string) ([]string, error) {
-	stmt, args, err := db.Prepare(
+func (s *Service) getDomainMetadata(ctx context.Context, name string, kind string) ([]string, error) {
+	rows, err := s.query(ctx,
 		"get-domain-metadata-query",
 		"domain", name,
 		"kind", kind,
@@ -365,38 +622,32 @@ func (s *Service) GetDomainMetadata(name string, kind string) ([]string, error)
 	if err != nil {
 		return nil, err
 	}
-	rows, err := s.db.Query(stmt, args...)
-	if err != nil {
-		return nil, err
-	}
+	defer rows.Close()
 	metas := make([]string, 0, 10)
 	for rows.Next() {
 		meta := ""
 		err = rows.Scan(&meta)
 		if err != nil {
-			log.Println("[ERROR] " + err.Error())
+			logging.FromContext(ctx).WithError(err).WithField("method", "getdomainmetadata").Error("не удалось разобрать строку результата")
 			return nil, err
 		}
 		metas = append(metas, meta)
 	}
-	return metas, nil
+	return metas, rows.Err()
 }
 
-func (s *Service) GetDomainKeys(name string) ([]*KeyData, error) {
+func (s *Service) getDomainKeys(ctx context.Context, name string) ([]*KeyData, error) {
 	if !s.dnssec {
-		return nil, errors.New("Only for DNSSEC")
+		return nil, ErrDNSSECDisabled
 	}
-	stmt, args, err := db.Prepare(
+	rows, err := s.query(ctx,
 		"list-domain-keys-query",
 		"domain", name,
 	)
 	if err != nil {
 		return nil, err
 	}
-	rows, err := s.db.Query(stmt, args...)
-	if err != nil {
-		return nil, err
-	}
+	defer rows.Close()
 	keys := make([]*KeyData, 0, 10)
 	for rows.Next() {
 		key := new(KeyData)
@@ -410,111 +661,68 @@ func (s *Service) GetDomainKeys(name string) ([]*KeyData, error) {
 		key.Published = published == "1"
 		keys = append(keys, key)
 	}
-	return keys, nil
+	return keys, rows.Err()
 }
 
-func (s *Service) RemoveDomainKey(name string, id int) error {
-	if !s.dnssec {
-		return errors.New("Only for DNSSEC")
-	}
-	stmt, args, err := db.Prepare(
-		"remove-domain-key-query",
-		"domain", name,
-		"key_id", id,
-	)
-	if err != nil {
-		return err
-	}
-
-	if _, err = s.db.Exec(stmt, args...); err != nil {
-		return err
-	}
-	return nil
+func (s *Service) removeDomainKey(ctx context.Context, name string, id int) error {
+	return s.keyChange(ctx, "removedomainkey", "remove-domain-key-query", name, id)
 }
-func (s *Service) ActivateDomainKey(name string, id int) error {
-	if !s.dnssec {
-		return errors.New("Only for DNSSEC")
-	}
-	stmt, args, err := db.Prepare(
-		"activate-domain-key-query",
-		"domain", name,
-		"key_id", id,
-	)
-	if err != nil {
-		return err
-	}
-
-	if _, err = s.db.Exec(stmt, args...); err != nil {
-		return err
-	}
-	return nil
+func (s *Service) activateDomainKey(ctx context.Context, name string, id int) error {
+	return s.keyChange(ctx, "activatedomainkey", "activate-domain-key-query", name, id)
 }
-func (s *Service) DeactivateDomainKey(name string, id int) error {
-	if !s.dnssec {
-		return errors.New("Only for DNSSEC")
-	}
-	stmt, args, err := db.Prepare(
-		"deactivate-domain-key-query",
-		"domain", name,
-		"key_id", id,
-	)
-	if err != nil {
-		return err
-	}
-
-	if _, err = s.db.Exec(stmt, args...); err != nil {
-		return err
-	}
-	return nil
+func (s *Service) deactivateDomainKey(ctx context.Context, name string, id int) error {
+	return s.keyChange(ctx, "deactivatedomainkey", "deactivate-domain-key-query", name, id)
 }
-func (s *Service) PublishDomainKey(name string, id int) error {
-	if !s.dnssec {
-		return errors.New("Only for DNSSEC")
-	}
-	stmt, args, err := db.Prepare(
-		"publish-domain-key-query",
-		"domain", name,
-		"key_id", id,
-	)
-	if err != nil {
-		return err
-	}
-
-	if _, err = s.db.Exec(stmt, args...); err != nil {
-		return err
-	}
-	return nil
+func (s *Service) publishDomainKey(ctx context.Context, name string, id int) error {
+	return s.keyChange(ctx, "publishdomainkey", "publish-domain-key-query", name, id)
+}
+func (s *Service) unPublishDomainKey(ctx context.Context, name string, id int) error {
+	return s.keyChange(ctx, "unpublishdomainkey", "unpublish-domain-key-query", name, id)
 }
-func (s *Service) UnPublishDomainKey(name string, id int) error {
+
+// keyChange меняет ключ запросом query, пишет в журнал его состояние до и после
+// и отмечает изменение зоны, чтобы остальные узлы сбросили кэш
+func (s *Service) keyChange(ctx context.Context, method, query, name string, id int) error {
 	if !s.dnssec {
-		return errors.New("Only for DNSSEC")
+		return ErrDNSSECDisabled
 	}
-	stmt, args, err := db.Prepare(
-		"unpublish-domain-key-query",
-		"domain", name,
-		"key_id", id,
-	)
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		before, err := auditKey(ctx, tx, name, id)
+		if err != nil {
+			return err
+		}
+		if _, err = s.execTx(ctx, tx, query,
+			"domain", name,
+			"key_id", id,
+		); err != nil {
+			return err
+		}
+		after, err := auditKey(ctx, tx, name, id)
+		if err != nil || before == nil {
+			// Ключа нет, ничего не изменилось
+			return err
+		}
+		if err = s.audit(ctx, tx, method, name, before, after); err != nil {
+			return err
+		}
+		return s.changed(ctx, tx, name)
+	})
 	if err != nil {
 		return err
 	}
-
-	if _, err = s.db.Exec(stmt, args...); err != nil {
-		return err
-	}
+	s.cache.invalidate([]string{name})
 	return nil
 }
-func (s *Service) GetTSIGKey(name string) (*string, *string, error) {
-	stmt, args, err := db.Prepare(
+
+func (s *Service) getTSIGKey(ctx context.Context, name string) (*string, *string, error) {
+	rows, err := s.query(ctx,
 		"get-tsig-key-query",
 		"key_name", name,
 	)
 	if err != nil {
 		return nil, nil, err
 	}
-	rows, err := s.db.Query(stmt, args...)
-	if err != nil {
-		return nil, nil, err
-	}
+	defer rows.Close()
 	var algorithm *string
 	var content *string
 	for rows.Next() {
@@ -525,15 +733,15 @@ func (s *Service) GetTSIGKey(name string) (*string, *string, error) {
 		}
 		if algorithm == nil {
 			algorithm = &row0
-			algorithm = &row1
+			content = &row1
 		}
 	}
-	return algorithm, content, nil
+	return algorithm, content, rows.Err()
 }
 
-func (s *Service) SuperMasterBackend(ip string, domain string, nsset []*DNSResourceRecord) (*string, *string, error) {
+func (s *Service) superMasterBackend(ctx context.Context, ip string, domain string, nsset []*DNSResourceRecord) (*string, *string, error) {
 	for _, rr := range nsset {
-		stmt, args, err := db.Prepare(
+		row, err := s.queryRow(ctx,
 			"supermaster-query",
 			"ip", ip,
 			"nameserver", rr.Content,
@@ -541,30 +749,39 @@ func (s *Service) SuperMasterBackend(ip string, domain string, nsset []*DNSResou
 		if err != nil {
 			return nil, nil, err
 		}
-		rows, err := s.db.Query(stmt, args...)
+		account := ""
+		err = row.Scan(&account)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
 		if err != nil {
 			return nil, nil, err
 		}
-		for rows.Next() {
-			account := ""
-			err = rows.Scan(&account)
-			if err != nil {
-				return nil, nil, err
-			}
-			return &rr.Content, &account, nil
-		}
+		nameserver := rr.Content
+		return &nameserver, &account, nil
 	}
 	return nil, nil, nil
 }
 
-func (s *Service) ReplaceRRSet(trxid, domain_id int, qname string, qt string, rrset []*DNSResourceRecord) error {
-	var tx *sql.Tx
-	var ok bool
-	if tx, ok = s.tx[trxid]; !ok {
-		return errors.New("replaceRRSet called outside of transaction")
+func (s *Service) ReplaceRRSet(ctx context.Context, trxid, domain_id int, qname string, qt string, rrset []*DNSResourceRecord) error {
+	t, ok := s.transaction(trxid)
+	if !ok {
+		return errors.Wrap(ErrNoTransaction, "replaceRRSet")
+	}
+	if err := s.touch(ctx, t, domain_id); err != nil {
+		return err
+	}
+	tx := t.tx
+	zone, err := zoneName(ctx, tx, domain_id)
+	if err != nil {
+		return err
+	}
+	before, err := auditRRSet(ctx, tx, domain_id, qname, qt)
+	if err != nil {
+		return err
 	}
 	if qt != "ANY" {
-		stmt, args, err := db.Prepare(
+		_, err := s.execTx(ctx, tx,
 			"delete-rrset-query",
 			"domain_id", domain_id,
 			"qname", qname,
@@ -573,12 +790,8 @@ func (s *Service) ReplaceRRSet(trxid, domain_id int, qname string, qt string, rr
 		if err != nil {
 			return err
 		}
-		_, err = tx.Exec(stmt, args...)
-		if err != nil {
-			return err
-		}
 	} else {
-		stmt, args, err := db.Prepare(
+		_, err := s.execTx(ctx, tx,
 			"delete-names-query",
 			"domain_id", domain_id,
 			"qname", qname,
@@ -586,13 +799,9 @@ func (s *Service) ReplaceRRSet(trxid, domain_id int, qname string, qt string, rr
 		if err != nil {
 			return err
 		}
-		_, err = tx.Exec(stmt, args...)
-		if err != nil {
-			return err
-		}
 	}
 	if len(rrset) == 0 {
-		stmt, args, err := db.Prepare(
+		_, err := s.execTx(ctx, tx,
 			"delete-comment-rrset-query",
 			"domain_id", domain_id,
 			"qname", qname,
@@ -601,28 +810,32 @@ func (s *Service) ReplaceRRSet(trxid, domain_id int, qname string, qt string, rr
 		if err != nil {
 			return err
 		}
-		_, err = tx.Exec(stmt, args...)
-		if err != nil {
-			return err
-		}
 	}
 	for _, rr := range rrset {
-		err := s.FeedRecord(rr, "")
+		rr.DomainID = domain_id
+		err := s.feedRecord(ctx, tx, rr, "")
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	after, err := auditRRSet(ctx, tx, domain_id, qname, qt)
+	if err != nil {
+		return err
+	}
+	return s.audit(ctx, tx, "replacerrset", zone, before, after)
 }
 
-func (s *Service) FeedEnts(trxid, domain_id int, nonterm map[string]bool) error {
-	var tx *sql.Tx
-	var ok bool
-	if tx, ok = s.tx[trxid]; !ok {
-		return errors.New("replaceRRSet called outside of transaction")
+func (s *Service) FeedEnts(ctx context.Context, trxid, domain_id int, nonterm map[string]bool) error {
+	t, ok := s.transaction(trxid)
+	if !ok {
+		return errors.Wrap(ErrNoTransaction, "feedEnts")
 	}
+	if err := s.touch(ctx, t, domain_id); err != nil {
+		return err
+	}
+	tx := t.tx
 	for qname, auth := range nonterm {
-		stmt, args, err := db.Prepare(
+		_, err := s.execTx(ctx, tx,
 			"insert-empty-non-terminal-order-query",
 			"domain_id", domain_id,
 			"qname", qname,
@@ -632,29 +845,28 @@ func (s *Service) FeedEnts(trxid, domain_id int, nonterm map[string]bool) error
 		if err != nil {
 			return err
 		}
-		_, err = tx.Exec(stmt, args...)
-		if err != nil {
-			return err
-		}
 	}
-	return nil
+	return s.auditEnts(ctx, t, domain_id, nonterm)
 }
-func (s *Service) FeedEnts3(trxid, domain_id int, domain string, nonterm map[string]bool, narrow bool) error {
+func (s *Service) FeedEnts3(ctx context.Context, trxid, domain_id int, domain string, nonterm map[string]bool, narrow bool) error {
 	if !s.dnssec {
-		return errors.New("Only for DNSSEC")
+		return ErrDNSSECDisabled
 	}
-	var tx *sql.Tx
-	var ok bool
-	if tx, ok = s.tx[trxid]; !ok {
-		return errors.New("replaceRRSet called outside of transaction")
+	t, ok := s.transaction(trxid)
+	if !ok {
+		return errors.Wrap(ErrNoTransaction, "feedEnts3")
 	}
+	if err := s.touch(ctx, t, domain_id); err != nil {
+		return err
+	}
+	tx := t.tx
 	var ordername *string
 	for qname, auth := range nonterm {
 		if narrow || !auth {
 			// TODO: Нужно реализовать хэш функцию
 			// ordername =
 		}
-		stmt, args, err := db.Prepare(
+		_, err := s.execTx(ctx, tx,
 			"insert-empty-non-terminal-order-query",
 			"domain_id", domain_id,
 			"qname", qname,
@@ -664,56 +876,134 @@ func (s *Service) FeedEnts3(trxid, domain_id int, domain string, nonterm map[str
 		if err != nil {
 			return err
 		}
-		_, err = tx.Exec(stmt, args...)
-		if err != nil {
-			return err
-		}
 	}
-	return nil
+	return s.auditEnts(ctx, t, domain_id, nonterm)
 }
 
-func (s *Service) StartTransaction(trxid, domain_id int) error {
-	if _, ok := s.tx[trxid]; ok {
-		return errors.New("Транзакция начата")
+func (s *Service) startTransaction(ctx context.Context, trxid, domain_id int) error {
+	s.mu.Lock()
+	err := s.canStart(trxid)
+	s.mu.Unlock()
+	if err != nil {
+		return err
 	}
-	tx, err := s.db.Begin()
+	// Соединение может ждать выборов лидера, поэтому берётся без блокировки
+	// и не дольше, чем позволяет ctx. Сама транзакция переживает запрос и
+	// начинается с фоновым контекстом, иначе database/sql откатит её по ctx.
+	conn, err := s.db.Conn(ctx)
 	if err != nil {
 		return err
 	}
-	s.tx[trxid] = tx
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	t := &transaction{conn: conn, tx: tx, domainID: domain_id, domains: map[int]bool{}, quotas: newQuotas()}
 	if domain_id > 0 {
-		stmt, args, err := db.Prepare(
+		if t.zone, err = zoneName(ctx, tx, domain_id); err == nil {
+			t.before, err = zoneRecords(ctx, tx, domain_id)
+		}
+		if err == nil {
+			err = s.touch(ctx, t, domain_id)
+		}
+		if err != nil {
+			t.end(tx.Rollback())
+			return err
+		}
+		_, err := s.execTx(ctx, tx,
 			"delete-zone-query",
 			"domain_id", domain_id,
 		)
 		if err != nil {
+			t.end(tx.Rollback())
 			return err
 		}
-		_, err = tx.Exec(stmt, args...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.canStart(trxid); err != nil {
+		t.end(tx.Rollback())
+		return err
+	}
+	s.tx[trxid] = t
+	return nil
+}
+
+func (s *Service) canStart(trxid int) error {
+	if s.closing {
+		return ErrShuttingDown
+	}
+	if _, ok := s.tx[trxid]; ok {
+		return ErrTransactionBegun
+	}
+	return nil
+}
+
+func (s *Service) finishTransaction(trxid int) (*transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tx[trxid]
+	if !ok {
+		return nil, ErrNoTransaction
+	}
+	delete(s.tx, trxid)
+	if s.drained != nil && len(s.tx) == 0 {
+		close(s.drained)
+		s.drained = nil
+	}
+	return t, nil
+}
+func (s *Service) CommitTransaction(ctx context.Context, trxid int) error {
+	t, err := s.finishTransaction(trxid)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		// PowerDNS уже не ждёт ответа и сочтёт транзакцию неудачной
+		t.end(t.tx.Rollback())
+		return errors.Wrap(err, "транзакция откачена")
+	}
+	if err = t.quotas.check(ctx, t.tx); err != nil {
+		t.end(t.tx.Rollback())
+		return errors.Wrap(err, "транзакция откачена")
+	}
+	if t.domainID > 0 {
+		err = s.audit(ctx, t.tx, "committransaction", t.zone, &zoneState{Records: &t.before}, &zoneState{Records: &t.records, Ents: &t.ents})
 		if err != nil {
+			t.end(t.tx.Rollback())
 			return err
 		}
 	}
-	return nil
-}
-func (s *Service) CommitTransaction(trxid int) error {
-	if _, ok := s.tx[trxid]; !ok {
-		return errors.New("Транзакция отсутствует")
+	for id := range t.domains {
+		if err = s.snapshot(ctx, t.tx, id, "committransaction"); err != nil {
+			t.end(t.tx.Rollback())
+			return err
+		}
+	}
+	if err = s.changedTx(ctx, t.tx, t.domains); err != nil {
+		t.end(t.tx.Rollback())
+		return err
+	}
+	if err = t.end(t.tx.Commit()); err != nil {
+		return err
+	}
+	if err = s.PollChanges(ctx); err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("кэш не сброшен после транзакции")
 	}
-	tx := s.tx[trxid]
-	return tx.Commit()
+	return nil
 }
-func (s *Service) AbortTransaction(trxid int) error {
-	if _, ok := s.tx[trxid]; !ok {
-		return errors.New("Транзакция отсутствует")
+func (s *Service) AbortTransaction(ctx context.Context, trxid int) error {
+	t, err := s.finishTransaction(trxid)
+	if err != nil {
+		return err
 	}
-	tx := s.tx[trxid]
-	return tx.Rollback()
+	return t.end(t.tx.Rollback())
 }
 
-func (s *Service) SearchRecords(pattern string, maxResult int) ([]*DNSResourceRecord, error) {
+func (s *Service) searchRecords(ctx context.Context, pattern string, maxResult int) ([]*DNSResourceRecord, error) {
 	escapedPattern := Pattern2SQLPattern(pattern)
-	stmt, args, err := db.Prepare(
+	rows, err := s.query(ctx,
 		"search-records-query",
 		"value", escapedPattern,
 		"value2", escapedPattern,
@@ -722,10 +1012,7 @@ func (s *Service) SearchRecords(pattern string, maxResult int) ([]*DNSResourceRe
 	if err != nil {
 		return nil, err
 	}
-	rows, err := s.db.Query(stmt, args...)
-	if err != nil {
-		return nil, err
-	}
+	defer rows.Close()
 	rrset := make([]*DNSResourceRecord, 0, 10)
 	for rows.Next() {
 		rr := new(DNSResourceRecord)
@@ -735,30 +1022,28 @@ func (s *Service) SearchRecords(pattern string, maxResult int) ([]*DNSResourceRe
 		}
 		rrset = append(rrset, rr)
 	}
-	return rrset, nil
+	return rrset, rows.Err()
 }
 
-func (s *Service) GetUpdatedMasters() ([]*DomainInfo, error) {
-	stmt, args, err := db.Prepare(
+func (s *Service) getUpdatedMasters(ctx context.Context) ([]*DomainInfo, error) {
+	rows, err := s.query(ctx,
 		"info-all-master-query",
 	)
 	if err != nil {
 		return nil, err
 	}
-	rows, err := s.db.Query(stmt, args...)
-	if err != nil {
-		return nil, err
-	}
+	defer rows.Close()
 	updatedDomains := make([]*DomainInfo, 0, 10)
 	var parts []string
 	for rows.Next() {
 		di := new(DomainInfo)
 		var content string
-		var notifiedSerial int64
-		err = rows.Scan(&di.ID, &di.Zone, &notifiedSerial, &content)
+		var notified sql.NullInt64
+		err = rows.Scan(&di.ID, &di.Zone, &notified, &content)
 		if err != nil {
 			return nil, err
 		}
+		notifiedSerial := notified.Int64
 		parts = StringTok(content, "")
 		serial := int64(0)
 		if len(parts) > 2 {
@@ -773,13 +1058,14 @@ func (s *Service) GetUpdatedMasters() ([]*DomainInfo, error) {
 			updatedDomains = append(updatedDomains, di)
 		}
 	}
-	return updatedDomains, nil
+	return updatedDomains, rows.Err()
 }
-func (s *Service) GetTest(key string) (string, error) {
-	rows, err := s.db.Query("SELECT value FROM model WHERE key = ?", key)
+func (s *Service) GetTest(ctx context.Context, key string) (string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT value FROM model WHERE key = ?", key)
 	if err != nil {
 		return "", err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		value := ""
 		err = rows.Scan(&value)
@@ -787,8 +1073,8 @@ func (s *Service) GetTest(key string) (string, error) {
 	}
 	return "", nil
 }
-func (s *Service) PostTest(key, value string) error {
-	_, err := s.db.Exec("INSERT OR REPLACE INTO model(key, value) VALUES(?, ?)", key, value)
+func (s *Service) PostTest(ctx context.Context, key, value string) error {
+	_, err := s.db.ExecContext(ctx, "INSERT OR REPLACE INTO model(key, value) VALUES(?, ?)", key, value)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,493 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/core/db"
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestService(t testing.TB, dnssec bool) *Service {
+	t.Helper()
+	conn, err := storage.NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return New(conn, dnssec)
+}
+
+func execQuery(t testing.TB, s *Service, name string, args ...interface{}) {
+	t.Helper()
+	stmt, params, err := db.Prepare(name, args...)
+	require.NoError(t, err)
+	_, err = s.db.Exec(stmt, params...)
+	require.NoError(t, err)
+}
+
+func addZone(t testing.TB, s *Service, name string, kind string) int {
+	t.Helper()
+	execQuery(t, s, "insert-zone-query", "domain", name, "account", "", "masters", "", "type", kind)
+	stmt, args, err := db.Prepare("get-domain-id", "domain", name)
+	require.NoError(t, err)
+	var id int
+	require.NoError(t, s.db.QueryRow(stmt, args...).Scan(&id))
+	return id
+}
+
+func feedZone(t testing.TB, s *Service, domainID int, rrs ...*DNSResourceRecord) {
+	t.Helper()
+	ctx := context.Background()
+	require.NoError(t, s.StartTransaction(ctx, 1, domainID))
+	for _, rr := range rrs {
+		require.NoError(t, s.FeedRecord(ctx, 1, rr, ""))
+	}
+	require.NoError(t, s.CommitTransaction(ctx, 1))
+}
+
+func exampleZone(t testing.TB, s *Service) int {
+	t.Helper()
+	id := addZone(t, s, "example.com", "MASTER")
+	feedZone(t, s, id,
+		&DNSResourceRecord{Qname: "example.com", Qtype: "SOA", TTL: 3600, Content: "ns1.example.com hostmaster.example.com 2022060101 10800 3600 604800 3600"},
+		&DNSResourceRecord{Qname: "example.com", Qtype: "NS", TTL: 3600, Content: "ns1.example.com"},
+		&DNSResourceRecord{Qname: "www.example.com", Qtype: "A", TTL: 300, Content: "192.0.2.1"},
+		&DNSResourceRecord{Qname: "www.example.com", Qtype: "AAAA", TTL: 300, Content: "2001:db8::1"},
+		&DNSResourceRecord{Qname: "old.example.com", Qtype: "A", TTL: 300, Content: "192.0.2.2", Disabled: true},
+	)
+	return id
+}
+
+func qtypes(rrs []*DNSResourceRecord) []string {
+	types := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		types = append(types, rr.Qtype)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func TestServiceLookup(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	id := exampleZone(t, s)
+	other := addZone(t, s, "example.org", "MASTER")
+
+	rrs, err := s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	require.Len(t, rrs, 1)
+	assert.Equal(t, "192.0.2.1", rrs[0].Content)
+	assert.Equal(t, 300, rrs[0].TTL)
+	assert.Equal(t, id, rrs[0].DomainID)
+	assert.True(t, rrs[0].Auth)
+
+	rrs, err = s.Lookup(ctx, "A", "www.example.com", id)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 1)
+
+	rrs, err = s.Lookup(ctx, "A", "www.example.com", other)
+	require.NoError(t, err)
+	assert.Empty(t, rrs)
+
+	rrs, err = s.Lookup(ctx, "ANY", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"A", "AAAA"}, qtypes(rrs))
+
+	rrs, err = s.Lookup(ctx, "ANY", "www.example.com", id)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 2)
+
+	rrs, err = s.Lookup(ctx, "A", "old.example.com", -1)
+	require.NoError(t, err)
+	assert.Empty(t, rrs, "disabled records must not be returned")
+
+	rrs, err = s.Lookup(ctx, "A", "missing.example.com", -1)
+	require.NoError(t, err)
+	assert.NotNil(t, rrs)
+	assert.Empty(t, rrs)
+}
+
+// BenchmarkLookup сравнивает запросы текстом с подготовленными выражениями
+// из кэша Statements на basic-query и id-query. Оба варианта читают строки
+// одинаково и обходят кэш ответов и повторы, чтобы различался только способ
+// выполнения запроса.
+func BenchmarkLookup(b *testing.B) {
+	ctx := context.Background()
+	s := newTestService(b, false)
+	id := exampleZone(b, s)
+	modes := map[string]func(name string, args ...interface{}) (*sql.Rows, error){
+		"raw": func(name string, args ...interface{}) (*sql.Rows, error) {
+			query, params, err := db.Prepare(name, args...)
+			if err != nil {
+				return nil, err
+			}
+			return s.db.QueryContext(ctx, query, params...)
+		},
+		"prepared": func(name string, args ...interface{}) (*sql.Rows, error) {
+			return s.query(ctx, name, args...)
+		},
+	}
+	queries := []struct {
+		name string
+		args []interface{}
+	}{
+		{"basic-query", []interface{}{"qtype", "A", "qname", "www.example.com"}},
+		{"id-query", []interface{}{"qtype", "A", "qname", "www.example.com", "domain_id", id}},
+	}
+	for _, q := range queries {
+		for _, mode := range []string{"raw", "prepared"} {
+			run := modes[mode]
+			b.Run(q.name+"/"+mode, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					rows, err := run(q.name, q.args...)
+					if err != nil {
+						b.Fatal(err)
+					}
+					for rows.Next() {
+						rr := new(DNSResourceRecord)
+						if err = rows.Scan(&rr.Content, &rr.TTL, &rr.Prio, &rr.Qtype, &rr.DomainID, &rr.Disabled, &rr.Qname, &rr.Auth); err != nil {
+							b.Fatal(err)
+						}
+					}
+					if err = rows.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestServiceList(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	id := exampleZone(t, s)
+
+	rrs, err := s.List(ctx, "example.com", id, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"A", "AAAA", "NS", "SOA"}, qtypes(rrs))
+
+	rrs, err = s.List(ctx, "example.com", -1, false)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 4)
+
+	rrs, err = s.List(ctx, "example.com", -1, true)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 5)
+
+	_, err = s.List(ctx, "missing.com", -1, false)
+	assert.Error(t, err)
+}
+
+func TestServiceDomainInfo(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	id := exampleZone(t, s)
+	require.NoError(t, s.CreateSlaveDomain(ctx, "192.0.2.53", "slave.com", ""))
+
+	di, err := s.GetDomainInfo(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id, di.ID)
+	assert.Equal(t, "example.com", di.Zone)
+	assert.Equal(t, "MASTER", di.Kind)
+	assert.Empty(t, di.Master)
+
+	di, err = s.GetDomainInfo(ctx, "slave.com")
+	require.NoError(t, err)
+	assert.Equal(t, "SLAVE", di.Kind)
+	assert.Equal(t, []string{"192.0.2.53:53"}, di.Master)
+
+	require.NoError(t, s.SetFresh(ctx, di.ID))
+	di, err = s.GetDomainInfo(ctx, "slave.com")
+	require.NoError(t, err)
+	assert.NotZero(t, di.LastCheck)
+
+	di, err = s.GetDomainInfo(ctx, "missing.com")
+	require.NoError(t, err)
+	assert.Zero(t, di.ID)
+
+	dis, err := s.GetAllDomains(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, dis, 2)
+	assert.Equal(t, "example.com", dis[0].Zone)
+	assert.Equal(t, int64(2022060101), dis[0].Serial)
+
+	dis, err = s.GetAllDomains(ctx, false)
+	require.NoError(t, err)
+	assert.Len(t, dis, 1, "zones without SOA are listed only with includeDisabled")
+}
+
+func TestServiceUpdatedMasters(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	id := exampleZone(t, s)
+
+	dis, err := s.GetUpdatedMasters(ctx)
+	require.NoError(t, err)
+	require.Len(t, dis, 1)
+	assert.Equal(t, id, dis[0].ID)
+	assert.Equal(t, int64(2022060101), dis[0].Serial)
+	assert.Zero(t, dis[0].NotifiedSerial)
+
+	require.NoError(t, s.SetNotified(ctx, id, 2022060101))
+	dis, err = s.GetUpdatedMasters(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, dis)
+}
+
+func TestServiceDomainMetadata(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	exampleZone(t, s)
+	assert.Error(t, s.SetDomainMetadata(ctx, "example.com", "ALSO-NOTIFY", []string{"192.0.2.10"}))
+
+	s = newTestService(t, true)
+	exampleZone(t, s)
+	require.NoError(t, s.SetDomainMetadata(ctx, "example.com", "ALSO-NOTIFY", []string{"192.0.2.10", "192.0.2.11"}))
+	require.NoError(t, s.SetDomainMetadata(ctx, "example.com", "SOA-EDIT", []string{"INCEPTION-INCREMENT"}))
+
+	meta, err := s.GetDomainMetadata(ctx, "example.com", "ALSO-NOTIFY")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"192.0.2.10", "192.0.2.11"}, meta)
+
+	all, err := s.GetAllDomainMetadata(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+	assert.Equal(t, []string{"INCEPTION-INCREMENT"}, all["SOA-EDIT"])
+
+	require.NoError(t, s.SetDomainMetadata(ctx, "example.com", "ALSO-NOTIFY", nil))
+	meta, err = s.GetDomainMetadata(ctx, "example.com", "ALSO-NOTIFY")
+	require.NoError(t, err)
+	assert.Empty(t, meta)
+
+	meta, err = s.GetDomainMetadata(ctx, "missing.com", "SOA-EDIT")
+	require.NoError(t, err)
+	assert.Empty(t, meta)
+}
+
+func TestServiceDomainKeys(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	exampleZone(t, s)
+	assert.Error(t, s.AddDomainKey(ctx, "example.com", &KeyData{Flags: 257}))
+	_, err := s.GetDomainKeys(ctx, "example.com")
+	assert.Error(t, err)
+
+	s = newTestService(t, true)
+	exampleZone(t, s)
+	require.NoError(t, s.AddDomainKey(ctx, "example.com", &KeyData{Flags: 257, Active: true, Published: true, Content: "ksk"}))
+	require.NoError(t, s.AddDomainKey(ctx, "example.com", &KeyData{Flags: 256, Active: false, Published: true, Content: "zsk"}))
+	missing := &KeyData{Flags: 257, Active: true, Content: "ksk"}
+	assert.ErrorIs(t, s.AddDomainKey(ctx, "missing.example", missing), ErrNotFound, "key for a missing zone is not reported as added")
+	assert.Zero(t, missing.ID)
+
+	keys, err := s.GetDomainKeys(ctx, "example.com")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	ksk, zsk := keys[0], keys[1]
+	assert.Equal(t, 257, ksk.Flags)
+	assert.True(t, ksk.Active)
+	assert.Equal(t, "zsk", zsk.Content)
+	assert.False(t, zsk.Active)
+
+	require.NoError(t, s.ActivateDomainKey(ctx, "example.com", zsk.ID))
+	require.NoError(t, s.DeactivateDomainKey(ctx, "example.com", ksk.ID))
+	require.NoError(t, s.UnPublishDomainKey(ctx, "example.com", ksk.ID))
+	keys, err = s.GetDomainKeys(ctx, "example.com")
+	require.NoError(t, err)
+	assert.False(t, keys[0].Active)
+	assert.False(t, keys[0].Published)
+	assert.True(t, keys[1].Active)
+
+	require.NoError(t, s.PublishDomainKey(ctx, "example.com", ksk.ID))
+	require.NoError(t, s.RemoveDomainKey(ctx, "example.com", zsk.ID))
+	keys, err = s.GetDomainKeys(ctx, "example.com")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.True(t, keys[0].Published)
+
+	keys, err = s.GetDomainKeys(ctx, "missing.com")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestServiceTransactions(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	id := exampleZone(t, s)
+
+	assert.Error(t, s.CommitTransaction(ctx, 7))
+	assert.Error(t, s.AbortTransaction(ctx, 7))
+	assert.Error(t, s.FeedRecord(ctx, 7, &DNSResourceRecord{Qname: "a.example.com", Qtype: "A", Content: "192.0.2.3"}, ""))
+	assert.Error(t, s.ReplaceRRSet(ctx, 7, id, "www.example.com", "A", nil))
+	assert.Error(t, s.FeedEnts(ctx, 7, id, map[string]bool{"b.example.com": true}))
+
+	// Прерванная транзакция не должна удалять зону
+	require.NoError(t, s.StartTransaction(ctx, 7, id))
+	assert.Error(t, s.StartTransaction(ctx, 7, id))
+	require.NoError(t, s.AbortTransaction(ctx, 7))
+	rrs, err := s.List(ctx, "example.com", id, true)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 5)
+
+	// Транзакция с domain_id заменяет содержимое зоны целиком
+	feedZone(t, s, id, &DNSResourceRecord{Qname: "example.com", Qtype: "SOA", TTL: 3600, Content: "ns1.example.com hostmaster.example.com 2022060102 10800 3600 604800 3600"})
+	rrs, err = s.List(ctx, "example.com", id, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"SOA"}, qtypes(rrs))
+
+	require.NoError(t, s.StartTransaction(ctx, 8, -1))
+	require.NoError(t, s.ReplaceRRSet(ctx, 8, id, "www.example.com", "A", []*DNSResourceRecord{
+		{Qname: "www.example.com", Qtype: "A", TTL: 60, Content: "192.0.2.7"},
+		{Qname: "www.example.com", Qtype: "A", TTL: 60, Content: "192.0.2.8"},
+	}))
+	require.NoError(t, s.FeedEnts(ctx, 8, id, map[string]bool{"sub.example.com": true}))
+	require.NoError(t, s.CommitTransaction(ctx, 8))
+
+	rrs, err = s.Lookup(ctx, "A", "www.example.com", id)
+	require.NoError(t, err)
+	require.Len(t, rrs, 2)
+	assert.Equal(t, 60, rrs[0].TTL)
+
+	require.NoError(t, s.StartTransaction(ctx, 9, -1))
+	require.NoError(t, s.ReplaceRRSet(ctx, 9, id, "www.example.com", "A", nil))
+	require.NoError(t, s.CommitTransaction(ctx, 9))
+	rrs, err = s.Lookup(ctx, "A", "www.example.com", id)
+	require.NoError(t, err)
+	assert.Empty(t, rrs)
+}
+
+func TestServiceSuperMasterBackend(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	execQuery(t, s, "supermaster-add", "ip", "192.0.2.53", "nameserver", "ns2.example.net", "account", "team-a")
+
+	nsset := []*DNSResourceRecord{
+		{Qname: "example.net", Qtype: "NS", Content: "ns1.example.net"},
+		{Qname: "example.net", Qtype: "NS", Content: "ns2.example.net"},
+	}
+	ns, account, err := s.SuperMasterBackend(ctx, "192.0.2.53", "example.net", nsset)
+	require.NoError(t, err)
+	require.NotNil(t, ns)
+	assert.Equal(t, "ns2.example.net", *ns)
+	assert.Equal(t, "team-a", *account)
+
+	ns, account, err = s.SuperMasterBackend(ctx, "192.0.2.54", "example.net", nsset)
+	require.NoError(t, err)
+	assert.Nil(t, ns)
+	assert.Nil(t, account)
+}
+
+func TestServiceSearchRecords(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	exampleZone(t, s)
+
+	rrs, err := s.SearchRecords(ctx, "www.*", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"A", "AAAA"}, qtypes(rrs))
+
+	rrs, err = s.SearchRecords(ctx, "192.0.2.?", 10)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 2)
+
+	rrs, err = s.SearchRecords(ctx, "*example.com", 2)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 2)
+
+	rrs, err = s.SearchRecords(ctx, "www_example_com", 10)
+	require.NoError(t, err)
+	assert.Empty(t, rrs, "_ must be matched literally")
+}
+
+func TestServiceGetTSIGKey(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	execQuery(t, s, "set-tsig-key-query", "key_name", "transfer", "algorithm", "hmac-sha256", "content", "c2VjcmV0")
+
+	alg, content, err := s.GetTSIGKey(ctx, "transfer")
+	require.NoError(t, err)
+	require.NotNil(t, alg)
+	assert.Equal(t, "hmac-sha256", *alg)
+	assert.Equal(t, "c2VjcmV0", *content)
+
+	alg, content, err = s.GetTSIGKey(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, alg)
+	assert.Nil(t, content)
+}
+
+func TestServiceShutdown(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	id := exampleZone(t, s)
+	require.NoError(t, s.StartTransaction(ctx, 1, -1))
+	require.NoError(t, s.FeedRecord(ctx, 1, &DNSResourceRecord{Qname: "new.example.com", Qtype: "A", Content: "192.0.2.9", DomainID: id}, ""))
+
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.closing
+	}, time.Second, time.Millisecond)
+	assert.Error(t, s.StartTransaction(ctx, 2, -1), "no new transactions while shutting down")
+	require.NoError(t, s.CommitTransaction(ctx, 1))
+	require.NoError(t, <-done)
+
+	rrs, err := s.Lookup(ctx, "A", "new.example.com", -1)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 1, "open transaction is drained, not lost")
+}
+
+func TestServiceShutdownTimeout(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	id := exampleZone(t, s)
+	require.NoError(t, s.StartTransaction(ctx, 1, id))
+
+	shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(shutdown), context.DeadlineExceeded)
+	assert.Error(t, s.CommitTransaction(ctx, 1), "transaction was aborted")
+
+	rrs, err := s.List(ctx, "example.com", id, true)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 5, "aborted transaction must not delete the zone")
+}
+
+func TestServiceContext(t *testing.T) {
+	s := newTestService(t, false)
+	id := exampleZone(t, s)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.Lookup(cancelled, "A", "www.example.com", -1)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Транзакция переживает запрос, в котором началась
+	start, cancel := context.WithCancel(context.Background())
+	require.NoError(t, s.StartTransaction(start, 1, id))
+	cancel()
+	ctx := context.Background()
+	require.NoError(t, s.FeedRecord(ctx, 1, &DNSResourceRecord{Qname: "new.example.com", Qtype: "A", TTL: 300, Content: "192.0.2.9"}, ""))
+	require.NoError(t, s.CommitTransaction(ctx, 1))
+	rrs, err := s.Lookup(ctx, "A", "new.example.com", -1)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 1)
+
+	// PowerDNS не дождался фиксации: транзакция откатывается
+	require.NoError(t, s.StartTransaction(ctx, 2, id))
+	assert.ErrorIs(t, s.CommitTransaction(cancelled, 2), context.Canceled)
+	assert.Zero(t, s.OpenTransactions())
+	rrs, err = s.List(ctx, "example.com", id, true)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 1, "rolled back transaction must not delete the zone")
+}
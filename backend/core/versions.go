@@ -0,0 +1,338 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/pkg/errors"
+)
+
+// После каждой транзакции, изменившей зону, в zone_versions сохраняется
+// снимок всех её записей. Перед первым изменением зоны без версий снимается
+// исходное состояние, поэтому зону можно вернуть и после первой неудачной
+// загрузки. Хранятся последние versions версий каждой зоны.
+const (
+	versionRecordsQuery = "SELECT name, COALESCE(type, ''), COALESCE(content, ''), COALESCE(ttl, 0), COALESCE(prio, 0), disabled, COALESCE(ordername, ''), auth FROM records WHERE domain_id = ? ORDER BY name, type, content"
+	insertVersionQuery  = "INSERT INTO zone_versions (domain_id, serial, at, node, caller, method, size, records) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	pruneVersionsQuery  = "DELETE FROM zone_versions WHERE domain_id = ? AND id NOT IN (SELECT id FROM zone_versions WHERE domain_id = ? ORDER BY id DESC LIMIT ?)"
+	countVersionsQuery  = "SELECT count(*) FROM zone_versions WHERE domain_id = ?"
+	listVersionsQuery   = "SELECT id, serial, at, node, caller, method, size FROM zone_versions WHERE domain_id = ? ORDER BY id"
+	serialVersionQuery  = "SELECT id, serial, at, node, caller, method, size, records FROM zone_versions WHERE domain_id = ? AND serial = ? ORDER BY id DESC LIMIT 1"
+	latestVersionQuery  = "SELECT id, serial, at, node, caller, method, size, records FROM zone_versions WHERE domain_id = ? ORDER BY id DESC LIMIT 1"
+	zoneIDQuery         = "SELECT id FROM domains WHERE name = ?"
+	restoreRecordQuery  = "INSERT INTO records (domain_id, name, type, content, ttl, prio, disabled, ordername, auth) VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?, ?)"
+)
+
+// DefaultVersions сколько версий каждой зоны хранится по умолчанию
+const DefaultVersions = 20
+
+// Version сохранённая версия зоны
+type Version struct {
+	ID      int64     `json:"id"`
+	Serial  int64     `json:"serial"`
+	Time    time.Time `json:"time"`
+	Node    string    `json:"node"`
+	Caller  string    `json:"caller"`
+	Method  string    `json:"method"`
+	Records int       `json:"records"`
+
+	records []*DNSResourceRecord
+}
+
+// Diff записи, которые появились и исчезли между версиями From и To
+type Diff struct {
+	From    int64                `json:"from"`
+	To      int64                `json:"to"`
+	Added   []*DNSResourceRecord `json:"added"`
+	Removed []*DNSResourceRecord `json:"removed"`
+}
+
+// SetVersions задаёт, сколько версий каждой зоны хранить, ноль отключает версии
+func (s *Service) SetVersions(keep int) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.versions = keep
+}
+
+func (s *Service) keepVersions() int {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.versions
+}
+
+func zoneID(ctx context.Context, q querier, zone string) (int, error) {
+	var id int
+	err := q.QueryRowContext(ctx, zoneIDQuery, strings.TrimSuffix(zone, ".")).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errors.Wrapf(ErrNotFound, "Domain %s", zone)
+	}
+	return id, err
+}
+
+// zoneSnapshot все записи зоны, включая пустые нетерминальные имена
+func zoneSnapshot(ctx context.Context, q querier, domainID int) ([]*DNSResourceRecord, error) {
+	rows, err := q.QueryContext(ctx, versionRecordsQuery, domainID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]*DNSResourceRecord, 0)
+	for rows.Next() {
+		rr := new(DNSResourceRecord)
+		err = rows.Scan(&rr.Qname, &rr.Qtype, &rr.Content, &rr.TTL, &rr.Prio, &rr.Disabled, &rr.OrderName, &rr.Auth)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rr)
+	}
+	return records, rows.Err()
+}
+
+// soaSerial серийный номер из SOA записи зоны, 0 если её нет
+func soaSerial(records []*DNSResourceRecord) int64 {
+	for _, rr := range records {
+		if rr.Qtype != "SOA" {
+			continue
+		}
+		if parts := StringTok(rr.Content, ""); len(parts) > 2 {
+			serial, _ := strconv.ParseInt(parts[2], 10, 64)
+			return serial
+		}
+	}
+	return 0
+}
+
+// snapshot сохраняет текущее состояние зоны как новую версию
+func (s *Service) snapshot(ctx context.Context, tx *sql.Tx, domainID int, method string) error {
+	keep := s.keepVersions()
+	if keep <= 0 {
+		return nil
+	}
+	records, err := zoneSnapshot(ctx, tx, domainID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, insertVersionQuery, domainID, soaSerial(records), time.Now().Unix(),
+		s.node, audit.Caller(ctx), method, len(records), string(data))
+	if err != nil {
+		return errors.Wrap(err, "не удалось сохранить версию зоны")
+	}
+	_, err = tx.ExecContext(ctx, pruneVersionsQuery, domainID, domainID, keep)
+	return errors.Wrap(err, "не удалось удалить старые версии зоны")
+}
+
+// baseline сохраняет исходное состояние зоны, у которой ещё нет версий
+func (s *Service) baseline(ctx context.Context, tx *sql.Tx, domainID int) error {
+	if s.keepVersions() <= 0 || domainID <= 0 {
+		return nil
+	}
+	var n int
+	if err := tx.QueryRowContext(ctx, countVersionsQuery, domainID).Scan(&n); err != nil {
+		return err
+	}
+	if n != 0 {
+		return nil
+	}
+	return s.snapshot(ctx, tx, domainID, "baseline")
+}
+
+func scanVersion(scan func(dest ...interface{}) error, withRecords bool) (*Version, error) {
+	v := new(Version)
+	var at int64
+	var caller sql.NullString
+	var data string
+	dest := []interface{}{&v.ID, &v.Serial, &at, &v.Node, &caller, &v.Method, &v.Records}
+	if withRecords {
+		dest = append(dest, &data)
+	}
+	if err := scan(dest...); err != nil {
+		return nil, err
+	}
+	v.Time, v.Caller = time.Unix(at, 0).UTC(), caller.String
+	if withRecords {
+		if err := json.Unmarshal([]byte(data), &v.records); err != nil {
+			return nil, errors.Wrapf(err, "версия %d повреждена", v.ID)
+		}
+	}
+	return v, nil
+}
+
+// version версия зоны с серийным номером serial (последняя из них), ноль даёт последнюю версию
+func version(ctx context.Context, q querier, domainID int, serial int64) (*Version, error) {
+	var row *sql.Row
+	if serial == 0 {
+		row = q.QueryRowContext(ctx, latestVersionQuery, domainID)
+	} else {
+		row = q.QueryRowContext(ctx, serialVersionQuery, domainID, serial)
+	}
+	v, err := scanVersion(row.Scan, true)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.Wrapf(ErrNotFound, "версия с serial %d", serial)
+	}
+	return v, err
+}
+
+// Versions сохранённые версии зоны, от старых к новым
+func (s *Service) Versions(ctx context.Context, zone string) ([]*Version, error) {
+	id, err := zoneID(ctx, s.db, zone)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, listVersionsQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := make([]*Version, 0)
+	for rows.Next() {
+		v, err := scanVersion(rows.Scan, false)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// Diff изменения записей зоны между версиями с серийными номерами from и to.
+// Нулевой to сравнивает с последней версией.
+func (s *Service) Diff(ctx context.Context, zone string, from, to int64) (*Diff, error) {
+	id, err := zoneID(ctx, s.db, zone)
+	if err != nil {
+		return nil, err
+	}
+	old, err := version(ctx, s.db, id, from)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := version(ctx, s.db, id, to)
+	if err != nil {
+		return nil, err
+	}
+	return &Diff{
+		From:    old.Serial,
+		To:      cur.Serial,
+		Added:   subtract(cur.records, old.records),
+		Removed: subtract(old.records, cur.records),
+	}, nil
+}
+
+func recordKey(rr *DNSResourceRecord) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%d\x00%t", strings.ToLower(rr.Qname), rr.Qtype, rr.Content, rr.TTL, rr.Prio, rr.Disabled)
+}
+
+// subtract записи a, которых нет в b. Пустые нетерминальные имена не сравниваются.
+func subtract(a, b []*DNSResourceRecord) []*DNSResourceRecord {
+	seen := make(map[string]int, len(b))
+	for _, rr := range b {
+		seen[recordKey(rr)]++
+	}
+	diff := make([]*DNSResourceRecord, 0)
+	for _, rr := range a {
+		if rr.Qtype == "" {
+			continue
+		}
+		key := recordKey(rr)
+		if seen[key] > 0 {
+			seen[key]--
+			continue
+		}
+		diff = append(diff, &DNSResourceRecord{Qname: rr.Qname, Qtype: rr.Qtype, Content: rr.Content, TTL: rr.TTL, Prio: rr.Prio, Disabled: rr.Disabled})
+	}
+	sort.SliceStable(diff, func(i, j int) bool { return recordKey(diff[i]) < recordKey(diff[j]) })
+	return diff
+}
+
+// bumpSerial ставит в SOA записи серийный номер больше after, чтобы вторичные
+// серверы забрали восстановленную зону
+func bumpSerial(records []*DNSResourceRecord, after int64) []*DNSResourceRecord {
+	bumped := make([]*DNSResourceRecord, len(records))
+	for i, rr := range records {
+		bumped[i] = rr
+		if rr.Qtype != "SOA" {
+			continue
+		}
+		parts := StringTok(rr.Content, "")
+		if len(parts) < 3 {
+			continue
+		}
+		if serial, err := strconv.ParseInt(parts[2], 10, 64); err == nil && serial > after {
+			continue
+		}
+		parts[2] = strconv.FormatInt(after+1, 10)
+		soa := *rr
+		soa.Content = strings.Join(parts, " ")
+		bumped[i] = &soa
+	}
+	return bumped
+}
+
+// Rollback возвращает записи зоны к версии с серийным номером serial одной
+// транзакцией. Серийный номер SOA становится больше текущего, восстановление
+// сохраняется как новая версия.
+func (s *Service) Rollback(ctx context.Context, zone string, serial int64) (*Version, error) {
+	var restored *Version
+	var id int
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		var err error
+		if id, err = zoneID(ctx, tx, zone); err != nil {
+			return err
+		}
+		target, err := version(ctx, tx, id, serial)
+		if err != nil {
+			return err
+		}
+		current, err := zoneSnapshot(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		q := newQuotas()
+		if err = q.watchDomain(ctx, tx, id); err != nil {
+			return err
+		}
+		if _, err = s.execTx(ctx, tx, "delete-zone-query", "domain_id", id); err != nil {
+			return err
+		}
+		records := bumpSerial(target.records, soaSerial(current))
+		for _, rr := range records {
+			var ordername interface{}
+			if rr.OrderName != "" {
+				ordername = []byte(rr.OrderName)
+			}
+			_, err = tx.ExecContext(ctx, restoreRecordQuery, id, rr.Qname, rr.Qtype, rr.Content, rr.TTL, rr.Prio, rr.Disabled, ordername, rr.Auth)
+			if err != nil {
+				return errors.Wrap(err, "не удалось восстановить запись")
+			}
+		}
+		if err = q.check(ctx, tx); err != nil {
+			return err
+		}
+		if err = s.snapshot(ctx, tx, id, "rollback"); err != nil {
+			return err
+		}
+		before, after := len(current), len(records)
+		if err = s.audit(ctx, tx, "rollback", zone, &zoneState{Records: &before}, &zoneState{Records: &after}); err != nil {
+			return err
+		}
+		if restored, err = version(ctx, tx, id, 0); err != nil {
+			return err
+		}
+		return s.changedTx(ctx, tx, map[int]bool{id: true})
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.cache.invalidate([]string{zone})
+	return restored, nil
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const soa = "ns1.example.com hostmaster.example.com %d 10800 3600 604800 3600"
+
+func TestVersionsRollback(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	s.EnableCache(CacheConfig{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute})
+	id := exampleZone(t, s)
+
+	// Неудачная загрузка зоны оставила только SOA
+	feedZone(t, s, id, &DNSResourceRecord{Qname: "example.com", Qtype: "SOA", TTL: 3600,
+		Content: fmt.Sprintf(soa, 2022060102)})
+	rrs, err := s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	require.Empty(t, rrs)
+
+	versions, err := s.Versions(ctx, "example.com.")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, "baseline", versions[0].Method)
+	assert.Zero(t, versions[0].Records, "zone was empty before the first transfer")
+	assert.EqualValues(t, 2022060101, versions[1].Serial)
+	assert.Equal(t, 5, versions[1].Records)
+	assert.EqualValues(t, 2022060102, versions[2].Serial)
+	assert.Equal(t, "committransaction", versions[2].Method)
+
+	diff, err := s.Diff(ctx, "example.com", 2022060101, 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2022060102, diff.To)
+	assert.Equal(t, []string{"SOA"}, qtypes(diff.Added))
+	assert.Equal(t, []string{"A", "A", "AAAA", "NS", "SOA"}, qtypes(diff.Removed))
+	same, err := s.Diff(ctx, "example.com", 2022060102, 2022060102)
+	require.NoError(t, err)
+	assert.Empty(t, same.Added)
+	assert.Empty(t, same.Removed)
+
+	restored, err := s.Rollback(ctx, "example.com", 2022060101)
+	require.NoError(t, err)
+	assert.Equal(t, "rollback", restored.Method)
+	assert.EqualValues(t, 2022060103, restored.Serial, "serial moves forward for secondaries")
+	rrs, err = s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	require.Len(t, rrs, 1, "cached empty answer is dropped")
+	assert.Equal(t, "192.0.2.1", rrs[0].Content)
+	list, err := s.List(ctx, "example.com", -1, true)
+	require.NoError(t, err)
+	assert.Len(t, list, 5)
+
+	diff, err = s.Diff(ctx, "example.com", 2022060101, 2022060103)
+	require.NoError(t, err)
+	require.Len(t, diff.Added, 1)
+	assert.Contains(t, diff.Added[0].Content, "2022060103")
+	assert.Len(t, auditEntries(t, s, "rollback"), 1)
+
+	_, err = s.Rollback(ctx, "example.com", 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.Versions(ctx, "missing.example")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestVersionsKeep(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	s.SetVersions(2)
+	id := exampleZone(t, s)
+	for serial := 2022060102; serial < 2022060105; serial++ {
+		feedZone(t, s, id, &DNSResourceRecord{Qname: "example.com", Qtype: "SOA", TTL: 3600,
+			Content: fmt.Sprintf(soa, serial)})
+	}
+	versions, err := s.Versions(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	s.SetVersions(0)
+	other := addZone(t, s, "example.org", "MASTER")
+	feedZone(t, s, other, &DNSResourceRecord{Qname: "example.org", Qtype: "NS", TTL: 3600, Content: "ns1.example.org"})
+	versions, err = s.Versions(ctx, "example.org")
+	require.NoError(t, err)
+	assert.Empty(t, versions, "versions are disabled")
+}
@@ -0,0 +1,314 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Управление зонами через HTTP API без участия PowerDNS. Каждый вызов
+// выполняется одной транзакцией базы вместе с журналом, версией зоны и
+// отметкой изменения для кэша.
+
+const (
+	soaRecordQuery      = "SELECT id, content FROM records WHERE domain_id = ? AND name = ? AND type = 'SOA'"
+	updateContentQuery  = "UPDATE records SET content = ? WHERE id = ?"
+	deleteVersionsQuery = "DELETE FROM zone_versions WHERE domain_id = ?"
+)
+
+// Kinds типы зон в таблице domains
+var Kinds = []string{"NATIVE", "MASTER", "SLAVE"}
+
+// RRSetChange изменение набора записей одного имени и типа: Replace заменяет
+// записи на Records, иначе набор удаляется
+type RRSetChange struct {
+	Name    string
+	Type    string
+	Replace bool
+	Records []*DNSResourceRecord
+}
+
+// Zone зона для создания и изменения через HTTP API
+type Zone struct {
+	Name    string
+	Kind    string
+	Masters []string
+	Account string
+}
+
+func validKind(kind string) error {
+	for _, k := range Kinds {
+		if k == kind {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrInvalid, "тип зоны %q, ожидается NATIVE, MASTER или SLAVE", kind)
+}
+
+// inZoneName имя name принадлежит зоне zone, имена без точки в конце
+func inZoneName(name, zone string) bool {
+	return inZone(normalize(name), normalize(zone))
+}
+
+func (s *Service) insertRecords(ctx context.Context, tx *sql.Tx, domainID int, zone string, records []*DNSResourceRecord) error {
+	for _, rr := range records {
+		if !inZoneName(rr.Qname, zone) {
+			return errors.Wrapf(ErrInvalid, "имя %s вне зоны %s", rr.Qname, zone)
+		}
+		if rr.Qtype == "" || rr.Content == "" {
+			return errors.Wrapf(ErrInvalid, "у записи %s нет типа или содержимого", rr.Qname)
+		}
+		rr.DomainID = domainID
+		if err := s.feedRecord(ctx, tx, rr, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// increaseSerial увеличивает серийный номер SOA зоны на единицу, как
+// soa-edit-api INCREASE в PowerDNS
+func increaseSerial(ctx context.Context, tx *sql.Tx, domainID int, zone string) error {
+	var id int
+	var content string
+	err := tx.QueryRowContext(ctx, soaRecordQuery, domainID, zone).Scan(&id, &content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	parts := StringTok(content, "")
+	if len(parts) < 3 {
+		return nil
+	}
+	serial, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil
+	}
+	parts[2] = strconv.FormatInt(serial+1, 10)
+	_, err = tx.ExecContext(ctx, updateContentQuery, strings.Join(parts, " "), id)
+	return err
+}
+
+// CreateZone создаёт зону с записями records
+func (s *Service) CreateZone(ctx context.Context, z *Zone, records []*DNSResourceRecord) error {
+	z.Name = strings.TrimSuffix(z.Name, ".")
+	if z.Name == "" {
+		return errors.Wrap(ErrInvalid, "не указано имя зоны")
+	}
+	if err := validKind(z.Kind); err != nil {
+		return err
+	}
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		if _, err := zoneID(ctx, tx, z.Name); err == nil {
+			return errors.Wrapf(ErrExists, "Domain %s", z.Name)
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		q := newQuotas()
+		if err := q.watch(ctx, tx, z.Account); err != nil {
+			return err
+		}
+		_, err := s.execTx(ctx, tx, "insert-zone-query",
+			"domain", z.Name,
+			"account", z.Account,
+			"masters", strings.Join(z.Masters, ","),
+			"type", z.Kind,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := zoneID(ctx, tx, z.Name)
+		if err != nil {
+			return err
+		}
+		if err = s.insertRecords(ctx, tx, id, z.Name, records); err != nil {
+			return err
+		}
+		if err = q.check(ctx, tx); err != nil {
+			return err
+		}
+		n := len(records)
+		if err = s.audit(ctx, tx, "createzone", z.Name, nil, &zoneState{Records: &n}); err != nil {
+			return err
+		}
+		if err = s.snapshot(ctx, tx, id, "createzone"); err != nil {
+			return err
+		}
+		return s.changedTx(ctx, tx, map[int]bool{id: true})
+	})
+	if err != nil {
+		return err
+	}
+	s.cache.invalidate([]string{z.Name})
+	return nil
+}
+
+// UpdateZone меняет тип, первичные серверы и владельца зоны
+func (s *Service) UpdateZone(ctx context.Context, z *Zone) error {
+	z.Name = strings.TrimSuffix(z.Name, ".")
+	if err := validKind(z.Kind); err != nil {
+		return err
+	}
+	before, err := s.getDomainInfo(ctx, z.Name)
+	if err != nil {
+		return err
+	}
+	if before.ID == 0 {
+		return errors.Wrapf(ErrNotFound, "Domain %s", z.Name)
+	}
+	err = s.write(ctx, func(tx *sql.Tx) error {
+		quotas := newQuotas()
+		if err := quotas.watch(ctx, tx, z.Account); err != nil {
+			return err
+		}
+		for _, q := range []struct {
+			name, param string
+			value       interface{}
+		}{
+			{"update-kind-query", "kind", z.Kind},
+			{"update-master-query", "master", strings.Join(z.Masters, ",")},
+			{"update-account-query", "account", z.Account},
+		} {
+			if _, err := s.execTx(ctx, tx, q.name, q.param, q.value, "domain", z.Name); err != nil {
+				return err
+			}
+		}
+		if err := quotas.check(ctx, tx); err != nil {
+			return err
+		}
+		err := s.audit(ctx, tx, "updatezone", z.Name,
+			&DomainInfo{Kind: before.Kind, Master: before.Master, Account: before.Account},
+			&DomainInfo{Kind: z.Kind, Master: z.Masters, Account: z.Account})
+		if err != nil {
+			return err
+		}
+		return s.changedTx(ctx, tx, map[int]bool{before.ID: true})
+	})
+	if err != nil {
+		return err
+	}
+	s.cache.invalidate([]string{z.Name})
+	return nil
+}
+
+// DeleteZone удаляет зону вместе с записями, комментариями, метаданными,
+// ключами и версиями
+func (s *Service) DeleteZone(ctx context.Context, zone string) error {
+	zone = strings.TrimSuffix(zone, ".")
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		id, err := zoneID(ctx, tx, zone)
+		if err != nil {
+			return err
+		}
+		before, err := zoneRecords(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		// Номер изменения берёт имя зоны из domains, поэтому отмечается до удаления
+		if err = s.changedTx(ctx, tx, map[int]bool{id: true}); err != nil {
+			return err
+		}
+		for _, q := range []struct {
+			name  string
+			param string
+			value interface{}
+		}{
+			{"delete-zone-query", "domain_id", id},
+			{"delete-comments-query", "domain_id", id},
+			{"clear-domain-all-metadata-query", "domain", zone},
+			{"clear-domain-all-keys-query", "domain", zone},
+			{"delete-domain-query", "domain", zone},
+		} {
+			if _, err = s.execTx(ctx, tx, q.name, q.param, q.value); err != nil {
+				return err
+			}
+		}
+		if _, err = tx.ExecContext(ctx, deleteVersionsQuery, id); err != nil {
+			return err
+		}
+		return s.audit(ctx, tx, "deletezone", zone, &zoneState{Records: &before}, nil)
+	})
+	if err != nil {
+		return err
+	}
+	s.cache.invalidate([]string{zone})
+	return nil
+}
+
+// PatchRRSets применяет изменения наборов записей одной транзакцией. Если
+// изменения не затрагивают SOA, её серийный номер увеличивается на единицу.
+func (s *Service) PatchRRSets(ctx context.Context, zone string, changes []*RRSetChange) error {
+	zone = strings.TrimSuffix(zone, ".")
+	err := s.write(ctx, func(tx *sql.Tx) error {
+		id, err := zoneID(ctx, tx, zone)
+		if err != nil {
+			return err
+		}
+		if err = s.baseline(ctx, tx, id); err != nil {
+			return err
+		}
+		q := newQuotas()
+		if err = q.watchDomain(ctx, tx, id); err != nil {
+			return err
+		}
+		soa := false
+		for _, c := range changes {
+			c.Name = strings.TrimSuffix(c.Name, ".")
+			c.Type = strings.ToUpper(c.Type)
+			if !inZoneName(c.Name, zone) || c.Type == "" {
+				return errors.Wrapf(ErrInvalid, "набор %s %s вне зоны %s", c.Name, c.Type, zone)
+			}
+			soa = soa || c.Type == "SOA"
+			before, err := auditRRSet(ctx, tx, id, c.Name, c.Type)
+			if err != nil {
+				return err
+			}
+			if _, err = s.execTx(ctx, tx, "delete-rrset-query", "domain_id", id, "qname", c.Name, "qtype", c.Type); err != nil {
+				return err
+			}
+			if !c.Replace || len(c.Records) == 0 {
+				_, err = s.execTx(ctx, tx, "delete-comment-rrset-query", "domain_id", id, "qname", c.Name, "qtype", c.Type)
+				if err != nil {
+					return err
+				}
+			}
+			if c.Replace {
+				for _, rr := range c.Records {
+					rr.Qname, rr.Qtype = c.Name, c.Type
+				}
+				if err = s.insertRecords(ctx, tx, id, zone, c.Records); err != nil {
+					return err
+				}
+			}
+			after, err := auditRRSet(ctx, tx, id, c.Name, c.Type)
+			if err != nil {
+				return err
+			}
+			if err = s.audit(ctx, tx, "patchrrsets", zone, before, after); err != nil {
+				return err
+			}
+		}
+		if !soa && len(changes) != 0 {
+			if err = increaseSerial(ctx, tx, id, zone); err != nil {
+				return err
+			}
+		}
+		if err = q.check(ctx, tx); err != nil {
+			return err
+		}
+		if err = s.snapshot(ctx, tx, id, "patchrrsets"); err != nil {
+			return err
+		}
+		return s.changedTx(ctx, tx, map[int]bool{id: true})
+	})
+	if err != nil {
+		return err
+	}
+	s.cache.invalidate([]string{zone})
+	return nil
+}
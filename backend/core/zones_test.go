@@ -0,0 +1,128 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZonesCreateDelete(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, true)
+	s.EnableCache(CacheConfig{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute})
+
+	di, err := s.GetDomainInfo(ctx, "example.net")
+	require.NoError(t, err)
+	require.Zero(t, di.ID)
+
+	require.NoError(t, s.CreateZone(ctx, &Zone{Name: "example.net.", Kind: "NATIVE", Account: "team"}, []*DNSResourceRecord{
+		{Qname: "example.net", Qtype: "SOA", TTL: 3600, Content: fmt.Sprintf(soa, 1), Auth: true},
+		{Qname: "www.example.net", Qtype: "A", TTL: 300, Content: "192.0.2.1", Auth: true},
+	}))
+	di, err = s.GetDomainInfo(ctx, "example.net")
+	require.NoError(t, err)
+	assert.Equal(t, "NATIVE", di.Kind, "cached missing zone is dropped")
+	assert.Equal(t, "team", di.Account)
+	rrs, err := s.Lookup(ctx, "A", "www.example.net", -1)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 1)
+
+	err = s.CreateZone(ctx, &Zone{Name: "example.net", Kind: "NATIVE"}, nil)
+	assert.ErrorIs(t, err, ErrExists)
+	err = s.CreateZone(ctx, &Zone{Name: "example.org", Kind: "PRODUCER"}, nil)
+	assert.ErrorIs(t, err, ErrInvalid)
+	err = s.CreateZone(ctx, &Zone{Name: "example.org", Kind: "NATIVE"}, []*DNSResourceRecord{
+		{Qname: "www.example.net", Qtype: "A", Content: "192.0.2.1"},
+	})
+	assert.ErrorIs(t, err, ErrInvalid)
+	di, err = s.GetDomainInfo(ctx, "example.org")
+	require.NoError(t, err)
+	assert.Zero(t, di.ID, "failed create leaves nothing")
+
+	require.NoError(t, s.UpdateZone(ctx, &Zone{Name: "example.net", Kind: "SLAVE", Masters: []string{"192.0.2.53"}}))
+	di, err = s.GetDomainInfo(ctx, "example.net")
+	require.NoError(t, err)
+	assert.Equal(t, "SLAVE", di.Kind)
+	assert.Equal(t, []string{"192.0.2.53"}, di.Master)
+	assert.Empty(t, di.Account)
+
+	require.NoError(t, s.SetDomainMetadata(ctx, "example.net", "ALSO-NOTIFY", []string{"192.0.2.5"}))
+	require.NoError(t, s.AddDomainKey(ctx, "example.net", &KeyData{Flags: 257, Active: true, Content: "ksk"}))
+	require.NoError(t, s.DeleteZone(ctx, "example.net."))
+	di, err = s.GetDomainInfo(ctx, "example.net")
+	require.NoError(t, err)
+	assert.Zero(t, di.ID)
+	rrs, err = s.Lookup(ctx, "A", "www.example.net", -1)
+	require.NoError(t, err)
+	assert.Empty(t, rrs, "cached answer is dropped")
+	meta, err := s.GetAllDomainMetadata(ctx, "example.net")
+	require.NoError(t, err)
+	assert.Empty(t, meta)
+	keys, err := s.GetDomainKeys(ctx, "example.net")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	_, err = s.Versions(ctx, "example.net")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.ErrorIs(t, s.DeleteZone(ctx, "example.net"), ErrNotFound)
+	assert.ErrorIs(t, s.UpdateZone(ctx, &Zone{Name: "example.net", Kind: "NATIVE"}), ErrNotFound)
+	assert.Len(t, auditEntries(t, s, "createzone"), 1)
+	assert.Len(t, auditEntries(t, s, "deletezone"), 1)
+}
+
+func TestZonesPatchRRSets(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, false)
+	exampleZone(t, s)
+
+	require.NoError(t, s.PatchRRSets(ctx, "example.com.", []*RRSetChange{
+		{Name: "www.example.com.", Type: "a", Replace: true, Records: []*DNSResourceRecord{
+			{TTL: 60, Content: "192.0.2.7"},
+			{TTL: 60, Content: "192.0.2.8"},
+		}},
+		{Name: "www.example.com", Type: "AAAA"},
+		{Name: "mail.example.com", Type: "MX", Replace: true, Records: []*DNSResourceRecord{
+			{TTL: 300, Content: "10 mx.example.com"},
+		}},
+	}))
+	rrs, err := s.Lookup(ctx, "ANY", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"A", "A"}, qtypes(rrs))
+	rrs, err = s.Lookup(ctx, "SOA", "example.com", -1)
+	require.NoError(t, err)
+	require.Len(t, rrs, 1)
+	assert.Equal(t, fmt.Sprintf(soa, 2022060102), rrs[0].Content, "serial is increased")
+	assert.Len(t, auditEntries(t, s, "patchrrsets"), 3)
+
+	versions, err := s.Versions(ctx, "example.com")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, "patchrrsets", versions[2].Method)
+
+	// Изменение с ошибкой не применяется целиком
+	err = s.PatchRRSets(ctx, "example.com", []*RRSetChange{
+		{Name: "www.example.com", Type: "A"},
+		{Name: "www.example.org", Type: "A"},
+	})
+	assert.ErrorIs(t, err, ErrInvalid)
+	rrs, err = s.Lookup(ctx, "A", "www.example.com", -1)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 2)
+
+	// Новая SOA не меняется
+	require.NoError(t, s.PatchRRSets(ctx, "example.com", []*RRSetChange{
+		{Name: "example.com", Type: "SOA", Replace: true, Records: []*DNSResourceRecord{
+			{TTL: 3600, Content: fmt.Sprintf(soa, 2022070101)},
+		}},
+	}))
+	rrs, err = s.Lookup(ctx, "SOA", "example.com", -1)
+	require.NoError(t, err)
+	require.Len(t, rrs, 1)
+	assert.Equal(t, fmt.Sprintf(soa, 2022070101), rrs[0].Content)
+
+	assert.ErrorIs(t, s.PatchRRSets(ctx, "missing.example", nil), ErrNotFound)
+}
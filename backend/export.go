@@ -0,0 +1,31 @@
+package backend
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/zonefile"
+	"github.com/pkg/errors"
+)
+
+// zoneExport выгружает зону ?format=json (по умолчанию) или bind. Файл зоны
+// отдаётся как text/plain без обёртки {"result": ...}.
+func (h *Handler) zoneExport(g *gin.Context) {
+	format := g.DefaultQuery("format", "json")
+	if format != "json" && format != "bind" {
+		badRequest(g, errors.Errorf("format: ожидается json или bind, получено %q", format))
+		return
+	}
+	e, err := h.svc.ExportZone(g.Request.Context(), g.Param("zone"))
+	if err != nil || format == "json" {
+		respond(g, e, err)
+		return
+	}
+	var buf strings.Builder
+	if err = zonefile.Write(&buf, e); err != nil {
+		respond(g, nil, err)
+		return
+	}
+	g.String(http.StatusOK, buf.String())
+}
@@ -1,276 +1,295 @@
 package backend
 
 import (
-	"net/http"
-	"strconv"
+	"context"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/auth"
+	"github.com/ivan-bokov/pdns-dqlite/backend/cluster"
 	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/ivan-bokov/pdns-dqlite/backend/health"
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/ivan-bokov/pdns-dqlite/backend/metrics"
+	"github.com/pkg/errors"
 )
 
 type Handler struct {
-	svc *core.Service
+	svc      *core.Service
+	cluster  *cluster.Manager
+	health   *health.Checker
+	mu       sync.RWMutex // timeouts меняются по SIGHUP
+	timeouts Timeouts
+	keys     *auth.Keys
 }
 
-func New(svc *core.Service) *Handler {
-	return &Handler{svc: svc}
+// Timeouts сроки обработки запросов, ноль снимает ограничение. По истечении
+// срока запрос к базе отменяется и клиент получает ошибку в log.
+type Timeouts struct {
+	// Backend таймаут remote backend в PowerDNS (timeout= в remote-connection-string).
+	// Методам отводится 90% от него, чтобы ошибка дошла до PowerDNS раньше,
+	// чем он перестанет ждать ответ.
+	Backend time.Duration
+	Admin   time.Duration // проверки и управление кластером
 }
+
+func New(svc *core.Service, cluster *cluster.Manager, health *health.Checker, timeouts Timeouts) *Handler {
+	return &Handler{svc: svc, cluster: cluster, health: health, timeouts: timeouts}
+}
+
+// deadline ограничивает контекст запроса сроком d. Контекст запроса уже
+// отменяется, когда PowerDNS закрывает соединение.
+func deadline(d time.Duration) gin.HandlerFunc {
+	return func(g *gin.Context) {
+		if d <= 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(g.Request.Context(), d)
+		defer cancel()
+		g.Request = g.Request.WithContext(ctx)
+		g.Next()
+	}
+}
+
+// SetBackendTimeout меняет таймаут remote backend для следующих запросов
+func (h *Handler) SetBackendTimeout(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.timeouts.Backend = d
+}
+
+// backendDeadline как deadline, но срок берётся из текущего Timeouts.Backend
+func (h *Handler) backendDeadline() gin.HandlerFunc {
+	return func(g *gin.Context) {
+		h.mu.RLock()
+		d := h.timeouts.Backend * 9 / 10
+		h.mu.RUnlock()
+		deadline(d)(g)
+	}
+}
+
+// noImplementation методы, которые не поддерживаются: PowerDNS понимает false как отказ
 func (h *Handler) noImplementation(g *gin.Context) {
-	g.JSON(200, gin.H{"result": false})
+	ok(g, false)
 }
+
 func (h *Handler) InitRoutes() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
-
-	r.GET("lookup/:qname/:qtype", h.lookup)    // ++++
-	r.GET("list/:domain_id/:zonename", h.list) // ++++
-	r.GET("getbeforeandafternamesabsolute/:domain_id/:qname", h.getbeforeandafternamesabsolute)
-	r.GET("getalldomainmetadata/:name", h.getAllDomainMetadata)    // ++++
-	r.GET("getdomainmetadata/:name/:kind", h.getDomainMetadata)    // ++++
-	r.PATCH("setdomainmetadata/:name/:kind", h.setDomainMetadata)  // ++++
-	r.GET("getdomainkeys/:name", h.getDomainKeys)                  // ++++
-	r.PUT("adddomainkey/:name", h.addDomainKey)                    // +++?
-	r.DELETE("removedomainkey/:name/:id", h.removeDomainKey)       // ++++
-	r.POST("activatedomainkey/:name/:id", h.activateDomainKey)     // ++++
-	r.POST("deactivatedomainkey/:name/:id", h.deactivateDomainKey) // ++++
-	r.POST("publishdomainkey/:name/:id", h.publishDomainKey)       // ++++
-	r.POST("unpublishdomainkey/:name/:id", h.unpublishDomainKey)   // ++++
-	r.GET("gettsigkey/:name", h.getTSIGKey)                        // ++++
-	r.GET("getdomaininfo/:name", h.getDomainInfo)                  // ++++
-	r.PATCH("setnotified/:id", h.setNotified)                      // ++++
-	r.GET("isMaster/:name/:ip", h.noImplementation)
-	r.POST("supermasterbackend/:ip/:domain", h.superMasterBackend)    // ++++
-	r.POST("createslavedomain/:ip/:domain", h.createSlaveDomain)      // ++++
-	r.PATCH("replacerrset/:domain_id/:qname/:qtype", h.replaceRRSet)  // ++++
-	r.PATCH("feedrecord/:trxid", h.feedRecord)                        // ++--
-	r.PATCH("feedents/:domain_id", h.feedents)                        // ++++
-	r.PATCH("feedEnts3/:domain_id/:domain", h.feedents3)              // ++++
-	r.POST("starttransaction/:domain_id/:domain", h.startTransaction) // ++++
-	r.POST("committransaction/:trxid", h.commitTransaction)           // ++++
-	r.POST("aborttransaction/:trxid", h.abortTransaction)             // ++++
-	r.POST("calculatesoaserial/:domain", h.noImplementation)
-	r.POST("directBackendCmd", h.noImplementation)
-	r.GET("getAllDomains", h.getAllDomains)         // ++++
-	r.GET("searchRecords", h.searchRecords)         // ++++
-	r.GET("getUpdatedMasters", h.getUpdatedMasters) // ++++
-	r.GET("getUnfreshSlaveInfos", h.noImplementation)
-	r.PATCH("setFresh/:id", h.setFresh) // ++++
-
-	r.GET("test/:key", h.getTest)
-	r.POST("test/:key", h.postTest)
+	r := gin.New()
+	r.Use(logging.Middleware(), metrics.Middleware(), recovery(), caller())
+	r.GET("metrics", gin.WrapH(metrics.Handler()))
+	checks := r.Group("", deadline(h.timeouts.Admin))
+	checks.GET("healthz", h.healthz)
+	checks.GET("readyz", h.readyz)
+	checks.GET("leader", h.leader)
+
+	pdns := r.Group("", h.backendDeadline(), h.authenticate(auth.KindBackend, fail))
+	pdns.GET("lookup/:qname/:qtype", h.lookup)    // ++++
+	pdns.GET("list/:domain_id/:zonename", h.list) // ++++
+	pdns.GET("getbeforeandafternamesabsolute/:domain_id/:qname", h.getbeforeandafternamesabsolute)
+	pdns.GET("getalldomainmetadata/:name", h.getAllDomainMetadata)    // ++++
+	pdns.GET("getdomainmetadata/:name/:kind", h.getDomainMetadata)    // ++++
+	pdns.PATCH("setdomainmetadata/:name/:kind", h.setDomainMetadata)  // ++++
+	pdns.GET("getdomainkeys/:name", h.getDomainKeys)                  // ++++
+	pdns.PUT("adddomainkey/:name", h.addDomainKey)                    // +++?
+	pdns.DELETE("removedomainkey/:name/:id", h.removeDomainKey)       // ++++
+	pdns.POST("activatedomainkey/:name/:id", h.activateDomainKey)     // ++++
+	pdns.POST("deactivatedomainkey/:name/:id", h.deactivateDomainKey) // ++++
+	pdns.POST("publishdomainkey/:name/:id", h.publishDomainKey)       // ++++
+	pdns.POST("unpublishdomainkey/:name/:id", h.unpublishDomainKey)   // ++++
+	pdns.GET("gettsigkey/:name", h.getTSIGKey)                        // ++++
+	pdns.GET("getdomaininfo/:name", h.getDomainInfo)                  // ++++
+	pdns.PATCH("setnotified/:id", h.setNotified)                      // ++++
+	pdns.GET("isMaster/:name/:ip", h.noImplementation)
+	pdns.POST("supermasterbackend/:ip/:domain", h.superMasterBackend)    // ++++
+	pdns.POST("createslavedomain/:ip/:domain", h.createSlaveDomain)      // ++++
+	pdns.PATCH("replacerrset/:domain_id/:qname/:qtype", h.replaceRRSet)  // ++++
+	pdns.PATCH("feedrecord/:trxid", h.feedRecord)                        // ++--
+	pdns.PATCH("feedents/:domain_id", h.feedents)                        // ++++
+	pdns.PATCH("feedEnts3/:domain_id/:domain", h.feedents3)              // ++++
+	pdns.POST("starttransaction/:domain_id/:domain", h.startTransaction) // ++++
+	pdns.POST("committransaction/:trxid", h.commitTransaction)           // ++++
+	pdns.POST("aborttransaction/:trxid", h.abortTransaction)             // ++++
+	pdns.POST("calculatesoaserial/:domain", h.noImplementation)
+	pdns.POST("directBackendCmd", h.noImplementation)
+	pdns.GET("getAllDomains", h.getAllDomains)         // ++++
+	pdns.GET("searchRecords", h.searchRecords)         // ++++
+	pdns.GET("getUpdatedMasters", h.getUpdatedMasters) // ++++
+	pdns.GET("getUnfreshSlaveInfos", h.noImplementation)
+	pdns.PATCH("setFresh/:id", h.setFresh) // ++++
+
+	manage := r.Group("admin", deadline(h.timeouts.Admin), h.authenticate(auth.KindAdmin, fail), h.zoneScope(fail))
+	admin := manage.Group("cluster", fullAccess(fail))
+	admin.GET("nodes", h.clusterNodes)
+	admin.GET("leader", h.clusterLeader)
+	admin.GET("status", h.clusterStatus)
+	admin.DELETE("nodes/:node", h.clusterRemove)
+	admin.POST("transfer/:node", h.clusterTransfer)
+	admin.POST("assign/:node/:role", h.clusterAssign)
+	manage.GET("audit", h.getAudit)
+	zones := manage.Group("zones")
+	zones.GET(":zone/versions", h.zoneVersions)
+	zones.GET(":zone/diff", h.zoneDiff)
+	zones.POST(":zone/rollback/:serial", h.zoneRollback)
+	zones.POST(":zone/import", h.zoneImport)
+	zones.GET(":zone/export", h.zoneExport)
+	zones.PUT(":zone/account/:account", fullAccess(fail), h.moveZone)
+	accounts := manage.Group("accounts")
+	accounts.GET("", fullAccess(fail), h.accounts)
+	accounts.GET(":account", h.account)
+	accounts.GET(":account/zones", h.accountZones)
+	accounts.GET(":account/search", h.accountSearch)
+	accounts.PUT(":account/quota", fullAccess(fail), h.setQuota)
+	accounts.DELETE(":account/quota", fullAccess(fail), h.deleteQuota)
+	manage.GET("log/level", fullAccess(fail), h.getLogLevel)
+	manage.PUT("log/level/:level", fullAccess(fail), h.setLogLevel)
+
+	// HTTP API PowerDNS. Список, создание и поиск зон сами учитывают права ключа.
+	servers := r.Group("api/v1/servers", deadline(h.timeouts.Admin), h.authenticate(auth.KindAdmin, apiFail))
+	servers.GET("", h.apiServers)
+	servers.GET("localhost", h.apiServer)
+	servers.GET("localhost/zones", h.apiZones)
+	servers.POST("localhost/zones", h.apiCreateZone)
+	servers.GET("localhost/search-data", h.apiSearch)
+	api := servers.Group("localhost/zones/:zone_id", h.zoneScope(apiFail))
+	api.GET("", h.apiGetZone)
+	api.PATCH("", h.apiPatchZone)
+	api.PUT("", h.apiUpdateZone)
+	api.DELETE("", h.apiDeleteZone)
+	api.GET("metadata", h.apiListMetadata)
+	api.POST("metadata", h.apiCreateMetadata)
+	api.GET("metadata/:kind", h.apiGetMetadata)
+	api.PUT("metadata/:kind", h.apiUpdateMetadata)
+	api.DELETE("metadata/:kind", h.apiDeleteMetadata)
+	api.GET("cryptokeys", h.apiListCryptokeys)
+	api.POST("cryptokeys", h.apiCreateCryptokey)
+	api.GET("cryptokeys/:id", h.apiGetCryptokey)
+	api.PUT("cryptokeys/:id", h.apiUpdateCryptokey)
+	api.DELETE("cryptokeys/:id", h.apiDeleteCryptokey)
 
 	return r
 }
+
+// DebugRoutes отладочные маршруты, пишут в таблицу model. Подключаются только с --debug.
+func (h *Handler) DebugRoutes(r *gin.Engine) {
+	debug := r.Group("test", h.authenticate(auth.KindAdmin, fail), h.zoneScope(fail))
+	debug.GET(":key", h.getTest)
+	debug.POST(":key", h.postTest)
+}
 func (h *Handler) getTest(g *gin.Context) {
-	key := g.Param("key")
-	val, err := h.svc.GetTest(key)
-	if err != nil {
-		g.JSON(204, gin.H{"err": err.Error()})
-	}
-	g.JSON(200, val)
+	val, err := h.svc.GetTest(g.Request.Context(), g.Param("key"))
+	respond(g, val, err)
 }
 func (h *Handler) postTest(g *gin.Context) {
-	key := g.Param("key")
 	value, _ := g.GetQuery("value")
-	err := h.svc.PostTest(key, value)
-	if err != nil {
-		g.JSON(204, gin.H{"err": err.Error()})
-	}
-	g.JSON(200, "OK")
+	done(g, h.svc.PostTest(g.Request.Context(), g.Param("key"), value))
 }
 func (h *Handler) getUpdatedMasters(g *gin.Context) {
-	di, err := h.svc.GetUpdatedMasters()
-	if err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
-		return
-	}
-	g.JSON(http.StatusBadRequest, gin.H{"result": di})
+	di, err := h.svc.GetUpdatedMasters(g.Request.Context())
+	respond(g, di, err)
 }
 func (h *Handler) searchRecords(g *gin.Context) {
-	var maxResult int
-	var err error
-	if maxResultS, ok := g.GetQuery("maxResults"); ok {
-		maxResult, err = strconv.Atoi(maxResultS)
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	pattern, _ := g.GetQuery("pattern")
-	rr, err := h.svc.SearchRecords(pattern, maxResult)
+	maxResult, err := atoi("maxResults", g.Query("maxResults"), 0)
 	if err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(http.StatusBadRequest, gin.H{"result": rr})
+	rr, err := h.svc.SearchRecords(g.Request.Context(), g.Query("pattern"), maxResult)
+	respond(g, rr, err)
 }
 func (h *Handler) abortTransaction(g *gin.Context) {
-	var trxid int
-	var err error
-	if g.Param("trxid") != "" {
-		trxid, err = strconv.Atoi(g.Param("trxid"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	err = h.svc.AbortTransaction(trxid)
+	trxid, err := atoi("trxid", g.Param("trxid"), 0)
 	if err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(http.StatusBadRequest, gin.H{"result": true})
+	done(g, h.svc.AbortTransaction(g.Request.Context(), trxid))
 }
 func (h *Handler) commitTransaction(g *gin.Context) {
-	var trxid int
-	var err error
-	if g.Param("trxid") != "" {
-		trxid, err = strconv.Atoi(g.Param("trxid"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	err = h.svc.CommitTransaction(trxid)
+	trxid, err := atoi("trxid", g.Param("trxid"), 0)
 	if err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(http.StatusBadRequest, gin.H{"result": true})
+	done(g, h.svc.CommitTransaction(g.Request.Context(), trxid))
 }
 func (h *Handler) startTransaction(g *gin.Context) {
-	var trxid int
-	var err error
-	var domainID int
-	if trx, ok := g.GetPostForm("trxid"); ok {
-		trxid, err = strconv.Atoi(trx)
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	if g.Param("domain_id") != "" {
-		domainID, err = strconv.Atoi(g.Param("domain_id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
+	trxid, err := atoi("trxid", g.PostForm("trxid"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
 	}
-	err = h.svc.StartTransaction(trxid, domainID)
+	domainID, err := atoi("domain_id", g.Param("domain_id"), 0)
 	if err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(http.StatusBadRequest, gin.H{"result": true})
+	done(g, h.svc.StartTransaction(g.Request.Context(), trxid, domainID))
 }
 
-func (h *Handler) feedents3(g *gin.Context) {
-	domain := g.Param("domain")
-	var domainID int
-	var trxid int
-	var narrow bool
-	var err error
-	if trx, ok := g.GetPostForm("trxid"); ok {
-		trxid, err = strconv.Atoi(trx)
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	if narrowS, ok := g.GetPostForm("narrow"); ok {
-		narrow, err = strconv.ParseBool(narrowS)
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	if g.Param("domain_id") != "" {
-		domainID, err = strconv.Atoi(g.Param("domain_id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
+// nonterms пустые нетерминальные имена из формы nonterm[]
+func nonterms(g *gin.Context) map[string]bool {
 	nonterms := map[string]bool{}
-
 	if nnt, ok := g.GetPostFormArray("nonterm"); ok {
 		for _, v := range nnt {
 			nonterms[v] = true
 		}
 	}
-	err = h.svc.FeedEnts3(trxid, domainID, domain, nonterms, narrow)
+	return nonterms
+}
+
+func (h *Handler) feedents3(g *gin.Context) {
+	trxid, err := atoi("trxid", g.PostForm("trxid"), 0)
 	if err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(http.StatusBadRequest, gin.H{"result": true})
-}
-
-func (h *Handler) feedents(g *gin.Context) {
-	var domainID int
-	var trxid int
-	var err error
-	if trx, ok := g.GetPostForm("trxid"); ok {
-		trxid, err = strconv.Atoi(trx)
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
+	narrow, err := parseBool("narrow", g.PostForm("narrow"), false)
+	if err != nil {
+		badRequest(g, err)
+		return
 	}
-	if g.Param("domain_id") != "" {
-		domainID, err = strconv.Atoi(g.Param("domain_id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
+	domainID, err := atoi("domain_id", g.Param("domain_id"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
 	}
-	nonterms := map[string]bool{}
+	done(g, h.svc.FeedEnts3(g.Request.Context(), trxid, domainID, g.Param("domain"), nonterms(g), narrow))
+}
 
-	if nnt, ok := g.GetPostFormArray("nonterm"); ok {
-		for _, v := range nnt {
-			nonterms[v] = true
-		}
+func (h *Handler) feedents(g *gin.Context) {
+	trxid, err := atoi("trxid", g.PostForm("trxid"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
 	}
-	err = h.svc.FeedEnts(trxid, domainID, nonterms)
+	domainID, err := atoi("domain_id", g.Param("domain_id"), 0)
 	if err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(http.StatusBadRequest, gin.H{"result": true})
+	done(g, h.svc.FeedEnts(g.Request.Context(), trxid, domainID, nonterms(g)))
 }
 func (h *Handler) replaceRRSet(g *gin.Context) {
-	qname := g.Param("qname")
-	qtype := g.Param("qtype")
-	var domainID int
-	var trxid int
-	rrset := make([]*core.DNSResourceRecord, 0, 10)
-	var err error
-	if g.Param("domain_id") != "" {
-		domainID, err = strconv.Atoi(g.Param("domain_id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
+	domainID, err := atoi("domain_id", g.Param("domain_id"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
 	}
-	if trx, ok := g.GetPostForm("trxid"); ok {
-		trxid, err = strconv.Atoi(trx)
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
+	trxid, err := atoi("trxid", g.PostForm("trxid"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
 	}
+	rrset := make([]*core.DNSResourceRecord, 0, 10)
 	if m, ok := g.GetPostFormMap("rrset"); ok {
-		var ttl int
-		var err error
-		if _, ok := m["ttl"]; ok {
-			ttl, err = strconv.Atoi(m["ttl"])
-			if err != nil {
-				g.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"result": false})
-				return
-			}
+		ttl, err := atoi("ttl", m["ttl"], 0)
+		if err != nil {
+			badRequest(g, err)
+			return
 		}
-
-		rr := &core.DNSResourceRecord{
+		rrset = append(rrset, &core.DNSResourceRecord{
 			Qname:        m["qname"],
 			OrderName:    m["order_name"],
 			WildcardName: m["wildcard_name"],
@@ -279,27 +298,18 @@ func (h *Handler) replaceRRSet(g *gin.Context) {
 			Qtype:        m["qtype"],
 			Auth:         m["auth"] == "1",
 			Qclass:       m["qclass"],
-		}
-		rrset = append(rrset, rr)
+		})
 	}
-	err = h.svc.ReplaceRRSet(trxid, domainID, qname, qtype, rrset)
-	if err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
-		return
-	}
-	g.JSON(http.StatusBadRequest, gin.H{"result": true})
-
+	done(g, h.svc.ReplaceRRSet(g.Request.Context(), trxid, domainID, g.Param("qname"), g.Param("qtype"), rrset))
 }
 
 func (h *Handler) superMasterBackend(g *gin.Context) {
-	ip := g.Param("ip")
-	domain := g.Param("domain")
 	type NSSet struct {
-		Row interface{} `json:"nsset" form:"nsset""`
+		Row interface{} `json:"nsset" form:"nsset"`
 	}
 	nsset := new(NSSet)
-	if ok := g.Bind(nsset); ok != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
+	if err := g.ShouldBind(nsset); err != nil {
+		badRequest(g, err)
 		return
 	}
 	// TODO: Не корректно парсится форма
@@ -307,357 +317,205 @@ func (h *Handler) superMasterBackend(g *gin.Context) {
 	//	for _, v := range nsset.Row {
 	//		nn = append(nn, v)
 	//	}
-	ns, account, err := h.svc.SuperMasterBackend(ip, domain, nn)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
+	ns, account, err := h.svc.SuperMasterBackend(g.Request.Context(), g.Param("ip"), g.Param("domain"), nn)
+	if err != nil || ns == nil {
+		respond(g, false, err)
 		return
 	}
-	g.JSON(200, gin.H{"result": gin.H{"account": account, "nameserver": ns}})
+	ok(g, gin.H{"account": account, "nameserver": ns})
 }
 
 func (h *Handler) getTSIGKey(g *gin.Context) {
-	name := g.Param("name")
-	alg, content, err := h.svc.GetTSIGKey(name)
+	alg, content, err := h.svc.GetTSIGKey(g.Request.Context(), g.Param("name"))
 	if err != nil || content == nil {
-		g.JSON(200, gin.H{"result": false})
+		respond(g, false, err)
 		return
 	}
-	g.JSON(200, gin.H{"result": gin.H{"algorithm": alg, "content": content}})
+	ok(g, gin.H{"algorithm": alg, "content": content})
 }
-func (h *Handler) removeDomainKey(g *gin.Context) {
-	name := g.Param("name")
-	var keyID int
-	var err error
-	if g.Param("id") != "" {
-		keyID, err = strconv.Atoi(g.Param("id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	err = h.svc.RemoveDomainKey(name, keyID)
+
+// keyID идентификатор ключа DNSSEC из пути
+func keyID(g *gin.Context) (int, bool) {
+	id, err := atoi("id", g.Param("id"), 0)
 	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
+		badRequest(g, err)
+		return 0, false
 	}
-	g.JSON(200, gin.H{"result": true})
+	return id, true
 }
-func (h *Handler) activateDomainKey(g *gin.Context) {
-	name := g.Param("name")
-	var keyID int
-	var err error
-	if g.Param("id") != "" {
-		keyID, err = strconv.Atoi(g.Param("id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
+
+func (h *Handler) removeDomainKey(g *gin.Context) {
+	if id, ok := keyID(g); ok {
+		done(g, h.svc.RemoveDomainKey(g.Request.Context(), g.Param("name"), id))
 	}
-	err = h.svc.ActivateDomainKey(name, keyID)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
+}
+func (h *Handler) activateDomainKey(g *gin.Context) {
+	if id, ok := keyID(g); ok {
+		done(g, h.svc.ActivateDomainKey(g.Request.Context(), g.Param("name"), id))
 	}
-	g.JSON(200, gin.H{"result": true})
 }
 func (h *Handler) deactivateDomainKey(g *gin.Context) {
-	name := g.Param("name")
-	var keyID int
-	var err error
-	if g.Param("id") != "" {
-		keyID, err = strconv.Atoi(g.Param("id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	err = h.svc.DeactivateDomainKey(name, keyID)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
+	if id, ok := keyID(g); ok {
+		done(g, h.svc.DeactivateDomainKey(g.Request.Context(), g.Param("name"), id))
 	}
-	g.JSON(200, gin.H{"result": true})
 }
 func (h *Handler) publishDomainKey(g *gin.Context) {
-	name := g.Param("name")
-	var keyID int
-	var err error
-	if g.Param("id") != "" {
-		keyID, err = strconv.Atoi(g.Param("id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	err = h.svc.PublishDomainKey(name, keyID)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
+	if id, ok := keyID(g); ok {
+		done(g, h.svc.PublishDomainKey(g.Request.Context(), g.Param("name"), id))
 	}
-	g.JSON(200, gin.H{"result": true})
 }
 func (h *Handler) unpublishDomainKey(g *gin.Context) {
-	name := g.Param("name")
-	var keyID int
-	var err error
-	if g.Param("id") != "" {
-		keyID, err = strconv.Atoi(g.Param("id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
+	if id, ok := keyID(g); ok {
+		done(g, h.svc.UnPublishDomainKey(g.Request.Context(), g.Param("name"), id))
 	}
-	err = h.svc.UnPublishDomainKey(name, keyID)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
-	}
-	g.JSON(200, gin.H{"result": true})
 }
 
 func (h *Handler) getDomainKeys(g *gin.Context) {
-	name := g.Param("name")
-	keys, err := h.svc.GetDomainKeys(name)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
-	}
-	g.JSON(200, gin.H{"result": keys})
+	keys, err := h.svc.GetDomainKeys(g.Request.Context(), g.Param("name"))
+	respond(g, keys, err)
 }
 
 func (h *Handler) getAllDomains(g *gin.Context) {
-	disabled := false
-	var err error
-	if g.Query("includeDisabled") != "" {
-		disabled, err = strconv.ParseBool(g.Query("includeDisabled"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	di, err := h.svc.GetAllDomains(disabled)
+	disabled, err := parseBool("includeDisabled", g.Query("includeDisabled"), false)
 	if err != nil {
-		g.JSON(200, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(200, gin.H{"result": di})
+	di, err := h.svc.GetAllDomains(g.Request.Context(), disabled)
+	respond(g, di, err)
 }
 
 func (h *Handler) lookup(g *gin.Context) {
-	qtype := g.Param("qtype")
-	qname := g.Param("qname")
-	zoneID := -1
-	var err error
-	if g.Request.Header.Get("X-RemoteBackend-zone-id") != "" {
-		zoneID, err = strconv.Atoi(g.Request.Header.Get("X-RemoteBackend-zone-id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	listRR, err := h.svc.Lookup(qtype, qname, zoneID)
+	zoneID, err := atoi("X-RemoteBackend-zone-id", g.GetHeader("X-RemoteBackend-zone-id"), -1)
 	if err != nil {
-		g.JSON(200, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(200, gin.H{"result": listRR})
+	listRR, err := h.svc.Lookup(g.Request.Context(), g.Param("qtype"), g.Param("qname"), zoneID)
+	respond(g, listRR, err)
 }
 func (h *Handler) getDomainInfo(g *gin.Context) {
-	name := g.Param("name")
-	di, err := h.svc.GetDomainInfo(name)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
-	}
-	g.JSON(200, gin.H{"result": di})
+	di, err := h.svc.GetDomainInfo(g.Request.Context(), g.Param("name"))
+	respond(g, di, err)
 }
 
 func (h *Handler) list(g *gin.Context) {
-	zonename := g.Param("zonename")
-	domainID := -1
-	var err error
-	if g.Request.Header.Get("X-RemoteBackend-domain-id") != "" {
-		domainID, err = strconv.Atoi(g.Request.Header.Get("X-RemoteBackend-domain-id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	if g.Param("domain_id") != "" {
-		domainID, err = strconv.Atoi(g.Param("domain_id"))
-		if err != nil {
-			g.JSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
-	}
-	listRR, err := h.svc.List(zonename, domainID, false)
+	domainID, err := atoi("X-RemoteBackend-domain-id", g.GetHeader("X-RemoteBackend-domain-id"), -1)
 	if err != nil {
-		g.JSON(200, gin.H{"result": make([]string, 0)})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(200, gin.H{"result": listRR})
-}
-func (h *Handler) getAllDomainMetadata(g *gin.Context) {
-	name := g.Param("name")
-	var err error
-	meta, err := h.svc.GetAllDomainMetadata(name)
+	domainID, err = atoi("domain_id", g.Param("domain_id"), domainID)
 	if err != nil {
-		g.JSON(200, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(200, gin.H{"result": meta})
+	listRR, err := h.svc.List(g.Request.Context(), g.Param("zonename"), domainID, false)
+	respond(g, listRR, err)
+}
+func (h *Handler) getAllDomainMetadata(g *gin.Context) {
+	meta, err := h.svc.GetAllDomainMetadata(g.Request.Context(), g.Param("name"))
+	respond(g, meta, err)
 }
 
 func (h *Handler) getbeforeandafternamesabsolute(g *gin.Context) {
 	//TODO непонятно что делать с параметрами, разобраться когда все закончу либо осенит
-
+	id, err := atoi("domain_id", g.Param("domain_id"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	done(g, h.svc.GetBeforeAndAfterNamesAbsolute(g.Request.Context(), id, g.Param("qname")))
 }
 
 func (h *Handler) setDomainMetadata(g *gin.Context) {
-	name := g.Param("name")
-	kind := g.Param("kind")
 	type valueMetadata struct {
 		Value []string `json:"value,omitempty" form:"value"`
 	}
 	values := new(valueMetadata)
-	if err := g.Bind(values); err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
+	if err := g.ShouldBind(values); err != nil {
+		badRequest(g, err)
 		return
 	}
-	err := h.svc.SetDomainMetadata(name, kind, values.Value)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
-	}
-	g.JSON(200, gin.H{"result": true})
+	done(g, h.svc.SetDomainMetadata(g.Request.Context(), g.Param("name"), g.Param("kind"), values.Value))
 }
 func (h *Handler) getDomainMetadata(g *gin.Context) {
-	name := g.Param("name")
-	kind := g.Param("kind")
-	meta, err := h.svc.GetDomainMetadata(name, kind)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
-	}
-	g.JSON(200, gin.H{"result": meta})
+	meta, err := h.svc.GetDomainMetadata(g.Request.Context(), g.Param("name"), g.Param("kind"))
+	respond(g, meta, err)
 }
 
 func (h *Handler) addDomainKey(g *gin.Context) {
-	name := g.Param("name")
-	key := new(core.KeyData)
+	key := &core.KeyData{Content: g.PostForm("content")}
 	var err error
-	if flags, ok := g.GetPostForm("flags"); ok {
-		key.Flags, err = strconv.Atoi(flags)
-		if err != nil {
-			g.AbortWithStatus(http.StatusBadRequest)
-			return
-		}
-	}
-	if active, ok := g.GetPostForm("active"); ok {
-		key.Active, err = strconv.ParseBool(active)
-		if err != nil {
-			g.AbortWithStatus(http.StatusBadRequest)
-			return
-		}
-	}
-	if published, ok := g.GetPostForm("published"); ok {
-		key.Published, err = strconv.ParseBool(published)
-		if err != nil {
-			g.AbortWithStatus(http.StatusBadRequest)
-			return
-		}
+	if key.Flags, err = atoi("flags", g.PostForm("flags"), 0); err != nil {
+		badRequest(g, err)
+		return
 	}
-	if content, ok := g.GetPostForm("content"); ok {
-		key.Content = content
+	if key.Active, err = parseBool("active", g.PostForm("active"), false); err != nil {
+		badRequest(g, err)
+		return
 	}
-
-	err = h.svc.AddDomainKey(name, key)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
+	if key.Published, err = parseBool("published", g.PostForm("published"), false); err != nil {
+		badRequest(g, err)
 		return
 	}
-	g.JSON(200, gin.H{"result": true})
+	done(g, h.svc.AddDomainKey(g.Request.Context(), g.Param("name"), key))
 }
 
 func (h *Handler) feedRecord(g *gin.Context) {
-	m := make(map[string]string)
-	var ok bool
-	if m, ok = g.GetPostFormMap("rr"); !ok {
-		g.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"result": false})
+	trxid, err := atoi("trxid", g.Param("trxid"), 0)
+	if err != nil {
+		badRequest(g, err)
 		return
 	}
-	var ttl int
-	var err error
-	if _, ok := m["ttl"]; ok {
-		ttl, err = strconv.Atoi(m["ttl"])
-		if err != nil {
-			g.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"result": false})
-			return
-		}
+	m, found := g.GetPostFormMap("rr")
+	if !found {
+		badRequest(g, errors.New("rr: запись не передана"))
+		return
 	}
-	var auth bool
-	if auth, err = strconv.ParseBool(m["auth"]); err != nil {
-		g.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"result": false})
+	ttl, err := atoi("ttl", m["ttl"], 0)
+	if err != nil {
+		badRequest(g, err)
 		return
 	}
-	err = h.svc.FeedRecord(&core.DNSResourceRecord{
+	auth, err := parseBool("auth", m["auth"], false)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	done(g, h.svc.FeedRecord(g.Request.Context(), trxid, &core.DNSResourceRecord{
 		Qname:   m["qname"],
 		Content: m["content"],
 		TTL:     ttl,
 		Qtype:   m["qtype"],
 		Auth:    auth,
 		Qclass:  m["qclass"],
-	}, "")
-	if err != nil {
-		g.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"result": false})
-		return
-	}
-	g.JSON(200, gin.H{"result": true})
+	}, ""))
 }
 
 func (h *Handler) createSlaveDomain(g *gin.Context) {
-	ip := g.Param("ip")
-	domain := g.Param("domain")
-	err := h.svc.CreateSlaveDomain(ip, domain)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
-	}
-	g.JSON(200, gin.H{"result": true})
+	done(g, h.svc.CreateSlaveDomain(g.Request.Context(), g.Param("ip"), g.Param("domain"), g.PostForm("account")))
 }
 
 func (h *Handler) setFresh(g *gin.Context) {
-	id, err := strconv.Atoi(g.Param("id"))
+	id, err := atoi("id", g.Param("id"), 0)
 	if err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	err = h.svc.SetFresh(id)
-	if err != nil {
-		g.JSON(200, gin.H{"result": false})
-		return
-	}
-	g.JSON(200, gin.H{"result": true})
+	done(g, h.svc.SetFresh(g.Request.Context(), id))
 }
 
 func (h *Handler) setNotified(g *gin.Context) {
-	id, err := strconv.Atoi(g.Param("id"))
+	id, err := atoi("id", g.Param("id"), 0)
 	if err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	var serial int
-	if s, ok := g.GetPostForm("serial"); ok {
-		serial, err = strconv.Atoi(s)
-		if err != nil {
-			g.AbortWithStatus(http.StatusBadRequest)
-			return
-		}
-	}
-	err = h.svc.SetNotified(id, serial)
+	serial, err := atoi("serial", g.PostForm("serial"), 0)
 	if err != nil {
-		g.JSON(200, gin.H{"result": false})
+		badRequest(g, err)
 		return
 	}
-	g.JSON(200, gin.H{"result": true})
+	done(g, h.svc.SetNotified(g.Request.Context(), id, serial))
 }
@@ -0,0 +1,334 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/cluster"
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/ivan-bokov/pdns-dqlite/backend/health"
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRoutes(t *testing.T, dnssec bool) *gin.Engine {
+	t.Helper()
+	h, _ := newTestHandler(t, dnssec)
+	r := h.InitRoutes()
+	h.DebugRoutes(r)
+	return r
+}
+
+func newTestHandler(t *testing.T, dnssec bool) (*Handler, *sql.DB) {
+	t.Helper()
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	require.NoError(t, storage.InitDebug(db))
+
+	// Кластер недоступен: маршруты управления кластером должны отвечать ошибкой в том же виде
+	manager := cluster.New(func(ctx context.Context) (cluster.Client, error) {
+		return nil, errors.New("кластер недоступен")
+	}, nil, cluster.Roles{})
+	ready := func(context.Context) error { return nil }
+	h := New(core.New(db, dnssec), manager, health.New(db, "127.0.0.1:6001", ready, manager), Timeouts{Backend: time.Minute})
+	return h, db
+}
+
+type contractCase struct {
+	route  string // метод и шаблон пути, как в gin.RouteInfo
+	method string
+	path   string
+	form   url.Values
+	json   string // тело запроса к HTTP API
+	text   string // тело запроса как есть, например файл зоны
+	header map[string]string
+	status int
+}
+
+func (c contractCase) do(r *gin.Engine) *httptest.ResponseRecorder {
+	var body *strings.Reader
+	switch {
+	case c.form != nil:
+		body = strings.NewReader(c.form.Encode())
+	case c.json != "":
+		body = strings.NewReader(c.json)
+	case c.text != "":
+		body = strings.NewReader(c.text)
+	default:
+		body = strings.NewReader("")
+	}
+	req := httptest.NewRequest(c.method, c.path, body)
+	if c.form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.json != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range c.header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// checkEnvelope ответ должен иметь вид {"result": ..., "log": [...]},
+// а ошибка обязательно сопровождаться текстом в log
+func checkEnvelope(t *testing.T, w *httptest.ResponseRecorder) map[string]json.RawMessage {
+	t.Helper()
+	resp := map[string]json.RawMessage{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+	assert.Contains(t, resp, "result")
+	for k := range resp {
+		assert.Contains(t, []string{"result", "log"}, k)
+	}
+	if w.Code != http.StatusOK {
+		assert.JSONEq(t, "false", string(resp["result"]))
+		var log []string
+		require.NoError(t, json.Unmarshal(resp["log"], &log))
+		assert.NotEmpty(t, log)
+	}
+	return resp
+}
+
+func form(kv ...string) url.Values {
+	v := url.Values{}
+	for i := 0; i < len(kv); i += 2 {
+		v.Add(kv[i], kv[i+1])
+	}
+	return v
+}
+
+const importZone = `$TTL 300
+@ SOA ns1 hostmaster ( 1 10800 3600 604800 300 )
+  NS ns1
+ns1 A 192.0.2.53
+`
+
+// TestContract проходит по всем маршрутам: коды ответов и формат тела.
+// Случаи выполняются по порядку и используют данные предыдущих.
+func TestContract(t *testing.T) {
+	r := newTestRoutes(t, true)
+	require.NoError(t, logging.SetLevel("error"))
+	t.Cleanup(func() { logging.SetLevel("info") })
+
+	cases := []contractCase{
+		{route: "GET /healthz", path: "/healthz", status: 200},
+		{route: "GET /readyz", path: "/readyz", status: 200},
+		{route: "GET /leader", path: "/leader", status: 503},
+
+		{route: "POST /createslavedomain/:ip/:domain", path: "/createslavedomain/192.0.2.1/example.com", status: 200},
+		{route: "POST /starttransaction/:domain_id/:domain", path: "/starttransaction/1/example.com", form: form("trxid", "7"), status: 200},
+		{route: "POST /starttransaction/:domain_id/:domain", path: "/starttransaction/1/example.com", form: form("trxid", "7"), status: 409},
+		{route: "POST /starttransaction/:domain_id/:domain", path: "/starttransaction/x/example.com", form: form("trxid", "9"), status: 400},
+		{route: "PATCH /feedrecord/:trxid", path: "/feedrecord/7", form: form(
+			"rr[qname]", "example.com", "rr[qtype]", "SOA", "rr[ttl]", "3600", "rr[auth]", "1",
+			"rr[content]", "ns1.example.com hostmaster.example.com 2022060101 10800 3600 604800 3600",
+		), status: 200},
+		{route: "PATCH /feedrecord/:trxid", path: "/feedrecord/7", form: form(
+			"rr[qname]", "www.example.com", "rr[qtype]", "A", "rr[ttl]", "300", "rr[auth]", "1", "rr[content]", "192.0.2.1",
+		), status: 200},
+		{route: "PATCH /feedrecord/:trxid", path: "/feedrecord/7", form: form("trxid", "7"), status: 400},
+		{route: "PATCH /feedrecord/:trxid", path: "/feedrecord/7", form: form("rr[qname]", "a.example.com", "rr[ttl]", "x"), status: 400},
+		{route: "PATCH /feedrecord/:trxid", path: "/feedrecord/8", form: form("rr[qname]", "a.example.com", "rr[auth]", "0"), status: 409},
+		{route: "PATCH /replacerrset/:domain_id/:qname/:qtype", path: "/replacerrset/1/www.example.com/A", form: form(
+			"trxid", "7", "rrset[qname]", "www.example.com", "rrset[qtype]", "A", "rrset[ttl]", "300", "rrset[auth]", "1", "rrset[content]", "192.0.2.3",
+		), status: 200},
+		{route: "PATCH /replacerrset/:domain_id/:qname/:qtype", path: "/replacerrset/1/www.example.com/A", form: form("trxid", "8"), status: 409},
+		{route: "PATCH /feedents/:domain_id", path: "/feedents/1", form: form("trxid", "7", "nonterm", "sub.example.com"), status: 200},
+		{route: "PATCH /feedEnts3/:domain_id/:domain", path: "/feedEnts3/1/example.com", form: form("trxid", "7", "narrow", "0"), status: 200},
+		{route: "PATCH /feedEnts3/:domain_id/:domain", path: "/feedEnts3/1/example.com", form: form("trxid", "7", "narrow", "maybe"), status: 400},
+		{route: "POST /committransaction/:trxid", path: "/committransaction/7", status: 200},
+		{route: "POST /committransaction/:trxid", path: "/committransaction/7", status: 409},
+		{route: "POST /starttransaction/:domain_id/:domain", path: "/starttransaction/0/example.com", form: form("trxid", "8"), status: 200},
+		{route: "POST /aborttransaction/:trxid", path: "/aborttransaction/8", status: 200},
+		{route: "POST /aborttransaction/:trxid", path: "/aborttransaction/x", status: 400},
+
+		{route: "GET /lookup/:qname/:qtype", path: "/lookup/www.example.com/A", status: 200},
+		{route: "GET /lookup/:qname/:qtype", path: "/lookup/www.example.com/A", header: map[string]string{"X-RemoteBackend-zone-id": "x"}, status: 400},
+		{route: "GET /list/:domain_id/:zonename", path: "/list/1/example.com", status: 200},
+		{route: "GET /list/:domain_id/:zonename", path: "/list/-1/missing.example", status: 404},
+		{route: "GET /getbeforeandafternamesabsolute/:domain_id/:qname", path: "/getbeforeandafternamesabsolute/1/www.example.com", status: 501},
+		{route: "PATCH /setdomainmetadata/:name/:kind", path: "/setdomainmetadata/example.com/ALSO-NOTIFY", form: form("value", "192.0.2.2"), status: 200},
+		{route: "GET /getalldomainmetadata/:name", path: "/getalldomainmetadata/example.com", status: 200},
+		{route: "GET /getdomainmetadata/:name/:kind", path: "/getdomainmetadata/example.com/ALSO-NOTIFY", status: 200},
+		{route: "PUT /adddomainkey/:name", path: "/adddomainkey/example.com", form: form("flags", "257", "active", "1", "published", "1", "content", "key"), status: 200},
+		{route: "PUT /adddomainkey/:name", path: "/adddomainkey/example.com", form: form("flags", "x"), status: 400},
+		{route: "GET /getdomainkeys/:name", path: "/getdomainkeys/example.com", status: 200},
+		{route: "POST /activatedomainkey/:name/:id", path: "/activatedomainkey/example.com/1", status: 200},
+		{route: "POST /activatedomainkey/:name/:id", path: "/activatedomainkey/example.com/x", status: 400},
+		{route: "POST /deactivatedomainkey/:name/:id", path: "/deactivatedomainkey/example.com/1", status: 200},
+		{route: "POST /publishdomainkey/:name/:id", path: "/publishdomainkey/example.com/1", status: 200},
+		{route: "POST /unpublishdomainkey/:name/:id", path: "/unpublishdomainkey/example.com/1", status: 200},
+		{route: "DELETE /removedomainkey/:name/:id", path: "/removedomainkey/example.com/1", status: 200},
+		{route: "GET /gettsigkey/:name", path: "/gettsigkey/missing", status: 200},
+		{route: "GET /getdomaininfo/:name", path: "/getdomaininfo/example.com", status: 200},
+		{route: "PATCH /setnotified/:id", path: "/setnotified/1", form: form("serial", "2022060101"), status: 200},
+		{route: "PATCH /setnotified/:id", path: "/setnotified/x", status: 400},
+		{route: "GET /isMaster/:name/:ip", path: "/isMaster/example.com/192.0.2.1", status: 200},
+		{route: "POST /supermasterbackend/:ip/:domain", path: "/supermasterbackend/192.0.2.1/example.com", status: 200},
+		{route: "POST /calculatesoaserial/:domain", path: "/calculatesoaserial/example.com", status: 200},
+		{route: "POST /directBackendCmd", path: "/directBackendCmd", status: 200},
+		{route: "GET /getAllDomains", path: "/getAllDomains?includeDisabled=true", status: 200},
+		{route: "GET /getAllDomains", path: "/getAllDomains?includeDisabled=maybe", status: 400},
+		{route: "GET /searchRecords", path: "/searchRecords?pattern=www*&maxResults=10", status: 200},
+		{route: "GET /searchRecords", path: "/searchRecords?pattern=www*&maxResults=x", status: 400},
+		{route: "GET /getUpdatedMasters", path: "/getUpdatedMasters", status: 200},
+		{route: "GET /getUnfreshSlaveInfos", path: "/getUnfreshSlaveInfos", status: 200},
+		{route: "PATCH /setFresh/:id", path: "/setFresh/1", status: 200},
+
+		{route: "GET /admin/cluster/nodes", path: "/admin/cluster/nodes", status: 503},
+		{route: "GET /admin/cluster/leader", path: "/admin/cluster/leader", status: 503},
+		{route: "GET /admin/cluster/status", path: "/admin/cluster/status", status: 503},
+		{route: "DELETE /admin/cluster/nodes/:node", path: "/admin/cluster/nodes/2", status: 400},
+		{route: "POST /admin/cluster/transfer/:node", path: "/admin/cluster/transfer/2", status: 400},
+		{route: "POST /admin/cluster/assign/:node/:role", path: "/admin/cluster/assign/2/voter", status: 400},
+		{route: "PUT /admin/log/level/:level", path: "/admin/log/level/error", status: 200},
+		{route: "PUT /admin/log/level/:level", path: "/admin/log/level/trace", status: 400},
+		{route: "GET /admin/log/level", path: "/admin/log/level", status: 200},
+		{route: "GET /admin/audit", path: "/admin/audit?zone=example.com&since=24h", status: 200},
+		{route: "GET /admin/audit", path: "/admin/audit?since=yesterday", status: 400},
+		{route: "GET /admin/zones/:zone/versions", path: "/admin/zones/example.com/versions", status: 200},
+		{route: "GET /admin/zones/:zone/versions", path: "/admin/zones/missing.example/versions", status: 404},
+		{route: "GET /admin/zones/:zone/diff", path: "/admin/zones/example.com/diff?from=2022060101", status: 200},
+		{route: "GET /admin/zones/:zone/diff", path: "/admin/zones/example.com/diff?from=1", status: 404},
+		{route: "GET /admin/zones/:zone/diff", path: "/admin/zones/example.com/diff?from=x", status: 400},
+		{route: "POST /admin/zones/:zone/rollback/:serial", path: "/admin/zones/example.com/rollback/2022060101", status: 200},
+		{route: "POST /admin/zones/:zone/rollback/:serial", path: "/admin/zones/example.com/rollback/x", status: 400},
+		{route: "POST /admin/zones/:zone/import", path: "/admin/zones/import.example/import?dry-run=1", text: importZone, status: 200},
+		{route: "POST /admin/zones/:zone/import", path: "/admin/zones/import.example/import", text: importZone, status: 200},
+		{route: "POST /admin/zones/:zone/import", path: "/admin/zones/import.example/import", text: "www 300 A 192.0.2.1\n", status: 422},
+		{route: "POST /admin/zones/:zone/import", path: "/admin/zones/import.example/import", text: "$INCLUDE /etc/hosts\n", status: 422},
+		{route: "POST /admin/zones/:zone/import", path: "/admin/zones/import.example/import?dry-run=maybe", status: 400},
+		{route: "POST /admin/zones/:zone/import", path: "/admin/zones/copy.example/import", json: `{"name":"copy.example","kind":"NATIVE","records":[
+			{"name":"copy.example","type":"SOA","ttl":300,"content":"ns1.copy.example hostmaster.copy.example 1 10800 3600 604800 300"}]}`, status: 200},
+		{route: "POST /admin/zones/:zone/import", path: "/admin/zones/other.example/import", json: `{"name":"copy.example"}`, status: 422},
+		{route: "GET /admin/zones/:zone/export", path: "/admin/zones/import.example/export", status: 200},
+		{route: "GET /admin/zones/:zone/export", path: "/admin/zones/missing.example/export", status: 404},
+		{route: "GET /admin/zones/:zone/export", path: "/admin/zones/import.example/export?format=xml", status: 400},
+		{route: "PUT /admin/accounts/:account/quota", path: "/admin/accounts/team/quota?zones=1&records=100", status: 200},
+		{route: "PUT /admin/accounts/:account/quota", path: "/admin/accounts/team/quota?zones=x", status: 400},
+		{route: "PUT /admin/accounts/:account/quota", path: "/admin/accounts/team/quota?zones=-1", status: 422},
+		{route: "PUT /admin/zones/:zone/account/:account", path: "/admin/zones/example.com/account/team", status: 200},
+		{route: "PUT /admin/zones/:zone/account/:account", path: "/admin/zones/missing.example/account/team", status: 404},
+		{route: "GET /admin/accounts", path: "/admin/accounts", status: 200},
+		{route: "GET /admin/accounts/:account", path: "/admin/accounts/team", status: 200},
+		{route: "GET /admin/accounts/:account/zones", path: "/admin/accounts/team/zones", status: 200},
+		{route: "GET /admin/accounts/:account/search", path: "/admin/accounts/team/search?pattern=www*", status: 200},
+		{route: "GET /admin/accounts/:account/search", path: "/admin/accounts/team/search?maxResults=x", status: 400},
+		{route: "DELETE /admin/accounts/:account/quota", path: "/admin/accounts/team/quota", status: 200},
+		{route: "DELETE /admin/accounts/:account/quota", path: "/admin/accounts/team/quota", status: 404},
+
+		{route: "POST /test/:key", path: "/test/k?value=v", status: 200},
+		{route: "GET /test/:key", path: "/test/k", status: 200},
+	}
+
+	covered := map[string]bool{"GET /metrics": true}
+	for _, c := range cases {
+		c.method = strings.Fields(c.route)[0]
+		t.Run(c.method+" "+c.path, func(t *testing.T) {
+			w := c.do(r)
+			assert.Equal(t, c.status, w.Code, w.Body.String())
+			checkEnvelope(t, w)
+		})
+		covered[c.route] = true
+	}
+	for _, route := range r.Routes() {
+		if strings.HasPrefix(route.Path, "/api/") {
+			// Проверяются в TestAPIContract
+			continue
+		}
+		assert.True(t, covered[route.Method+" "+route.Path], "нет случая для %s %s", route.Method, route.Path)
+	}
+}
+
+func TestContractResults(t *testing.T) {
+	r := newTestRoutes(t, false)
+
+	w := contractCase{method: "GET", path: "/getdomainkeys/example.com"}.do(r)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+	resp := checkEnvelope(t, w)
+	assert.JSONEq(t, `["Only for DNSSEC"]`, string(resp["log"]))
+
+	w = contractCase{method: "POST", path: "/test/k?value=v"}.do(r)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = contractCase{method: "GET", path: "/test/k"}.do(r)
+	assert.JSONEq(t, `{"result":"v"}`, w.Body.String())
+
+	w = contractCase{method: "GET", path: "/gettsigkey/missing"}.do(r)
+	assert.JSONEq(t, `{"result":false}`, w.Body.String())
+}
+
+func TestZoneExport(t *testing.T) {
+	r := newTestRoutes(t, false)
+	w := contractCase{method: "POST", path: "/admin/zones/import.example/import", text: importZone}.do(r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = contractCase{method: "GET", path: "/admin/zones/import.example/export?format=bind"}.do(r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `$ORIGIN import.example.
+import.example.	300	IN	SOA	ns1.import.example. hostmaster.import.example. 1 10800 3600 604800 300
+import.example.	300	IN	NS	ns1.import.example.
+ns1.import.example.	300	IN	A	192.0.2.53
+`, w.Body.String())
+
+	w = contractCase{method: "GET", path: "/admin/zones/import.example/export"}.do(r)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Result core.ZoneExport `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "NATIVE", resp.Result.Kind)
+	assert.Len(t, resp.Result.Records, 3)
+}
+
+func TestRecovery(t *testing.T) {
+	r := newTestRoutes(t, false)
+	require.NoError(t, logging.SetLevel("error"))
+	t.Cleanup(func() { logging.SetLevel("info") })
+	r.GET("panic", func(g *gin.Context) { panic("boom") })
+
+	w := contractCase{method: "GET", path: "/panic"}.do(r)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	resp := checkEnvelope(t, w)
+	assert.Contains(t, string(resp["log"]), "boom")
+}
+
+func TestDeadline(t *testing.T) {
+	r := newTestRoutes(t, false)
+	require.NoError(t, logging.SetLevel("error"))
+	t.Cleanup(func() { logging.SetLevel("info") })
+	r.GET("slow", deadline(time.Millisecond), func(g *gin.Context) {
+		<-g.Request.Context().Done()
+		respond(g, nil, g.Request.Context().Err())
+	})
+
+	w := contractCase{method: "GET", path: "/slow"}.do(r)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	checkEnvelope(t, w)
+
+	// Таймаут remote backend меняется без перезапуска
+	h, _ := newTestHandler(t, false)
+	r = h.InitRoutes()
+	r.GET("backend", h.backendDeadline(), func(g *gin.Context) {
+		deadline, _ := g.Request.Context().Deadline()
+		respond(g, time.Until(deadline) < time.Second, nil)
+	})
+	w = contractCase{method: "GET", path: "/backend"}.do(r)
+	assert.JSONEq(t, `{"result":false}`, w.Body.String())
+	h.SetBackendTimeout(time.Second)
+	w = contractCase{method: "GET", path: "/backend"}.do(r)
+	assert.JSONEq(t, `{"result":true}`, w.Body.String())
+}
@@ -0,0 +1,31 @@
+package backend
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Проверки для балансировщика. healthz отвечает, пока процесс жив, readyz
+// только когда узел может обслуживать PowerDNS.
+
+func (h *Handler) healthz(g *gin.Context) {
+	ok(g, true)
+}
+
+func (h *Handler) readyz(g *gin.Context) {
+	if err := h.health.Ready(g.Request.Context()); err != nil {
+		fail(g, http.StatusServiceUnavailable, err)
+		return
+	}
+	ok(g, true)
+}
+
+func (h *Handler) leader(g *gin.Context) {
+	status, err := h.health.Leader(g.Request.Context())
+	if err != nil {
+		fail(g, http.StatusServiceUnavailable, err)
+		return
+	}
+	ok(g, status)
+}
@@ -0,0 +1,75 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/cluster"
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/pkg/errors"
+)
+
+// Checker проверки для балансировщика: готов ли узел обслуживать PowerDNS
+// и кто сейчас лидер
+type Checker struct {
+	db      *sql.DB
+	node    string
+	ready   func(ctx context.Context) error
+	cluster *cluster.Manager
+}
+
+// New node адрес dqlite этого узла, ready сообщает, готов ли экземпляр dqlite
+func New(db *sql.DB, node string, ready func(ctx context.Context) error, cluster *cluster.Manager) *Checker {
+	return &Checker{db: db, node: node, ready: ready, cluster: cluster}
+}
+
+// Ready узел готов, если dqlite запущен, схема нужной версии и в базу можно писать
+func (c *Checker) Ready(ctx context.Context) error {
+	if err := c.ready(ctx); err != nil {
+		return errors.Wrap(err, "dqlite не готов")
+	}
+	version, err := storage.Version(ctx, c.db)
+	if err != nil {
+		return err
+	}
+	if version != storage.SchemaVersion {
+		return errors.Errorf("версия схемы %d, ожидается %d", version, storage.SchemaVersion)
+	}
+	// Пробная запись проходит через лидера и подтверждается большинством голосующих
+	_, err = c.db.ExecContext(ctx, "REPLACE INTO health (node, checked_at) VALUES (?, ?)", c.node, time.Now().Unix())
+	if err != nil {
+		return errors.Wrap(err, "база недоступна для записи")
+	}
+	return nil
+}
+
+// Leader роль этого узла и адрес текущего лидера
+type Leader struct {
+	Node          string `json:"node"`
+	Role          string `json:"role"`
+	IsLeader      bool   `json:"is_leader"`
+	LeaderID      uint64 `json:"leader_id"`
+	LeaderAddress string `json:"leader_address"`
+}
+
+func (c *Checker) Leader(ctx context.Context) (*Leader, error) {
+	nodes, err := c.cluster.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := &Leader{Node: c.node}
+	for _, n := range nodes {
+		if n.Address == c.node {
+			status.Role = n.Role
+			status.IsLeader = n.Leader
+		}
+		if n.Leader {
+			status.LeaderID, status.LeaderAddress = n.ID, n.Address
+		}
+	}
+	if status.LeaderAddress == "" {
+		return nil, errors.New("в кластере нет лидера")
+	}
+	return status, nil
+}
@@ -0,0 +1,33 @@
+package health
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReady(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	var notReady error
+	c := New(db, "127.0.0.1:6001", func(context.Context) error { return notReady }, nil)
+	require.NoError(t, c.Ready(ctx))
+	var node string
+	require.NoError(t, db.QueryRow("SELECT node FROM health").Scan(&node))
+	assert.Equal(t, "127.0.0.1:6001", node)
+
+	notReady = errors.New("no leader")
+	assert.Error(t, c.Ready(ctx))
+	notReady = nil
+
+	_, err = db.Exec("UPDATE schema_version SET version = ?", storage.SchemaVersion+1)
+	require.NoError(t, err)
+	assert.Error(t, c.Ready(ctx), "schema version mismatch")
+}
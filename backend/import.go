@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/auth"
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/ivan-bokov/pdns-dqlite/backend/zonefile"
+	"github.com/pkg/errors"
+)
+
+// zoneImport загружает зону из файла зоны BIND в теле запроса
+// ?dry-run=&kind=&account=. Тип и владелец задаются только новой зоне,
+// $INCLUDE не поддерживается. Тело application/json загружается как
+// выгрузка zoneExport в JSON вместе с типом, владельцем и метаданными.
+func (h *Handler) zoneImport(g *gin.Context) {
+	dryRun, err := parseBool("dry-run", g.Query("dry-run"), false)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	zone := strings.TrimSuffix(g.Param("zone"), ".")
+	if g.ContentType() == "application/json" {
+		var e core.ZoneExport
+		if err = g.ShouldBindJSON(&e); err != nil {
+			badRequest(g, err)
+			return
+		}
+		if !strings.EqualFold(strings.TrimSuffix(e.Name, "."), zone) {
+			fail(g, http.StatusUnprocessableEntity, errors.Wrapf(core.ErrInvalid, "выгрузка зоны %s, а не %s", e.Name, zone))
+			return
+		}
+		if !h.importAllowed(g, zone, &e.Account) {
+			return
+		}
+		result, err := h.svc.LoadZone(g.Request.Context(), &e, dryRun)
+		respond(g, result, err)
+		return
+	}
+	records, err := zonefile.Parse(g.Request.Body, zone, nil)
+	if err != nil {
+		respond(g, nil, err)
+		return
+	}
+	z := &core.Zone{Name: zone, Kind: storedKind(g.Query("kind")), Account: g.Query("account")}
+	if !h.importAllowed(g, zone, &z.Account) {
+		return
+	}
+	result, err := h.svc.ImportZone(g.Request.Context(), z, records, dryRun)
+	respond(g, result, err)
+}
+
+// importAllowed ключу запроса можно загрузить зону владельца account. Ключ
+// владельца загружает новые зоны только себе, иначе ответ 403.
+func (h *Handler) importAllowed(g *gin.Context, zone string, account *string) bool {
+	key := auth.FromContext(g.Request.Context())
+	if key == nil {
+		return true
+	}
+	if *account == "" {
+		*account = key.Account
+	}
+	if !key.AllowsZone(zone, *account) {
+		fail(g, http.StatusForbidden, errors.Wrapf(auth.ErrForbidden, "ключ %s, зона %s владельца %q", key.Name, zone, *account))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/canonical/go-dqlite/client"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger общий логгер процесса. Уровень можно менять на лету через SetLevel.
+var Logger = logrus.New()
+
+// RequestIDHeader заголовок с идентификатором запроса. Если PowerDNS или
+// балансировщик его передали, идентификатор сохраняется, иначе создаётся новый.
+const RequestIDHeader = "X-Request-ID"
+
+var levels = map[string]logrus.Level{
+	"debug": logrus.DebugLevel,
+	"info":  logrus.InfoLevel,
+	"warn":  logrus.WarnLevel,
+	"error": logrus.ErrorLevel,
+}
+
+func init() {
+	Logger.SetOutput(os.Stderr)
+	Logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+}
+
+// Configure задаёт формат вывода (logfmt или json) и уровень
+func Configure(format, level string) error {
+	switch format {
+	case "logfmt", "text", "":
+		Logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	case "json":
+		Logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("неизвестный формат логов %s, допустимы: logfmt, json", format)
+	}
+	return SetLevel(level)
+}
+
+func SetLevel(level string) error {
+	l, ok := levels[level]
+	if !ok {
+		return errors.Errorf("неизвестный уровень логирования %s", level)
+	}
+	Logger.SetLevel(l)
+	return nil
+}
+
+// Level текущий уровень в тех же обозначениях, что и в конфигурации
+func Level() string {
+	current := Logger.GetLevel()
+	for name, l := range levels {
+		if l == current {
+			return name
+		}
+	}
+	return current.String()
+}
+
+type ctxKey struct{}
+
+// WithEntry сохраняет в контексте запись лога с полями запроса
+func WithEntry(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, ctxKey{}, entry)
+}
+
+// FromContext запись лога запроса или общий логгер, если запроса нет
+func FromContext(ctx context.Context) *logrus.Entry {
+	if ctx != nil {
+		if entry, ok := ctx.Value(ctxKey{}).(*logrus.Entry); ok {
+			return entry
+		}
+	}
+	return logrus.NewEntry(Logger)
+}
+
+// Middleware присваивает запросу идентификатор, кладёт в контекст запрос
+// запись лога с ним и после ответа пишет строку access лога
+func Middleware() gin.HandlerFunc {
+	return func(g *gin.Context) {
+		start := time.Now()
+		id := g.GetHeader(RequestIDHeader)
+		if id == "" {
+			id = uuid.NewString()
+		}
+		g.Header(RequestIDHeader, id)
+		entry := Logger.WithField("request_id", id)
+		g.Request = g.Request.WithContext(WithEntry(g.Request.Context(), entry))
+		g.Next()
+
+		status := g.Writer.Status()
+		entry = entry.WithFields(logrus.Fields{
+			"method":  g.Request.Method,
+			"path":    g.Request.URL.Path,
+			"status":  status,
+			"latency": time.Since(start).String(),
+		})
+		if len(g.Errors) != 0 {
+			entry = entry.WithField("errors", g.Errors.String())
+		}
+		switch {
+		case status >= 500:
+			entry.Error("request")
+		case status >= 400:
+			entry.Warn("request")
+		default:
+			entry.Debug("request")
+		}
+	}
+}
+
+var dqliteLevels = map[client.LogLevel]logrus.Level{
+	client.LogDebug: logrus.DebugLevel,
+	client.LogInfo:  logrus.InfoLevel,
+	client.LogWarn:  logrus.WarnLevel,
+	client.LogError: logrus.ErrorLevel,
+}
+
+// Dqlite перенаправляет сообщения dqlite в общий логгер, подходит для
+// app.WithLogFunc и driver.WithLogFunc
+func Dqlite(l client.LogLevel, format string, a ...interface{}) {
+	level, ok := dqliteLevels[l]
+	if !ok {
+		level = logrus.InfoLevel
+	}
+	if !Logger.IsLevelEnabled(level) {
+		return
+	}
+	Logger.WithField("component", "dqlite").Log(level, fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/canonical/go-dqlite/client"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func capture(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	out := Logger.Out
+	Logger.SetOutput(buf)
+	t.Cleanup(func() {
+		Logger.SetOutput(out)
+		require.NoError(t, Configure("logfmt", "info"))
+	})
+	return buf
+}
+
+func TestMiddleware(t *testing.T) {
+	buf := capture(t)
+	require.NoError(t, Configure("json", "debug"))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware())
+	r.GET("lookup/:qname/:qtype", func(g *gin.Context) {
+		FromContext(g.Request.Context()).Info("inside")
+		g.JSON(http.StatusOK, gin.H{"result": true})
+	})
+	req := httptest.NewRequest(http.MethodGet, "/lookup/example.com./SOA", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "abc", w.Header().Get(RequestIDHeader))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		entry := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, "abc", entry["request_id"])
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/lookup/example.com./NS", nil))
+	assert.NotEmpty(t, w.Header().Get(RequestIDHeader), "request id is generated")
+}
+
+func TestLevels(t *testing.T) {
+	buf := capture(t)
+	require.NoError(t, Configure("logfmt", "warn"))
+	assert.Equal(t, "warn", Level())
+	assert.Error(t, SetLevel("trace"))
+	assert.Error(t, Configure("xml", "info"))
+
+	Dqlite(client.LogInfo, "hidden %d", 1)
+	Dqlite(client.LogError, "shown %d", 2)
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), `msg="shown 2"`)
+	assert.Contains(t, buf.String(), "component=dqlite")
+
+	require.NoError(t, SetLevel("debug"))
+	Dqlite(client.LogDebug, "now visible")
+	assert.Contains(t, buf.String(), "now visible")
+}
@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pdns_dqlite"
+
+// Registry реестр метрик процесса, отдаётся на /metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_requests_total",
+		Help:      "Remote backend requests by method.",
+	}, []string{"method"})
+	requestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_errors_total",
+		Help:      "Remote backend requests answered with a 4xx or 5xx status.",
+	}, []string{"method"})
+	duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_request_duration_seconds",
+		Help:      "Remote backend request latency.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"method"})
+	queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_total",
+		Help:      "Named SQL query executions.",
+	}, []string{"query"})
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Service calls repeated after losing the dqlite leader.",
+	}, []string{"method"})
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cached service calls by method and result (hit or miss).",
+	}, []string{"method", "result"})
+	retriesExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_exhausted_total",
+		Help:      "Service calls that failed after retrying for the whole retry timeout.",
+	}, []string{"method"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requests, requestErrors, duration, queries, retries, retriesExhausted, cacheRequests,
+	)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// method имя метода remote backend из шаблона маршрута: lookup/:qname/:qtype -> lookup
+func method(g *gin.Context) string {
+	path := g.FullPath()
+	if path == "" {
+		return "not_found"
+	}
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/:"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// Middleware считает вызовы, ошибки и время ответа каждого метода
+func Middleware() gin.HandlerFunc {
+	return func(g *gin.Context) {
+		start := time.Now()
+		g.Next()
+		m := method(g)
+		requests.WithLabelValues(m).Inc()
+		duration.WithLabelValues(m).Observe(time.Since(start).Seconds())
+		if g.Writer.Status() >= http.StatusBadRequest {
+			requestErrors.WithLabelValues(m).Inc()
+		}
+	}
+}
+
+// Query отмечает выполнение именованного запроса
+func Query(name string) {
+	queries.WithLabelValues(name).Inc()
+}
+
+// Retry отмечает повтор вызова метода сервиса после потери лидера
+func Retry(method string) {
+	retries.WithLabelValues(method).Inc()
+}
+
+// RetryExhausted отмечает вызов, который не удался за всё время повторов
+func RetryExhausted(method string) {
+	retriesExhausted.WithLabelValues(method).Inc()
+}
+
+// Cache отмечает обращение к кэшу ответов
+func Cache(method string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(method, result).Inc()
+}
+
+// NodeStatus роль узла dqlite и признак лидерства
+type NodeStatus func(ctx context.Context) (role string, leader bool, err error)
+
+// Collector метрики, которые вычисляются при каждом опросе: число зон и
+// записей, открытые транзакции, роль узла dqlite
+type Collector struct {
+	db           *sql.DB
+	transactions func() int
+	node         NodeStatus
+	timeout      time.Duration
+
+	zones        *prometheus.Desc
+	records      *prometheus.Desc
+	openTx       *prometheus.Desc
+	role         *prometheus.Desc
+	leader       *prometheus.Desc
+	scrapeErrors *prometheus.Desc
+}
+
+var roles = []string{"voter", "stand-by", "spare"}
+
+func NewCollector(db *sql.DB, transactions func() int, node NodeStatus, timeout time.Duration) *Collector {
+	return &Collector{
+		db:           db,
+		transactions: transactions,
+		node:         node,
+		timeout:      timeout,
+		zones:        prometheus.NewDesc(namespace+"_zones", "Zones in the database.", nil, nil),
+		records:      prometheus.NewDesc(namespace+"_records", "Records in the database.", nil, nil),
+		openTx:       prometheus.NewDesc(namespace+"_open_transactions", "Open PowerDNS transactions.", nil, nil),
+		role:         prometheus.NewDesc(namespace+"_node_role", "Current dqlite role of the node.", []string{"role"}, nil),
+		leader:       prometheus.NewDesc(namespace+"_node_leader", "Whether the node is the dqlite leader.", nil, nil),
+		scrapeErrors: prometheus.NewDesc(namespace+"_scrape_error", "Whether the last collection of database or node metrics failed.", []string{"source"}, nil),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.zones
+	ch <- c.records
+	ch <- c.openTx
+	ch <- c.role
+	ch <- c.leader
+	ch <- c.scrapeErrors
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	ch <- prometheus.MustNewConstMetric(c.openTx, prometheus.GaugeValue, float64(c.transactions()))
+
+	var zones, records int
+	err := c.db.QueryRowContext(ctx, "SELECT (SELECT count(*) FROM domains), (SELECT count(*) FROM records)").Scan(&zones, &records)
+	if err == nil {
+		ch <- prometheus.MustNewConstMetric(c.zones, prometheus.GaugeValue, float64(zones))
+		ch <- prometheus.MustNewConstMetric(c.records, prometheus.GaugeValue, float64(records))
+	}
+	ch <- prometheus.MustNewConstMetric(c.scrapeErrors, prometheus.GaugeValue, flag(err != nil), "database")
+
+	role, leader, err := c.node(ctx)
+	if err == nil {
+		for _, r := range roles {
+			ch <- prometheus.MustNewConstMetric(c.role, prometheus.GaugeValue, flag(r == role), r)
+		}
+		ch <- prometheus.MustNewConstMetric(c.leader, prometheus.GaugeValue, flag(leader))
+	}
+	ch <- prometheus.MustNewConstMetric(c.scrapeErrors, prometheus.GaugeValue, flag(err != nil), "node")
+}
+
+func flag(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware())
+	r.GET("lookup/:qname/:qtype", func(g *gin.Context) { g.JSON(http.StatusOK, gin.H{"result": true}) })
+	r.GET("getdomaininfo/:name", func(g *gin.Context) { g.JSON(http.StatusNotFound, gin.H{"result": false}) })
+
+	for _, path := range []string{"/lookup/example.com./SOA", "/lookup/example.com./NS", "/getdomaininfo/example.com.", "/nothing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(requests.WithLabelValues("lookup")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(requestErrors.WithLabelValues("lookup")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requestErrors.WithLabelValues("getdomaininfo")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues("not_found")))
+
+	Query("basic-query")
+	assert.Equal(t, 1.0, testutil.ToFloat64(queries.WithLabelValues("basic-query")))
+}
+
+func TestCollector(t *testing.T) {
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(`INSERT INTO domains (id, name, type) VALUES (1, 'example.com', 'NATIVE')`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO records (domain_id, name, type, content) VALUES (1, 'example.com', 'NS', 'ns1.example.com'), (1, 'example.com', 'NS', 'ns2.example.com')`)
+	require.NoError(t, err)
+
+	node := func(ctx context.Context) (string, bool, error) { return "voter", true, nil }
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollector(db, func() int { return 3 }, node, time.Second))
+
+	expected := `
+# HELP pdns_dqlite_node_leader Whether the node is the dqlite leader.
+# TYPE pdns_dqlite_node_leader gauge
+pdns_dqlite_node_leader 1
+# HELP pdns_dqlite_node_role Current dqlite role of the node.
+# TYPE pdns_dqlite_node_role gauge
+pdns_dqlite_node_role{role="spare"} 0
+pdns_dqlite_node_role{role="stand-by"} 0
+pdns_dqlite_node_role{role="voter"} 1
+# HELP pdns_dqlite_open_transactions Open PowerDNS transactions.
+# TYPE pdns_dqlite_open_transactions gauge
+pdns_dqlite_open_transactions 3
+# HELP pdns_dqlite_records Records in the database.
+# TYPE pdns_dqlite_records gauge
+pdns_dqlite_records 2
+# HELP pdns_dqlite_zones Zones in the database.
+# TYPE pdns_dqlite_zones gauge
+pdns_dqlite_zones 1
+`
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"pdns_dqlite_node_leader", "pdns_dqlite_node_role", "pdns_dqlite_open_transactions",
+		"pdns_dqlite_records", "pdns_dqlite_zones"))
+}
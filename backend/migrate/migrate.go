@@ -0,0 +1,462 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Source база PowerDNS, из которой переносятся данные
+type Source interface {
+	// Scan вызывает fn для каждой строки таблицы table. Таблицы, которой нет
+	// в источнике, считается пустой.
+	Scan(ctx context.Context, table string, fn func(columns []string, values []interface{}) error) error
+	Close() error
+}
+
+// table таблица PowerDNS и её ключ, по которому сверяются перенесённые строки
+type table struct {
+	name string
+	key  []string
+}
+
+// tables таблицы в порядке копирования, сначала зоны, потом то, что на них ссылается
+var tables = []table{
+	{"domains", []string{"id"}},
+	{"records", []string{"id"}},
+	{"comments", []string{"id"}},
+	{"domainmetadata", []string{"id"}},
+	{"cryptokeys", []string{"id"}},
+	{"tsigkeys", []string{"id"}},
+	{"supermasters", []string{"ip", "nameserver"}},
+}
+
+// Result итог копирования таблицы
+type Result struct {
+	Table   string
+	Rows    int64    // строк в источнике
+	Copied  int64    // скопировано сейчас, остальные были скопированы раньше
+	Ignored []string // столбцы источника, которых нет в схеме dqlite
+}
+
+// Check сверка таблицы источника и dqlite
+type Check struct {
+	Table     string
+	Source    int64
+	Target    int64 // строк dqlite с ключами из источника
+	Other     int64 // остальных строк dqlite, в сверку не входят
+	SourceSum string
+	TargetSum string
+}
+
+// OK число строк и контрольные суммы совпадают
+func (c *Check) OK() bool {
+	return c.Source == c.Target && c.SourceSum == c.TargetSum
+}
+
+// markChangesQuery отмечает все зоны изменёнными, чтобы работающие узлы
+// сбросили кэш ответов
+const markChangesQuery = "REPLACE INTO changes (domain, serial) SELECT name, (SELECT COALESCE(MAX(serial), 0) + 1 FROM changes) FROM domains"
+
+// columnsOf столбцы таблицы в dqlite
+func columnsOf(ctx context.Context, db *sql.DB, name string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT * FROM "`+name+`" LIMIT 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+// common столбцы источника, которые есть в dqlite, в порядке dqlite, и их
+// номера в строке источника. Остальные столбцы источника возвращаются отдельно.
+func common(columns, target []string) (names []string, index []int, ignored []string) {
+	pos := make(map[string]int, len(columns))
+	for i, c := range columns {
+		pos[strings.ToLower(c)] = i
+	}
+	known := make(map[string]bool, len(target))
+	for _, c := range target {
+		known[c] = true
+		if i, ok := pos[c]; ok {
+			names = append(names, c)
+			index = append(index, i)
+		}
+	}
+	for _, c := range columns {
+		if !known[strings.ToLower(c)] {
+			ignored = append(ignored, c)
+		}
+	}
+	return names, index, ignored
+}
+
+// inserter пишет строки таблицы пачками по batch строк, каждая пачка в своей
+// транзакции. Строки, которые совпали с уже имеющимися по идентификатору
+// или уникальному индексу, пропускаются.
+type inserter struct {
+	ctx    context.Context
+	db     *sql.DB
+	table  table
+	target []string
+	batch  int
+	result *Result
+
+	layout  string   // столбцы источника, для которых подготовлен stmt
+	names   []string // столбцы dqlite, в которые пишется строка
+	index   []int
+	tx      *sql.Tx
+	stmt    *sql.Stmt
+	pending int
+}
+
+func (w *inserter) prepare(columns []string) error {
+	layout := strings.Join(columns, ",")
+	if w.index != nil && layout == w.layout {
+		return nil
+	}
+	if err := w.commit(); err != nil {
+		return err
+	}
+	names, index, ignored := common(columns, w.target)
+	have := make(map[string]bool, len(names))
+	for _, c := range names {
+		have[c] = true
+	}
+	for _, c := range w.table.key {
+		if !have[c] {
+			return errors.Errorf("в источнике нет столбца %s.%s", w.table.name, c)
+		}
+	}
+	for _, c := range ignored {
+		if !contains(w.result.Ignored, c) {
+			w.result.Ignored = append(w.result.Ignored, c)
+		}
+	}
+	w.layout, w.names, w.index = layout, names, index
+	return nil
+}
+
+func (w *inserter) insert(values []interface{}) error {
+	if w.tx == nil {
+		tx, err := w.db.BeginTx(w.ctx, nil)
+		if err != nil {
+			return err
+		}
+		w.tx = tx
+	}
+	if w.stmt == nil {
+		query := fmt.Sprintf(`INSERT INTO "%s" ("%s") VALUES (%s) ON CONFLICT DO NOTHING`,
+			w.table.name, strings.Join(w.names, `","`), strings.TrimSuffix(strings.Repeat("?,", len(w.names)), ","))
+		stmt, err := w.tx.PrepareContext(w.ctx, query)
+		if err != nil {
+			return err
+		}
+		w.stmt = stmt
+	}
+	args := make([]interface{}, len(w.index))
+	for i, j := range w.index {
+		args[i] = values[j]
+	}
+	res, err := w.stmt.ExecContext(w.ctx, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		w.result.Copied += n
+	}
+	w.pending++
+	if w.pending >= w.batch {
+		return w.commit()
+	}
+	return nil
+}
+
+// commit фиксирует пачку: после сбоя повторный запуск продолжит со следующей
+func (w *inserter) commit() error {
+	if w.tx == nil {
+		return nil
+	}
+	if w.stmt != nil {
+		w.stmt.Close()
+	}
+	err := w.tx.Commit()
+	w.tx, w.stmt, w.pending = nil, nil, 0
+	return err
+}
+
+func (w *inserter) rollback() {
+	if w.tx != nil {
+		w.tx.Rollback()
+		w.tx, w.stmt = nil, nil
+	}
+}
+
+// Copy переносит таблицы PowerDNS из src в db с сохранением идентификаторов.
+// Строки пишутся пачками по batch. Строки, которые нарушили бы идентификатор
+// или уникальный индекс db, пропускаются: так прерванный перенос продолжается
+// повторным запуском, а строку, которая столкнулась с другими данными, найдёт Verify.
+func Copy(ctx context.Context, src Source, db *sql.DB, batch int) ([]*Result, error) {
+	if batch <= 0 {
+		batch = 1
+	}
+	results := make([]*Result, 0, len(tables))
+	for _, t := range tables {
+		target, err := columnsOf(ctx, db, t.name)
+		if err != nil {
+			return results, errors.Wrapf(err, "не удалось прочитать столбцы %s", t.name)
+		}
+		result := &Result{Table: t.name}
+		w := &inserter{ctx: ctx, db: db, table: t, target: target, batch: batch, result: result}
+		err = src.Scan(ctx, t.name, func(columns []string, values []interface{}) error {
+			if err := w.prepare(columns); err != nil {
+				return err
+			}
+			result.Rows++
+			return w.insert(values)
+		})
+		if err == nil {
+			err = w.commit()
+		}
+		if err != nil {
+			w.rollback()
+			return results, errors.Wrapf(err, "не удалось перенести %s, строка %d", t.name, result.Rows)
+		}
+		results = append(results, result)
+	}
+	if _, err := db.ExecContext(ctx, markChangesQuery); err != nil {
+		return results, errors.Wrap(err, "не удалось отметить изменение зон")
+	}
+	return results, nil
+}
+
+// checksum число строк и сумма sha256 строк по модулю 2^256. От порядка
+// строк сумма не зависит, поэтому источник не нужно сортировать.
+type checksum struct {
+	rows  int64
+	total *big.Int
+}
+
+var modulus = new(big.Int).Lsh(big.NewInt(1), 256)
+
+func newChecksum() *checksum {
+	return &checksum{total: new(big.Int)}
+}
+
+func (c *checksum) add(values []interface{}) {
+	h := sha256.New()
+	for _, v := range values {
+		if s, ok := text(v); ok {
+			fmt.Fprintf(h, "V%d:%s", len(s), s)
+		} else {
+			h.Write([]byte("N"))
+		}
+	}
+	c.rows++
+	c.total.Add(c.total, new(big.Int).SetBytes(h.Sum(nil)))
+	c.total.Mod(c.total, modulus)
+}
+
+func (c *checksum) String() string {
+	sum := make([]byte, 32)
+	return hex.EncodeToString(c.total.FillBytes(sum))
+}
+
+// text значение в одном виде для всех источников: драйвер dqlite отдаёт
+// BOOLEAN как bool, sqlite как число, а в выгрузке mysqldump числа могут
+// стоять в кавычках. Второе значение false для NULL.
+func text(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	case time.Time:
+		return v.Format(time.RFC3339Nano), true
+	}
+	return fmt.Sprint(v), true
+}
+
+// keySet ключи перенесённых строк. Целые идентификаторы хранятся
+// отсортированным срезом, чтобы миллионы записей занимали немного памяти.
+type keySet struct {
+	ids    []int64
+	sorted bool
+	other  map[string]bool
+}
+
+func newKeySet() *keySet {
+	return &keySet{other: make(map[string]bool)}
+}
+
+func keyOf(values []interface{}) (int64, string, bool) {
+	if len(values) == 1 {
+		if s, ok := text(values[0]); ok {
+			if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return id, "", true
+			}
+		}
+	}
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i], _ = text(v)
+	}
+	return 0, strings.Join(parts, "\x00"), false
+}
+
+func (k *keySet) add(values []interface{}) {
+	if id, s, ok := keyOf(values); ok {
+		k.ids = append(k.ids, id)
+		k.sorted = false
+	} else {
+		k.other[s] = true
+	}
+}
+
+func (k *keySet) has(values []interface{}) bool {
+	id, s, ok := keyOf(values)
+	if !ok {
+		return k.other[s]
+	}
+	if !k.sorted {
+		sort.Slice(k.ids, func(i, j int) bool { return k.ids[i] < k.ids[j] })
+		k.sorted = true
+	}
+	i := sort.Search(len(k.ids), func(i int) bool { return k.ids[i] >= id })
+	return i < len(k.ids) && k.ids[i] == id
+}
+
+// Verify сверяет число строк и контрольные суммы таблиц src и db по столбцам,
+// которые есть в обеих базах. В сверку входят только строки db с ключами из
+// src, данные, которые были в db до переноса, не мешают. Если хоть одна
+// таблица не совпала, кроме результата возвращается ошибка.
+func Verify(ctx context.Context, src Source, db *sql.DB) ([]*Check, error) {
+	checks := make([]*Check, 0, len(tables))
+	var failed []string
+	for _, t := range tables {
+		target, err := columnsOf(ctx, db, t.name)
+		if err != nil {
+			return checks, errors.Wrapf(err, "не удалось прочитать столбцы %s", t.name)
+		}
+		// Столбцы сверки определяются по первой строке источника, пустой
+		// источник сверяется по всем столбцам dqlite
+		names := target
+		var layout string
+		var index []int
+		sum := newChecksum()
+		keys := newKeySet()
+		err = src.Scan(ctx, t.name, func(columns []string, values []interface{}) error {
+			if l := strings.Join(columns, ","); l != layout {
+				n, i, _ := common(columns, target)
+				if layout != "" && strings.Join(n, ",") != strings.Join(names, ",") {
+					return errors.New("в источнике строки с разными наборами столбцов")
+				}
+				layout, names, index = l, n, i
+			}
+			row := make([]interface{}, len(index))
+			for i, j := range index {
+				row[i] = values[j]
+			}
+			sum.add(row)
+			key, err := pick(names, t.key, row)
+			if err != nil {
+				return err
+			}
+			keys.add(key)
+			return nil
+		})
+		if err != nil {
+			return checks, errors.Wrapf(err, "не удалось прочитать %s из источника", t.name)
+		}
+		got, other, err := tableChecksum(ctx, db, t, names, keys)
+		if err != nil {
+			return checks, errors.Wrapf(err, "не удалось прочитать %s из dqlite", t.name)
+		}
+		check := &Check{Table: t.name, Source: sum.rows, Target: got.rows, Other: other,
+			SourceSum: sum.String(), TargetSum: got.String()}
+		if !check.OK() {
+			failed = append(failed, t.name)
+		}
+		checks = append(checks, check)
+	}
+	if len(failed) != 0 {
+		return checks, errors.Errorf("данные не совпадают с источником: %s", strings.Join(failed, ", "))
+	}
+	return checks, nil
+}
+
+// pick значения столбцов key из строки со столбцами names
+func pick(names, key []string, row []interface{}) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(key))
+	for _, k := range key {
+		i := 0
+		for i < len(names) && names[i] != k {
+			i++
+		}
+		if i == len(names) {
+			return nil, errors.Errorf("в источнике нет столбца %s", k)
+		}
+		values = append(values, row[i])
+	}
+	return values, nil
+}
+
+// tableChecksum контрольная сумма строк таблицы с ключами из keys и число остальных строк
+func tableChecksum(ctx context.Context, db *sql.DB, t table, columns []string, keys *keySet) (*checksum, int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT "`+strings.Join(columns, `","`)+`" FROM "`+t.name+`"`)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	sum := newChecksum()
+	var other int64
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, 0, err
+		}
+		key, err := pick(columns, t.key, values)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !keys.has(key) {
+			other++
+			continue
+		}
+		sum.add(values)
+	}
+	return sum, other, rows.Err()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gsqlite3 схема PowerDNS 4.7: в domains есть options и catalog, которых нет в dqlite
+const gsqlite3 = `
+CREATE TABLE domains (id INTEGER PRIMARY KEY, name VARCHAR(255) NOT NULL COLLATE NOCASE, master VARCHAR(128) DEFAULT NULL,
+  last_check INTEGER DEFAULT NULL, type VARCHAR(8) NOT NULL, notified_serial INTEGER DEFAULT NULL,
+  account VARCHAR(40) DEFAULT NULL, options VARCHAR(65535) DEFAULT NULL, catalog VARCHAR(255) DEFAULT NULL);
+CREATE TABLE records (id INTEGER PRIMARY KEY, domain_id INTEGER DEFAULT NULL, name VARCHAR(255) DEFAULT NULL,
+  type VARCHAR(10) DEFAULT NULL, content VARCHAR(65535) DEFAULT NULL, ttl INTEGER DEFAULT NULL, prio INTEGER DEFAULT NULL,
+  disabled BOOLEAN DEFAULT 0, ordername VARCHAR(255), auth BOOL DEFAULT 1);
+CREATE TABLE supermasters (ip VARCHAR(64) NOT NULL, nameserver VARCHAR(255) NOT NULL COLLATE NOCASE, account VARCHAR(40) NOT NULL);
+CREATE TABLE domainmetadata (id INTEGER PRIMARY KEY, domain_id INT NOT NULL, kind VARCHAR(32) COLLATE NOCASE, content TEXT);
+CREATE TABLE tsigkeys (id INTEGER PRIMARY KEY, name VARCHAR(255) COLLATE NOCASE, algorithm VARCHAR(50) COLLATE NOCASE, secret VARCHAR(255));
+INSERT INTO domains VALUES (3, 'example.com', NULL, NULL, 'NATIVE', NULL, 'team', NULL, NULL);
+INSERT INTO domains VALUES (9, 'example.org', '192.0.2.1', 1600000000, 'SLAVE', 7, NULL, NULL, NULL);
+INSERT INTO records VALUES (10, 3, 'example.com', 'SOA', 'ns1.example.com hostmaster.example.com 1 10800 3600 604800 300', 3600, 0, 0, '', 1);
+INSERT INTO records VALUES (11, 3, 'www.example.com', 'TXT', '"it''s"' || char(10), 300, NULL, 1, 'www', 1);
+INSERT INTO records VALUES (12, 3, 'example.com', 'MX', 'mx.example.com', 300, 10, 0, NULL, 1);
+INSERT INTO records VALUES (40, 9, 'example.org', 'A', '192.0.2.9', 60, 0, 0, NULL, 1);
+INSERT INTO supermasters VALUES ('192.0.2.1', 'ns1.example.org', 'team');
+INSERT INTO domainmetadata VALUES (5, 3, 'ALSO-NOTIFY', '192.0.2.7');
+INSERT INTO tsigkeys VALUES (2, 'key', 'hmac-sha256', 'c2VjcmV0');
+`
+
+func newSource(t *testing.T) Source {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pdns.sqlite3")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(gsqlite3)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	src, err := OpenSQLite(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { src.Close() })
+	return src
+}
+
+func newTarget(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := storage.NewMemory()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func copied(results []*Result) map[string]int64 {
+	m := make(map[string]int64)
+	for _, r := range results {
+		m[r.Table] = r.Copied
+	}
+	return m
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	src := newSource(t)
+	db := newTarget(t)
+
+	results, err := Copy(ctx, src, db, 2)
+	require.NoError(t, err)
+	require.Len(t, results, len(tables))
+	assert.Equal(t, &Result{Table: "domains", Rows: 2, Copied: 2, Ignored: []string{"options", "catalog"}}, results[0])
+	assert.Equal(t, map[string]int64{"domains": 2, "records": 4, "comments": 0, "domainmetadata": 1, "cryptokeys": 0, "tsigkeys": 1, "supermasters": 1}, copied(results))
+
+	// Идентификаторы сохраняются, новые записи продолжают нумерацию источника
+	var name string
+	require.NoError(t, db.QueryRow("SELECT name FROM records WHERE id = 40 AND domain_id = 9").Scan(&name))
+	assert.Equal(t, "example.org", name)
+	_, err = db.Exec("INSERT INTO records (domain_id, name, type, content) VALUES (3, 'new.example.com', 'A', '192.0.2.2')")
+	require.NoError(t, err)
+	var id int
+	require.NoError(t, db.QueryRow("SELECT id FROM records WHERE name = 'new.example.com'").Scan(&id))
+	assert.Equal(t, 41, id)
+	_, err = db.Exec("DELETE FROM records WHERE id = 41")
+	require.NoError(t, err)
+
+	// Зоны отмечены изменёнными для сброса кэша
+	var changes int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM changes").Scan(&changes))
+	assert.Equal(t, 2, changes)
+
+	checks, err := Verify(ctx, src, db)
+	require.NoError(t, err)
+	for _, c := range checks {
+		assert.True(t, c.OK(), c.Table)
+	}
+	assert.Equal(t, int64(4), checks[1].Target)
+}
+
+func TestCopyResume(t *testing.T) {
+	ctx := context.Background()
+	src := newSource(t)
+	db := newTarget(t)
+	_, err := Copy(ctx, src, db, 1)
+	require.NoError(t, err)
+
+	// Прерванный перенос: часть строк не дошла до dqlite
+	_, err = db.Exec("DELETE FROM records WHERE id > 10")
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM supermasters")
+	require.NoError(t, err)
+	_, err = Verify(ctx, src, db)
+	assert.EqualError(t, err, "данные не совпадают с источником: records, supermasters")
+
+	results, err := Copy(ctx, src, db, 100)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"domains": 0, "records": 3, "comments": 0, "domainmetadata": 0, "cryptokeys": 0, "tsigkeys": 0, "supermasters": 1}, copied(results))
+	assert.Equal(t, int64(4), results[1].Rows)
+	_, err = Verify(ctx, src, db)
+	require.NoError(t, err)
+
+	// Изменённая после переноса строка видна по контрольной сумме
+	_, err = db.Exec("UPDATE records SET disabled = 0 WHERE id = 11")
+	require.NoError(t, err)
+	checks, err := Verify(ctx, src, db)
+	assert.EqualError(t, err, "данные не совпадают с источником: records")
+	assert.Equal(t, checks[1].Source, checks[1].Target)
+	assert.NotEqual(t, checks[1].SourceSum, checks[1].TargetSum)
+}
+
+func TestCopyExisting(t *testing.T) {
+	ctx := context.Background()
+	src := newSource(t)
+	db := newTarget(t)
+	// Зона, которая была в dqlite до переноса, в сверку не входит
+	_, err := db.Exec("INSERT INTO domains (id, name, type) VALUES (100, 'example.net', 'NATIVE')")
+	require.NoError(t, err)
+	_, err = Copy(ctx, src, db, 500)
+	require.NoError(t, err)
+	checks, err := Verify(ctx, src, db)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), checks[0].Target)
+	assert.Equal(t, int64(1), checks[0].Other)
+
+	// Зона с тем же именем и другим идентификатором не ломает перенос,
+	// а расхождение видно при сверке
+	db = newTarget(t)
+	_, err = db.Exec("INSERT INTO domains (id, name, type) VALUES (100, 'example.org', 'NATIVE')")
+	require.NoError(t, err)
+	results, err := Copy(ctx, src, db, 500)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), results[0].Copied)
+	checks, err = Verify(ctx, src, db)
+	assert.EqualError(t, err, "данные не совпадают с источником: domains")
+	assert.Equal(t, int64(2), checks[0].Source)
+	assert.Equal(t, int64(1), checks[0].Target)
+}
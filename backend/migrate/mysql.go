@@ -0,0 +1,516 @@
+package migrate
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dumpSource выгрузка базы gmysql, сделанная mysqldump. Файл читается заново
+// для каждой таблицы, поэтому в памяти держится только одна строка.
+type dumpSource struct {
+	path string
+}
+
+// OpenMySQLDump открывает выгрузку mysqldump, сжатую gzip, если имя
+// оканчивается на .gz. Понимаются CREATE TABLE и INSERT с несколькими
+// строками, с перечнем столбцов и без него.
+func OpenMySQLDump(path string) (Source, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return &dumpSource{path: path}, nil
+}
+
+func (s *dumpSource) Scan(ctx context.Context, table string, fn func(columns []string, values []interface{}) error) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(s.path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return errors.Wrapf(err, "не могу распаковать %s", s.path)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	if err = scanDump(ctx, r, table, fn); err != nil {
+		return errors.Wrap(err, s.path)
+	}
+	return nil
+}
+
+func (s *dumpSource) Close() error {
+	return nil
+}
+
+// Виды лексем выгрузки
+const (
+	tokenEOF    = iota
+	tokenWord   // ключевое слово, NULL или число
+	tokenName   // имя в обратных кавычках
+	tokenString // строка в кавычках
+	tokenPunct  // скобки, запятые и прочие знаки
+)
+
+type token struct {
+	kind int
+	text string
+}
+
+func (t token) is(kind int, text string) bool {
+	return t.kind == kind && strings.EqualFold(t.text, text)
+}
+
+// lexer делит выгрузку на лексемы, пропуская комментарии
+type lexer struct {
+	r    *bufio.Reader
+	line int
+	back *token
+}
+
+func newLexer(r io.Reader) *lexer {
+	return &lexer{r: bufio.NewReaderSize(r, 64*1024), line: 1}
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return errors.Errorf("строка %d: "+format, append([]interface{}{l.line}, args...)...)
+}
+
+func (l *lexer) read() (byte, bool) {
+	c, err := l.r.ReadByte()
+	if err != nil {
+		return 0, false
+	}
+	if c == '\n' {
+		l.line++
+	}
+	return c, true
+}
+
+func (l *lexer) unread(c byte) {
+	l.r.UnreadByte()
+	if c == '\n' {
+		l.line--
+	}
+}
+
+func (l *lexer) peek() byte {
+	b, err := l.r.Peek(1)
+	if err != nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (l *lexer) skipLine() {
+	for {
+		c, ok := l.read()
+		if !ok || c == '\n' {
+			return
+		}
+	}
+}
+
+func isWord(c byte) bool {
+	return c == '_' || c == '$' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// next следующая лексема. Комментарии -- и # до конца строки и /* */,
+// в том числе условные /*!40101 ... */, пропускаются.
+func (l *lexer) next() (token, error) {
+	if l.back != nil {
+		t := *l.back
+		l.back = nil
+		return t, nil
+	}
+	for {
+		c, ok := l.read()
+		switch {
+		case !ok:
+			return token{kind: tokenEOF}, nil
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case c == '#':
+			l.skipLine()
+		case c == '-' && l.peek() == '-':
+			l.skipLine()
+		case c == '/' && l.peek() == '*':
+			l.read()
+			for prev := byte(0); ; {
+				c, ok = l.read()
+				if !ok {
+					return token{}, l.errorf("комментарий не закрыт")
+				}
+				if prev == '*' && c == '/' {
+					break
+				}
+				prev = c
+			}
+		case c == '`':
+			return l.quoted('`', tokenName)
+		case c == '\'' || c == '"':
+			return l.quoted(c, tokenString)
+		case isWord(c) || c == '-' || c == '+':
+			var b strings.Builder
+			b.WriteByte(c)
+			for {
+				c, ok = l.read()
+				if !ok {
+					break
+				}
+				last := b.String()[b.Len()-1]
+				if !isWord(c) && !((c == '-' || c == '+') && (last == 'e' || last == 'E')) {
+					l.unread(c)
+					break
+				}
+				b.WriteByte(c)
+			}
+			return token{kind: tokenWord, text: b.String()}, nil
+		default:
+			return token{kind: tokenPunct, text: string(c)}, nil
+		}
+	}
+}
+
+// quoted строка или имя до закрывающей кавычки q. В строках понимаются
+// экранирования MySQL через \ и удвоенная кавычка.
+func (l *lexer) quoted(q byte, kind int) (token, error) {
+	var b strings.Builder
+	for {
+		c, ok := l.read()
+		if !ok {
+			return token{}, l.errorf("кавычка %c не закрыта", q)
+		}
+		switch {
+		case c == q && l.peek() == q:
+			l.read()
+			b.WriteByte(q)
+		case c == q:
+			return token{kind: kind, text: b.String()}, nil
+		case c == '\\' && kind == tokenString:
+			c, ok = l.read()
+			if !ok {
+				return token{}, l.errorf("кавычка %c не закрыта", q)
+			}
+			switch c {
+			case '0':
+				b.WriteByte(0)
+			case 'b':
+				b.WriteByte('\b')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'Z':
+				b.WriteByte(26)
+			case '%', '_':
+				// В LIKE \% и \_ остаются как есть
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			default:
+				b.WriteByte(c)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (l *lexer) push(t token) {
+	l.back = &t
+}
+
+// skip пропускает лексемы до конца команды
+func (l *lexer) skip() error {
+	for {
+		t, err := l.next()
+		if err != nil || t.kind == tokenEOF || t.is(tokenPunct, ";") {
+			return err
+		}
+	}
+}
+
+// name имя таблицы, возможно с именем базы через точку
+func (l *lexer) name() (string, error) {
+	t, err := l.next()
+	if err != nil {
+		return "", err
+	}
+	if t.kind != tokenName && t.kind != tokenWord {
+		return "", l.errorf("ожидалось имя таблицы, а не %q", t.text)
+	}
+	name := t.text
+	if t.kind == tokenWord {
+		// Имя без кавычек лексер читает вместе с точкой
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			name = name[i+1:]
+		}
+		return name, nil
+	}
+	next, err := l.next()
+	if err != nil {
+		return "", err
+	}
+	// Точка между именами в кавычках читается как слово
+	if !next.is(tokenWord, ".") {
+		l.push(next)
+		return name, nil
+	}
+	return l.name()
+}
+
+// scanDump вызывает fn для каждой строки table в выгрузке
+func scanDump(ctx context.Context, r io.Reader, table string, fn func(columns []string, values []interface{}) error) error {
+	l := newLexer(r)
+	var created []string
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t, err := l.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case t.kind == tokenEOF:
+			return nil
+		case t.is(tokenPunct, ";"):
+		case t.is(tokenWord, "CREATE"):
+			t, err = l.next()
+			if err != nil {
+				return err
+			}
+			if !t.is(tokenWord, "TABLE") {
+				err = l.skip()
+				break
+			}
+			var columns []string
+			if columns, err = l.create(table); err == nil && columns != nil {
+				created = columns
+			}
+		case t.is(tokenWord, "INSERT") || t.is(tokenWord, "REPLACE"):
+			err = l.insert(table, created, fn)
+		default:
+			err = l.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// create читает CREATE TABLE и возвращает столбцы, если это таблица table
+func (l *lexer) create(table string) ([]string, error) {
+	var name string
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.is(tokenWord, "IF") || t.is(tokenWord, "NOT") || t.is(tokenWord, "EXISTS") {
+			continue
+		}
+		l.push(t)
+		if name, err = l.name(); err != nil {
+			return nil, err
+		}
+		break
+	}
+	if !strings.EqualFold(name, table) {
+		return nil, l.skip()
+	}
+	if t, err := l.next(); err != nil || !t.is(tokenPunct, "(") {
+		if err == nil {
+			err = l.errorf("ожидалось ( после CREATE TABLE %s", name)
+		}
+		return nil, err
+	}
+	columns := make([]string, 0)
+	for {
+		// Определение начинается с имени столбца в кавычках или со слова
+		// PRIMARY, KEY, UNIQUE, CONSTRAINT и других, которые не столбцы
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.kind == tokenName {
+			columns = append(columns, t.text)
+		}
+		for depth := 0; ; {
+			if t.kind == tokenEOF {
+				return nil, l.errorf("CREATE TABLE %s не закончен", name)
+			}
+			if t, err = l.next(); err != nil {
+				return nil, err
+			}
+			if t.is(tokenPunct, "(") {
+				depth++
+			} else if t.is(tokenPunct, ")") && depth > 0 {
+				depth--
+			} else if depth == 0 && (t.is(tokenPunct, ",") || t.is(tokenPunct, ")")) {
+				break
+			}
+		}
+		if t.is(tokenPunct, ")") {
+			return columns, l.skip()
+		}
+	}
+}
+
+// insert читает INSERT и вызывает fn для строк, если это таблица table.
+// Без перечня столбцов используются столбцы из CREATE TABLE.
+func (l *lexer) insert(table string, created []string, fn func(columns []string, values []interface{}) error) error {
+	var name string
+	for {
+		t, err := l.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case t.is(tokenWord, "INTO"), t.is(tokenWord, "IGNORE"), t.is(tokenWord, "LOW_PRIORITY"),
+			t.is(tokenWord, "DELAYED"), t.is(tokenWord, "HIGH_PRIORITY"):
+			continue
+		}
+		l.push(t)
+		if name, err = l.name(); err != nil {
+			return err
+		}
+		break
+	}
+	if !strings.EqualFold(name, table) {
+		return l.skip()
+	}
+	columns := created
+	t, err := l.next()
+	if err != nil {
+		return err
+	}
+	if t.is(tokenPunct, "(") {
+		columns = make([]string, 0)
+		for {
+			if t, err = l.next(); err != nil {
+				return err
+			}
+			if t.kind != tokenName && t.kind != tokenWord {
+				return l.errorf("ожидалось имя столбца, а не %q", t.text)
+			}
+			columns = append(columns, t.text)
+			if t, err = l.next(); err != nil {
+				return err
+			}
+			if t.is(tokenPunct, ")") {
+				break
+			}
+			if !t.is(tokenPunct, ",") {
+				return l.errorf("ожидалась запятая, а не %q", t.text)
+			}
+		}
+		if t, err = l.next(); err != nil {
+			return err
+		}
+	}
+	if !t.is(tokenWord, "VALUES") && !t.is(tokenWord, "VALUE") {
+		return l.errorf("ожидалось VALUES, а не %q", t.text)
+	}
+	if columns == nil {
+		return l.errorf("нет CREATE TABLE %s, выгрузите схему вместе с данными или с --complete-insert", table)
+	}
+	values := make([]interface{}, 0, len(columns))
+	for {
+		if t, err = l.next(); err != nil {
+			return err
+		}
+		if !t.is(tokenPunct, "(") {
+			return l.errorf("ожидалась (, а не %q", t.text)
+		}
+		values = values[:0]
+		for {
+			v, err := l.value()
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+			if t, err = l.next(); err != nil {
+				return err
+			}
+			if t.is(tokenPunct, ")") {
+				break
+			}
+			if !t.is(tokenPunct, ",") {
+				return l.errorf("ожидалась запятая, а не %q", t.text)
+			}
+		}
+		if len(values) != len(columns) {
+			return l.errorf("в строке %s %d значений, а столбцов %d", table, len(values), len(columns))
+		}
+		if err = fn(columns, values); err != nil {
+			return err
+		}
+		if t, err = l.next(); err != nil {
+			return err
+		}
+		switch {
+		case t.is(tokenPunct, ","):
+		case t.is(tokenPunct, ";"), t.kind == tokenEOF:
+			return nil
+		default:
+			// ON DUPLICATE KEY UPDATE и прочее после строк не нужно
+			return l.skip()
+		}
+	}
+}
+
+// value значение в строке INSERT: строка, NULL, число или 0x в шестнадцатеричном
+// виде. Кодировка перед строкой, например _binary, пропускается.
+func (l *lexer) value() (interface{}, error) {
+	t, err := l.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind == tokenWord && strings.HasPrefix(t.text, "_") {
+		if t, err = l.next(); err != nil {
+			return nil, err
+		}
+	}
+	switch t.kind {
+	case tokenString:
+		return t.text, nil
+	case tokenWord:
+	default:
+		return nil, l.errorf("ожидалось значение, а не %q", t.text)
+	}
+	switch s := t.text; {
+	case strings.EqualFold(s, "NULL"):
+		return nil, nil
+	case strings.EqualFold(s, "TRUE"):
+		return int64(1), nil
+	case strings.EqualFold(s, "FALSE"):
+		return int64(0), nil
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		b, err := hex.DecodeString(s[2:])
+		if err != nil {
+			return nil, l.errorf("неверное значение %s", s)
+		}
+		return string(b), nil
+	default:
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+		return nil, l.errorf("неверное значение %s", s)
+	}
+}
@@ -0,0 +1,112 @@
+package migrate
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dump = "-- MySQL dump 10.13  Distrib 8.0.35\n" +
+	"/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;\n" +
+	"DROP TABLE IF EXISTS `domains`;\n" +
+	"CREATE TABLE `domains` (\n" +
+	"  `id` int NOT NULL AUTO_INCREMENT,\n" +
+	"  `name` varchar(255) NOT NULL,\n" +
+	"  `master` varchar(128) DEFAULT NULL,\n" +
+	"  `last_check` int DEFAULT NULL,\n" +
+	"  `type` varchar(8) NOT NULL,\n" +
+	"  `notified_serial` int unsigned DEFAULT NULL,\n" +
+	"  `account` varchar(40) CHARACTER SET utf8mb3 DEFAULT NULL,\n" +
+	"  `options` varchar(64000) DEFAULT NULL,\n" +
+	"  `catalog` varchar(255) DEFAULT NULL,\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  UNIQUE KEY `name_index` (`name`),\n" +
+	"  KEY `catalog_idx` (`catalog`)\n" +
+	") ENGINE=InnoDB AUTO_INCREMENT=10 DEFAULT CHARSET=latin1;\n" +
+	"LOCK TABLES `domains` WRITE;\n" +
+	"/*!40000 ALTER TABLE `domains` DISABLE KEYS */;\n" +
+	"INSERT INTO `domains` VALUES (3,'example.com',NULL,NULL,'NATIVE',NULL,'team',NULL,NULL),(9,'example.org','192.0.2.1',1600000000,'SLAVE',7,NULL,NULL,NULL);\n" +
+	"/*!40000 ALTER TABLE `domains` ENABLE KEYS */;\n" +
+	"UNLOCK TABLES;\n" +
+	"CREATE TABLE `records` (\n" +
+	"  `id` bigint NOT NULL AUTO_INCREMENT,\n" +
+	"  `domain_id` int DEFAULT NULL,\n" +
+	"  `name` varchar(255) DEFAULT NULL,\n" +
+	"  `type` varchar(10) DEFAULT NULL,\n" +
+	"  `content` varchar(64000) DEFAULT NULL,\n" +
+	"  `ttl` int DEFAULT NULL,\n" +
+	"  `prio` int DEFAULT NULL,\n" +
+	"  `disabled` tinyint(1) DEFAULT '0',\n" +
+	"  `ordername` varchar(255) CHARACTER SET latin1 COLLATE latin1_bin DEFAULT NULL,\n" +
+	"  `auth` tinyint(1) DEFAULT '1',\n" +
+	"  PRIMARY KEY (`id`)\n" +
+	");\n" +
+	"INSERT INTO `records` VALUES (10,3,'example.com','SOA','ns1.example.com hostmaster.example.com 1 10800 3600 604800 300',3600,0,0,'',1),\n" +
+	"(11,3,'www.example.com','TXT','\\\"it\\'s\\\"\\n',300,NULL,1,'www',1),(12,3,'example.com','MX','mx.example.com',300,10,0,NULL,1);\n" +
+	"INSERT INTO `records` VALUES (40,9,'example.org','A','192.0.2.9',60,0,0,NULL,1);\n" +
+	"INSERT INTO `supermasters` (`ip`, `nameserver`, `account`) VALUES ('192.0.2.1','ns1.example.org','team');\n" +
+	"INSERT INTO `domainmetadata` (`id`,`domain_id`,`kind`,`content`) VALUES (5,3,'ALSO-NOTIFY','192.0.2.7');\n" +
+	"INSERT INTO `tsigkeys` (`id`,`name`,`algorithm`,`secret`) VALUES (2,'key','hmac-sha256',_binary 'c2VjcmV0');\n"
+
+func scanAll(t *testing.T, text, table string) (columns []string, rows [][]interface{}) {
+	t.Helper()
+	err := scanDump(context.Background(), strings.NewReader(text), table, func(c []string, values []interface{}) error {
+		columns = c
+		rows = append(rows, append([]interface{}(nil), values...))
+		return nil
+	})
+	require.NoError(t, err)
+	return columns, rows
+}
+
+func TestScanDump(t *testing.T) {
+	columns, rows := scanAll(t, dump, "records")
+	assert.Equal(t, []string{"id", "domain_id", "name", "type", "content", "ttl", "prio", "disabled", "ordername", "auth"}, columns)
+	require.Len(t, rows, 4)
+	assert.Equal(t, []interface{}{int64(11), int64(3), "www.example.com", "TXT", "\"it's\"\n", int64(300), nil, int64(1), "www", int64(1)}, rows[1])
+	assert.Equal(t, int64(40), rows[3][0])
+
+	columns, rows = scanAll(t, dump, "domains")
+	assert.Len(t, columns, 9)
+	assert.Equal(t, []interface{}{int64(9), "example.org", "192.0.2.1", int64(1600000000), "SLAVE", int64(7), nil, nil, nil}, rows[1])
+
+	_, rows = scanAll(t, dump, "tsigkeys")
+	assert.Equal(t, [][]interface{}{{int64(2), "key", "hmac-sha256", "c2VjcmV0"}}, rows)
+
+	_, rows = scanAll(t, dump, "comments")
+	assert.Empty(t, rows)
+
+	err := scanDump(context.Background(), strings.NewReader("INSERT INTO t VALUES (1);"), "t", nil)
+	assert.EqualError(t, err, "строка 1: нет CREATE TABLE t, выгрузите схему вместе с данными или с --complete-insert")
+	_, rows = scanAll(t, "INSERT INTO `pdns`.`t` (`a`,`b`,`c`,`d`) VALUES ('a''b', 0x6869, -1.5, 'x\\\\y');", "t")
+	assert.Equal(t, [][]interface{}{{"a'b", "hi", -1.5, `x\y`}}, rows)
+	err = scanDump(context.Background(), strings.NewReader("INSERT INTO t (a) VALUES (1, 2);"), "t", nil)
+	assert.EqualError(t, err, "строка 1: в строке t 2 значений, а столбцов 1")
+}
+
+func TestCopyDump(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "pdns.sql")
+	require.NoError(t, ioutil.WriteFile(path, []byte(dump), 0o644))
+	src, err := OpenMySQLDump(path)
+	require.NoError(t, err)
+	db := newTarget(t)
+
+	results, err := Copy(ctx, src, db, 500)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"domains": 2, "records": 4, "comments": 0, "domainmetadata": 1, "cryptokeys": 0, "tsigkeys": 1, "supermasters": 1}, copied(results))
+	_, err = Verify(ctx, src, db)
+	require.NoError(t, err)
+
+	// Данные из выгрузки MySQL совпадают с теми же данными из gsqlite3
+	sqlite, err := Verify(ctx, newSource(t), db)
+	require.NoError(t, err)
+	mysql, err := Verify(ctx, src, db)
+	require.NoError(t, err)
+	assert.Equal(t, sqlite, mysql)
+}
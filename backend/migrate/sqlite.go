@@ -0,0 +1,64 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSource база gsqlite3 PowerDNS, открытая только для чтения
+type sqliteSource struct {
+	db *sql.DB
+}
+
+// OpenSQLite открывает базу gsqlite3 только для чтения. PowerDNS можно
+// не останавливать, но то, что он запишет после переноса, не попадёт в dqlite.
+func OpenSQLite(path string) (Source, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+(&url.URL{Path: path}).EscapedPath()+"?mode=ro")
+	if err != nil {
+		return nil, errors.Wrapf(err, "не удалось открыть %s", path)
+	}
+	return &sqliteSource{db: db}, nil
+}
+
+func (s *sqliteSource) Scan(ctx context.Context, table string, fn func(columns []string, values []interface{}) error) error {
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?", table).Scan(&n)
+	if err != nil || n == 0 {
+		return err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT * FROM "`+table+`"`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		if err = fn(columns, values); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteSource) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivan-bokov/pdns-dqlite/backend/auth"
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/pkg/errors"
+)
+
+// Все ответы имеют вид {"result": ..., "log": [...]}, как ждёт remote backend.
+// Строки log PowerDNS пишет в свой лог, поэтому текст ошибки всегда попадает туда.
+
+func ok(g *gin.Context, result interface{}) {
+	g.JSON(http.StatusOK, gin.H{"result": result})
+}
+
+// fail отвечает {"result": false} с текстом ошибки в log. Ошибка добавляется
+// в g.Errors и попадает в строку access лога.
+func fail(g *gin.Context, status int, err error) {
+	g.Error(err)
+	g.AbortWithStatusJSON(status, gin.H{"result": false, "log": []string{err.Error()}})
+}
+
+func badRequest(g *gin.Context, err error) {
+	fail(g, http.StatusBadRequest, err)
+}
+
+// errorStatus код ответа для ошибки сервиса
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, auth.ErrNoKey), errors.Is(err, auth.ErrInvalidKey):
+		return http.StatusUnauthorized
+	case errors.Is(err, auth.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, core.ErrNotFound), errors.Is(err, auth.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, core.ErrNoTransaction), errors.Is(err, core.ErrTransactionBegun), errors.Is(err, core.ErrExists):
+		return http.StatusConflict
+	case errors.Is(err, core.ErrInvalid), errors.Is(err, core.ErrQuotaExceeded):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, core.ErrDNSSECDisabled), errors.Is(err, core.ErrNotImplemented):
+		return http.StatusNotImplemented
+	case errors.Is(err, core.ErrShuttingDown), core.Retryable(err):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// respond отвечает result или ошибкой сервиса
+func respond(g *gin.Context, result interface{}, err error) {
+	if err != nil {
+		fail(g, errorStatus(err), err)
+		return
+	}
+	ok(g, result)
+}
+
+// done ответ методов, которые возвращают только успех
+func done(g *gin.Context, err error) {
+	respond(g, true, err)
+}
+
+// atoi разбирает целое число из параметра name, пустое значение даёт def
+func atoi(name, value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Errorf("%s: ожидается целое число, получено %q", name, value)
+	}
+	return n, nil
+}
+
+// parseBool разбирает логическое значение из параметра name, пустое значение даёт def
+func parseBool(name, value string, def bool) (bool, error) {
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.Errorf("%s: ожидается логическое значение, получено %q", name, value)
+	}
+	return b, nil
+}
+
+// recovery превращает панику обработчика в ответ 500 того же вида и пишет стек в лог
+func recovery() gin.HandlerFunc {
+	return func(g *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				logging.FromContext(g.Request.Context()).
+					WithField("stack", string(debug.Stack())).
+					Errorf("паника в обработчике: %v", r)
+				fail(g, http.StatusInternalServerError, errors.Errorf("внутренняя ошибка: %v", r))
+			}
+		}()
+		g.Next()
+	}
+}
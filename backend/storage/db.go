@@ -1,7 +1,184 @@
 package storage
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
 
-type Storage struct {
-	db *sql.DB
+	"github.com/pkg/errors"
+)
+
+// Database имя базы данных в dqlite
+const Database = "power-dns"
+
+// Schema повторяет схему gsqlite3 backend PowerDNS
+const Schema = `
+PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE IF NOT EXISTS domains (
+  id                    INTEGER PRIMARY KEY,
+  name                  VARCHAR(255) NOT NULL COLLATE NOCASE,
+  master                VARCHAR(128) DEFAULT NULL,
+  last_check            INTEGER DEFAULT NULL,
+  type                  VARCHAR(6) NOT NULL,
+  notified_serial       INTEGER DEFAULT NULL,
+  account               VARCHAR(40) DEFAULT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS name_index ON domains(name);
+CREATE TABLE IF NOT EXISTS records (
+  id                    INTEGER PRIMARY KEY,
+  domain_id             INTEGER DEFAULT NULL,
+  name                  VARCHAR(255) DEFAULT NULL,
+  type                  VARCHAR(10) DEFAULT NULL,
+  content               VARCHAR(65535) DEFAULT NULL,
+  ttl                   INTEGER DEFAULT NULL,
+  prio                  INTEGER DEFAULT NULL,
+  disabled              BOOLEAN DEFAULT 0,
+  ordername             VARCHAR(255),
+  auth                  BOOL DEFAULT 1,
+  FOREIGN KEY(domain_id) REFERENCES domains(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS records_lookup_idx ON records(name, type);
+CREATE INDEX IF NOT EXISTS records_lookup_id_idx ON records(domain_id, name, type);
+CREATE INDEX IF NOT EXISTS records_order_idx ON records(domain_id, ordername);
+CREATE TABLE IF NOT EXISTS supermasters (
+  ip                    VARCHAR(64) NOT NULL,
+  nameserver            VARCHAR(255) NOT NULL COLLATE NOCASE,
+  account               VARCHAR(40) NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS ip_nameserver_pk ON supermasters(ip, nameserver);
+CREATE TABLE IF NOT EXISTS comments (
+  id                    INTEGER PRIMARY KEY,
+  domain_id             INTEGER NOT NULL,
+  name                  VARCHAR(255) NOT NULL,
+  type                  VARCHAR(10) NOT NULL,
+  modified_at           INT NOT NULL,
+  account               VARCHAR(40) DEFAULT NULL,
+  comment               VARCHAR(65535) NOT NULL,
+  FOREIGN KEY(domain_id) REFERENCES domains(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS comments_idx ON comments(domain_id, name, type);
+CREATE INDEX IF NOT EXISTS comments_order_idx ON comments (domain_id, modified_at);
+CREATE TABLE IF NOT EXISTS domainmetadata (
+ id                     INTEGER PRIMARY KEY,
+ domain_id              INT NOT NULL,
+ kind                   VARCHAR(32) COLLATE NOCASE,
+ content                TEXT,
+ FOREIGN KEY(domain_id) REFERENCES domains(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS  domainmetaidindex ON domainmetadata(domain_id);
+CREATE TABLE IF NOT EXISTS cryptokeys (
+ id                     INTEGER PRIMARY KEY,
+ domain_id              INT NOT NULL,
+ flags                  INT NOT NULL,
+ active                 BOOL,
+ published              BOOL DEFAULT 1,
+ content                TEXT,
+ FOREIGN KEY(domain_id) REFERENCES domains(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS domainidindex ON cryptokeys(domain_id);
+CREATE TABLE IF NOT EXISTS tsigkeys (
+ id                     INTEGER PRIMARY KEY,
+ name                   VARCHAR(255) COLLATE NOCASE,
+ algorithm              VARCHAR(50) COLLATE NOCASE,
+ secret                 VARCHAR(255)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS namealgoindex ON tsigkeys(name, algorithm);
+CREATE TABLE IF NOT EXISTS schema_version (
+ version                INTEGER NOT NULL
+);
+INSERT INTO schema_version (version) SELECT 1 WHERE NOT EXISTS (SELECT 1 FROM schema_version);
+CREATE TABLE IF NOT EXISTS health (
+ node                   VARCHAR(255) PRIMARY KEY,
+ checked_at             INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS changes (
+ domain                 VARCHAR(255) PRIMARY KEY COLLATE NOCASE,
+ serial                 INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS changes_serial_idx ON changes(serial);
+CREATE TABLE IF NOT EXISTS audit (
+ id                     INTEGER PRIMARY KEY AUTOINCREMENT,
+ at                     INTEGER NOT NULL,
+ node                   VARCHAR(255) NOT NULL,
+ method                 VARCHAR(64) NOT NULL,
+ zone                   VARCHAR(255) COLLATE NOCASE,
+ caller                 VARCHAR(255),
+ before_value           TEXT,
+ after_value            TEXT
+);
+CREATE INDEX IF NOT EXISTS audit_zone_idx ON audit(zone, at);
+CREATE INDEX IF NOT EXISTS audit_at_idx ON audit(at);
+CREATE TABLE IF NOT EXISTS zone_versions (
+ id                     INTEGER PRIMARY KEY AUTOINCREMENT,
+ domain_id              INTEGER NOT NULL,
+ serial                 INTEGER NOT NULL,
+ at                     INTEGER NOT NULL,
+ node                   VARCHAR(255) NOT NULL,
+ caller                 VARCHAR(255),
+ method                 VARCHAR(64) NOT NULL,
+ size                   INTEGER NOT NULL,
+ records                TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS zone_versions_idx ON zone_versions(domain_id, serial);
+CREATE TABLE IF NOT EXISTS api_keys (
+ id                     INTEGER PRIMARY KEY AUTOINCREMENT,
+ name                   VARCHAR(255) NOT NULL,
+ kind                   VARCHAR(16) NOT NULL,
+ hash                   VARCHAR(64) NOT NULL,
+ previous_hash          VARCHAR(64),
+ previous_until         INTEGER,
+ read_only              BOOL NOT NULL DEFAULT 0,
+ zones                  TEXT,
+ account                VARCHAR(40),
+ created_at             INTEGER NOT NULL,
+ expires_at             INTEGER,
+ rotated_at             INTEGER
+);
+CREATE UNIQUE INDEX IF NOT EXISTS api_keys_name_idx ON api_keys(name);
+CREATE UNIQUE INDEX IF NOT EXISTS api_keys_hash_idx ON api_keys(hash);
+CREATE INDEX IF NOT EXISTS api_keys_previous_idx ON api_keys(previous_hash);
+CREATE TABLE IF NOT EXISTS account_quotas (
+ account                VARCHAR(40) NOT NULL PRIMARY KEY,
+ max_zones              INTEGER,
+ max_records            INTEGER
+);
+CREATE INDEX IF NOT EXISTS domains_account_idx ON domains(account);
+COMMIT;`
+
+// SchemaVersion версия схемы, которую ожидает этот код
+const SchemaVersion = 1
+
+// ServiceTables служебные таблицы, которые не входят в резервные копии:
+// schema_version создаётся вместе со схемой, health хранит только пробные записи,
+// changes только счётчики изменений зон для сброса кэша, а DebugTable есть
+// только на узлах, запускавшихся с --debug, и restore её не создаёт
+var ServiceTables = []string{"schema_version", "health", "changes", DebugTable}
+
+// DebugTable таблица отладочных маршрутов test/:key
+const DebugTable = "model"
+
+// DebugSchema создаёт DebugTable, выполняется только с --debug
+const DebugSchema = `CREATE TABLE IF NOT EXISTS ` + DebugTable + ` (key TEXT, value TEXT, UNIQUE(key));`
+
+func Init(db *sql.DB) error {
+	if _, err := db.Exec(Schema); err != nil {
+		return errors.Wrap(err, "не удалось создать схему базы данных")
+	}
+	return nil
+}
+
+func InitDebug(db *sql.DB) error {
+	if _, err := db.Exec(DebugSchema); err != nil {
+		return errors.Wrap(err, "не удалось создать отладочную таблицу")
+	}
+	return nil
+}
+
+// Version версия схемы в базе
+func Version(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRowContext(ctx, "SELECT max(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, errors.Wrap(err, "не удалось прочитать версию схемы")
+	}
+	return version, nil
 }
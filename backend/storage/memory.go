@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+// NewMemory открывает базу данных в памяти с той же схемой, что и в dqlite.
+// Используется в тестах, где поднимать кластер dqlite не нужно.
+func NewMemory() (*sql.DB, error) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, errors.Wrap(err, "не удалось открыть базу данных в памяти")
+	}
+	// Каждое соединение с :memory: получает свою базу, поэтому оставляем одно
+	db.SetMaxOpenConns(1)
+	if err = Init(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,38 @@
+package backend
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Версии зон: список, разница между серийными номерами и откат
+
+func (h *Handler) zoneVersions(g *gin.Context) {
+	versions, err := h.svc.Versions(g.Request.Context(), g.Param("zone"))
+	respond(g, versions, err)
+}
+
+// zoneDiff ?from=serial&to=serial, без to сравнивает с последней версией
+func (h *Handler) zoneDiff(g *gin.Context) {
+	from, err := atoi("from", g.Query("from"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	to, err := atoi("to", g.Query("to"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	diff, err := h.svc.Diff(g.Request.Context(), g.Param("zone"), int64(from), int64(to))
+	respond(g, diff, err)
+}
+
+func (h *Handler) zoneRollback(g *gin.Context) {
+	serial, err := atoi("serial", g.Param("serial"), 0)
+	if err != nil {
+		badRequest(g, err)
+		return
+	}
+	version, err := h.svc.Rollback(g.Request.Context(), g.Param("zone"), int64(serial))
+	respond(g, version, err)
+}
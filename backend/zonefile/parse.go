@@ -0,0 +1,431 @@
+package zonefile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/pkg/errors"
+)
+
+// Разбор мастер-файлов зон RFC 1035 в том виде, в котором их пишет BIND:
+// директивы $ORIGIN, $TTL и $INCLUDE, относительные имена и @, скобки для
+// записей на несколько строк, комментарии и строки в кавычках. Имена в
+// записях возвращаются без точки в конце, как их хранит PowerDNS, а
+// приоритет MX и SRV остаётся в содержимом.
+
+// maxDepth глубина вложенных $INCLUDE
+const maxDepth = 10
+
+// names номера полей с именами в содержимом записей по типам
+var names = map[string][]int{
+	"NS":    {0},
+	"CNAME": {0},
+	"PTR":   {0},
+	"DNAME": {0},
+	"MX":    {1},
+	"AFSDB": {1},
+	"KX":    {1},
+	"RT":    {1},
+	"SRV":   {3},
+	"NAPTR": {5},
+	"SOA":   {0, 1},
+	"RP":    {0, 1},
+}
+
+var typeName = regexp.MustCompile(`^[A-Z][A-Z0-9-]*$`)
+
+// Opener открывает файл из директивы $INCLUDE
+type Opener func(name string) (io.ReadCloser, error)
+
+// Dir открывает файлы $INCLUDE относительно каталога dir
+func Dir(dir string) Opener {
+	return func(name string) (io.ReadCloser, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.Open(name)
+	}
+}
+
+// Parse разбирает файл зоны с начальным $ORIGIN origin. Если include не
+// задан, директива $INCLUDE считается ошибкой: так файл, присланный по сети,
+// не может прочитать файлы сервера.
+func Parse(r io.Reader, origin string, include Opener) ([]*core.DNSResourceRecord, error) {
+	p := &parser{include: include, ttl: -1, last: -1, records: make([]*core.DNSResourceRecord, 0)}
+	if err := p.parse("", r, strings.ToLower(strings.TrimSuffix(origin, ".")), 0); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// ParseFile разбирает файл зоны path, $INCLUDE открываются относительно его каталога
+func ParseFile(path, origin string) ([]*core.DNSResourceRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p := &parser{include: Dir(filepath.Dir(path)), ttl: -1, last: -1, records: make([]*core.DNSResourceRecord, 0)}
+	if err = p.parse(filepath.Base(path), f, strings.ToLower(strings.TrimSuffix(origin, ".")), 0); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+type parser struct {
+	include Opener
+	ttl     int // из $TTL, -1 пока не задан
+	last    int // последний явно указанный TTL, -1 пока его не было
+	records []*core.DNSResourceRecord
+}
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+// line логическая строка файла, запись в скобках занимает несколько строк
+type line struct {
+	no     int  // номер первой строки
+	blank  bool // начинается с пробела: имя как у предыдущей записи
+	tokens []token
+}
+
+func position(name string, no int) string {
+	if name == "" {
+		return fmt.Sprintf("строка %d", no)
+	}
+	return fmt.Sprintf("%s:%d", name, no)
+}
+
+// scan делит файл на логические строки и слова
+func scan(name string, r io.Reader) ([]line, error) {
+	br := bufio.NewReader(r)
+	lines := make([]line, 0)
+	no, depth, start := 1, 0, true
+	cur := line{no: no}
+	var buf strings.Builder
+	word := false
+	flush := func() {
+		if word {
+			cur.tokens = append(cur.tokens, token{text: buf.String()})
+			buf.Reset()
+			word = false
+		}
+	}
+	newline := func() {
+		flush()
+		no++
+		if depth == 0 {
+			if len(cur.tokens) != 0 {
+				lines = append(lines, cur)
+			}
+			cur, start = line{no: no}, true
+		}
+	}
+	for {
+		c, _, err := br.ReadRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start {
+			start = false
+			cur.blank = c == ' ' || c == '\t'
+		}
+		switch c {
+		case '\n':
+			newline()
+		case ';':
+			flush()
+			for c != '\n' {
+				if c, _, err = br.ReadRune(); err == io.EOF {
+					break
+				} else if err != nil {
+					return nil, err
+				}
+			}
+			if c == '\n' {
+				newline()
+			}
+		case '"':
+			flush()
+			for {
+				c, _, err = br.ReadRune()
+				if err == io.EOF || c == '\n' {
+					return nil, errors.Wrapf(core.ErrInvalid, "%s: незакрытая кавычка", position(name, no))
+				}
+				if err != nil {
+					return nil, err
+				}
+				if c == '"' {
+					break
+				}
+				buf.WriteRune(c)
+				if c == '\\' {
+					if c, _, err = br.ReadRune(); err != nil {
+						return nil, errors.Wrapf(core.ErrInvalid, "%s: незакрытая кавычка", position(name, no))
+					}
+					buf.WriteRune(c)
+				}
+			}
+			cur.tokens = append(cur.tokens, token{text: buf.String(), quoted: true})
+			buf.Reset()
+		case '(':
+			flush()
+			depth++
+		case ')':
+			flush()
+			if depth--; depth < 0 {
+				return nil, errors.Wrapf(core.ErrInvalid, "%s: лишняя закрывающая скобка", position(name, no))
+			}
+		case ' ', '\t', '\r':
+			flush()
+		case '\\':
+			buf.WriteRune(c)
+			if c, _, err = br.ReadRune(); err != nil {
+				return nil, errors.Wrapf(core.ErrInvalid, "%s: \\ в конце файла", position(name, no))
+			}
+			buf.WriteRune(c)
+			word = true
+		default:
+			buf.WriteRune(c)
+			word = true
+		}
+	}
+	if depth > 0 {
+		return nil, errors.Wrapf(core.ErrInvalid, "%s: скобка не закрыта", position(name, cur.no))
+	}
+	flush()
+	if len(cur.tokens) != 0 {
+		lines = append(lines, cur)
+	}
+	return lines, nil
+}
+
+// absolute полное имя без точки в конце для имени name из файла с $ORIGIN origin
+func absolute(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case name == ".":
+		return name
+	case strings.HasSuffix(name, ".") && !strings.HasSuffix(name, `\.`):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	}
+	return name + "." + origin
+}
+
+// parseTTL TTL в секундах: число или число с единицами, как 1h30m или 1w
+func parseTTL(s string) (int, error) {
+	if s == "" {
+		return 0, errors.New("пустой TTL")
+	}
+	var total, n uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		var unit uint64
+		switch c {
+		case 's':
+			unit = 1
+		case 'm':
+			unit = 60
+		case 'h':
+			unit = 3600
+		case 'd':
+			unit = 86400
+		case 'w':
+			unit = 604800
+		default:
+			if c < '0' || c > '9' {
+				return 0, errors.Errorf("неверный TTL %q", s)
+			}
+			n, digits = n*10+uint64(c-'0'), true
+			if n > math.MaxInt32 {
+				return 0, errors.Errorf("TTL %q слишком большой", s)
+			}
+			continue
+		}
+		if !digits {
+			return 0, errors.Errorf("неверный TTL %q", s)
+		}
+		total, n, digits = total+n*unit, 0, false
+		if total > math.MaxInt32 {
+			return 0, errors.Errorf("TTL %q слишком большой", s)
+		}
+	}
+	total += n
+	if total > math.MaxInt32 {
+		return 0, errors.Errorf("TTL %q слишком большой", s)
+	}
+	return int(total), nil
+}
+
+func (p *parser) parse(name string, r io.Reader, origin string, depth int) error {
+	lines, err := scan(name, r)
+	if err != nil {
+		return err
+	}
+	owner, named := "", false
+	for _, l := range lines {
+		at := position(name, l.no)
+		first := l.tokens[0]
+		if !l.blank && !first.quoted && strings.HasPrefix(first.text, "$") {
+			if err = p.directive(at, l.tokens, &origin, depth); err != nil {
+				return err
+			}
+			continue
+		}
+		tokens := l.tokens
+		if !l.blank {
+			owner, named, tokens = strings.ToLower(absolute(first.text, origin)), true, tokens[1:]
+		} else if !named {
+			return errors.Wrapf(core.ErrInvalid, "%s: у первой записи нет имени", at)
+		}
+		rr, err := p.record(owner, origin, tokens)
+		if err != nil {
+			return errors.Wrapf(core.ErrInvalid, "%s: %v", at, err)
+		}
+		p.records = append(p.records, rr)
+	}
+	return nil
+}
+
+func (p *parser) directive(at string, tokens []token, origin *string, depth int) error {
+	args := make([]string, 0, len(tokens)-1)
+	for _, t := range tokens[1:] {
+		args = append(args, t.text)
+	}
+	switch directive := strings.ToUpper(tokens[0].text); directive {
+	case "$ORIGIN":
+		if len(args) != 1 {
+			return errors.Wrapf(core.ErrInvalid, "%s: $ORIGIN ожидает одно имя", at)
+		}
+		*origin = strings.ToLower(absolute(args[0], *origin))
+	case "$TTL":
+		if len(args) != 1 {
+			return errors.Wrapf(core.ErrInvalid, "%s: $TTL ожидает одно значение", at)
+		}
+		ttl, err := parseTTL(args[0])
+		if err != nil {
+			return errors.Wrapf(core.ErrInvalid, "%s: %v", at, err)
+		}
+		p.ttl = ttl
+	case "$INCLUDE":
+		if len(args) != 1 && len(args) != 2 {
+			return errors.Wrapf(core.ErrInvalid, "%s: $INCLUDE ожидает файл и необязательный $ORIGIN", at)
+		}
+		if p.include == nil {
+			return errors.Wrapf(core.ErrInvalid, "%s: $INCLUDE здесь не поддерживается", at)
+		}
+		if depth >= maxDepth {
+			return errors.Wrapf(core.ErrInvalid, "%s: больше %d вложенных $INCLUDE", at, maxDepth)
+		}
+		// $ORIGIN внутри включённого файла не меняет его у включающего
+		inner := *origin
+		if len(args) == 2 {
+			inner = strings.ToLower(absolute(args[1], *origin))
+		}
+		f, err := p.include(args[0])
+		if err != nil {
+			return errors.Wrapf(err, "%s: $INCLUDE", at)
+		}
+		defer f.Close()
+		return p.parse(args[0], f, inner, depth+1)
+	default:
+		return errors.Wrapf(core.ErrInvalid, "%s: директива %s не поддерживается", at, directive)
+	}
+	return nil
+}
+
+// record запись из слов после имени: [TTL] [класс] тип данные, TTL и класс
+// могут идти в любом порядке
+func (p *parser) record(owner, origin string, tokens []token) (*core.DNSResourceRecord, error) {
+	ttl := -1
+prefix:
+	for i := 0; i < 2 && len(tokens) != 0 && !tokens[0].quoted; i++ {
+		t := tokens[0].text
+		switch strings.ToUpper(t) {
+		case "IN":
+		case "CH", "CS", "HS", "NONE", "ANY":
+			return nil, errors.Errorf("класс %s не поддерживается", t)
+		default:
+			if ttl >= 0 || t[0] < '0' || t[0] > '9' {
+				break prefix
+			}
+			v, err := parseTTL(t)
+			if err != nil {
+				return nil, err
+			}
+			ttl = v
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("не указан тип записи")
+	}
+	qtype := strings.ToUpper(tokens[0].text)
+	if tokens[0].quoted || !typeName.MatchString(qtype) {
+		return nil, errors.Errorf("неверный тип записи %q", tokens[0].text)
+	}
+	fields := make([]string, 0, len(tokens)-1)
+	for _, t := range tokens[1:] {
+		if t.quoted || qtype == "TXT" || qtype == "SPF" {
+			fields = append(fields, `"`+t.text+`"`)
+		} else {
+			fields = append(fields, t.text)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.Errorf("у записи %s нет данных", qtype)
+	}
+	for _, i := range names[qtype] {
+		if i < len(fields) {
+			fields[i] = absolute(fields[i], origin)
+		}
+	}
+	minimum := -1
+	if qtype == "SOA" {
+		if len(fields) != 7 {
+			return nil, errors.Errorf("у SOA %d полей вместо 7", len(fields))
+		}
+		if _, err := strconv.ParseUint(fields[2], 10, 32); err != nil {
+			return nil, errors.Errorf("неверный серийный номер SOA %q", fields[2])
+		}
+		for i := 3; i < 7; i++ {
+			v, err := parseTTL(fields[i])
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = strconv.Itoa(v)
+			minimum = v
+		}
+	}
+	switch {
+	case ttl >= 0:
+	case p.ttl >= 0:
+		ttl = p.ttl
+	case p.last >= 0:
+		ttl = p.last
+	case minimum >= 0:
+		ttl = minimum
+	default:
+		return nil, errors.New("не задан TTL: нет $TTL и TTL у предыдущих записей")
+	}
+	if p.ttl < 0 {
+		p.last = ttl
+	}
+	return &core.DNSResourceRecord{Qname: owner, Qtype: qtype, TTL: ttl, Content: strings.Join(fields, " "), Auth: true}, nil
+}
@@ -0,0 +1,116 @@
+package zonefile
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const example = `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		3h         ; refresh
+		1h
+		1w
+		300 )
+	IN	NS	ns1
+	IN	NS	ns2.example.net.
+	IN	MX	10 mail
+ns1	30m	A	192.0.2.53
+mail	IN 300	A	192.0.2.25
+	AAAA	2001:db8::25
+txt	TXT	"v=spf1 mx -all" "with ; semicolon" plain
+_sip._udp	SRV	0 5 5060 sip.example.com.
+$ORIGIN sub.example.com.
+www	CNAME	@
+`
+
+func TestParse(t *testing.T) {
+	records, err := Parse(strings.NewReader(example), "example.com", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []*core.DNSResourceRecord{
+		{Qname: "example.com", Qtype: "SOA", TTL: 3600, Content: "ns1.example.com hostmaster.example.com 2024010101 10800 3600 604800 300", Auth: true},
+		{Qname: "example.com", Qtype: "NS", TTL: 3600, Content: "ns1.example.com", Auth: true},
+		{Qname: "example.com", Qtype: "NS", TTL: 3600, Content: "ns2.example.net", Auth: true},
+		{Qname: "example.com", Qtype: "MX", TTL: 3600, Content: "10 mail.example.com", Auth: true},
+		{Qname: "ns1.example.com", Qtype: "A", TTL: 1800, Content: "192.0.2.53", Auth: true},
+		{Qname: "mail.example.com", Qtype: "A", TTL: 300, Content: "192.0.2.25", Auth: true},
+		{Qname: "mail.example.com", Qtype: "AAAA", TTL: 3600, Content: "2001:db8::25", Auth: true},
+		{Qname: "txt.example.com", Qtype: "TXT", TTL: 3600, Content: `"v=spf1 mx -all" "with ; semicolon" "plain"`, Auth: true},
+		{Qname: "_sip._udp.example.com", Qtype: "SRV", TTL: 3600, Content: "0 5 5060 sip.example.com", Auth: true},
+		{Qname: "www.sub.example.com", Qtype: "CNAME", TTL: 3600, Content: "sub.example.com", Auth: true},
+	}, records)
+}
+
+func TestParseTTL(t *testing.T) {
+	// Без $TTL действует последний явный TTL, до него минимум из SOA
+	records, err := Parse(strings.NewReader("@ SOA ns1 hostmaster 1 2 3 4 60\n  NS ns1\nwww 300 A 192.0.2.1\nftp A 192.0.2.2\n"), "example.com.", nil)
+	require.NoError(t, err)
+	ttls := make([]int, 0)
+	for _, rr := range records {
+		ttls = append(ttls, rr.TTL)
+	}
+	assert.Equal(t, []int{60, 60, 300, 300}, ttls)
+
+	for in, want := range map[string]int{"0": 0, "300": 300, "1h30m": 5400, "1W": 604800, "2d1": 172801} {
+		ttl, err := parseTTL(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, ttl, in)
+	}
+	for _, in := range []string{"", "h", "1x", "99999999999", "3000000000s"} {
+		_, err := parseTTL(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "hosts.inc"), []byte("www A 192.0.2.1\n$ORIGIN other.example.com.\nftp A 192.0.2.2\n"), 0o644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "loop.inc"), []byte("$INCLUDE loop.inc\n"), 0o644))
+	path := filepath.Join(dir, "example.com.db")
+	require.NoError(t, ioutil.WriteFile(path, []byte("$TTL 300\n@ SOA ns1 hostmaster 1 2 3 4 5\n$INCLUDE hosts.inc lan\nmail A 192.0.2.3\n"), 0o644))
+
+	records, err := ParseFile(path, "example.com")
+	require.NoError(t, err)
+	names := make([]string, 0)
+	for _, rr := range records {
+		names = append(names, rr.Qname)
+	}
+	assert.Equal(t, []string{"example.com", "www.lan.example.com", "ftp.other.example.com", "mail.example.com"}, names)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("$INCLUDE loop.inc\n"), 0o644))
+	_, err = ParseFile(path, "example.com")
+	assert.ErrorIs(t, err, core.ErrInvalid)
+	_, err = Parse(strings.NewReader("$INCLUDE /etc/passwd\n"), "example.com", nil)
+	assert.ErrorIs(t, err, core.ErrInvalid)
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, in := range map[string]string{
+		"unclosed paren":  "@ 300 SOA ns1 hostmaster ( 1 2 3 4 5\n",
+		"extra paren":     "@ 300 A 192.0.2.1 )\n",
+		"unclosed quote":  "@ 300 TXT \"text\n",
+		"directive":       "$GENERATE 1-10 host$ A 192.0.2.$\n",
+		"no owner":        "  300 A 192.0.2.1\n",
+		"no ttl":          "www A 192.0.2.1\n",
+		"class":           "www 300 CH A 192.0.2.1\n",
+		"no type":         "www 300 IN\n",
+		"no data":         "www 300 IN A\n",
+		"bad type":        "www 300 IN A.B 192.0.2.1\n",
+		"soa fields":      "@ 300 SOA ns1 hostmaster 1 2 3\n",
+		"soa serial":      "@ 300 SOA ns1 hostmaster x 2 3 4 5\n",
+		"origin argument": "$ORIGIN\n",
+	} {
+		_, err := Parse(strings.NewReader(in), "example.com", nil)
+		assert.ErrorIs(t, err, core.ErrInvalid, name)
+	}
+	_, err := Parse(strings.NewReader("$TTL 300\n\nwww A 192.0.2.1\nbad\n"), "example.com", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "строка 4: не указан тип записи")
+}
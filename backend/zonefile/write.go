@@ -0,0 +1,78 @@
+package zonefile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+)
+
+// maxString длина строки в кавычках в TXT, больше не помещается в одну
+// character-string (RFC 1035, 3.3)
+const maxString = 255
+
+// fqdn полное имя с точкой в конце
+func fqdn(name string) string {
+	if name == "" || name == "." {
+		return "."
+	}
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// quote содержимое TXT в кавычках. Содержимое, которое уже начинается с
+// кавычки, хранится в виде файла зоны, как его пишет PowerDNS, и не меняется.
+// Остальное экранируется и делится на строки по maxString байт.
+func quote(content string) string {
+	if strings.HasPrefix(content, `"`) {
+		return content
+	}
+	parts := make([]string, 0, len(content)/maxString+1)
+	for len(content) > maxString {
+		parts = append(parts, content[:maxString])
+		content = content[maxString:]
+	}
+	parts = append(parts, content)
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	for i, p := range parts {
+		parts[i] = `"` + escape.Replace(p) + `"`
+	}
+	return strings.Join(parts, " ")
+}
+
+// rdata содержимое записи в виде файла зоны: полные имена и TXT в кавычках
+func rdata(qtype, content string) string {
+	if qtype == "TXT" || qtype == "SPF" {
+		return quote(content)
+	}
+	fields, ok := names[qtype]
+	if !ok {
+		return content
+	}
+	parts := strings.Fields(content)
+	for _, i := range fields {
+		if i < len(parts) {
+			parts[i] = fqdn(parts[i])
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Write пишет зону в каноническом виде файла зоны: полные имена с точкой в
+// конце, записи в порядке core.SortRecords. Выключенные записи пишутся
+// закомментированными, при загрузке они пропадут.
+func Write(w io.Writer, e *core.ZoneExport) error {
+	records := make([]*core.ExportRecord, len(e.Records))
+	copy(records, e.Records)
+	core.SortRecords(records)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", fqdn(e.Name))
+	for _, rr := range records {
+		if rr.Disabled {
+			bw.WriteString("; disabled: ")
+		}
+		fmt.Fprintf(bw, "%s\t%d\tIN\t%s\t%s\n", fqdn(rr.Name), rr.TTL, rr.Type, rdata(rr.Type, rr.Content))
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,57 @@
+package zonefile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	e := &core.ZoneExport{Name: "example.com", Kind: "NATIVE", Records: []*core.ExportRecord{
+		{Name: "www.example.com", Type: "A", TTL: 300, Content: "192.0.2.1"},
+		{Name: "example.com", Type: "MX", TTL: 300, Content: "20 mx2.example.com"},
+		{Name: "example.com", Type: "MX", TTL: 300, Content: "5 mx1.example.com"},
+		{Name: "example.com", Type: "TXT", TTL: 300, Content: `"v=spf1 -all"`},
+		{Name: "note.example.com", Type: "TXT", TTL: 300, Content: `say "hi" \o/`},
+		{Name: "example.com", Type: "NS", TTL: 3600, Content: "ns1.example.com"},
+		{Name: "_sip._udp.example.com", Type: "SRV", TTL: 300, Content: "0 5 5060 ."},
+		{Name: "old.example.com", Type: "A", TTL: 300, Content: "192.0.2.9", Disabled: true},
+		{Name: "example.com", Type: "SOA", TTL: 3600, Content: "ns1.example.com hostmaster.example.com 1 10800 3600 604800 300"},
+	}}
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, e))
+	assert.Equal(t, `$ORIGIN example.com.
+example.com.	3600	IN	SOA	ns1.example.com. hostmaster.example.com. 1 10800 3600 604800 300
+example.com.	3600	IN	NS	ns1.example.com.
+example.com.	300	IN	MX	5 mx1.example.com.
+example.com.	300	IN	MX	20 mx2.example.com.
+example.com.	300	IN	TXT	"v=spf1 -all"
+_sip._udp.example.com.	300	IN	SRV	0 5 5060 .
+note.example.com.	300	IN	TXT	"say \"hi\" \\o/"
+; disabled: old.example.com.	300	IN	A	192.0.2.9
+www.example.com.	300	IN	A	192.0.2.1
+`, buf.String())
+
+	// Выгрузка загружается обратно без изменений, кроме выключенных записей
+	written := buf.String()
+	records, err := Parse(&buf, "example.com", nil)
+	require.NoError(t, err)
+	back := &core.ZoneExport{Name: "example.com", Kind: "NATIVE", Records: make([]*core.ExportRecord, 0)}
+	for _, rr := range records {
+		back.Records = append(back.Records, &core.ExportRecord{Name: rr.Qname, Type: rr.Qtype, TTL: rr.TTL, Content: rr.Content})
+	}
+	var again bytes.Buffer
+	require.NoError(t, Write(&again, back))
+	assert.Equal(t, strings.Replace(written, "; disabled: old.example.com.\t300\tIN\tA\t192.0.2.9\n", "", 1), again.String())
+}
+
+func TestQuote(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	assert.Equal(t, `"`+long[:255]+`" "`+long[255:]+`"`, quote(long))
+	assert.Equal(t, `""`, quote(""))
+	assert.Equal(t, `"a" "b"`, quote(`"a" "b"`))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/spf13/cobra"
+)
+
+// auditCmd журнал изменений зон, читается через лидера кластера
+func auditCmd(load func() (*config.Config, error)) *cobra.Command {
+	var filter audit.Filter
+	var since, until string
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Показать журнал изменений зон",
+		Long: "Показать журнал изменений зон: кто, когда и через какой узел изменил данные. " +
+			"Записи старше audit.retention удаляются.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := load()
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			if filter.Since, err = audit.ParseTime(since, now); err != nil {
+				return err
+			}
+			if filter.Until, err = audit.ParseTime(until, now); err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Request)
+			defer cancel()
+			db, err := openCluster(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			entries, err := audit.Query(ctx, db, filter)
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			if asJSON {
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				return enc.Encode(entries)
+			}
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tNODE\tCALLER\tMETHOD\tZONE\tBEFORE\tAFTER")
+			for _, e := range entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.RFC3339),
+					e.Node, dash(e.Caller), e.Method, dash(e.Zone), dash(string(e.Before)), dash(string(e.After)))
+			}
+			return w.Flush()
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&filter.Zone, "zone", "", "only changes of this zone")
+	flags.StringVar(&filter.Method, "method", "", "only changes made by this backend method, e.g. replacerrset")
+	flags.StringVar(&filter.Caller, "caller", "", "only changes made by this caller")
+	flags.StringVar(&since, "since", "24h", "changes after this time: duration ago (24h) or RFC 3339")
+	flags.StringVar(&until, "until", "", "changes before this time: duration ago (1h) or RFC 3339")
+	flags.IntVar(&filter.Limit, "limit", 1000, "show at most this many latest changes, 0 shows all")
+	flags.BoolVar(&asJSON, "json", false, "print entries as JSON")
+	return cmd
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
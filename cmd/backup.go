@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/canonical/go-dqlite/app"
+	"github.com/canonical/go-dqlite/client"
+	"github.com/canonical/go-dqlite/driver"
+	"github.com/ivan-bokov/pdns-dqlite/backend/backup"
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// openCluster открывает базу через лидера кластера, используется командами,
+// которые запускаются без собственного узла dqlite
+func openCluster(ctx context.Context, cfg *config.Config) (*sql.DB, error) {
+	addresses, err := clusterAddresses(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dial, err := dialFunc(cfg)
+	if err != nil {
+		return nil, err
+	}
+	store := client.NewInmemNodeStore()
+	nodes := make([]client.NodeInfo, 0, len(addresses))
+	for _, addr := range addresses {
+		nodes = append(nodes, client.NodeInfo{Address: addr})
+	}
+	if err = store.Set(ctx, nodes); err != nil {
+		return nil, err
+	}
+	drv, err := driver.New(store, driver.WithDialFunc(dial), driver.WithLogFunc(logging.Dqlite))
+	if err != nil {
+		return nil, err
+	}
+	connector, err := drv.OpenConnector(storage.Database)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+func backupCmd(load func() (*config.Config, error)) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup [file]",
+		Short: "Сделать резервную копию базы через лидера кластера",
+		Long: "Сделать согласованную резервную копию базы через лидера кластера. " +
+			"Рядом с копией сохраняется контрольная сумма file.sha256.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := load()
+			if err != nil {
+				return err
+			}
+			path := backup.FileName(storage.Database, time.Now())
+			if len(args) != 0 {
+				path = args[0]
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+			defer cancel()
+			db, err := openCluster(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			if err = backup.Create(ctx, db, path); err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), path)
+			return nil
+		},
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "verify <file>",
+		Short: "Проверить контрольную сумму резервной копии",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := backup.Verify(args[0]); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: OK\n", args[0])
+			return nil
+		},
+	})
+	return cmd
+}
+
+// restoreCmd создаёт новый кластер из резервной копии: в пустой папке dir
+// запускается первый узел с адресом host, в него загружаются данные,
+// после чего узел останавливается. Дальше узел запускается как обычно,
+// остальные узлы присоединяются к нему через --cluster.
+func restoreCmd(load func() (*config.Config, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <file>",
+		Short: "Создать новый кластер из резервной копии",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := load()
+			if err != nil {
+				return err
+			}
+			if err = cfg.Validate(); err != nil {
+				return err
+			}
+			if err = backup.Verify(args[0]); err != nil {
+				return err
+			}
+			if entries, err := ioutil.ReadDir(cfg.Dir); err == nil && len(entries) != 0 {
+				return errors.Errorf("папка %s не пустая, восстановление возможно только в новый кластер", cfg.Dir)
+			}
+			if err = os.MkdirAll(cfg.Dir, 0o755); err != nil {
+				return errors.Wrapf(err, "не могу создать %s", cfg.Dir)
+			}
+			opts, _, _, err := nodeOptions(cfg)
+			if err != nil {
+				return err
+			}
+			dqlite, err := app.New(cfg.Dir, opts...)
+			if err != nil {
+				return errors.Wrap(err, "Ошибка создания экземпляра dqlite")
+			}
+			defer dqlite.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Ready)
+			defer cancel()
+			if err = dqlite.Ready(ctx); err != nil {
+				return errors.Wrap(err, "Экземпляр dqlite не готов к работе")
+			}
+			db, err := dqlite.Open(ctx, storage.Database)
+			if err != nil {
+				return errors.Wrap(err, "Ошибка открытия базы данных к работе")
+			}
+			defer db.Close()
+			if err = storage.Init(db); err != nil {
+				return err
+			}
+			if err = backup.Load(context.Background(), db, args[0]); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s восстановлен в %s, запустите узел с --host %s\n", args[0], cfg.Dir, cfg.Host)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/certs"
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/spf13/cobra"
+)
+
+// replicationTLS загружает сертификаты для трафика dqlite между узлами.
+// Если TLS репликации не настроен, возвращает nil.
+func replicationTLS(cfg *config.Config) (*certs.Keypair, *tls.Config, *tls.Config, error) {
+	r := cfg.Replication
+	if r.Cert == "" {
+		return nil, nil, nil, nil
+	}
+	pool, err := certs.LoadPool(r.CA)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	kp, err := certs.LoadKeypair(r.Cert, r.Key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	listen, dial := certs.Config(kp, pool)
+	return kp, listen, dial, nil
+}
+
+// apiTLS загружает сертификат API и центр для проверки клиентов. Если TLS
+// API не настроен, возвращает nil.
+func apiTLS(cfg *config.Config) (*certs.Keypair, *tls.Config, error) {
+	if cfg.TLS.Cert == "" {
+		return nil, nil, nil
+	}
+	kp, err := certs.LoadKeypair(cfg.TLS.Cert, cfg.TLS.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pool *x509.CertPool
+	if cfg.TLS.ClientCA != "" {
+		if pool, err = certs.LoadPool(cfg.TLS.ClientCA); err != nil {
+			return nil, nil, err
+		}
+	}
+	return kp, certs.ServerConfig(kp, pool), nil
+}
+
+func certsCmd() *cobra.Command {
+	var out string
+	var validity time.Duration
+	cmd := &cobra.Command{
+		Use:   "certs",
+		Short: "Создать центр сертификации кластера и сертификаты узлов",
+	}
+	cmd.PersistentFlags().StringVarP(&out, "out", "o", ".", "directory with the cluster CA and certificates")
+	cmd.PersistentFlags().DurationVarP(&validity, "validity", "", 10*365*24*time.Hour, "certificate validity")
+
+	var caName string
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Создать центр сертификации кластера",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := certs.InitCA(out, caName, validity); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s\n%s\n", filepath.Join(out, certs.CACert), filepath.Join(out, certs.CAKey))
+			return nil
+		},
+	}
+	initCmd.Flags().StringVarP(&caName, "name", "", "pdns-dqlite", "CA common name")
+
+	var hosts []string
+	issueCmd := &cobra.Command{
+		Use:   "issue <node>",
+		Short: "Выпустить сертификат узла",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := certs.Issue(out, args[0], hosts, validity); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s\n%s\n", filepath.Join(out, args[0]+".crt"), filepath.Join(out, args[0]+".key"))
+			return nil
+		},
+	}
+	issueCmd.Flags().StringSliceVarP(&hosts, "san", "", nil, "IP addresses and DNS names other nodes use to reach the node")
+
+	cmd.AddCommand(initCmd, issueCmd)
+	return cmd
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/canonical/go-dqlite/client"
+	"github.com/ivan-bokov/pdns-dqlite/backend/cluster"
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// clusterAddresses адреса, среди которых команды ищут лидера: host и cluster из конфигурации
+func clusterAddresses(cfg *config.Config) ([]string, error) {
+	addresses := make([]string, 0, len(cfg.Cluster)+1)
+	if cfg.Host != "" {
+		addresses = append(addresses, cfg.Host)
+	}
+	addresses = append(addresses, cfg.Cluster...)
+	if len(addresses) == 0 {
+		return nil, errors.New("не указаны адреса узлов (host или cluster)")
+	}
+	return addresses, nil
+}
+
+// dialFunc подключение к узлам dqlite с TLS репликации, если он настроен
+func dialFunc(cfg *config.Config) (client.DialFunc, error) {
+	_, _, dial, err := replicationTLS(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if dial != nil {
+		return client.DialFuncWithTLS(client.DefaultDialFunc, dial), nil
+	}
+	return client.DefaultDialFunc, nil
+}
+
+// clusterCmd управление кластером с любой машины, откуда доступны узлы.
+// Лидер ищется среди адресов host и cluster из конфигурации.
+func clusterCmd(load func() (*config.Config, error)) *cobra.Command {
+	manager := func() (*cluster.Manager, context.Context, context.CancelFunc, error) {
+		cfg, err := load()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		addresses, err := clusterAddresses(cfg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		dial, err := dialFunc(cfg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Request)
+		roles := cluster.Roles{Voters: cfg.Roles.Voters, StandBys: cfg.Roles.StandBys}
+		return cluster.NewWithAddresses(addresses, roles, client.WithDialFunc(dial)), ctx, cancel, nil
+	}
+
+	cmd := &cobra.Command{
+		Use:   "cluster",
+		Short: "Управление узлами кластера",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "Вывести узлы кластера",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, ctx, cancel, err := manager()
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			status, err := m.Status(ctx)
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "voters: %d/%d, stand-bys: %d/%d\n\n",
+				status.Voters, status.Roles.Voters, status.StandBys, status.Roles.StandBys)
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tADDRESS\tROLE\tLEADER\tFAILURE DOMAIN\tONLINE")
+			for _, n := range status.Nodes {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%d\t%t\n", n.ID, n.Address, n.Role, n.Leader, n.FailureDomain, n.Online)
+			}
+			return w.Flush()
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "leader",
+		Short: "Вывести адрес лидера",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, ctx, cancel, err := manager()
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			leader, err := m.Leader(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%d %s\n", leader.ID, leader.Address)
+			return nil
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove <id|address>",
+		Short: "Удалить узел из кластера",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, ctx, cancel, err := manager()
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			return m.Remove(ctx, args[0])
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "transfer <id|address>",
+		Short: "Передать лидерство узлу",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, ctx, cancel, err := manager()
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			return m.Transfer(ctx, args[0])
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "assign-role <id|address> <voter|stand-by|spare>",
+		Short: "Изменить роль узла",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, ctx, cancel, err := manager()
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			return m.Assign(ctx, args[0], args[1])
+		},
+	})
+	return cmd
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/spf13/cobra"
+)
+
+func configCmd(load func() (*config.Config, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "config",
+		Short: "Проверить и вывести действующую конфигурацию",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := load()
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(cmd.OutOrStdout(), cfg.String())
+			return cfg.Validate()
+		},
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/ivan-bokov/pdns-dqlite/backend/auth"
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/spf13/cobra"
+)
+
+// keysCmd управление ключами API через лидера кластера. Значение ключа
+// печатается один раз при создании и ротации.
+func keysCmd(load func() (*config.Config, error)) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Управление ключами API",
+		Long: "Управление ключами API. Ключи проверяются при auth.enabled: ключи backend для remote backend PowerDNS, " +
+			"ключи admin для управления и HTTP API.",
+	}
+	// withKeys открывает базу кластера и вызывает f с ключами
+	withKeys := func(f func(ctx context.Context, keys *auth.Keys) error) error {
+		cfg, err := load()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(audit.WithCaller(context.Background(), "cli"), cfg.Timeouts.Request)
+		defer cancel()
+		db, err := openCluster(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return f(ctx, auth.New(db, cfg.Host, 0))
+	}
+
+	var asJSON bool
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "Показать ключи API без их значений",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withKeys(func(ctx context.Context, keys *auth.Keys) error {
+				all, err := keys.List(ctx)
+				if err != nil {
+					return err
+				}
+				out := cmd.OutOrStdout()
+				if asJSON {
+					enc := json.NewEncoder(out)
+					enc.SetIndent("", "  ")
+					return enc.Encode(all)
+				}
+				w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tKIND\tREAD-ONLY\tZONES\tACCOUNT\tCREATED\tEXPIRES")
+				for _, k := range all {
+					expires := "-"
+					if k.Expires != nil {
+						expires = k.Expires.Local().Format(time.RFC3339)
+					}
+					fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\t%s\n", k.Name, k.Kind, k.ReadOnly,
+						dash(strings.Join(k.Zones, ",")), dash(k.Account), k.Created.Local().Format(time.RFC3339), expires)
+				}
+				return w.Flush()
+			})
+		},
+	}
+	list.Flags().BoolVar(&asJSON, "json", false, "print keys as JSON")
+
+	var key auth.Key
+	var expires time.Duration
+	create := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Создать ключ API и напечатать его значение",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key.Name = args[0]
+			if expires > 0 {
+				at := time.Now().Add(expires)
+				key.Expires = &at
+			}
+			return withKeys(func(ctx context.Context, keys *auth.Keys) error {
+				secret, err := keys.Create(ctx, &key)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), secret)
+				return nil
+			})
+		},
+	}
+	flags := create.Flags()
+	flags.StringVar(&key.Kind, "kind", auth.KindAdmin, "key kind: admin for management routes, backend for the PowerDNS remote backend")
+	flags.BoolVar(&key.ReadOnly, "read-only", false, "allow only GET requests")
+	flags.StringSliceVar(&key.Zones, "zone", nil, "allow only these zones, can be repeated")
+	flags.StringVar(&key.Account, "account", "", "allow only zones of this account")
+	flags.DurationVar(&expires, "expires", 0, "key lifetime, 0 never expires")
+
+	var grace time.Duration
+	rotate := &cobra.Command{
+		Use:   "rotate <name>",
+		Short: "Заменить значение ключа API и напечатать новое",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withKeys(func(ctx context.Context, keys *auth.Keys) error {
+				secret, err := keys.Rotate(ctx, args[0], grace)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), secret)
+				return nil
+			})
+		},
+	}
+	rotate.Flags().DurationVar(&grace, "grace", time.Hour, "how long the old value keeps working")
+
+	remove := &cobra.Command{
+		Use:   "delete <name>",
+		Short: "Удалить ключ API",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withKeys(func(ctx context.Context, keys *auth.Keys) error {
+				return keys.Delete(ctx, args[0])
+			})
+		},
+	}
+
+	cmd.AddCommand(list, create, rotate, remove)
+	return cmd
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/pkg/errors"
+)
+
+// apiListeners открывает адрес API, с TLS если он настроен, и Unix сокет.
+// Сокет обслуживается без TLS, доступ к нему ограничивают права файла.
+func apiListeners(cfg *config.Config, tlsConfig *tls.Config) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, 2)
+	if cfg.API != "" {
+		l, err := net.Listen("tcp", cfg.API)
+		if err != nil {
+			return nil, errors.Wrapf(err, "не могу слушать %s", cfg.API)
+		}
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		listeners = append(listeners, l)
+	}
+	if cfg.Socket.Path != "" {
+		l, err := listenSocket(cfg.Socket)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenSocket создаёт Unix сокет с правами из настроек. Сокет, оставшийся
+// после аварийной остановки, удаляется, занятый другим процессом нет.
+func listenSocket(s config.Socket) (net.Listener, error) {
+	mode, err := s.FileMode()
+	if err != nil {
+		return nil, err
+	}
+	if st, err := os.Lstat(s.Path); err == nil {
+		if st.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("%s уже существует и не является сокетом", s.Path)
+		}
+		if conn, err := net.Dial("unix", s.Path); err == nil {
+			conn.Close()
+			return nil, errors.Errorf("сокет %s занят другим процессом", s.Path)
+		}
+		if err = os.Remove(s.Path); err != nil {
+			return nil, errors.Wrapf(err, "не могу удалить старый сокет %s", s.Path)
+		}
+	}
+	// Сокет создаётся в папке с правами 0700 и переносится на место уже с
+	// нужными правами, иначе до chmod к нему мог бы подключиться любой
+	// пользователь, которому umask оставил права
+	dir, err := os.MkdirTemp(filepath.Dir(s.Path), ".sock-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "не могу создать временную папку для %s", s.Path)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "api")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "не могу слушать %s", s.Path)
+	}
+	unix := l.(*net.UnixListener)
+	unix.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, mode); err != nil {
+		l.Close()
+		return nil, errors.Wrapf(err, "не могу изменить права %s", s.Path)
+	}
+	if err = os.Rename(tmp, s.Path); err != nil {
+		l.Close()
+		return nil, errors.Wrapf(err, "не могу перенести сокет в %s", s.Path)
+	}
+	return &socketListener{UnixListener: unix, path: s.Path}, nil
+}
+
+// socketListener удаляет файл сокета при закрытии, как net.UnixListener
+// удалял бы его по исходному пути
+type socketListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *socketListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
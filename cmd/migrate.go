@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/ivan-bokov/pdns-dqlite/backend/migrate"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd переносит данные существующей базы PowerDNS в кластер
+func migrateCmd(load func() (*config.Config, error)) *cobra.Command {
+	var sqlitePath, dumpPath string
+	var batch int
+	var verifyOnly bool
+	var timeout time.Duration
+	cmd := &cobra.Command{
+		Use:   "migrate-from",
+		Short: "Перенести данные из базы gsqlite3 или выгрузки gmysql PowerDNS",
+		Long: "Перенести domains, records, comments, domainmetadata, cryptokeys, tsigkeys и supermasters из базы " +
+			"gsqlite3 (--sqlite) или выгрузки mysqldump базы gmysql (--mysql-dump) в кластер через его лидера. " +
+			"Идентификаторы сохраняются. Строки пишутся пачками по --batch, строки, совпавшие с данными кластера " +
+			"по идентификатору или уникальному индексу, пропускаются, поэтому прерванный перенос продолжается " +
+			"повторным запуском. После переноса число строк и контрольные суммы перенесённых строк сверяются " +
+			"с источником, остальные данные кластера в сверку не входят.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (sqlitePath == "") == (dumpPath == "") {
+				return errors.New("укажите --sqlite или --mysql-dump")
+			}
+			cfg, err := load()
+			if err != nil {
+				return err
+			}
+			var src migrate.Source
+			if sqlitePath != "" {
+				src, err = migrate.OpenSQLite(sqlitePath)
+			} else {
+				src, err = migrate.OpenMySQLDump(dumpPath)
+			}
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			db, err := openCluster(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			out := cmd.OutOrStdout()
+			if !verifyOnly {
+				results, err := migrate.Copy(ctx, src, db, batch)
+				printResults(out, results)
+				if err != nil {
+					return err
+				}
+			}
+			checks, err := migrate.Verify(ctx, src, db)
+			printChecks(out, checks)
+			return err
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&sqlitePath, "sqlite", "", "PowerDNS gsqlite3 database file")
+	flags.StringVar(&dumpPath, "mysql-dump", "", "mysqldump file of a PowerDNS gmysql database, may be gzipped")
+	flags.IntVar(&batch, "batch", 500, "rows per transaction")
+	flags.BoolVar(&verifyOnly, "verify-only", false, "only compare row counts and checksums with the source")
+	flags.DurationVar(&timeout, "timeout", time.Hour, "how long the migration may take")
+	return cmd
+}
+
+func printResults(out io.Writer, results []*migrate.Result) {
+	for _, r := range results {
+		fmt.Fprintf(out, "%s: строк %d, скопировано %d, было раньше %d", r.Table, r.Rows, r.Copied, r.Rows-r.Copied)
+		if len(r.Ignored) != 0 {
+			fmt.Fprintf(out, ", пропущены столбцы %s", strings.Join(r.Ignored, ", "))
+		}
+		fmt.Fprintln(out)
+	}
+}
+
+func printChecks(out io.Writer, checks []*migrate.Check) {
+	for _, c := range checks {
+		other := ""
+		if c.Other != 0 {
+			other = fmt.Sprintf(", других строк в кластере %d", c.Other)
+		}
+		if c.OK() {
+			fmt.Fprintf(out, "%s: %d строк, sha256 %s%s: OK\n", c.Table, c.Target, c.TargetSum, other)
+			continue
+		}
+		fmt.Fprintf(out, "%s: в источнике %d строк, sha256 %s, в кластере %d строк, sha256 %s%s\n",
+			c.Table, c.Source, c.SourceSum, c.Target, c.TargetSum, other)
+	}
+}
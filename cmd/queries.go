@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/ivan-bokov/pdns-dqlite/backend/core/db"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// loadQueries применяет переопределения запросов из YAML файла вида
+// имя-запроса: SQL и из секции queries конфигурации, секция имеет приоритет.
+// Ошибка в любом запросе останавливает запуск.
+func loadQueries(cfg *config.Config) error {
+	overrides := make(map[string]string)
+	if cfg.QueriesFile != "" {
+		data, err := ioutil.ReadFile(cfg.QueriesFile)
+		if err != nil {
+			return errors.Wrapf(err, "не могу прочитать %s", cfg.QueriesFile)
+		}
+		if err = yaml.Unmarshal(data, &overrides); err != nil {
+			return errors.Wrapf(err, "не могу разобрать %s", cfg.QueriesFile)
+		}
+	}
+	for name, text := range cfg.Queries {
+		overrides[name] = text
+	}
+	if err := db.Override(overrides); err != nil {
+		return errors.Wrap(err, "ошибка в переопределённых запросах")
+	}
+	return nil
+}
+
+func queriesCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "queries",
+		Short: "Вывести действующий набор SQL запросов",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			declared := db.Declared()
+			names := make([]string, 0, len(declared))
+			for name := range declared {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				out, err := yaml.Marshal(map[string]string{name: declared[name]})
+				if err != nil {
+					return err
+				}
+				fmt.Fprint(cmd.OutOrStdout(), string(out))
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/canonical/go-dqlite/app"
+	"github.com/canonical/go-dqlite/client"
+	"github.com/ivan-bokov/pdns-dqlite/backend"
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/ivan-bokov/pdns-dqlite/backend/auth"
+	"github.com/ivan-bokov/pdns-dqlite/backend/backup"
+	"github.com/ivan-bokov/pdns-dqlite/backend/certs"
+	"github.com/ivan-bokov/pdns-dqlite/backend/cluster"
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/ivan-bokov/pdns-dqlite/backend/health"
+	"github.com/ivan-bokov/pdns-dqlite/backend/logging"
+	"github.com/ivan-bokov/pdns-dqlite/backend/metrics"
+	"github.com/ivan-bokov/pdns-dqlite/backend/storage"
+	"github.com/pkg/errors"
+)
+
+// nodeOptions настройки узла dqlite, общие для serve и restore
+func nodeOptions(cfg *config.Config) ([]app.Option, *certs.Keypair, *tls.Config, error) {
+	opts := make([]app.Option, 0)
+	opts = append(opts, app.WithAddress(cfg.Host))
+	opts = append(opts, app.WithLogFunc(logging.Dqlite))
+	opts = append(opts,
+		app.WithVoters(cfg.Roles.Voters),
+		app.WithStandBys(cfg.Roles.StandBys),
+		app.WithFailureDomain(cfg.Roles.FailureDomain),
+		app.WithRolesAdjustmentFrequency(cfg.Roles.AdjustmentFrequency),
+	)
+	keypair, listenTLS, dialTLS, err := replicationTLS(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if keypair != nil {
+		opts = append(opts, app.WithTLS(listenTLS, dialTLS))
+	}
+	return opts, keypair, dialTLS, nil
+}
+
+func serve(cfg *config.Config, load func() (*config.Config, error)) error {
+	log := logging.Logger
+	if err := os.Mkdir(cfg.Dir, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return errors.Wrapf(err, "не могу создать %s", cfg.Dir)
+	}
+	opts, keypair, dialTLS, err := nodeOptions(cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Cluster) != 0 {
+		opts = append(opts, app.WithCluster(cfg.Cluster))
+	}
+	dqlite, err := app.New(cfg.Dir, opts...)
+	if err != nil {
+		return errors.Wrap(err, "Ошибка создания экземпляра dqlite")
+	}
+	// Пока API не запущен, любая ошибка закрывает базу и узел, чтобы он
+	// освободил порты и папку данных. Запущенный узел закрывает shutdown.
+	var db *sql.DB
+	started := false
+	defer func() {
+		if started {
+			return
+		}
+		if db != nil {
+			db.Close()
+		}
+		dqlite.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Ready)
+	defer cancel()
+	if err = dqlite.Ready(ctx); err != nil {
+		return errors.Wrap(err, "Экземпляр dqlite не готов к работе")
+	}
+	db, err = dqlite.Open(context.Background(), storage.Database)
+	if err != nil {
+		return errors.Wrap(err, "Ошибка открытия базы данных к работе")
+	}
+	if err = storage.Init(db); err != nil {
+		return err
+	}
+
+	svc := core.New(db, cfg.DNSSEC)
+	svc.SetRetry(core.Retry{Timeout: cfg.Retry.Timeout, Backoff: cfg.Retry.Backoff})
+	svc.SetNode(cfg.Host)
+	svc.SetVersions(cfg.Audit.Versions)
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	if cfg.Cache.Size > 0 {
+		svc.EnableCache(core.CacheConfig{Size: cfg.Cache.Size, TTL: cfg.Cache.TTL, NegativeTTL: cfg.Cache.NegativeTTL})
+		go svc.WatchChanges(background, cfg.Cache.Poll)
+	}
+	if cfg.Audit.Retention > 0 {
+		go audit.Schedule(background, db, cfg.Audit.Retention, time.Hour)
+	}
+	if cfg.Backup.Dir != "" {
+		if err = os.MkdirAll(cfg.Backup.Dir, 0o755); err != nil {
+			return errors.Wrapf(err, "не могу создать %s", cfg.Backup.Dir)
+		}
+		go backup.Schedule(background, db, cfg.Backup.Dir, storage.Database, cfg.Backup.Interval, cfg.Backup.Keep)
+	}
+	dialOpts := make([]client.Option, 0)
+	if dialTLS != nil {
+		dialOpts = append(dialOpts, client.WithDialFunc(client.DialFuncWithTLS(client.DefaultDialFunc, dialTLS)))
+	}
+	manager := cluster.New(func(ctx context.Context) (cluster.Client, error) {
+		cli, err := dqlite.Leader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return cli, nil
+	}, func(ctx context.Context, address string) (cluster.Client, error) {
+		cli, err := client.New(ctx, address, dialOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return cli, nil
+	}, cluster.Roles{Voters: cfg.Roles.Voters, StandBys: cfg.Roles.StandBys})
+	if cfg.Roles.Role != "" {
+		// Лидер может позже пересмотреть роль, если голосующих или резервных узлов не хватает
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Request)
+		err = manager.Assign(ctx, cfg.Host, cfg.Roles.Role)
+		cancel()
+		if err != nil {
+			log.WithError(err).WithField("role", cfg.Roles.Role).Warn("не удалось назначить роль")
+		}
+	}
+	metrics.Registry.MustRegister(metrics.NewCollector(db, svc.OpenTransactions,
+		func(ctx context.Context) (string, bool, error) {
+			nodes, err := manager.Nodes(ctx)
+			if err != nil {
+				return "", false, err
+			}
+			for _, n := range nodes {
+				if n.Address == cfg.Host {
+					return n.Role, n.Leader, nil
+				}
+			}
+			return "", false, errors.Errorf("узел %s не найден в кластере", cfg.Host)
+		}, cfg.Timeouts.Request))
+	handler := backend.New(svc, manager, health.New(db, cfg.Host, dqlite.Ready, manager), backend.Timeouts{
+		Backend: cfg.Timeouts.Backend,
+		Admin:   cfg.Timeouts.Request,
+	})
+	if cfg.Auth.Enabled {
+		keys := auth.New(db, cfg.Host, cfg.Auth.Cache)
+		handler.SetKeys(keys)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Request)
+		list, err := keys.List(ctx)
+		cancel()
+		if err == nil && len(list) == 0 {
+			// Узел всё равно запускается: ключи создаёт команда keys через dqlite, без API
+			log.Warn("ключей API нет, API отвечает 401 на все запросы, кроме проверок, пока ключи не созданы командой keys create")
+		}
+	} else {
+		log.Warn("проверка ключей API выключена (auth.enabled: false), изменения через API доступны всем, кто может к нему подключиться")
+	}
+	routes := handler.InitRoutes()
+	if cfg.Debug {
+		if err = storage.InitDebug(db); err != nil {
+			return err
+		}
+		handler.DebugRoutes(routes)
+	}
+	apiKeypair, apiTLSConfig, err := apiTLS(cfg)
+	if err != nil {
+		return err
+	}
+	listeners, err := apiListeners(cfg, apiTLSConfig)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:      routes,
+		ReadTimeout:  cfg.Timeouts.Request,
+		WriteTimeout: cfg.Timeouts.Request,
+	}
+	started = true
+	serveErr := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+				serveErr <- err
+			}
+		}(l)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ch, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGPWR, syscall.SIGINT, syscall.SIGQUIT)
+	defer stop()
+	for {
+		select {
+		case <-hup:
+			cfg = reload(cfg, load, func(cfg *config.Config) {
+				if err := logging.SetLevel(cfg.Log.Level); err != nil {
+					log.WithError(err).Error("уровень логирования не изменён")
+				}
+				svc.SetRetry(core.Retry{Timeout: cfg.Retry.Timeout, Backoff: cfg.Retry.Backoff})
+				svc.SetVersions(cfg.Audit.Versions)
+				svc.SetCacheTTL(cfg.Cache.TTL, cfg.Cache.NegativeTTL)
+				handler.SetBackendTimeout(cfg.Timeouts.Backend)
+			})
+			if keypair != nil {
+				if err := keypair.Reload(); err != nil {
+					log.WithError(err).Error("сертификат репликации не перечитан")
+				}
+			}
+			if apiKeypair != nil {
+				if err := apiKeypair.Reload(); err != nil {
+					log.WithError(err).Error("сертификат API не перечитан")
+				}
+			}
+			continue
+		case err = <-serveErr:
+			log.WithError(err).Error("API остановлен")
+		case <-ch.Done():
+			log.Info("получен сигнал остановки")
+		}
+		break
+	}
+	// Повторный сигнал во время остановки завершает процесс сразу
+	stop()
+
+	stopBackground()
+	shutdownErr := shutdown(cfg.Timeouts.Shutdown, server, svc, db, dqlite)
+	if err != nil {
+		return err
+	}
+	return shutdownErr
+}
+
+// shutdownError остановка не уложилась в таймаут или прошла с ошибками,
+// процесс завершается с кодом exitShutdown
+type shutdownError struct {
+	errs []string
+}
+
+func (e *shutdownError) Error() string {
+	return "остановка завершилась с ошибками: " + strings.Join(e.errs, "; ")
+}
+
+// shutdown останавливает узел по шагам: API перестаёт принимать запросы и
+// дожидается текущих, открытые транзакции завершаются или откатываются,
+// узел передаёт лидерство и роль голосующего другим узлам и закрывается.
+// Все шаги делят общий таймаут.
+func shutdown(timeout time.Duration, server *http.Server, svc *core.Service, db *sql.DB, dqlite *app.App) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make([]string, 0)
+	step := func(name string, err error) {
+		entry := logging.Logger.WithField("step", name)
+		if err != nil {
+			errs = append(errs, name+": "+err.Error())
+			entry.WithError(err).Error("шаг остановки не выполнен")
+			return
+		}
+		entry.Info("шаг остановки выполнен")
+	}
+	// Транзакции завершаются, пока API ещё отвечает: PowerDNS присылает
+	// committransaction и aborttransaction через него
+	step("завершение транзакций", svc.Shutdown(ctx))
+	step("остановка API", server.Shutdown(ctx))
+	step("закрытие запросов", svc.Close())
+	step("закрытие базы данных", db.Close())
+	// Лидерство передаётся со своим сроком, даже если предыдущие шаги
+	// исчерпали общий
+	handover, cancelHandover := context.WithTimeout(context.Background(), timeout)
+	defer cancelHandover()
+	step("передача лидерства", dqlite.Handover(handover))
+	step("остановка dqlite", dqlite.Close())
+	if len(errs) != 0 {
+		return &shutdownError{errs: errs}
+	}
+	return nil
+}
+
+// reload перечитывает конфигурацию и передаёт в apply настройки, которые
+// меняются без перезапуска. Остальные изменения только перечисляются в логе
+// и вступят в силу после перезапуска.
+func reload(cfg *config.Config, load func() (*config.Config, error), apply func(*config.Config)) *config.Config {
+	next, err := load()
+	if err == nil {
+		err = next.Validate()
+	}
+	if err != nil {
+		logging.Logger.WithError(err).Error("конфигурация не перечитана")
+		return cfg
+	}
+	changed, restart := cfg.Changed(next)
+	if len(restart) != 0 {
+		logging.Logger.WithField("changed", strings.Join(restart, ",")).Warn("изменения требуют перезапуска")
+	}
+	// Уровень, изменённый через API, возвращается к заданному в конфигурации
+	cfg = cfg.Reload(next)
+	apply(cfg)
+	logging.Logger.WithField("changed", strings.Join(changed, ",")).Info("конфигурация перечитана")
+	return cfg
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ivan-bokov/pdns-dqlite/backend/audit"
+	"github.com/ivan-bokov/pdns-dqlite/backend/config"
+	"github.com/ivan-bokov/pdns-dqlite/backend/core"
+	"github.com/ivan-bokov/pdns-dqlite/backend/zonefile"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// zoneCmd работа с зонами через лидера кластера без PowerDNS
+func zoneCmd(load func() (*config.Config, error)) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "zone",
+		Short: "Загрузка и выгрузка зон",
+	}
+	var timeout time.Duration
+	cmd.PersistentFlags().DurationVar(&timeout, "timeout", 5*time.Minute, "how long to wait for the cluster")
+	// withService открывает базу кластера и вызывает f с сервисом зон
+	withService := func(f func(ctx context.Context, svc *core.Service) error) error {
+		cfg, err := load()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(audit.WithCaller(context.Background(), "cli"), timeout)
+		defer cancel()
+		db, err := openCluster(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		svc := core.New(db, cfg.DNSSEC)
+		svc.SetNode(cfg.Host)
+		svc.SetVersions(cfg.Audit.Versions)
+		return f(ctx, svc)
+	}
+
+	var zone core.Zone
+	var dryRun, asJSON bool
+	var format string
+	importCmd := &cobra.Command{
+		Use:   "import <zone> <file>",
+		Short: "Загрузить зону из файла зоны BIND или выгрузки",
+		Long: "Загрузить зону из файла зоны BIND (RFC 1035) или выгрузки zone export в JSON и YAML одной транзакцией: " +
+			"записи зоны заменяются записями файла. Зона, которой нет, создаётся. $INCLUDE открываются относительно " +
+			"каталога файла. Выгрузка заменяет и метаданные зоны, а тип и владелец новой зоны берутся из неё. " +
+			"С --dry-run печатаются изменения без загрузки.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format == "" {
+				format = formatOf(args[1])
+			}
+			var load func(ctx context.Context, svc *core.Service) (*core.Import, error)
+			switch format {
+			case "bind":
+				records, err := zonefile.ParseFile(args[1], args[0])
+				if err != nil {
+					return err
+				}
+				zone.Name = args[0]
+				load = func(ctx context.Context, svc *core.Service) (*core.Import, error) {
+					return svc.ImportZone(ctx, &zone, records, dryRun)
+				}
+			case "json", "yaml":
+				e, err := readExport(args[1], format)
+				if err != nil {
+					return err
+				}
+				if !strings.EqualFold(strings.TrimSuffix(e.Name, "."), strings.TrimSuffix(args[0], ".")) {
+					return errors.Errorf("%s: выгрузка зоны %s, а не %s", args[1], e.Name, args[0])
+				}
+				load = func(ctx context.Context, svc *core.Service) (*core.Import, error) {
+					return svc.LoadZone(ctx, e, dryRun)
+				}
+			default:
+				return errors.Errorf("формат %q, ожидается bind, json или yaml", format)
+			}
+			return withService(func(ctx context.Context, svc *core.Service) error {
+				result, err := load(ctx, svc)
+				if err != nil {
+					return err
+				}
+				out := cmd.OutOrStdout()
+				if asJSON {
+					enc := json.NewEncoder(out)
+					enc.SetIndent("", "  ")
+					return enc.Encode(result)
+				}
+				printImport(out, result)
+				return nil
+			})
+		},
+	}
+	flags := importCmd.Flags()
+	flags.BoolVar(&dryRun, "dry-run", false, "print changes without loading the zone")
+	flags.StringVar(&format, "format", "", "file format: bind, json or yaml, by default from the file extension")
+	flags.StringVar(&zone.Kind, "kind", "NATIVE", "kind of a new zone loaded from a BIND file: NATIVE, MASTER or SLAVE")
+	flags.StringVar(&zone.Account, "account", "", "account of a new zone loaded from a BIND file")
+	flags.StringSliceVar(&zone.Masters, "master", nil, "masters of a new SLAVE zone loaded from a BIND file, can be repeated")
+	flags.BoolVar(&asJSON, "json", false, "print the result as JSON")
+
+	var exportFormat, dir string
+	exportCmd := &cobra.Command{
+		Use:   "export [zone...]",
+		Short: "Выгрузить зоны в файл зоны BIND, JSON или YAML",
+		Long: "Выгрузить зоны в каноническом виде: записи отсортированы, в выгрузке нет идентификаторов и времени, " +
+			"поэтому её удобно хранить в git. Без --dir одна зона печатается в stdout, с --dir каждая зона " +
+			"пишется в файл <зона>.<формат>, а без списка зон выгружаются все зоны.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if exportFormat != "bind" && exportFormat != "json" && exportFormat != "yaml" {
+				return errors.Errorf("формат %q, ожидается bind, json или yaml", exportFormat)
+			}
+			if dir == "" && len(args) != 1 {
+				return errors.New("без --dir укажите одну зону")
+			}
+			return withService(func(ctx context.Context, svc *core.Service) error {
+				zones := args
+				if len(zones) == 0 {
+					all, err := svc.GetAllDomains(ctx, true)
+					if err != nil {
+						return err
+					}
+					for _, di := range all {
+						zones = append(zones, di.Zone)
+					}
+				}
+				for _, name := range zones {
+					e, err := svc.ExportZone(ctx, name)
+					if err != nil {
+						return err
+					}
+					if dir == "" {
+						return writeExport(cmd.OutOrStdout(), e, exportFormat)
+					}
+					path := filepath.Join(dir, e.Name+"."+exportFormat)
+					if exportFormat == "bind" {
+						path = filepath.Join(dir, e.Name+".zone")
+					}
+					var buf bytes.Buffer
+					if err = writeExport(&buf, e, exportFormat); err != nil {
+						return err
+					}
+					if err = ioutil.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+						return err
+					}
+					fmt.Fprintln(cmd.OutOrStdout(), path)
+				}
+				return nil
+			})
+		},
+	}
+	flags = exportCmd.Flags()
+	flags.StringVar(&exportFormat, "format", "bind", "output format: bind, json or yaml")
+	flags.StringVar(&dir, "dir", "", "write each zone to a file in this directory")
+
+	cmd.AddCommand(importCmd, exportCmd)
+	return cmd
+}
+
+// formatOf формат файла зоны по расширению: .json, .yaml и .yml для выгрузок, остальное bind
+func formatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "bind"
+}
+
+func readExport(path, format string) (*core.ZoneExport, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e := new(core.ZoneExport)
+	if format == "json" {
+		err = json.Unmarshal(data, e)
+	} else {
+		err = yaml.Unmarshal(data, e)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return e, nil
+}
+
+func writeExport(out io.Writer, e *core.ZoneExport, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e)
+	case "yaml":
+		enc := yaml.NewEncoder(out)
+		enc.SetIndent(2)
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	return zonefile.Write(out, e)
+}
+
+// printImport печатает изменения зоны в виде записей файла зоны: + новые, - удалённые
+func printImport(out io.Writer, result *core.Import) {
+	for _, rr := range result.Removed {
+		fmt.Fprintf(out, "- %s %d IN %s %s\n", rr.Qname, rr.TTL, rr.Qtype, rr.Content)
+	}
+	for _, rr := range result.Added {
+		fmt.Fprintf(out, "+ %s %d IN %s %s\n", rr.Qname, rr.TTL, rr.Qtype, rr.Content)
+	}
+	action := "загружена"
+	switch {
+	case result.DryRun && result.Created:
+		action = "будет создана"
+	case result.DryRun:
+		action = "будет изменена"
+	case result.Created:
+		action = "создана"
+	}
+	fmt.Fprintf(out, "зона %s %s: записей было %d, стало %d, добавлено %d, удалено %d\n",
+		result.Zone, action, result.Before, result.After, len(result.Added), len(result.Removed))
+}